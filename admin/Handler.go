@@ -0,0 +1,319 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package admin
+
+import (
+  "bufio"
+  "bytes"
+  "context"
+  "crypto/subtle"
+  "crypto/tls"
+  "encoding/json"
+  "fmt"
+  "net/url"
+  "regexp"
+  "strings"
+  "time"
+  "github.com/rinusser/hopgoblin/bootstrap"
+  "github.com/rinusser/hopgoblin/http"
+  "github.com/rinusser/hopgoblin/log"
+  "github.com/rinusser/hopgoblin/metrics"
+  "github.com/rinusser/hopgoblin/utils"
+)
+
+
+func init() {
+  bootstrap.AfterFlagParse(registerHandler)
+}
+
+func registerHandler() {
+  handler:=LoadHandler()
+  if handler!=nil {
+    http.RegisterSiteHandler(handler)
+  }
+}
+
+
+/*
+  The request header carrying the admin API token, see Handler.Token.
+ */
+const TokenHeader="X-Admin-Token"
+
+
+/*
+  Site handler serving the admin API on a magic hostname, see the package documentation for the endpoints.
+ */
+type Handler struct {
+  Hostname string
+  Token string //required in the TokenHeader of all requests if set, otherwise requests changing state and /connections are refused
+}
+
+/*
+  Creates a new Handler instance for the given hostname.
+ */
+func NewHandler(hostname string) *Handler {
+  return &Handler{Hostname:hostname}
+}
+
+/*
+  Creates a Handler from the application configuration's admin.hostname and admin.token settings. Returns nil if the admin API is
+  disabled.
+ */
+func LoadHandler() *Handler {
+  hostname:=utils.GetConfigValue("admin.hostname")
+  if hostname=="" {
+    return nil
+  }
+  log.Info("admin API enabled on %s",hostname)
+  rv:=NewHandler(hostname)
+  rv.Token=utils.GetConfigValue("admin.token")
+  return rv
+}
+
+
+/*
+  required by http.SiteHandler interface
+ */
+func (this *Handler) HandlesHost(host string) bool {
+  return strings.EqualFold(host,this.Hostname)
+}
+
+/*
+  required by http.SiteHandler interface
+ */
+func (this *Handler) HandleRequest(server *http.Server, browserio *bufio.ReadWriter, request *http.Request) {
+  _,err:=request.ReadBody()
+  if err!=nil {
+    request.Logger().Debug("could not read admin request body: %s",err)
+    return
+  }
+  response,shutdown:=this.serve(server,request)
+  server.WriteResponse(browserio,response)
+  if shutdown {
+    request.Logger().Info("shutdown requested via admin API")
+    go func() {
+      ctx,cancel:=context.WithTimeout(context.Background(),server.GetShutdownTimeout())
+      defer cancel()
+      server.Shutdown(ctx)
+    }()
+  }
+}
+
+/*
+  optional http.HostPatternSiteHandler interface
+ */
+func (this *Handler) GetHostPatterns() []string {
+  return []string{"^"+regexp.QuoteMeta(this.Hostname)+"$"}
+}
+
+/*
+  required by http.SiteHandler interface
+ */
+func (this *Handler) GetCertificateMap() map[string]*tls.Certificate {
+  return map[string]*tls.Certificate{}
+}
+
+
+/*
+  Answers an API request. Returns the response and whether the server should be stopped after sending it.
+ */
+func (this *Handler) serve(server *http.Server, request *http.Request) (*http.Response,bool) {
+  path:="/"
+  if parsed,err:=url.Parse(request.Url);err==nil && parsed.Path!="" {
+    path=parsed.Path
+  }
+  allowed:=map[string]string {
+    "/":"GET",
+    "/handlers":"GET",
+    "/connections":"GET",
+    "/log":"GET, PUT",
+    "/metrics":"GET",
+    "/shutdown":"POST",
+  }
+  methods,found:=allowed[path]
+  if !found {
+    return createErrorResponse(404,"unknown endpoint "+path),false
+  }
+  if !strings.Contains(", "+methods+",",", "+request.Method+",") {
+    response:=createErrorResponse(405,"use "+methods+" for "+path)
+    response.Headers.Set("Allow",methods)
+    return response,false
+  }
+  if message:=this.checkAccess(request,path);message!="" {
+    request.Logger().Warn("rejected admin request %s %s: %s",request.Method,path,message)
+    return createErrorResponse(403,message),false
+  }
+
+  switch path {
+    case "/handlers":
+      return createJSONResponse(200,getHandlers(server)),false
+    case "/connections":
+      return createJSONResponse(200,getConnections(server)),false
+    case "/log":
+      if request.Method=="PUT" {
+        if err:=setLogLevels(request.Body);err!=nil {
+          return createErrorResponse(400,err.Error()),false
+        }
+      }
+      return createJSONResponse(200,getLogLevels()),false
+    case "/metrics":
+      return createMetricsResponse(),false
+    case "/shutdown":
+      return createJSONResponse(202,map[string]string{"status":"stopping"}),true
+  }
+  return createJSONResponse(200,map[string]map[string]string{"endpoints":allowed}),false
+}
+
+
+/*
+  Protects the API against unauthorized clients and requests forged by web pages the proxy's users visit: requests from other
+  origins are rejected, and all requests need the Token in the TokenHeader. Browsers can't add custom headers to cross-origin
+  requests without a CORS preflight, which the API never allows.
+  Without a Token only reading requests not exposing other clients' traffic are allowed: requests changing state and /connections
+  are refused.
+
+  Returns the reason for rejecting the request, or an empty string if it's allowed.
+ */
+func (this *Handler) checkAccess(request *http.Request, path string) string {
+  if origin,found:=request.Headers.Get("Origin");found && !this.isOwnOrigin(origin) {
+    return "cross-origin requests aren't allowed"
+  }
+  if this.Token=="" {
+    if request.Method!="GET" || path=="/connections" {
+      return "admin.token must be configured for "+request.Method+" "+path
+    }
+    return ""
+  }
+  token,_:=request.Headers.Get(TokenHeader)
+  if subtle.ConstantTimeCompare([]byte(token),[]byte(this.Token))!=1 {
+    return "missing or invalid "+TokenHeader+" header"
+  }
+  return ""
+}
+
+func (this *Handler) isOwnOrigin(origin string) bool {
+  parsed,err:=url.Parse(origin)
+  if err!=nil || (parsed.Scheme!="http" && parsed.Scheme!="https") {
+    return false
+  }
+  return strings.EqualFold(parsed.Hostname(),this.Hostname)
+}
+
+
+type handlerInfo struct {
+  Type string `json:"type"`
+  Hosts []string `json:"hosts"` //null if the handler doesn't list its host regexes
+}
+
+func getHandlers(server *http.Server) []handlerInfo {
+  rv:=[]handlerInfo{}
+  for _,handler:=range server.GetSiteHandlers() {
+    info:=handlerInfo{Type:http.GetSiteHandlerName(handler)}
+    if lister,ok:=handler.(http.HostPatternSiteHandler);ok {
+      info.Hosts=append([]string{},lister.GetHostPatterns()...)
+    }
+    rv=append(rv,info)
+  }
+  return rv
+}
+
+type connectionInfo struct {
+  ID string `json:"id"`
+  User string `json:"user,omitempty"`
+  RemoteAddress string `json:"remoteAddress"`
+  Opened string `json:"opened"`
+  TunnelHost string `json:"tunnelHost,omitempty"`
+  Relaying string `json:"relaying,omitempty"`
+  Requests int `json:"requests"`
+  Method string `json:"method,omitempty"`
+  Url string `json:"url,omitempty"`
+}
+
+func getConnections(server *http.Server) []connectionInfo {
+  rv:=[]connectionInfo{}
+  for _,connection:=range server.GetConnections() {
+    rv=append(rv,connectionInfo {
+      ID: connection.ID,
+      User: connection.User,
+      RemoteAddress: connection.RemoteAddress,
+      Opened: connection.Opened.Format(time.RFC3339),
+      TunnelHost: connection.TunnelHost,
+      Relaying: connection.Relaying,
+      Requests: connection.Requests,
+      Method: connection.Method,
+      Url: connection.Url,
+    })
+  }
+  return rv
+}
+
+type logLevels struct {
+  Prefixes map[string]string `json:"prefixes"`
+}
+
+func getLogLevels() logLevels {
+  rv:=logLevels{Prefixes:make(map[string]string)}
+  for prefix,level:=range log.GetPrefixLevels() {
+    rv.Prefixes[prefix]=level.String()
+  }
+  return rv
+}
+
+/*
+  Applies log level changes from a request body. No changes are made if any of the levels is invalid.
+ */
+func setLogLevels(body []byte) error {
+  var input logLevels
+  if err:=json.Unmarshal(body,&input);err!=nil {
+    return fmt.Errorf("invalid JSON: %s",err)
+  }
+  levels:=make(map[string]log.Level)
+  for prefix,name:=range input.Prefixes {
+    if name=="" {
+      continue
+    }
+    level,err:=log.ParseLevel(name)
+    if err!=nil {
+      return err
+    }
+    levels[prefix]=level
+  }
+  for prefix,name:=range input.Prefixes {
+    if name=="" {
+      log.RemovePrefixLevel(prefix)
+    } else {
+      log.SetPrefixLevel(prefix,levels[prefix])
+    }
+  }
+  return nil
+}
+
+
+func createJSONResponse(status uint16, value interface{}) *http.Response {
+  body,err:=json.MarshalIndent(value,"","  ")
+  if err!=nil {
+    log.Error("could not encode admin response: %s",err)
+    return http.CreateSimpleResponse(500)
+  }
+  rv:=http.NewResponse()
+  rv.Status=status
+  rv.Headers.Set("Content-Type","application/json")
+  rv.Headers.Set("Cache-Control","no-store")
+  rv.Body=append(body,'\n')
+  return rv
+}
+
+func createMetricsResponse() *http.Response {
+  var body bytes.Buffer
+  metrics.DefaultRegistry.WriteText(&body)
+  rv:=http.NewResponse()
+  rv.Headers.Set("Content-Type",metrics.TextContentType)
+  rv.Headers.Set("Cache-Control","no-store")
+  rv.Body=body.Bytes()
+  return rv
+}
+
+func createErrorResponse(status uint16, message string) *http.Response {
+  return createJSONResponse(status,map[string]string{"error":message})
+}
@@ -0,0 +1,211 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package admin
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "bufio"
+  "bytes"
+  "encoding/json"
+  "net"
+  "time"
+  "github.com/rinusser/hopgoblin/http"
+  "github.com/rinusser/hopgoblin/log"
+  "github.com/rinusser/hopgoblin/metrics"
+)
+
+
+func runHandler(t *testing.T, server *http.Server, raw string, result interface{}) *http.Response {
+  var output bytes.Buffer
+  buf:=bufio.NewReadWriter(bufio.NewReader(&output),bufio.NewWriter(&output))
+  server.GetSiteHandlers()[0].HandleRequest(server,buf,http.ParseRequest(raw))
+  response:=http.ParseResponseBytes(output.Bytes())
+  if result!=nil {
+    assert.Nil(t,json.Unmarshal(response.Body,result),"response should be valid JSON:\n%s",response.Body)
+  }
+  return &response
+}
+
+/*
+  Makes sure site handlers are listed with their host regexes, and unknown endpoints and methods are rejected.
+ */
+func TestHandlerEndpoints(t *testing.T) {
+  server:=http.NewServer()
+  handler:=NewHandler("hopgoblin.localhost")
+  server.AddSiteHandler(handler)
+  assert.True(t,handler.HandlesHost("HopGoblin.localhost"))
+  assert.False(t,handler.HandlesHost("hopgoblin.localhost.example.com"))
+
+  var handlers []handlerInfo
+  response:=runHandler(t,server,"GET http://hopgoblin.localhost/handlers HTTP/1.1\r\n\r\n",&handlers)
+  assert.Equal(t,uint16(200),response.Status)
+  assert.Equal(t,[]handlerInfo{{Type:"admin.Handler",Hosts:[]string{`^hopgoblin\.localhost$`}}},handlers)
+
+  response=runHandler(t,server,"GET http://hopgoblin.localhost/unknown HTTP/1.1\r\n\r\n",nil)
+  assert.Equal(t,uint16(404),response.Status)
+  response=runHandler(t,server,"DELETE http://hopgoblin.localhost/log HTTP/1.1\r\n\r\n",nil)
+  assert.Equal(t,uint16(405),response.Status)
+  allow,_:=response.Headers.Get("Allow")
+  assert.Equal(t,"GET, PUT",allow)
+}
+
+/*
+  Makes sure log levels can be changed, and invalid changes are rejected without applying any of them.
+ */
+func TestHandlerLogLevels(t *testing.T) {
+  previous:=log.GetPrefixLevels()
+  defer func() {
+    for prefix:=range log.GetPrefixLevels() {
+      log.RemovePrefixLevel(prefix)
+    }
+    for prefix,level:=range previous {
+      log.SetPrefixLevel(prefix,level)
+    }
+  }()
+  server:=http.NewServer()
+  handler:=NewHandler("hopgoblin.localhost")
+  handler.Token="1"
+  server.AddSiteHandler(handler)
+  log.SetPrefixLevel("remove/",log.WARN)
+
+  var levels logLevels
+  body:=`{"prefixes":{"admin/":"trace","remove/":""}}`
+  response:=runHandler(t,server,"PUT http://hopgoblin.localhost/log HTTP/1.1\r\nX-Admin-Token: 1\r\n\r\n"+body,&levels)
+  assert.Equal(t,uint16(200),response.Status)
+  assert.Equal(t,"TRACE",levels.Prefixes["admin/"])
+  _,found:=levels.Prefixes["remove/"]
+  assert.False(t,found,"prefix should have been removed")
+
+  body=`{"prefixes":{"first/":"debug","second/":"loud"}}`
+  response=runHandler(t,server,"PUT http://hopgoblin.localhost/log HTTP/1.1\r\nX-Admin-Token: 1\r\n\r\n"+body,nil)
+  assert.Equal(t,uint16(400),response.Status)
+  _,found=log.GetPrefixLevels()["first/"]
+  assert.False(t,found,"no levels should have been changed")
+  response=runHandler(t,server,"PUT http://hopgoblin.localhost/log HTTP/1.1\r\nX-Admin-Token: 1\r\n\r\n{",nil)
+  assert.Equal(t,uint16(400),response.Status)
+}
+
+/*
+  Makes sure open connections are listed and the server can be shut down.
+ */
+func TestHandlerConnectionsAndShutdown(t *testing.T) {
+  server:=http.NewServer()
+  handler:=NewHandler("hopgoblin.localhost")
+  handler.Token="1"
+  server.AddSiteHandler(handler)
+  stopped:=make(chan bool)
+  go func() {
+    server.Listen(&net.TCPAddr{IP:net.ParseIP("127.0.0.1"),Port:64148})
+    stopped<-true
+  }()
+  time.Sleep(2e8)
+
+  conn,err:=net.Dial("tcp","127.0.0.1:64148")
+  if !assert.Nil(t,err) {
+    return
+  }
+  defer conn.Close()
+  reader:=bufio.NewReader(conn)
+  send:=func(raw string, result interface{}) *http.Response {
+    conn.Write([]byte(raw))
+    response,err:=http.ReadResponse(reader,"GET")
+    if !assert.Nil(t,err) {
+      t.FailNow()
+    }
+    body,_:=response.ReadBody()
+    assert.Nil(t,json.Unmarshal(body,result),"response should be valid JSON:\n%s",body)
+    return response
+  }
+
+  var connections []connectionInfo
+  send("GET http://hopgoblin.localhost/connections HTTP/1.1\r\nX-Admin-Token: 1\r\n\r\n",&connections)
+  if assert.Equal(t,1,len(connections)) {
+    assert.Equal(t,conn.LocalAddr().String(),connections[0].RemoteAddress)
+    assert.Equal(t,1,connections[0].Requests)
+    assert.Equal(t,"GET",connections[0].Method)
+    assert.Equal(t,"http://hopgoblin.localhost/connections",connections[0].Url)
+  }
+
+  var status map[string]string
+  response:=send("POST http://hopgoblin.localhost/shutdown HTTP/1.1\r\nContent-Length: 0\r\n\r\n",&status)
+  assert.Equal(t,uint16(403),response.Status,"shutdown without token should have been rejected")
+  response=send("POST http://hopgoblin.localhost/shutdown HTTP/1.1\r\nX-Admin-Token: 1\r\nContent-Length: 0\r\n\r\n",&status)
+  assert.Equal(t,uint16(202),response.Status)
+  select {
+    case <-stopped:
+    case <-time.After(3*time.Second):
+      t.Errorf("server should have stopped")
+      server.Close()
+  }
+}
+
+/*
+  Makes sure requests web pages could forge are rejected: cross-origin requests and any request without the configured token.
+ */
+func TestHandlerRejectsForgedRequests(t *testing.T) {
+  server:=http.NewServer()
+  handler:=NewHandler("hopgoblin.localhost")
+  handler.Token="secret"
+  server.AddSiteHandler(handler)
+
+  cases:=[]struct {
+    headers string
+    status uint16
+  } {
+    {"",                                                                403},
+    {"Content-Type: text/plain\r\n",                                    403},
+    {"X-Admin-Token: wrong\r\n",                                        403},
+    {"X-Admin-Token: secret\r\nOrigin: http://attacker.example\r\n",    403},
+    {"X-Admin-Token: secret\r\nOrigin: null\r\n",                       403},
+    {"X-Admin-Token: secret\r\nOrigin: http://hopgoblin.localhost\r\n", 200},
+    {"X-Admin-Token: secret\r\n",                                       200},
+  }
+  for _,c:=range cases {
+    response:=runHandler(t,server,"PUT http://hopgoblin.localhost/log HTTP/1.1\r\n"+c.headers+"\r\n{}",nil)
+    assert.Equal(t,c.status,response.Status,"headers: %q",c.headers)
+  }
+  for token,status:=range map[string]uint16{"":403,"wrong":403,"secret":200} {
+    response:=runHandler(t,server,"GET http://hopgoblin.localhost/log HTTP/1.1\r\nX-Admin-Token: "+token+"\r\n\r\n",nil)
+    assert.Equal(t,status,response.Status,"token %q",token)
+  }
+}
+
+/*
+  Makes sure requests changing state and listing connections are refused if no token is configured, even with a token header.
+ */
+func TestHandlerWithoutToken(t *testing.T) {
+  server:=http.NewServer()
+  server.AddSiteHandler(NewHandler("hopgoblin.localhost"))
+
+  cases:=[]struct {
+    request string
+    status uint16
+  } {
+    {"GET http://hopgoblin.localhost/log HTTP/1.1\r\n\r\n",                                                200},
+    {"GET http://hopgoblin.localhost/handlers HTTP/1.1\r\n\r\n",                                           200},
+    {"GET http://hopgoblin.localhost/connections HTTP/1.1\r\n\r\n",                                        403},
+    {"GET http://hopgoblin.localhost/connections HTTP/1.1\r\nX-Admin-Token: 1\r\n\r\n",                    403},
+    {"PUT http://hopgoblin.localhost/log HTTP/1.1\r\nX-Admin-Token: 1\r\n\r\n{}",                          403},
+    {"POST http://hopgoblin.localhost/shutdown HTTP/1.1\r\nX-Admin-Token: 1\r\nContent-Length: 0\r\n\r\n", 403},
+    {"GET http://hopgoblin.localhost/log HTTP/1.1\r\nOrigin: http://attacker.example\r\n\r\n",             403},
+  }
+  for _,c:=range cases {
+    response:=runHandler(t,server,c.request,nil)
+    assert.Equal(t,c.status,response.Status,"request: %q",c.request)
+  }
+}
+
+/*
+  Makes sure metrics are served in the Prometheus text format.
+ */
+func TestHandlerMetrics(t *testing.T) {
+  server:=http.NewServer()
+  server.AddSiteHandler(NewHandler("hopgoblin.localhost"))
+  response:=runHandler(t,server,"GET http://hopgoblin.localhost/metrics HTTP/1.1\r\n\r\n",nil)
+  assert.Equal(t,uint16(200),response.Status)
+  content_type,_:=response.Headers.Get("Content-Type")
+  assert.Equal(t,metrics.TextContentType,content_type)
+  assert.Contains(t,string(response.Body),"# TYPE hopgoblin_requests_total counter\n")
+}
@@ -0,0 +1,32 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+/*
+  JSON API for inspecting and controlling a running server.
+
+  The API is served by a site handler on a magic hostname, hopgoblin.localhost by default, set in the application
+  configuration's [admin] section. Send requests through the proxy, e.g.:
+
+    curl -x localhost:64080 -H "X-Admin-Token: secret" http://hopgoblin.localhost/connections
+
+  Endpoints:
+
+    GET  /             lists the endpoints
+    GET  /handlers     the server's site handlers in dispatch order, with their host regexes if known
+    GET  /connections  open client connections, including CONNECT tunnels
+    GET  /log          log levels by prefix
+    PUT  /log          changes log levels, e.g. {"prefixes":{"http/":"TRACE"}} - an empty level removes the prefix
+    GET  /metrics      request, connection and upstream metrics in the Prometheus text format
+    POST /shutdown     shuts the server down gracefully, see http.Server.Shutdown()
+
+  If admin.token is set, all requests need it as X-Admin-Token header value:
+
+    curl -x localhost:64080 -X POST -H "X-Admin-Token: secret" http://hopgoblin.localhost/shutdown
+
+  Web pages can't forge requests with this header: browsers don't send custom headers cross-origin without a CORS preflight, which
+  the API never allows. Requests with an Origin header other than the API's own hostname are rejected as well.
+
+  Without a token only the read-only endpoints not exposing other clients' traffic are available to anyone who can use the proxy:
+  requests changing state (PUT and POST) and /connections are refused.
+ */
+package admin
@@ -28,6 +28,9 @@
   Then, assuming the application's main() function somehow calls bootstrap.Init(), your hook will be called once your command-line
   parameters are available.
 
+  Hooks registered with OnReload() are called by Reload() instead, e.g. when the application receives SIGHUP. Packages caching
+  configuration values can use this to re-read them at runtime.
+
   Keep in mind Go loads packages only as required: a package's init() methods, and thus any hooks attempted to register, won't be
   invoked unless the package is imported somewhere. See for example the main/main.go file where the "sitehandlers" package is
   imported with a dummy alias.
@@ -11,6 +11,7 @@ import (
 type hookType func()
 
 var afterFlagParseHooks []hookType
+var reloadHooks []hookType
 
 
 /*
@@ -21,6 +22,14 @@ func AfterFlagParse(hook hookType) {
   afterFlagParseHooks=append(afterFlagParseHooks,hook)
 }
 
+/*
+  Registers a hook to be called by Reload().
+  Put code that re-reads configuration at runtime there.
+ */
+func OnReload(hook hookType) {
+  reloadHooks=append(reloadHooks,hook)
+}
+
 
 /*
   Bootstraps the application.
@@ -33,3 +42,13 @@ func Init() {
     f()
   }
 }
+
+/*
+  Reloads the application's configuration, e.g. after receiving SIGHUP.
+  Calls the hooks registered with OnReload() in registration order.
+ */
+func Reload() {
+  for _,f:=range reloadHooks {
+    f()
+  }
+}
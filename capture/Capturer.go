@@ -0,0 +1,132 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package capture
+
+import (
+  "path/filepath"
+  "regexp"
+  "strconv"
+  "strings"
+  "github.com/rinusser/hopgoblin/bootstrap"
+  "github.com/rinusser/hopgoblin/http"
+  "github.com/rinusser/hopgoblin/log"
+  "github.com/rinusser/hopgoblin/utils"
+)
+
+
+func init() {
+  bootstrap.AfterFlagParse(registerCapturer)
+}
+
+func registerCapturer() {
+  capturer:=LoadCapturer()
+  if capturer!=nil {
+    http.RegisterCaptureHook(capturer)
+  }
+}
+
+
+/*
+  Capture hook writing exchanges with matching hosts to a HAR file.
+ */
+type Capturer struct {
+  Include *utils.MultiRegexMatcher //hosts to capture, nil to capture all hosts
+  Exclude *utils.MultiRegexMatcher //hosts not to capture even if included, nil to exclude none
+  Writer *HARWriter
+}
+
+/*
+  Creates a new Capturer instance capturing all hosts.
+ */
+func NewCapturer(writer *HARWriter) *Capturer {
+  return &Capturer{Writer:writer}
+}
+
+/*
+  Creates a Capturer from the application configuration's [capture] section. Returns nil if capturing is disabled or the
+  settings are invalid.
+
+  Settings:
+
+    directory     directory to write HAR files to, relative to resources/ unless absolute; capturing is disabled if empty
+    include       whitespace-separated list of host regexes to capture, optional: all hosts are captured if empty
+    exclude       whitespace-separated list of host regexes not to capture, optional
+    max_file_size size in bytes after which the HAR file is rotated
+    max_files     the number of HAR files to keep, including the current one
+    max_body_size the maximum number of body bytes captured per request and response, longer bodies are truncated
+ */
+func LoadCapturer() *Capturer {
+  directory:=utils.GetConfigValue("capture.directory")
+  if directory=="" {
+    return nil
+  }
+  if !filepath.IsAbs(directory) {
+    directory=utils.GetResourcePath(directory)
+  }
+
+  rv:=NewCapturer(NewHARWriter(directory))
+  var err error
+  rv.Include,err=parseHostList(utils.GetConfigValue("capture.include"))
+  if err==nil {
+    rv.Exclude,err=parseHostList(utils.GetConfigValue("capture.exclude"))
+  }
+  if err!=nil {
+    log.Error("capturing disabled: %s",err)
+    return nil
+  }
+
+  rv.Writer.MaxFileSize=int64(getPositiveConfigInt("capture.max_file_size",int(rv.Writer.MaxFileSize)))
+  rv.Writer.MaxFiles=getPositiveConfigInt("capture.max_files",rv.Writer.MaxFiles)
+  http.MaxCapturedBodySize=getPositiveConfigInt("capture.max_body_size",http.MaxCapturedBodySize)
+  log.Info("capturing exchanges to %s",directory)
+  return rv
+}
+
+func parseHostList(value string) (*utils.MultiRegexMatcher,error) {
+  hosts:=strings.Fields(value)
+  if len(hosts)==0 {
+    return nil,nil
+  }
+  for _,host:=range hosts {
+    if _,err:=regexp.Compile(host);err!=nil {
+      return nil,err
+    }
+  }
+  rv:=utils.NewMultiRegexMatcher(hosts)
+  return &rv,nil
+}
+
+func getPositiveConfigInt(key string, fallback int) int {
+  value:=utils.GetConfigValue(key)
+  if value=="" {
+    return fallback
+  }
+  rv,err:=strconv.Atoi(value)
+  if err!=nil || rv<1 {
+    log.Warn("invalid %s \"%s\", using default",key,value)
+    return fallback
+  }
+  return rv
+}
+
+
+/*
+  required by http.CaptureHook interface
+ */
+func (this *Capturer) CapturesHost(host string) bool {
+  if this.Include!=nil && !this.Include.MatchesAnyRegex(host) {
+    return false
+  }
+  return this.Exclude==nil || !this.Exclude.MatchesAnyRegex(host)
+}
+
+/*
+  required by http.CaptureHook interface
+ */
+func (this *Capturer) CaptureExchange(exchange *http.Exchange) {
+  err:=this.Writer.Write(NewEntry(exchange))
+  if err!=nil {
+    exchange.Request.Logger().Error("could not write capture entry: %s",err)
+  }
+}
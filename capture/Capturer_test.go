@@ -0,0 +1,46 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package capture
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "os"
+)
+
+
+/*
+  Makes sure include and exclude host filters are applied.
+ */
+func TestCapturerHostFilters(t *testing.T) {
+  capturer:=NewCapturer(nil)
+  assert.True(t,capturer.CapturesHost("anything.local"),"all hosts should be captured by default")
+
+  capturer.Include,_=parseHostList(`\.example\.com$ ^example\.org$`)
+  capturer.Exclude,_=parseHostList(`^static\.`)
+  assert.True(t,capturer.CapturesHost("www.example.com"))
+  assert.True(t,capturer.CapturesHost("example.org"))
+  assert.False(t,capturer.CapturesHost("www.example.org"))
+  assert.False(t,capturer.CapturesHost("static.example.com"))
+
+  _,err:=parseHostList("valid (invalid")
+  assert.NotNil(t,err)
+}
+
+/*
+  Makes sure captured exchanges are written to the HAR file.
+ */
+func TestCapturerWritesEntries(t *testing.T) {
+  directory,_:=ioutil.TempDir("","hopgoblin-capture")
+  defer os.RemoveAll(directory)
+  capturer:=NewCapturer(NewHARWriter(directory))
+  defer capturer.Writer.Close()
+
+  capturer.CaptureExchange(createTestExchange())
+  document:=readHARFile(t,capturer.Writer.GetFilename(0))
+  assert.Equal(t,1,len(document.Log.Entries))
+  assert.Equal(t,"https://example.com/form?q=a%20b&flag",document.Log.Entries[0].Request.Url)
+  assert.Equal(t,"sitehandlers.RuleHandler",document.Log.Entries[0].SiteHandler)
+}
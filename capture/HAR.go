@@ -0,0 +1,340 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package capture
+
+import (
+  "encoding/base64"
+  "encoding/json"
+  "io/ioutil"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+  "unicode/utf8"
+  "github.com/rinusser/hopgoblin/http"
+)
+
+
+/*
+  The HAR format version written.
+ */
+const HARVersion="1.2"
+
+/*
+  The creator name and version written to HAR files.
+ */
+var Creator=NameVersion{Name:"hopgoblin",Version:"dev"}
+
+
+/*
+  A complete HAR document.
+ */
+type Document struct {
+  Log Log `json:"log"`
+}
+
+/*
+  HAR "log" object.
+ */
+type Log struct {
+  Version string `json:"version"`
+  Creator NameVersion `json:"creator"`
+  Entries []Entry `json:"entries"`
+}
+
+/*
+  HAR "creator" object.
+ */
+type NameVersion struct {
+  Name string `json:"name"`
+  Version string `json:"version"`
+}
+
+/*
+  A single HAR entry, i.e. one request/response exchange.
+ */
+type Entry struct {
+  StartedDateTime string `json:"startedDateTime"`
+  Time float64 `json:"time"`
+  Request EntryRequest `json:"request"`
+  Response EntryResponse `json:"response"`
+  Cache struct{} `json:"cache"`
+  Timings Timings `json:"timings"`
+  Tunneled bool `json:"_tunneled"`
+  SiteHandler string `json:"_siteHandler,omitempty"`
+}
+
+/*
+  HAR "request" object.
+ */
+type EntryRequest struct {
+  Method string `json:"method"`
+  Url string `json:"url"`
+  HTTPVersion string `json:"httpVersion"`
+  Cookies []NameValue `json:"cookies"`
+  Headers []NameValue `json:"headers"`
+  QueryString []NameValue `json:"queryString"`
+  PostData *PostData `json:"postData,omitempty"`
+  HeadersSize int `json:"headersSize"`
+  BodySize int `json:"bodySize"`
+}
+
+/*
+  HAR "response" object.
+ */
+type EntryResponse struct {
+  Status int `json:"status"`
+  StatusText string `json:"statusText"`
+  HTTPVersion string `json:"httpVersion"`
+  Cookies []NameValue `json:"cookies"`
+  Headers []NameValue `json:"headers"`
+  Content Content `json:"content"`
+  RedirectURL string `json:"redirectURL"`
+  HeadersSize int `json:"headersSize"`
+  BodySize int `json:"bodySize"`
+}
+
+/*
+  HAR name/value pair, used for headers, cookies and query parameters.
+ */
+type NameValue struct {
+  Name string `json:"name"`
+  Value string `json:"value"`
+}
+
+/*
+  HAR "postData" object. Binary data is base64-encoded, as marked by the non-standard "_encoding" field.
+ */
+type PostData struct {
+  MimeType string `json:"mimeType"`
+  Text string `json:"text"`
+  Encoding string `json:"_encoding,omitempty"`
+  Comment string `json:"comment,omitempty"`
+}
+
+/*
+  HAR "content" object: the response body with all transfer and content codings removed.
+ */
+type Content struct {
+  Size int `json:"size"`
+  MimeType string `json:"mimeType"`
+  Text string `json:"text,omitempty"`
+  Encoding string `json:"encoding,omitempty"`
+  Comment string `json:"comment,omitempty"`
+}
+
+/*
+  HAR "timings" object, in milliseconds. Phases that didn't happen are -1.
+ */
+type Timings struct {
+  Blocked float64 `json:"blocked"`
+  DNS float64 `json:"dns"`
+  Connect float64 `json:"connect"`
+  Send float64 `json:"send"`
+  Wait float64 `json:"wait"`
+  Receive float64 `json:"receive"`
+  SSL float64 `json:"ssl"`
+}
+
+
+/*
+  Creates an empty HAR document.
+ */
+func NewDocument() *Document {
+  return &Document{Log:Log{Version:HARVersion,Creator:Creator,Entries:[]Entry{}}}
+}
+
+/*
+  Reads a HAR document from a file.
+ */
+func ReadHARFile(filename string) (*Document,error) {
+  data,err:=ioutil.ReadFile(filename)
+  if err!=nil {
+    return nil,err
+  }
+  rv:=&Document{}
+  err=json.Unmarshal(data,rv)
+  if err!=nil {
+    return nil,err
+  }
+  return rv,nil
+}
+
+/*
+  Writes a HAR document to a file, replacing any previous content.
+ */
+func WriteHARFile(filename string, document *Document) error {
+  data,err:=json.MarshalIndent(document,"","  ")
+  if err!=nil {
+    return err
+  }
+  return ioutil.WriteFile(filename,append(data,'\n'),0600)
+}
+
+
+/*
+  Converts an exchange into a HAR entry.
+ */
+func NewEntry(exchange *http.Exchange) *Entry {
+  rv:=&Entry {
+    StartedDateTime: exchange.Started.Format("2006-01-02T15:04:05.000Z07:00"),
+    Request: newEntryRequest(exchange),
+    Response: newEntryResponse(exchange),
+    Timings: newTimings(exchange.Timings),
+    Tunneled: exchange.Tunneled,
+    SiteHandler: exchange.SiteHandler,
+  }
+  for _,value:=range []float64{rv.Timings.Connect,rv.Timings.Send,rv.Timings.Wait,rv.Timings.Receive} {
+    if value>0 {
+      rv.Time+=value
+    }
+  }
+  return rv
+}
+
+func newEntryRequest(exchange *http.Exchange) EntryRequest {
+  request:=exchange.Request
+  rv:=EntryRequest {
+    Method: request.Method,
+    Url: exchange.Url,
+    HTTPVersion: request.Protocol,
+    Cookies: []NameValue{},
+    Headers: getHeaders(request.Headers),
+    QueryString: getQueryString(exchange.Url),
+    HeadersSize: -1,
+    BodySize: len(request.Body),
+  }
+  for _,header:=range request.Headers.GetAll("Cookie") {
+    for _,cookie:=range strings.Split(header,";") {
+      if pair:=parseCookie(cookie);pair!=nil {
+        rv.Cookies=append(rv.Cookies,*pair)
+      }
+    }
+  }
+  if exchange.RequestBodyTruncated {
+    rv.BodySize=getContentLength(request.Headers)
+  }
+  if len(request.Body)>0 {
+    mime_type,_:=request.Headers.Get("Content-Type")
+    text,encoding:=encodeText(request.Body)
+    rv.PostData=&PostData{MimeType:mime_type,Text:text,Encoding:encoding}
+    if exchange.RequestBodyTruncated {
+      rv.PostData.Comment="truncated"
+    }
+  }
+  return rv
+}
+
+func newEntryResponse(exchange *http.Exchange) EntryResponse {
+  response:=exchange.Response
+  rv:=EntryResponse {
+    Status: int(response.Status),
+    StatusText: http.StatusText(response.Status),
+    HTTPVersion: response.Protocol,
+    Cookies: []NameValue{},
+    Headers: getHeaders(response.Headers),
+    HeadersSize: -1,
+    BodySize: len(response.Body),
+  }
+  for _,header:=range response.Headers.GetAll("Set-Cookie") {
+    if pair:=parseCookie(strings.SplitN(header,";",2)[0]);pair!=nil {
+      rv.Cookies=append(rv.Cookies,*pair)
+    }
+  }
+  rv.RedirectURL,_=response.Headers.Get("Location")
+  if exchange.ResponseBodyTruncated {
+    rv.BodySize=getContentLength(response.Headers)
+  }
+
+  rv.Content.MimeType,_=response.Headers.Get("Content-Type")
+  body,err:=response.DecodeBody()
+  rv.Content.Size=len(body)
+  rv.Content.Text,rv.Content.Encoding=encodeText(body)
+  if exchange.ResponseBodyTruncated {
+    rv.Content.Comment="truncated"
+  } else if err!=nil {
+    rv.Content.Comment=err.Error()
+  }
+  return rv
+}
+
+func newTimings(timings http.ExchangeTimings) Timings {
+  rv:=Timings {
+    Blocked: -1,
+    DNS: -1,
+    Connect: toMilliseconds(timings.Connect),
+    Send: toMilliseconds(timings.Send),
+    Wait: toMilliseconds(timings.Wait),
+    Receive: toMilliseconds(timings.Receive),
+    SSL: toMilliseconds(timings.TLS),
+  }
+  if rv.Connect>=0 && rv.SSL>0 {
+    rv.Connect+=rv.SSL //HAR counts the TLS handshake as part of connecting
+  }
+  return rv
+}
+
+func toMilliseconds(duration time.Duration) float64 {
+  if duration<0 {
+    return -1
+  }
+  return float64(duration)/float64(time.Millisecond)
+}
+
+func getHeaders(headers *http.Headers) []NameValue {
+  rv:=[]NameValue{}
+  headers.ForEach(func(name string, value string) {
+    rv=append(rv,NameValue{Name:name,Value:value})
+  })
+  return rv
+}
+
+func getQueryString(rawurl string) []NameValue {
+  rv:=[]NameValue{}
+  parsed,err:=url.Parse(rawurl)
+  if err!=nil || parsed.RawQuery=="" {
+    return rv
+  }
+  for _,pair:=range strings.Split(parsed.RawQuery,"&") {
+    parts:=strings.SplitN(pair,"=",2)
+    name,_:=url.QueryUnescape(parts[0])
+    value:=""
+    if len(parts)>1 {
+      value,_=url.QueryUnescape(parts[1])
+    }
+    rv=append(rv,NameValue{Name:name,Value:value})
+  }
+  return rv
+}
+
+func parseCookie(cookie string) *NameValue {
+  parts:=strings.SplitN(strings.TrimSpace(cookie),"=",2)
+  if parts[0]=="" {
+    return nil
+  }
+  rv:=&NameValue{Name:parts[0]}
+  if len(parts)>1 {
+    rv.Value=parts[1]
+  }
+  return rv
+}
+
+func getContentLength(headers *http.Headers) int {
+  value,_:=headers.Get("Content-Length")
+  length,err:=strconv.Atoi(value)
+  if err!=nil {
+    return -1
+  }
+  return length
+}
+
+/*
+  Returns body data as text, base64-encoded along with the encoding name if it isn't valid UTF-8.
+ */
+func encodeText(data []byte) (string,string) {
+  if utf8.Valid(data) {
+    return string(data),""
+  }
+  return base64.StdEncoding.EncodeToString(data),"base64"
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package capture
+
+import (
+  "encoding/json"
+  "fmt"
+  "os"
+  "path/filepath"
+  "sync"
+)
+
+
+/*
+  Writes HAR entries to a rotating file.
+
+  Entries are written to <BaseName>.har in Directory. Once the file would grow beyond MaxFileSize bytes it's rotated: existing
+  files are renamed to <BaseName>.1.har, <BaseName>.2.har and so on, keeping at most MaxFiles files in total. A file left over
+  from a previous run is rotated before the first entry is written.
+
+  The file is kept a complete HAR document after each entry, so it can be read at any time.
+ */
+type HARWriter struct {
+  Directory string
+  BaseName string
+  MaxFileSize int64 //a file always gets at least one entry, regardless of its size
+  MaxFiles int
+
+  file *os.File
+  size int64        //the file's size without the closing footer
+  entries int       //the number of entries in the current file
+  mutex sync.Mutex
+}
+
+const harFooter="\n]}}\n"
+
+/*
+  Creates a new HARWriter instance with default limits.
+ */
+func NewHARWriter(directory string) *HARWriter {
+  return &HARWriter {
+    Directory: directory,
+    BaseName: "capture",
+    MaxFileSize: 10*1024*1024,
+    MaxFiles: 5,
+  }
+}
+
+/*
+  Appends an entry to the current file, rotating it first if necessary.
+ */
+func (this *HARWriter) Write(entry *Entry) error {
+  data,err:=json.Marshal(entry)
+  if err!=nil {
+    return err
+  }
+
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+
+  if this.file!=nil && this.entries>0 && this.size+int64(len(data))+2>this.MaxFileSize {
+    this.file.Close()
+    this.file=nil
+  }
+  if this.file==nil {
+    err=this.open()
+    if err!=nil {
+      return err
+    }
+  }
+
+  separator:=",\n"
+  if this.entries==0 {
+    separator="\n"
+  }
+  chunk:=append(append([]byte(separator),data...),harFooter...)
+  _,err=this.file.WriteAt(chunk,this.size)
+  if err!=nil {
+    return err
+  }
+  this.size+=int64(len(chunk)-len(harFooter))
+  this.entries++
+  return nil
+}
+
+/*
+  Closes the current file. The next entry will be written to a new file.
+ */
+func (this *HARWriter) Close() error {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  if this.file==nil {
+    return nil
+  }
+  err:=this.file.Close()
+  this.file=nil
+  return err
+}
+
+/*
+  Returns the filename of the current file (index 0) or a rotated file (index 1 and up).
+ */
+func (this *HARWriter) GetFilename(index int) string {
+  name:=this.BaseName+".har"
+  if index>0 {
+    name=fmt.Sprintf("%s.%d.har",this.BaseName,index)
+  }
+  return filepath.Join(this.Directory,name)
+}
+
+/*
+  Rotates existing files and starts a new one.
+ */
+func (this *HARWriter) open() error {
+  err:=os.MkdirAll(this.Directory,0700)
+  if err!=nil {
+    return err
+  }
+  this.rotate()
+
+  file,err:=os.OpenFile(this.GetFilename(0),os.O_RDWR|os.O_CREATE|os.O_TRUNC,0600)
+  if err!=nil {
+    return err
+  }
+  header,_:=json.Marshal(NewDocument())
+  header=header[0:len(header)-3] //cut off the empty entries list's closing "]}}"
+  _,err=file.Write(append(header,harFooter...))
+  if err!=nil {
+    file.Close()
+    return err
+  }
+  this.file=file
+  this.size=int64(len(header))
+  this.entries=0
+  return nil
+}
+
+func (this *HARWriter) rotate() {
+  if _,err:=os.Stat(this.GetFilename(0));err!=nil {
+    return
+  }
+  if this.MaxFiles<2 {
+    os.Remove(this.GetFilename(0))
+    return
+  }
+  os.Remove(this.GetFilename(this.MaxFiles-1))
+  for index:=this.MaxFiles-2;index>=0;index-- {
+    os.Rename(this.GetFilename(index),this.GetFilename(index+1))
+  }
+}
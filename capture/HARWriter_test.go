@@ -0,0 +1,64 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package capture
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "os"
+)
+
+
+func readHARFile(t *testing.T, filename string) *Document {
+  rv,err:=ReadHARFile(filename)
+  if !assert.Nil(t,err,"%s should be a valid HAR file",filename) {
+    t.FailNow()
+  }
+  return rv
+}
+
+/*
+  Makes sure the HAR file is a complete document after each entry.
+ */
+func TestHARWriterWritesValidDocuments(t *testing.T) {
+  directory,_:=ioutil.TempDir("","hopgoblin-capture")
+  defer os.RemoveAll(directory)
+  writer:=NewHARWriter(directory)
+  defer writer.Close()
+
+  entry:=NewEntry(createTestExchange())
+  for count:=1;count<=3;count++ {
+    assert.Nil(t,writer.Write(entry))
+    document:=readHARFile(t,writer.GetFilename(0))
+    assert.Equal(t,HARVersion,document.Log.Version)
+    assert.Equal(t,Creator,document.Log.Creator)
+    assert.Equal(t,count,len(document.Log.Entries))
+  }
+  assert.Equal(t,"POST",readHARFile(t,writer.GetFilename(0)).Log.Entries[2].Request.Method)
+}
+
+/*
+  Makes sure files are rotated once they grow too large, and old files are removed.
+ */
+func TestHARWriterRotatesFiles(t *testing.T) {
+  directory,_:=ioutil.TempDir("","hopgoblin-capture")
+  defer os.RemoveAll(directory)
+  ioutil.WriteFile(directory+"/capture.har",[]byte("left over"),0600)
+  writer:=NewHARWriter(directory)
+  writer.MaxFileSize=1
+  writer.MaxFiles=3
+  defer writer.Close()
+
+  entry:=NewEntry(createTestExchange())
+  for count:=1;count<=4;count++ {
+    assert.Nil(t,writer.Write(entry))
+  }
+  for index:=0;index<3;index++ {
+    document:=readHARFile(t,writer.GetFilename(index))
+    assert.Equal(t,1,len(document.Log.Entries),"file %d should contain a single entry",index)
+  }
+  _,err:=os.Stat(writer.GetFilename(3))
+  assert.True(t,os.IsNotExist(err),"there should be at most 3 files")
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package capture
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "encoding/base64"
+  "time"
+  "github.com/rinusser/hopgoblin/http"
+)
+
+
+func createTestExchange() *http.Exchange {
+  request:=http.ParseRequest("POST /form?q=a%20b&flag HTTP/1.1\r\nHost: example.com\r\nCookie: a=1; b=2\r\nContent-Type: text/plain\r\n\r\nhello")
+  response:=http.ParseResponse("HTTP/1.1 302 Found\r\nSet-Cookie: c=3; Path=/\r\nLocation: /next\r\nContent-Type: text/plain\r\n\r\nmoved")
+  return &http.Exchange {
+    Started: time.Date(2018,8,1,12,0,0,0,time.UTC),
+    Url: "https://example.com/form?q=a%20b&flag",
+    Request: request,
+    Response: &response,
+    Timings: http.ExchangeTimings {
+      Connect: 3*time.Millisecond,
+      TLS: 2*time.Millisecond,
+      Send: time.Millisecond,
+      Wait: 10*time.Millisecond,
+      Receive: 4*time.Millisecond,
+    },
+    Tunneled: true,
+    SiteHandler: "sitehandlers.RuleHandler",
+  }
+}
+
+/*
+  Makes sure exchanges are converted into HAR entries with all fields set.
+ */
+func TestNewEntry(t *testing.T) {
+  entry:=NewEntry(createTestExchange())
+
+  assert.Equal(t,"2018-08-01T12:00:00.000Z",entry.StartedDateTime)
+  assert.Equal(t,20.0,entry.Time)
+  assert.True(t,entry.Tunneled)
+  assert.Equal(t,"sitehandlers.RuleHandler",entry.SiteHandler)
+
+  assert.Equal(t,"POST",entry.Request.Method)
+  assert.Equal(t,"https://example.com/form?q=a%20b&flag",entry.Request.Url)
+  assert.Equal(t,"HTTP/1.1",entry.Request.HTTPVersion)
+  assert.Equal(t,[]NameValue{{"a","1"},{"b","2"}},entry.Request.Cookies)
+  assert.Equal(t,[]NameValue{{"q","a b"},{"flag",""}},entry.Request.QueryString)
+  assert.Equal(t,NameValue{"Host","example.com"},entry.Request.Headers[0])
+  assert.Equal(t,&PostData{MimeType:"text/plain",Text:"hello"},entry.Request.PostData)
+  assert.Equal(t,5,entry.Request.BodySize)
+
+  assert.Equal(t,302,entry.Response.Status)
+  assert.Equal(t,"Found",entry.Response.StatusText)
+  assert.Equal(t,[]NameValue{{"c","3"}},entry.Response.Cookies)
+  assert.Equal(t,"/next",entry.Response.RedirectURL)
+  assert.Equal(t,Content{Size:5,MimeType:"text/plain",Text:"moved"},entry.Response.Content)
+
+  assert.Equal(t,Timings{Blocked:-1,DNS:-1,Connect:5,Send:1,Wait:10,Receive:4,SSL:2},entry.Timings)
+}
+
+/*
+  Makes sure response content is decoded, and binary content is base64-encoded.
+ */
+func TestNewEntryContentEncoding(t *testing.T) {
+  exchange:=createTestExchange()
+  exchange.Response.Headers.Set("Content-Encoding","gzip")
+  exchange.Response.Body,_=http.GetCodec("gzip").Encode([]byte{0xff,0x00,0xfe})
+  exchange.Timings.Connect=-1
+  exchange.Timings.TLS=-1
+
+  entry:=NewEntry(exchange)
+  assert.Equal(t,len(exchange.Response.Body),entry.Response.BodySize)
+  assert.Equal(t,3,entry.Response.Content.Size)
+  assert.Equal(t,"base64",entry.Response.Content.Encoding)
+  assert.Equal(t,base64.StdEncoding.EncodeToString([]byte{0xff,0x00,0xfe}),entry.Response.Content.Text)
+  assert.Equal(t,-1.0,entry.Timings.Connect)
+  assert.Equal(t,-1.0,entry.Timings.SSL)
+  assert.Equal(t,15.0,entry.Time)
+}
+
+/*
+  Makes sure truncated bodies are marked as such.
+ */
+func TestNewEntryTruncatedBodies(t *testing.T) {
+  exchange:=createTestExchange()
+  exchange.Request.Headers.Set("Content-Length","100")
+  exchange.RequestBodyTruncated=true
+  exchange.ResponseBodyTruncated=true
+
+  entry:=NewEntry(exchange)
+  assert.Equal(t,100,entry.Request.BodySize)
+  assert.Equal(t,"truncated",entry.Request.PostData.Comment)
+  assert.Equal(t,-1,entry.Response.BodySize)
+  assert.Equal(t,"truncated",entry.Response.Content.Comment)
+}
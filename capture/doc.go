@@ -0,0 +1,15 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+/*
+  Records exchanges handled by the proxy server as HAR 1.2 entries, for debugging site handlers.
+
+  Capturing is enabled by setting a capture directory in the application configuration's [capture] section. Entries are
+  appended to capture.har in that directory, which is rotated once it gets too large: the previous file is renamed to
+  capture.1.har, capture.1.har to capture.2.har and so on. The current file is always a complete HAR document, so it can be
+  opened in browsers' developer tools or other HAR viewers at any time.
+
+  Besides the standard HAR fields each entry contains "_tunneled" (whether the request was received inside a CONNECT tunnel)
+  and "_siteHandler" (the type of the site handler that served the request, if any).
+ */
+package capture
@@ -40,6 +40,7 @@ check_imports_order() {
 
   test_regex='^(testing|github\.com/stretchr/testify/assert)$'
   proj_regex='hopgoblin'
+  vendor_regex='^[^/]*\.'
 
   files=`$findcmd * -name '*.go'`
   for file in $files; do
@@ -49,7 +50,9 @@ check_imports_order() {
     imports=`echo "$imports" | grep -vE "$test_regex"`
     imports_proj=`echo "$imports" | grep -E "$proj_regex"`
     imports=`echo "$imports" | grep -vE "$proj_regex"`
-    expected=`(echo "$imports_test" | $sortcmd -r; echo "$imports" | $sortcmd; echo "$imports_proj" | $sortcmd) | xargs`
+    imports_vendor=`echo "$imports" | grep -E "$vendor_regex"`
+    imports=`echo "$imports" | grep -vE "$vendor_regex"`
+    expected=`(echo "$imports_test" | $sortcmd -r; echo "$imports" | $sortcmd; echo "$imports_vendor" | $sortcmd; echo "$imports_proj" | $sortcmd) | xargs`
     actual=`echo "$raw_imports" | xargs`
 
     if [ "$actual" == "$expected" ]; then
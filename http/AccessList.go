@@ -0,0 +1,98 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "errors"
+  "net"
+  "strings"
+  "github.com/rinusser/hopgoblin/utils"
+)
+
+
+/*
+  Client IP address filter, checked for each accepted connection.
+
+  Addresses matching any Deny network are rejected. If there are Allow networks, addresses must additionally match one of them.
+  A nil *AccessList allows all clients.
+ */
+type AccessList struct {
+  Allow []*net.IPNet
+  Deny []*net.IPNet
+}
+
+
+/*
+  Fetches the default access list from the application configuration's "access" section: access.allow and access.deny are lists
+  of networks in CIDR notation or single IP addresses, separated by whitespace or commas.
+  Returns nil if neither is set.
+ */
+func GetDefaultAccessList() *AccessList {
+  rv,err:=parseAccessList(utils.GetConfigValue("access.allow"),utils.GetConfigValue("access.deny"))
+  if err!=nil {
+    panic("invalid access list: "+err.Error())
+  }
+  return rv
+}
+
+func parseAccessList(allow string, deny string) (*AccessList,error) {
+  allowed,err:=parseNetworks(allow)
+  if err!=nil {
+    return nil,err
+  }
+  denied,err:=parseNetworks(deny)
+  if err!=nil {
+    return nil,err
+  }
+  if len(allowed)==0 && len(denied)==0 {
+    return nil,nil
+  }
+  return &AccessList{Allow:allowed,Deny:denied},nil
+}
+
+func parseNetworks(input string) ([]*net.IPNet,error) {
+  var rv []*net.IPNet
+  for _,entry:=range strings.FieldsFunc(input,func(r rune) bool { return r==',' || r==' ' || r=='\t' }) {
+    if !strings.Contains(entry,"/") {
+      ip:=net.ParseIP(entry)
+      if ip==nil {
+        return nil,errors.New("invalid IP address \""+entry+"\"")
+      }
+      if ip.To4()!=nil {
+        entry+="/32"
+      } else {
+        entry+="/128"
+      }
+    }
+    _,network,err:=net.ParseCIDR(entry)
+    if err!=nil {
+      return nil,errors.New("invalid network \""+entry+"\"")
+    }
+    rv=append(rv,network)
+  }
+  return rv,nil
+}
+
+/*
+  Checks whether a client address is allowed.
+ */
+func (this *AccessList) Allows(ip net.IP) bool {
+  if this==nil {
+    return true
+  }
+  for _,network:=range this.Deny {
+    if network.Contains(ip) {
+      return false
+    }
+  }
+  if len(this.Allow)==0 {
+    return true
+  }
+  for _,network:=range this.Allow {
+    if network.Contains(ip) {
+      return true
+    }
+  }
+  return false
+}
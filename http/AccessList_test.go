@@ -0,0 +1,52 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "net"
+)
+
+
+/*
+  Makes sure deny lists take precedence over allow lists, and allow lists restrict clients to the listed networks.
+ */
+func TestAccessList(t *testing.T) {
+  var list *AccessList
+  assert.True(t,list.Allows(net.ParseIP("192.0.2.1")),"nil access list should allow everyone")
+
+  list,err:=parseAccessList("","")
+  assert.Nil(t,err)
+  assert.Nil(t,list,"empty lists should result in nil access list")
+
+  list,err=parseAccessList("127.0.0.1, 192.168.0.0/16\t::1","192.168.1.0/24")
+  if !assert.Nil(t,err) {
+    return
+  }
+  cases:=map[string]bool {
+    "127.0.0.1":true,
+    "127.0.0.2":false,
+    "192.168.2.3":true,
+    "192.168.1.3":false,
+    "::1":true,
+    "::ffff:192.168.2.3":true,
+    "2001:db8::1":false,
+  }
+  for ip,expected:=range cases {
+    assert.Equal(t,expected,list.Allows(net.ParseIP(ip)),ip)
+  }
+
+  list,err=parseAccessList("","10.0.0.0/8")
+  assert.Nil(t,err)
+  assert.True(t,list.Allows(net.ParseIP("192.0.2.1")),"deny list alone should allow other addresses")
+  assert.False(t,list.Allows(net.ParseIP("10.1.2.3")))
+
+  for _,invalid:=range []string{"localhost","10.0.0.0/33","300.0.0.1"} {
+    _,err=parseAccessList(invalid,"")
+    assert.NotNil(t,err,"%q should be invalid",invalid)
+    _,err=parseAccessList("",invalid)
+    assert.NotNil(t,err,"%q should be invalid",invalid)
+  }
+}
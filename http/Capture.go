@@ -0,0 +1,216 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "bufio"
+  "bytes"
+  "io"
+  "strings"
+  "time"
+)
+
+
+/*
+  A single request/response exchange handled by the server, as passed to capture hooks.
+ */
+type Exchange struct {
+  Started time.Time       //when the request was received
+  Url string              //absolute request URL, e.g. "https://example.com/index.html"
+  Request *Request        //the request as received from the client
+  Response *Response      //the response as sent to the client
+  RequestBodyTruncated bool
+  ResponseBodyTruncated bool
+  Timings ExchangeTimings
+  Tunneled bool           //whether the request was received inside a CONNECT tunnel
+  SiteHandler string      //type of the site handler that served the request, empty if there was none
+}
+
+/*
+  Time spent in the phases of an exchange. Phases that didn't happen, e.g. connecting if a pooled upstream connection was reused,
+  are set to -1.
+ */
+type ExchangeTimings struct {
+  Connect time.Duration //opening the upstream connection, including any CONNECT tunnel through the upstream proxy
+  TLS time.Duration     //TLS handshake with the target host
+  Send time.Duration    //sending the request upstream
+  Wait time.Duration    //waiting for the response header
+  Receive time.Duration //passing the response on to the client
+}
+
+/*
+  Receives exchanges handled by the server, e.g. to record them.
+ */
+type CaptureHook interface {
+  CapturesHost(host string) bool //called before the request is handled, return false to skip capturing exchanges with this host
+  CaptureExchange(exchange *Exchange)
+}
+
+/*
+  The maximum number of body bytes captured per request and response, longer bodies are truncated in captures.
+ */
+var MaxCapturedBodySize=1024*1024
+
+var registeredCaptureHooks []CaptureHook
+
+/*
+  Registers a capture hook, new Server instances will pass their exchanges to it. Call this e.g. in other packages' init()
+  functions.
+ */
+func RegisterCaptureHook(hook CaptureHook) {
+  registeredCaptureHooks=append(registeredCaptureHooks,hook)
+}
+
+/*
+  Returns all registered capture hooks.
+ */
+func GetRegisteredCaptureHooks() []CaptureHook {
+  return append([]CaptureHook(nil),registeredCaptureHooks...)
+}
+
+
+/*
+  An exchange being captured, until the response is written.
+ */
+type captureState struct {
+  exchange *Exchange
+  hooks []CaptureHook
+  requestBody *capturedBody
+}
+
+/*
+  Starts capturing a request if any of the server's capture hooks wants it. The request's body stream is replaced with one that
+  records the body data as it's read.
+  Returns nil if the request isn't captured.
+ */
+func (server *Server) startCapture(request *Request, tunnelHost string) *captureState {
+  if len(server.CaptureHooks)==0 || request.Method=="CONNECT" {
+    return nil
+  }
+  host:=tunnelHost
+  if host=="" {
+    host=getRequestHost(request)
+  }
+  var hooks []CaptureHook
+  for _,hook:=range server.CaptureHooks {
+    if hook.CapturesHost(host) {
+      hooks=append(hooks,hook)
+    }
+  }
+  if len(hooks)==0 {
+    return nil
+  }
+
+  rv:=&captureState {
+    exchange: &Exchange {
+      Started: time.Now(),
+      Url: getAbsoluteUrl(request,tunnelHost),
+      Request: &Request {
+        Method: request.Method,
+        Url: request.Url,
+        IsSSL: tunnelHost!="",
+        message: message {
+          Protocol: request.Protocol,
+          Headers: request.Headers.Clone(),
+        },
+      },
+      Timings: ExchangeTimings{Connect:-1,TLS:-1},
+      Tunneled: tunnelHost!="",
+    },
+    hooks: hooks,
+    requestBody: &capturedBody{},
+  }
+  if request.BodyStream!=nil {
+    request.BodyStream=&recordingReader{ReadCloser:request.BodyStream,body:rv.requestBody}
+  }
+  return rv
+}
+
+/*
+  Builds the absolute URL of a request, using the tunnel's target host if a tunneled request has no Host header.
+ */
+func getAbsoluteUrl(request *Request, tunnelHost string) string {
+  if _,found:=request.Headers.Get("Host");!found && tunnelHost!="" && !strings.Contains(request.Url,"://") {
+    return "https://"+tunnelHost+request.Url
+  }
+  return request.GetAbsoluteUrl()
+}
+
+/*
+  Records the site handler type for the exchange.
+ */
+func (this *captureState) setSiteHandler(handler SiteHandler) {
+  this.exchange.SiteHandler=GetSiteHandlerName(handler)
+}
+
+/*
+  Writes the response to the client while recording it, then passes the finished exchange to the capture hooks.
+ */
+func (this *captureState) writeResponse(response *Response, out *bufio.Writer) error {
+  body:=&capturedBody{}
+  body.record(response.Body)
+  if response.BodyStream!=nil {
+    response.BodyStream=&recordingReader{ReadCloser:response.BodyStream,body:body}
+  }
+  if response.timings!=nil {
+    this.exchange.Timings=*response.timings
+  }
+
+  started:=time.Now()
+  err:=response.Write(out)
+  this.exchange.Timings.Receive=time.Since(started)
+
+  this.exchange.Request.Body=this.requestBody.data.Bytes()
+  this.exchange.RequestBodyTruncated=this.requestBody.truncated
+  this.exchange.Response=&Response {
+    Status: response.Status,
+    message: message {
+      Protocol: response.Protocol,
+      Headers: response.Headers.Clone(),
+      Body: body.data.Bytes(),
+    },
+  }
+  this.exchange.ResponseBodyTruncated=body.truncated
+  for _,hook:=range this.hooks {
+    hook.CaptureExchange(this.exchange)
+  }
+  return err
+}
+
+
+/*
+  Body data recorded for captures, up to MaxCapturedBodySize bytes.
+ */
+type capturedBody struct {
+  data bytes.Buffer
+  truncated bool
+}
+
+func (this *capturedBody) record(data []byte) {
+  remaining:=MaxCapturedBodySize-this.data.Len()
+  if len(data)>remaining {
+    data=data[0:remaining]
+    this.truncated=true
+  }
+  this.data.Write(data)
+}
+
+/*
+  Passes body data through while recording it.
+ */
+type recordingReader struct {
+  io.ReadCloser
+  body *capturedBody
+}
+
+/*
+  required by io.Reader interface
+ */
+func (this *recordingReader) Read(out []byte) (int,error) {
+  size,err:=this.ReadCloser.Read(out)
+  if size>0 {
+    this.body.record(out[0:size])
+  }
+  return size,err
+}
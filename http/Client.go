@@ -12,6 +12,7 @@ import (
   "net"
   "os"
   "strings"
+  "time"
   "github.com/rinusser/hopgoblin/log"
   "github.com/rinusser/hopgoblin/utils"
 )
@@ -22,17 +23,34 @@ import (
  */
 type Client struct {
   conn net.Conn                      //the outgoing connection
-  *ProxySettings                     //proxy settings to use
+  *ProxySettings                     //proxy settings to use, nil to connect to target hosts directly
   EnableCertificateVerification bool //whether remote certificates should be verified
+  Pool *ConnectionPool               //idle upstream connections to reuse, nil to use a new connection for each request
+  CorrelationHeader string           //request header to send correlation IDs upstream in, empty to not send them
 }
 
 /*
-  Creates a default Client instance.
+  Creates a default Client instance, using the shared default connection pool.
+  The correlation header is read from the client.correlation_header configuration setting.
  */
 func NewClient() *Client {
+  return newClient(GetDefaultProxySettings())
+}
+
+/*
+  Creates a Client for requests made on behalf of the server, with a snapshot of the server's proxy settings.
+  Unlike NewClient() this doesn't parse the proxy configuration again, so it's safe to use while serving requests.
+ */
+func NewServerClient(server *Server) *Client {
+  return newClient(server.getProxySettings().Copy())
+}
+
+func newClient(proxy_settings *ProxySettings) *Client {
   return &Client {
-    ProxySettings:GetDefaultProxySettings(),
+    ProxySettings:proxy_settings,
     EnableCertificateVerification:true,
+    Pool:GetDefaultConnectionPool(),
+    CorrelationHeader:utils.GetConfigValue("client.correlation_header"),
   }
 }
 
@@ -44,95 +62,408 @@ var caCertPool *x509.CertPool=nil
   Take proxy server settings from parent server instance.
  */
 func (this *Client) CopyProxySettings(server *Server) {
-  settings:=server.ProxySettings
-  if settings!=nil {
-    val:=*settings
-    settings=&val
-  }
-  this.ProxySettings=settings
+  this.ProxySettings=server.getProxySettings().Copy()
 }
 
-func sendHTTPStringAndParseResponse(request string, buf *bufio.ReadWriter) (*Response,error) {
-  _,err:=buf.WriteString(request)
-  if err!=nil {
-    log.Error("ERROR: could not send request (%s)",err)
-    return nil,err
-  }
+func sendRequestAndReadResponse(request *Request, buf *bufio.ReadWriter, closer func() error, logger log.CorrelatedLogger) (*Response,error) {
+  return sendRequestAndReadResponseTimed(request,buf,closer,&ExchangeTimings{},logger)
+}
 
-  err=buf.Flush()
+/*
+  Sends a request and reads the response header, recording the send and wait times.
+ */
+func sendRequestAndReadResponseTimed(request *Request, buf *bufio.ReadWriter, closer func() error, timings *ExchangeTimings, logger log.CorrelatedLogger) (*Response,error) {
+  started:=time.Now()
+  err:=request.Write(buf.Writer)
   if err!=nil {
-    log.Error("flush failed: %s",err)
+    logger.Error("ERROR: could not send request (%s)",err)
     return nil,err
   }
+  timings.Send=time.Since(started)
 
-  log.Trace("starting to read response...")
-  response_text,err:=ReadHTTPMessageAsString(buf)
-  log.Trace("finished reading")
+  logger.Trace("starting to read response...")
+  started=time.Now()
+  response,err:=readResponse(buf.Reader,request.Method,closer,logger)
+  timings.Wait=time.Since(started)
+  logger.Trace("finished reading response header")
   if err!=nil {
     return nil,err
   }
-
-  response:=ParseResponse(response_text)
-  return &response,nil
+  return response,nil
 }
 
 /*
-  Forwards an HTTP request to the upstream proxy.
-  Will use the HTTP CONNECT method to open a tunnel for SSL requests
+  Splits a "host[:port]" string, using the default port if none is given.
  */
-func (client *Client) ForwardRequest(request Request) (*Response,error) {
-  log.Debug("connecting to proxy %s:%d\n",client.ProxySettings.Host,client.ProxySettings.Port)
-  conn,err:=net.Dial("tcp",fmt.Sprintf("%s:%d",client.ProxySettings.Host,client.ProxySettings.Port))
+func splitHostPort(hostport string, default_port string) (string,string) {
+  host,port,err:=net.SplitHostPort(hostport)
   if err!=nil {
-    log.Warn("could not connect to proxy %s:%d (%s)",client.ProxySettings.Host,client.ProxySettings.Port,err)
-    return CreateSimpleResponse(502),nil
+    return hostport,default_port
   }
-  log.Trace("got connection to proxy")
-  defer conn.Close()
-  client.conn=conn
-  request.Headers.Set("Connection","close")
-  buf:=bufio.NewReadWriter(bufio.NewReader(conn),bufio.NewWriter(conn))
+  return host,port
+}
 
+/*
+  Determines the target host and port of a request: SSL requests are sent to the Host header's target, plain requests to the
+  host in the request URL (or the Host header for relative URLs).
+ */
+func getTargetAddress(request *Request) (string,string,bool) {
   if request.IsSSL {
-    log.Trace("handling https request, establishing tunnel through proxy..")
     host,found:=request.Headers.Get("Host")
     if !found {
-      log.Error("no host header found in request, aborting")
-      return nil,nil
+      return "","",false
     }
+    host,port:=splitHostPort(host,"443")
+    return host,port,true
+  }
 
-    portstr:=":443"
-    colonpos:=strings.Index(host,":")
-    if colonpos>0 {
-      portstr=host[colonpos:]
-      host=host[0:colonpos]
+  matches:=requestHostMatcher.FindStringSubmatch(request.Url)
+  if matches!=nil && matches[2]!="" {
+    port:="80"
+    if matches[3]!="" {
+      port=matches[3][1:]
     }
-    response,err:=sendHTTPStringAndParseResponse("CONNECT "+host+portstr+" HTTP/1.1\r\n\r\n",buf)
-    if err!=nil {
-      log.Error("could not communicate with proxy: %s",err)
-      return nil,nil
+    return matches[2],port,true
+  }
+  host,found:=request.Headers.Get("Host")
+  if !found {
+    return "","",false
+  }
+  host,port:=splitHostPort(host,"80")
+  return host,port,true
+}
+
+/*
+  Turns a plain request's absolute URL into a path as expected by origin servers, adding a Host header if there is none yet.
+ */
+func toOriginForm(request *Request, host string, port string) {
+  if _,found:=request.Headers.Get("Host");!found {
+    if port=="80" {
+      request.Headers.Set("Host",host)
+    } else {
+      request.Headers.Set("Host",net.JoinHostPort(host,port))
     }
-    if response.Status!=200 {
-      log.Warn("got status %d from proxy",response.Status)
-      return response,nil //TODO: should this be a new, generic 503 maybe?
+  }
+  matches:=requestHostMatcher.FindStringSubmatch(request.Url)
+  if matches!=nil {
+    request.Url=request.Url[len(matches[0])-1:]
+  }
+}
+
+/*
+  Forwards an HTTP request to the upstream proxy responsible for the target host, or directly to the target host if there is none.
+  Will use the HTTP CONNECT method to open a tunnel through upstream HTTP proxies for SSL requests. Upstream SOCKS5 proxies are
+  used to open tunnels for all requests.
+
+  Upstream connections are taken from and returned to the client's connection pool, if set. The returned response's body is
+  streamed from the upstream connection: the connection will be reused or closed once the body has been read or closed, so make
+  sure to do either.
+
+  If the client has a CorrelationHeader the request's correlation ID is sent in it, replacing any value the request had. Upstream
+  proxy credentials are sent in the Proxy-Authorization header.
+
+  If there are multiple upstream proxies for the target host they're tried in the order picked by the proxy settings' strategy,
+  until one of them can be connected to. Proxies that can't be reached are ejected.
+
+  Requests failing on a pooled connection are retried once on a new connection, but only if they're idempotent and have no body:
+  the upstream may have received and processed the request before the connection failed.
+ */
+func (client *Client) ForwardRequest(request Request) (*Response,error) {
+  logger:=request.Logger()
+  host,port,found:=getTargetAddress(&request)
+  if !found && request.IsSSL {
+    logger.Error("no host header found in request, aborting")
+    return nil,nil
+  }
+  upstreams:=client.ProxySettings.GetUpstreams(host)
+  target:=net.JoinHostPort(host,port)
+
+  request.Headers.Set("Connection","keep-alive")
+  if client.CorrelationHeader!="" && request.ID!="" {
+    request.Headers.Set(client.CorrelationHeader,request.ID)
+  }
+  original_url:=request.Url
+  original_authorization,_:=request.Headers.Get("Proxy-Authorization")
+  prepare:=func(upstream *ProxyUpstream) {
+    request.Url=original_url
+    if upstream.IsSOCKS5() {
+      upstream=nil //SOCKS5 tunnels lead to the target host directly
     }
+    if upstream==nil && !request.IsSSL {
+      toOriginForm(&request,host,port)
+    }
+    setProxyAuthorization(&request,upstream,original_authorization)
+  }
+  if client.Pool!=nil {
+    var upstream *ProxyUpstream
+    if len(upstreams)>0 {
+      upstream=upstreams[0]
+    }
+    connection:=client.Pool.get(connectionPoolKey{proxy:upstream.getPoolAddress(),target:target,tls:request.IsSSL},logger)
+    if connection!=nil {
+      prepare(upstream)
+      retryable:=isIdempotentMethod(request.Method) && isBodyKnownEmpty(request.BodyStream)
+      response,err:=client.sendOnConnection(connection,&request,&ExchangeTimings{Connect:-1,TLS:-1})
+      if err==nil || !retryable {
+        return response,err
+      }
+      logger.Debug("pooled connection to %s failed (%s), retrying with new connection",target,err)
+    }
+  }
+
+  timings:=&ExchangeTimings{TLS:-1}
+  connection,response,err:=client.openConnection(upstreams,target,host,request.IsSSL,logger,timings)
+  if connection==nil {
+    return response,err
+  }
+  prepare(connection.upstream)
+  return client.sendOnConnection(connection,&request,timings)
+}
+
+/*
+  Checks whether sending the request method twice has the same effect as sending it once (RFC 7231, section 4.2.2).
+ */
+func isIdempotentMethod(method string) bool {
+  switch method {
+    case "GET","HEAD","OPTIONS","PUT","DELETE":
+      return true
+  }
+  return false
+}
+
+/*
+  Sends the upstream proxy's credentials with plain requests. For upstream proxies without credentials the request's original
+  Proxy-Authorization value is kept, if it had any. Requests sent to the target host directly, or through a tunnel, never carry
+  the header: it holds the client's proxy credentials.
+ */
+func setProxyAuthorization(request *Request, upstream *ProxyUpstream, original string) {
+  if request.IsSSL || upstream==nil {
+    request.Headers.Del("Proxy-Authorization")
+    return
+  }
+  authorization:=upstream.GetAuthorization()
+  if authorization=="" {
+    authorization=original
+  }
+  if authorization=="" {
+    request.Headers.Del("Proxy-Authorization")
+  } else {
+    request.Headers.Set("Proxy-Authorization",authorization)
+  }
+}
 
-    tlsconfig:=&tls.Config{
-      InsecureSkipVerify:!client.EnableCertificateVerification,
-      ServerName:host,
-      RootCAs:GetCertificatePool(),
+/*
+  Opens a new connection to one of the upstream proxies or, without any, to the target host. For SSL requests additionally
+  performs the TLS handshake with the target host, through a tunnel if there's an upstream proxy. Connections through SOCKS5
+  proxies are always tunneled. The logger's correlation ID is sent along with CONNECT requests, see establishTunnel().
+  Returns either the connection, or the response/error to return to the caller.
+ */
+func (client *Client) openConnection(upstreams []*ProxyUpstream, target string, host string, use_tls bool, logger log.CorrelatedLogger, timings *ExchangeTimings) (*pooledConnection,*Response,error) {
+  started:=time.Now()
+  conn,upstream,err:=client.dialUpstream(upstreams,target,logger)
+  if err!=nil {
+    return nil,CreateSimpleResponse(502),nil
+  }
+  key:=connectionPoolKey{proxy:upstream.getPoolAddress(),target:target,tls:use_tls}
+  reader:=bufio.NewReader(conn)
+  if use_tls || upstream.IsSOCKS5() {
+    var response *Response
+    reader,response,err=client.establishTunnel(conn,upstream,target,logger)
+    if reader==nil {
+      return nil,response,err
+    }
+  }
+  timings.Connect=time.Since(started)
+  upstreamConnectDuration.Observe(timings.Connect.Seconds())
+  if !use_tls {
+    buf:=bufio.NewReadWriter(reader,bufio.NewWriter(conn))
+    return &pooledConnection{conn:conn,buf:buf,key:key,upstream:upstream},nil,nil
+  }
+
+  if reader.Buffered()>0 {
+    logger.Error("received unexpected data before TLS handshake")
+    conn.Close()
+    return nil,nil,nil
+  }
+
+  tlsconfig:=&tls.Config{
+    InsecureSkipVerify:!client.EnableCertificateVerification,
+    ServerName:host,
+    RootCAs:getCertificatePool(logger),
+  }
+  tlsconn:=tls.Client(conn,tlsconfig)
+  logger.Trace("performing TLS handshake...")
+  started=time.Now()
+  err=tlsconn.Handshake()
+  if err!=nil {
+    logger.Error("TLS handshake error: %v",err)
+    upstreamFailures.Inc("tls")
+    conn.Close()
+    return nil,nil,err
+  }
+  timings.TLS=time.Since(started)
+  buf:=bufio.NewReadWriter(bufio.NewReader(tlsconn),bufio.NewWriter(tlsconn))
+  return &pooledConnection{conn:tlsconn,buf:buf,key:key,upstream:upstream},nil,nil
+}
+
+/*
+  Connects to the upstream proxy if there is one, otherwise to the target address.
+ */
+func (client *Client) dial(proxy string, target string, logger log.CorrelatedLogger) (net.Conn,error) {
+  address:=proxy
+  if address=="" {
+    address=target
+  }
+  logger.Debug("connecting to %s",address)
+  conn,err:=net.Dial("tcp",address)
+  if err!=nil {
+    logger.Warn("could not connect to %s (%s)",address,err)
+    upstreamFailures.Inc("connect")
+    return nil,err
+  }
+  logger.Trace("got connection to %s",address)
+  return conn,nil
+}
+
+/*
+  Connects to the first of the upstream proxies that can be reached, or to the target address if there are none. Proxies that
+  can't be reached are ejected.
+  Returns the connection along with the upstream proxy it's connected to.
+ */
+func (client *Client) dialUpstream(upstreams []*ProxyUpstream, target string, logger log.CorrelatedLogger) (net.Conn,*ProxyUpstream,error) {
+  if len(upstreams)==0 {
+    conn,err:=client.dial("",target,logger)
+    return conn,nil,err
+  }
+  var err error
+  for _,upstream:=range upstreams {
+    var conn net.Conn
+    conn,err=client.dial(upstream.GetAddress(),target,logger)
+    state:=upstream.getState()
+    if err==nil {
+      state.restore(logger)
+      return state.trackConnection(conn),upstream,nil
     }
-    tlsconn:=tls.Client(conn,tlsconfig)
-    log.Trace("performing TLS handshake...")
-    err=tlsconn.Handshake()
-    if err!=nil {
-      log.Error("TLS handshake error: %v",err)
-      return nil,err
+    state.eject(err,client.ProxySettings.getEjectTime(),logger)
+  }
+  return nil,nil,err
+}
+
+/*
+  Opens a raw connection to the target address ("host:port"): through a CONNECT tunnel if there's an upstream proxy responsible for
+  the target host, directly otherwise. Tunnels through SOCKS5 proxies use the SOCKS5 protocol instead of CONNECT.
+
+  Returns the connection along with a reader to read incoming data with, since it may already contain buffered data. If no tunnel
+  could be opened the connection is nil and the response and/or error to pass on is returned instead.
+
+  If the client has a CorrelationHeader the correlation ID (e.g. the CONNECT request's ID) is sent to the upstream proxy in it,
+  along with the upstream proxy's credentials if there are any. Pass an empty ID to not send one.
+ */
+func (client *Client) OpenTunnel(target string, correlation_id string) (net.Conn,*bufio.Reader,*Response,error) {
+  logger:=log.WithCorrelationID(correlation_id)
+  host,_:=splitHostPort(target,"")
+  conn,upstream,err:=client.dialUpstream(client.ProxySettings.GetUpstreams(host),target,logger)
+  if err!=nil {
+    return nil,nil,CreateSimpleResponse(502),nil
+  }
+  reader,response,err:=client.establishTunnel(conn,upstream,target,logger)
+  if reader==nil {
+    return nil,nil,response,err
+  }
+  return conn,reader,nil,nil
+}
+
+/*
+  Opens a tunnel to the target address through the upstream proxy the connection is connected to: with CONNECT for HTTP proxies,
+  with the SOCKS5 protocol for SOCKS5 proxies. Without an upstream proxy the connection already is connected to the target
+  address.
+
+  Messages are logged through the given logger. Its correlation ID is sent in CONNECT requests if the client has a
+  CorrelationHeader and the ID isn't empty.
+
+  Returns a reader to read incoming data with. If no tunnel could be opened the connection is closed, the reader is nil and the
+  response and/or error to pass on is returned instead.
+ */
+func (client *Client) establishTunnel(conn net.Conn, upstream *ProxyUpstream, target string, logger log.CorrelatedLogger) (*bufio.Reader,*Response,error) {
+  buf:=bufio.NewReadWriter(bufio.NewReader(conn),bufio.NewWriter(conn))
+  if upstream==nil {
+    return buf.Reader,nil,nil
+  }
+  if upstream.IsSOCKS5() {
+    logger.Trace("establishing tunnel through SOCKS5 proxy..")
+    if err:=socks5Connect(buf,upstream,target);err!=nil {
+      logger.Warn("could not open SOCKS5 tunnel to %s: %s",target,err)
+      upstreamFailures.Inc("proxy")
+      conn.Close()
+      return nil,CreateSimpleResponse(502),nil
     }
-    buf=bufio.NewReadWriter(bufio.NewReader(tlsconn),bufio.NewWriter(tlsconn))
+    return buf.Reader,nil,nil
+  }
+
+  logger.Trace("establishing tunnel through proxy..")
+  connect_request:=newConnectRequest(target,upstream)
+  if client.CorrelationHeader!="" && logger.CorrelationID!="" {
+    connect_request.Headers.Set(client.CorrelationHeader,logger.CorrelationID)
+  }
+  response,err:=sendRequestAndReadResponse(connect_request,buf,nil,logger)
+  if err!=nil {
+    logger.Error("could not communicate with proxy: %s",err)
+    upstreamFailures.Inc("proxy")
+    conn.Close()
+    return nil,nil,nil
+  }
+  if response.Status!=200 {
+    logger.Warn("got status %d from proxy",response.Status)
+    upstreamFailures.Inc("proxy")
+    response.ReadBody()
+    conn.Close()
+    return nil,response,nil //TODO: should this be a new, generic 503 maybe?
+  }
+  return buf.Reader,nil,nil
+}
+
+/*
+  Creates a CONNECT request for the target address, including the upstream proxy's credentials if there are any.
+ */
+func newConnectRequest(target string, upstream *ProxyUpstream) *Request {
+  rv:=&Request {
+    Method: "CONNECT",
+    Url: target,
+    message: message {
+      Protocol: "HTTP/1.1",
+      Headers: NewHeaders(),
+    },
+  }
+  if authorization:=upstream.GetAuthorization();authorization!="" {
+    rv.Headers.Set("Proxy-Authorization",authorization)
+  }
+  return rv
+}
+
+/*
+  Sends a request over an upstream connection and reads the response header.
+  Once the response body is done the connection is returned to the pool if possible, otherwise closed.
+ */
+func (client *Client) sendOnConnection(connection *pooledConnection, request *Request, timings *ExchangeTimings) (*Response,error) {
+  logger:=request.Logger()
+  client.conn=connection.conn
+  response,err:=sendRequestAndReadResponseTimed(request,connection.buf,nil,timings,logger)
+  if err!=nil {
+    connection.conn.Close()
+    return nil,err
   }
+  response.timings=timings
 
-  response,err:=sendHTTPStringAndParseResponse(request.ToString(),buf)
+  pool:=client.Pool
+  reusable:=pool!=nil && response.allowsConnectionReuse(request.Method)
+  body:=response.BodyStream.(*bodyReader)
+  body.closer=func() error {
+    if reusable && body.complete {
+      pool.put(connection,logger)
+      return nil
+    }
+    return connection.conn.Close()
+  }
   return response,nil
 }
 
@@ -141,6 +472,10 @@ func (client *Client) ForwardRequest(request Request) (*Response,error) {
   The pool consists of CAs supplied by the system, additionally CAs loaded from the "certs" resource directory.
  */
 func GetCertificatePool() *x509.CertPool {
+  return getCertificatePool(log.CorrelatedLogger{})
+}
+
+func getCertificatePool(logger log.CorrelatedLogger) *x509.CertPool {
   if caCertPool==nil {
     caCertPool,_=x509.SystemCertPool()
     if caCertPool==nil {
@@ -154,18 +489,18 @@ func GetCertificatePool() *x509.CertPool {
     certnames,err:=certsdir.Readdirnames(0)
     if err!=nil { panic(err) }
     for _,certname:=range certnames {
-      if strings.Index(certname,"CA-")!=0 {
+      if strings.Index(certname,"CA-")!=0 || strings.HasSuffix(certname,".key") {
         continue
       }
       certs,err:=ioutil.ReadFile(fmt.Sprintf("%s%c%s",certspath,os.PathSeparator,certname))
       if err!=nil || !caCertPool.AppendCertsFromPEM(certs) {
-        log.Warn("could not load CA certificate %s",certname)
+        logger.Warn("could not load CA certificate %s",certname)
       } else {
-        log.Debug("loaded CA certificate %s",certname)
+        logger.Debug("loaded CA certificate %s",certname)
       }
     }
   } else {
-    log.Trace("reusing cached CA certificate pool")
+    logger.Trace("reusing cached CA certificate pool")
   }
 
   return caCertPool
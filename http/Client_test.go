@@ -6,9 +6,16 @@ package http
 import (
   "testing"
   "github.com/stretchr/testify/assert"
+  "bufio"
+  "crypto/tls"
   "crypto/x509"
+  "errors"
+  "fmt"
+  "net"
+  "sync/atomic"
   "time"
   "github.com/rinusser/hopgoblin/http/dummyproxy"
+  "github.com/rinusser/hopgoblin/utils"
 )
 
 
@@ -17,7 +24,7 @@ import (
  */
 func TestCopyProxySettings(t *testing.T) {
   server:=NewServer()
-  server.ProxySettings=nil
+  server.SetProxySettings(nil)
 
   client:=NewClient()
   client.ProxySettings=NewProxySettings("1.2.3.4",1234)
@@ -25,12 +32,13 @@ func TestCopyProxySettings(t *testing.T) {
   client.CopyProxySettings(server)
   assert.Nil(t,client.ProxySettings,"nil should have been copied to client")
 
-  server.ProxySettings=NewProxySettings("2.3.4.5",2345)
+  settings:=NewProxySettings("2.3.4.5",2345)
+  server.SetProxySettings(settings)
   client.CopyProxySettings(server)
   assertProxySettings(t,client,"2.3.4.5",2345,"settings should have been copied")
 
-  server.ProxySettings.Host="asdf"
-  server.ProxySettings.Port=999
+  settings.Host="asdf"
+  settings.Port=999
   assertProxySettings(t,client,"2.3.4.5",2345,"settings should have remained unchanged")
 }
 
@@ -67,8 +75,8 @@ func TestCertificateVerificationSetting(t *testing.T) {
   response,err:=client.ForwardRequest(request)
 
   assert.NotNil(t,err)
-  err,ok:=err.(x509.HostnameError)
-  assert.True(t,ok)
+  var hostname_error x509.HostnameError
+  assert.True(t,errors.As(err,&hostname_error))
   assert.Nil(t,response)
 
   proxyrunner.StartRandom()
@@ -82,3 +90,411 @@ func TestCertificateVerificationSetting(t *testing.T) {
   assert.Nil(t,err)
   assert.NotNil(t,response)
 }
+
+
+/*
+  Starts a minimal upstream server on a random port that keeps connections alive and answers each request with its URL, its
+  Host header in X-Request-Host, its X-Request-Id header and its Proxy-Authorization header in X-Proxy-Authorization. Pass a TLS configuration to accept encrypted connections, nil for plain connections.
+  Returns the port and a counter for accepted connections.
+ */
+func startKeepAliveUpstream(t *testing.T, tlsconfig *tls.Config) (int,*int32) {
+  listener,err:=net.Listen("tcp","127.0.0.1:0")
+  if err!=nil {
+    t.Fatalf("could not start upstream: %s",err)
+  }
+  if tlsconfig!=nil {
+    listener=tls.NewListener(listener,tlsconfig)
+  }
+  accepts:=new(int32)
+  go func() {
+    for {
+      conn,err:=listener.Accept()
+      if err!=nil {
+        return
+      }
+      atomic.AddInt32(accepts,1)
+      go func() {
+        defer conn.Close()
+        buf:=bufio.NewReadWriter(bufio.NewReader(conn),bufio.NewWriter(conn))
+        for {
+          request,err:=ReadRequest(buf.Reader)
+          if err!=nil {
+            return
+          }
+          request.ReadBody()
+          host,_:=request.Headers.Get("Host")
+          id,_:=request.Headers.Get("X-Request-Id")
+          authorization,_:=request.Headers.Get("Proxy-Authorization")
+          fmt.Fprintf(buf,"HTTP/1.1 200 OK\r\nX-Request-Host: %s\r\nX-Request-Id: %s\r\nX-Proxy-Authorization: %s\r\n"+
+                      "Content-Length: %d\r\n\r\n%s",host,id,authorization,len(request.Url),request.Url)
+          buf.Flush()
+        }
+      }()
+    }
+  }()
+  return listener.Addr().(*net.TCPAddr).Port,accepts
+}
+
+func createPlainRequest(url string) Request {
+  request:=Request {
+    Method:"GET",
+    Url:url,
+    message: message {
+      Protocol: "HTTP/1.1",
+      Headers: NewHeaders(),
+    },
+  }
+  return request
+}
+
+/*
+  Makes sure upstream connections are reused once the previous response's body was read entirely.
+ */
+func TestForwardRequestReusesConnections(t *testing.T) {
+  port,accepts:=startKeepAliveUpstream(t,nil)
+  client:=NewClient()
+  client.Pool=NewConnectionPool()
+  client.ProxySettings=NewProxySettings("127.0.0.1",port)
+
+  for _,url:=range []string{"http://pooled.local/1","http://pooled.local/2","http://pooled.local/3"} {
+    response,err:=client.ForwardRequest(createPlainRequest(url))
+    assert.Nil(t,err)
+    body,_:=response.ReadBody()
+    assert.Equal(t,url,string(body))
+  }
+  assert.Equal(t,int32(1),atomic.LoadInt32(accepts),"all requests should have used the same connection")
+  assert.Equal(t,1,client.Pool.IdleCount())
+
+  response,_:=client.ForwardRequest(createPlainRequest("http://other.local/1"))
+  response.ReadBody()
+  assert.Equal(t,int32(2),atomic.LoadInt32(accepts),"different target host should have used a new connection")
+
+  response,_=client.ForwardRequest(createPlainRequest("http://pooled.local/unread"))
+  response.CloseBody()
+  response,_=client.ForwardRequest(createPlainRequest("http://pooled.local/4"))
+  response.ReadBody()
+  assert.Equal(t,int32(3),atomic.LoadInt32(accepts),"connection with unread response body shouldn't have been reused")
+
+  client.Pool=nil
+  response,_=client.ForwardRequest(createPlainRequest("http://pooled.local/5"))
+  response.ReadBody()
+  assert.Equal(t,int32(4),atomic.LoadInt32(accepts),"client without pool should have used a new connection")
+}
+
+/*
+  Makes sure only idempotent requests are retried on a new connection if the pooled connection fails after sending the request.
+ */
+func TestForwardRequestRetriesIdempotentOnly(t *testing.T) {
+  listener,err:=net.Listen("tcp","127.0.0.1:0")
+  if err!=nil {
+    t.Fatalf("could not start upstream: %s",err)
+  }
+  defer listener.Close()
+  received:=make(chan string,10)
+  go func() {
+    for {
+      conn,err:=listener.Accept()
+      if err!=nil {
+        return
+      }
+      go func() { //answers the first request, then reads the next one and closes the connection without answering
+        defer conn.Close()
+        reader:=bufio.NewReader(conn)
+        for count:=1;;count++ {
+          request,err:=ReadRequest(reader)
+          if err!=nil {
+            return
+          }
+          request.ReadBody()
+          received<-request.Method+" "+request.Url
+          if count>1 {
+            return
+          }
+          fmt.Fprintf(conn,"HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s",len(request.Url),request.Url)
+        }
+      }()
+    }
+  }()
+  client:=NewClient()
+  client.Pool=NewConnectionPool()
+  client.ProxySettings=NewProxySettings("127.0.0.1",listener.Addr().(*net.TCPAddr).Port)
+
+  for _,method:=range []string{"GET","GET","POST"} {
+    request:=createPlainRequest("http://retry.local/"+method)
+    request.Method=method
+    response,err:=client.ForwardRequest(request)
+    if method=="POST" {
+      assert.NotNil(t,err,"POST request shouldn't have been retried")
+      continue
+    }
+    if assert.Nil(t,err,method) {
+      response.ReadBody()
+    }
+  }
+  var requests []string
+  for waiting:=true;waiting; {
+    select {
+      case request:=<-received:
+        requests=append(requests,request)
+      case <-time.After(200*time.Millisecond):
+        waiting=false
+    }
+  }
+  expected:=[]string{"GET http://retry.local/GET","GET http://retry.local/GET","GET http://retry.local/GET","POST http://retry.local/POST"}
+  assert.Equal(t,expected,requests,"only the GET request should have been sent again")
+}
+
+
+/*
+  Makes sure requests are sent to target hosts directly if there's no upstream proxy, using origin-form URLs for plain requests.
+  The client's proxy credentials mustn't be passed on to target hosts.
+ */
+func TestForwardRequestDirect(t *testing.T) {
+  port,accepts:=startKeepAliveUpstream(t,nil)
+  client:=NewClient()
+  client.Pool=nil
+  client.ProxySettings=nil
+
+  target:=fmt.Sprintf("127.0.0.1:%d",port)
+  request:=createPlainRequest("http://"+target+"/direct?a=1")
+  request.Headers.Set("Proxy-Authorization","Basic YWxpY2U6c2VjcmV0")
+  response,err:=client.ForwardRequest(request)
+  assert.Nil(t,err)
+  body,_:=response.ReadBody()
+  assert.Equal(t,"/direct?a=1",string(body),"URL should have been turned into path")
+  host,_:=response.Headers.Get("X-Request-Host")
+  assert.Equal(t,target,host,"Host header should have been added")
+  authorization,_:=response.Headers.Get("X-Proxy-Authorization")
+  assert.Equal(t,"",authorization,"client's proxy credentials shouldn't have been sent to target host")
+  assert.Equal(t,int32(1),atomic.LoadInt32(accepts))
+
+  cert:=utils.LoadCertificate(utils.GetResourcePath("certs"),"test")
+  tlsport,tlsaccepts:=startKeepAliveUpstream(t,&tls.Config{Certificates:[]tls.Certificate{*cert}})
+  client.EnableCertificateVerification=false
+  request=createPlainRequest("/encrypted")
+  request.IsSSL=true
+  request.Headers.Set("Host",fmt.Sprintf("127.0.0.1:%d",tlsport))
+  request.Headers.Set("Proxy-Authorization","Basic YWxpY2U6c2VjcmV0")
+  response,err=client.ForwardRequest(request)
+  assert.Nil(t,err)
+  body,_=response.ReadBody()
+  assert.Equal(t,"/encrypted",string(body))
+  authorization,_=response.Headers.Get("X-Proxy-Authorization")
+  assert.Equal(t,"",authorization,"client's proxy credentials shouldn't have been sent through tunnel")
+  assert.Equal(t,int32(1),atomic.LoadInt32(tlsaccepts),"SSL request should have been sent directly")
+}
+
+/*
+  Makes sure correlation IDs are sent upstream only if a correlation header is set.
+ */
+func TestForwardRequestCorrelationHeader(t *testing.T) {
+  port,_:=startKeepAliveUpstream(t,nil)
+  client:=NewClient()
+  client.Pool=nil
+  client.ProxySettings=NewProxySettings("127.0.0.1",port)
+
+  request:=createPlainRequest("http://correlated.local/")
+  request.ID="abc-1-1"
+  client.CorrelationHeader=""
+  response,err:=client.ForwardRequest(request)
+  if assert.Nil(t,err) {
+    response.ReadBody()
+    id,_:=response.Headers.Get("X-Request-Id")
+    assert.Equal(t,"",id,"correlation ID shouldn't have been sent without header")
+  }
+
+  request=createPlainRequest("http://correlated.local/")
+  request.ID="abc-1-2"
+  request.Headers.Set("X-Request-ID","from client")
+  client.CorrelationHeader="X-Request-ID"
+  response,err=client.ForwardRequest(request)
+  if assert.Nil(t,err) {
+    response.ReadBody()
+    id,_:=response.Headers.Get("X-Request-Id")
+    assert.Equal(t,"abc-1-2",id)
+  }
+}
+
+/*
+  Makes sure per-host proxy rules pick the route for each target host.
+ */
+func TestForwardRequestRoutes(t *testing.T) {
+  port,accepts:=startKeepAliveUpstream(t,nil)
+  proxyport,proxyaccepts:=startKeepAliveUpstream(t,nil)
+  client:=NewClient()
+  client.Pool=nil
+  client.ProxySettings,_=parseProxySettings(map[string]string {
+    "mode":"rules",
+    "route.1":"direct ^127\\.0\\.0\\.1$",
+    "route.2":fmt.Sprintf("127.0.0.1:%d .",proxyport),
+  })
+
+  response,_:=client.ForwardRequest(createPlainRequest(fmt.Sprintf("http://127.0.0.1:%d/direct",port)))
+  body,_:=response.ReadBody()
+  assert.Equal(t,"/direct",string(body))
+  assert.Equal(t,int32(1),atomic.LoadInt32(accepts),"request should have been sent directly")
+
+  response,_=client.ForwardRequest(createPlainRequest("http://proxied.local/proxied"))
+  body,_=response.ReadBody()
+  assert.Equal(t,"http://proxied.local/proxied",string(body),"URL should have been kept for proxy")
+  assert.Equal(t,int32(1),atomic.LoadInt32(proxyaccepts),"request should have been sent through proxy")
+}
+
+/*
+  Makes sure upstream proxy credentials are sent with plain requests and CONNECT requests, and only to the proxy they're for.
+ */
+func TestForwardRequestProxyCredentials(t *testing.T) {
+  port,_:=startKeepAliveUpstream(t,nil)
+  listener,err:=net.Listen("tcp","127.0.0.1:0")
+  if err!=nil {
+    t.Fatalf("could not start proxy: %s",err)
+  }
+  defer listener.Close()
+  go func() {
+    for {
+      conn,err:=listener.Accept()
+      if err!=nil {
+        return
+      }
+      request,err:=ReadRequest(bufio.NewReader(conn))
+      if err==nil {
+        authorization,_:=request.Headers.Get("Proxy-Authorization")
+        id,_:=request.Headers.Get("X-Request-ID")
+        fmt.Fprintf(conn,"HTTP/1.1 407 Proxy Authentication Required\r\nX-Method: %s\r\nX-Proxy-Authorization: %s\r\n"+
+                    "X-Request-Id: %s\r\nContent-Length: 0\r\n\r\n",request.Method,authorization,id)
+      }
+      conn.Close()
+    }
+  }()
+
+  client:=NewClient()
+  client.Pool=nil
+  client.ProxySettings,_=parseProxySettings(map[string]string {
+    "mode":"rules",
+    "host":"127.0.0.1",
+    "port":fmt.Sprintf("%d",port),
+    "user":"alice",
+    "password":"secret",
+    "upstream.tunnel":fmt.Sprintf("%s bob:hunter2",listener.Addr()),
+    "route.1":"direct ^127\\.0\\.0\\.1$",
+    "route.2":"tunnel ^secure\\.local$",
+  })
+
+  response,err:=client.ForwardRequest(createPlainRequest("http://proxied.local/"))
+  if assert.Nil(t,err) {
+    response.ReadBody()
+    authorization,_:=response.Headers.Get("X-Proxy-Authorization")
+    assert.Equal(t,"Basic YWxpY2U6c2VjcmV0",authorization)
+  }
+
+  request:=createPlainRequest(fmt.Sprintf("http://127.0.0.1:%d/",port))
+  response,err=client.ForwardRequest(request)
+  if assert.Nil(t,err) {
+    response.ReadBody()
+    authorization,_:=response.Headers.Get("X-Proxy-Authorization")
+    assert.Equal(t,"",authorization,"credentials shouldn't have been sent to target host")
+  }
+
+  client.CorrelationHeader="X-Request-ID"
+  conn,_,response,_:=client.OpenTunnel("secure.local:443","abc-2-1")
+  assert.Nil(t,conn)
+  if assert.NotNil(t,response) {
+    method,_:=response.Headers.Get("X-Method")
+    authorization,_:=response.Headers.Get("X-Proxy-Authorization")
+    id,_:=response.Headers.Get("X-Request-Id")
+    assert.Equal(t,"CONNECT",method)
+    assert.Equal(t,"Basic Ym9iOmh1bnRlcjI=",authorization)
+    assert.Equal(t,"abc-2-1",id,"correlation ID should have been sent with CONNECT request")
+  }
+}
+
+/*
+  Returns the address of a local port nothing listens on.
+ */
+func getClosedAddress(t *testing.T) string {
+  listener,err:=net.Listen("tcp","127.0.0.1:0")
+  if err!=nil {
+    t.Fatalf("could not find closed port: %s",err)
+  }
+  listener.Close()
+  return listener.Addr().String()
+}
+
+/*
+  Makes sure unreachable upstream proxies are skipped and ejected, so the next request goes to a working proxy first.
+ */
+func TestForwardRequestFailover(t *testing.T) {
+  port,accepts:=startKeepAliveUpstream(t,nil)
+  closed:=getClosedAddress(t)
+  client:=NewClient()
+  client.Pool=nil
+  client.ProxySettings,_=parseProxySettings(map[string]string {
+    "upstreams":fmt.Sprintf("%s,127.0.0.1:%d",closed,port),
+  })
+
+  response,err:=client.ForwardRequest(createPlainRequest("http://failover.local/"))
+  if assert.Nil(t,err) && assert.NotNil(t,response) {
+    body,_:=response.ReadBody()
+    assert.Equal(t,"http://failover.local/",string(body))
+  }
+  assert.Equal(t,int32(1),atomic.LoadInt32(accepts))
+  assert.Equal(t,float64(1),upstreamEjections.Get(closed))
+  assert.Equal(t,fmt.Sprintf("127.0.0.1:%d",port),client.ProxySettings.GetUpstreamAddress("failover.local"),
+               "unreachable proxy should have been ejected")
+  assert.Equal(t,float64(0),upstreamConnections.Get(fmt.Sprintf("127.0.0.1:%d",port)),"closed connection should be uncounted")
+
+  client.ProxySettings,_=parseProxySettings(map[string]string{"upstreams":closed})
+  response,_=client.ForwardRequest(createPlainRequest("http://failover.local/"))
+  if assert.NotNil(t,response) {
+    assert.Equal(t,uint16(502),response.Status,"ejected proxy should still have been tried as last resort")
+  }
+}
+
+/*
+  Makes sure plain and SSL requests are tunneled through SOCKS5 proxies, with username/password authentication.
+ */
+func TestForwardRequestSOCKS5(t *testing.T) {
+  proxyrunner:=dummyproxy.NewDummyProxyRunner()
+  proxyrunner.SOCKS5=true
+  proxyrunner.User="alice"
+  proxyrunner.Password="secret"
+  proxyrunner.StartRandom()
+
+  client:=NewClient()
+  client.Pool=nil
+  client.ProxySettings,_=parseProxySettings(map[string]string {
+    "upstreams":fmt.Sprintf("socks5://127.0.0.1:%d alice:secret",proxyrunner.Port),
+  })
+  response,err:=client.ForwardRequest(createPlainRequest("http://socks.local/plain"))
+  if assert.Nil(t,err) && assert.NotNil(t,response) {
+    assert.Equal(t,uint16(418),response.Status)
+    body,_:=response.ReadBody()
+    assert.Contains(t,string(body),"GET /plain HTTP/1.1","request should have been sent in origin form")
+  }
+  stdout,_,_:=proxyrunner.ReadAndWait()
+  assert.Contains(t,string(stdout),"SOCKS5 CONNECT socks.local:80")
+
+  proxyrunner.StartRandom()
+  client.ProxySettings.Upstreams[0].Port=proxyrunner.Port
+  client.EnableCertificateVerification=false
+  request:=createPlainRequest("/secure")
+  request.IsSSL=true
+  request.Headers.Set("Host","socks.local")
+  response,err=client.ForwardRequest(request)
+  if assert.Nil(t,err) && assert.NotNil(t,response) {
+    assert.Equal(t,uint16(418),response.Status)
+    response.ReadBody()
+  }
+  stdout,_,_=proxyrunner.ReadAndWait()
+  assert.Contains(t,string(stdout),"SOCKS5 CONNECT socks.local:443")
+
+  proxyrunner.StartRandom()
+  client.ProxySettings.Upstreams[0].Port=proxyrunner.Port
+  client.ProxySettings.Upstreams[0].Password="wrong"
+  response,err=client.ForwardRequest(createPlainRequest("http://socks.local/plain"))
+  assert.Nil(t,err)
+  if assert.NotNil(t,response) {
+    assert.Equal(t,uint16(502),response.Status,"rejected credentials should have resulted in a bad gateway response")
+  }
+  proxyrunner.ReadAndWait()
+}
@@ -0,0 +1,215 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "bufio"
+  "bytes"
+  "compress/flate"
+  "compress/gzip"
+  "compress/zlib"
+  "errors"
+  "io"
+  "io/ioutil"
+  "strings"
+  "github.com/andybalholm/brotli"
+)
+
+
+/*
+  Encodes and decodes message bodies for a single content or transfer coding, e.g. "gzip".
+ */
+type Codec interface {
+  Decode(data []byte) ([]byte,error)
+  Encode(data []byte) ([]byte,error)
+}
+
+var registeredCodecs=make(map[string]Codec)
+
+func init() {
+  RegisterCodec("identity",identityCodec{})
+  RegisterCodec("chunked",chunkedCodec{})
+  RegisterCodec("gzip",gzipCodec{})
+  RegisterCodec("x-gzip",gzipCodec{})
+  RegisterCodec("deflate",deflateCodec{})
+  RegisterCodec("br",brotliCodec{})
+}
+
+/*
+  Registers a codec by coding name, as used in Content-Encoding and Transfer-Encoding headers. Registering a name again replaces
+  the previous codec.
+ */
+func RegisterCodec(name string, codec Codec) {
+  registeredCodecs[strings.ToLower(name)]=codec
+}
+
+/*
+  Returns the codec registered for the given coding name, or nil if there is none.
+ */
+func GetCodec(name string) Codec {
+  return registeredCodecs[strings.ToLower(strings.TrimSpace(name))]
+}
+
+/*
+  Removes a list of codings from data, in reverse order of their application: e.g. for "gzip, chunked" the "chunked" coding is
+  removed first. Returns the data decoded so far along with an error if a coding is unknown or data is invalid.
+ */
+func DecodeCodings(data []byte, codings []string) ([]byte,error) {
+  for pos:=len(codings)-1;pos>=0;pos-- {
+    codec:=GetCodec(codings[pos])
+    if codec==nil {
+      return data,errors.New("unsupported coding \""+codings[pos]+"\"")
+    }
+    decoded,err:=codec.Decode(data)
+    if err!=nil {
+      return data,errors.New("invalid "+codings[pos]+" data: "+err.Error())
+    }
+    data=decoded
+  }
+  return data,nil
+}
+
+/*
+  Applies a list of codings to data, in the given order.
+ */
+func EncodeCodings(data []byte, codings []string) ([]byte,error) {
+  for _,coding:=range codings {
+    codec:=GetCodec(coding)
+    if codec==nil {
+      return nil,errors.New("unsupported coding \""+coding+"\"")
+    }
+    var err error
+    data,err=codec.Encode(data)
+    if err!=nil {
+      return nil,err
+    }
+  }
+  return data,nil
+}
+
+
+type identityCodec struct {
+}
+
+/*
+  required by Codec interface
+ */
+func (identityCodec) Decode(data []byte) ([]byte,error) {
+  return data,nil
+}
+
+/*
+  required by Codec interface
+ */
+func (identityCodec) Encode(data []byte) ([]byte,error) {
+  return data,nil
+}
+
+
+type chunkedCodec struct {
+}
+
+/*
+  required by Codec interface
+ */
+func (chunkedCodec) Decode(data []byte) ([]byte,error) {
+  var buf bytes.Buffer
+  err:=chunkDecodeBody(bufio.NewReader(bytes.NewReader(data)),&buf,nil)
+  return buf.Bytes(),err
+}
+
+/*
+  required by Codec interface
+ */
+func (chunkedCodec) Encode(data []byte) ([]byte,error) {
+  if len(data)==0 {
+    return []byte("0\r\n\r\n"),nil
+  }
+  return ChunkEncodeBody(string(data),32*1024,0),nil
+}
+
+
+type gzipCodec struct {
+}
+
+/*
+  required by Codec interface
+ */
+func (gzipCodec) Decode(data []byte) ([]byte,error) {
+  reader,err:=gzip.NewReader(bytes.NewReader(data))
+  if err!=nil {
+    return nil,err
+  }
+  defer reader.Close()
+  return ioutil.ReadAll(reader)
+}
+
+/*
+  required by Codec interface
+ */
+func (gzipCodec) Encode(data []byte) ([]byte,error) {
+  var buf bytes.Buffer
+  err:=writeCompressed(gzip.NewWriter(&buf),data)
+  return buf.Bytes(),err
+}
+
+
+/*
+  The "deflate" coding is supposed to be zlib-wrapped, but some servers send raw deflate data: decoding accepts both.
+ */
+type deflateCodec struct {
+}
+
+/*
+  required by Codec interface
+ */
+func (deflateCodec) Decode(data []byte) ([]byte,error) {
+  reader,err:=zlib.NewReader(bytes.NewReader(data))
+  if err==zlib.ErrHeader {
+    reader=flate.NewReader(bytes.NewReader(data))
+  } else if err!=nil {
+    return nil,err
+  }
+  defer reader.Close()
+  return ioutil.ReadAll(reader)
+}
+
+/*
+  required by Codec interface
+ */
+func (deflateCodec) Encode(data []byte) ([]byte,error) {
+  var buf bytes.Buffer
+  err:=writeCompressed(zlib.NewWriter(&buf),data)
+  return buf.Bytes(),err
+}
+
+
+type brotliCodec struct {
+}
+
+/*
+  required by Codec interface
+ */
+func (brotliCodec) Decode(data []byte) ([]byte,error) {
+  return ioutil.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+}
+
+/*
+  required by Codec interface
+ */
+func (brotliCodec) Encode(data []byte) ([]byte,error) {
+  var buf bytes.Buffer
+  err:=writeCompressed(brotli.NewWriter(&buf),data)
+  return buf.Bytes(),err
+}
+
+
+func writeCompressed(writer io.WriteCloser, data []byte) error {
+  _,err:=writer.Write(data)
+  close_err:=writer.Close()
+  if err==nil {
+    err=close_err
+  }
+  return err
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "bytes"
+  "compress/flate"
+)
+
+
+/*
+  Makes sure all built-in codecs can decode what they encoded.
+ */
+func TestCodecRoundTrips(t *testing.T) {
+  plain:=[]byte("round and round and round we go\r\n\x00\xff")
+  for _,name:=range []string{"identity","chunked","gzip","x-gzip","deflate","br","GZip"} {
+    codec:=GetCodec(name)
+    if !assert.NotNil(t,codec,name) {
+      continue
+    }
+    encoded,err:=codec.Encode(plain)
+    assert.Nil(t,err,name)
+    decoded,err:=codec.Decode(encoded)
+    assert.Nil(t,err,name)
+    assert.Equal(t,plain,decoded,name)
+  }
+  assert.Nil(t,GetCodec("compress"),"unknown codings shouldn't have a codec")
+}
+
+/*
+  Makes sure the deflate codec accepts raw deflate data in addition to zlib-wrapped data.
+ */
+func TestDeflateCodecDecodesRawData(t *testing.T) {
+  var raw bytes.Buffer
+  writer,_:=flate.NewWriter(&raw,flate.DefaultCompression)
+  writer.Write([]byte("no zlib header"))
+  writer.Close()
+
+  actual,err:=GetCodec("deflate").Decode(raw.Bytes())
+  assert.Nil(t,err)
+  assert.Equal(t,"no zlib header",string(actual))
+}
+
+/*
+  Makes sure stacked codings are applied in order and removed in reverse order.
+ */
+func TestStackedCodings(t *testing.T) {
+  codings:=[]string{"deflate","br","gzip","chunked"}
+  encoded,err:=EncodeCodings([]byte("layered"),codings)
+  assert.Nil(t,err)
+
+  decoded,err:=DecodeCodings(encoded,codings)
+  assert.Nil(t,err)
+  assert.Equal(t,"layered",string(decoded))
+
+  _,err=DecodeCodings(encoded,[]string{"chunked","gzip","br","deflate"})
+  assert.NotNil(t,err,"decoding in the wrong order should fail")
+
+  _,err=EncodeCodings([]byte("x"),[]string{"gzip","compress"})
+  assert.NotNil(t,err,"unknown codings should fail")
+}
+
+/*
+  Makes sure custom codecs can be registered.
+ */
+func TestRegisterCodec(t *testing.T) {
+  RegisterCodec("X-Test-Reverse",reverseCodec{})
+  defer delete(registeredCodecs,"x-test-reverse")
+
+  encoded,err:=EncodeCodings([]byte("abc"),[]string{"x-test-reverse"})
+  assert.Nil(t,err)
+  assert.Equal(t,"cba",string(encoded))
+}
+
+type reverseCodec struct {
+}
+
+func (reverseCodec) Decode(data []byte) ([]byte,error) {
+  rv:=make([]byte,len(data))
+  for index,value:=range data {
+    rv[len(data)-1-index]=value
+  }
+  return rv,nil
+}
+
+func (this reverseCodec) Encode(data []byte) ([]byte,error) {
+  return this.Decode(data)
+}
@@ -0,0 +1,258 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "bufio"
+  "net"
+  "strconv"
+  "sync"
+  "time"
+  "github.com/rinusser/hopgoblin/log"
+  "github.com/rinusser/hopgoblin/utils"
+)
+
+
+/*
+  The default maximum number of idle connections kept per pool key. Only used as fallback if no other value could be found.
+ */
+var DefaultMaxIdleConnectionsPerKey=4
+
+/*
+  The default time idle connections are kept in the pool. Only used as fallback if no other value could be found.
+ */
+var DefaultPoolIdleTimeout=90*time.Second
+
+
+/*
+  Identifies upstream connections that can be used interchangeably.
+ */
+type connectionPoolKey struct {
+  proxy string  //upstream proxy address, e.g. "127.0.0.1:3128", with scheme prefix for SOCKS5 proxies
+  target string //target host, e.g. "example.com:443"
+  tls bool      //whether the connection is a TLS tunnel to the target host
+}
+
+/*
+  An upstream connection along with its I/O buffer.
+ */
+type pooledConnection struct {
+  conn net.Conn
+  buf *bufio.ReadWriter
+  key connectionPoolKey
+  upstream *ProxyUpstream //the upstream proxy connected to, nil for direct connections
+  idleSince time.Time
+}
+
+/*
+  Pool of idle upstream connections, so consecutive requests to the same host don't need to connect (and possibly perform
+  CONNECT and TLS handshakes) each time.
+
+  Idle connections are kept for at most IdleTimeout, and at most MaxIdlePerKey connections are kept for each combination of
+  upstream proxy, target host and TLS-ness. Connections are checked before they're handed out again: if the remote end closed the
+  connection or sent unexpected data in the meantime, the connection is discarded.
+ */
+type ConnectionPool struct {
+  MaxIdlePerKey int           //maximum number of idle connections per key
+  IdleTimeout time.Duration   //how long to keep idle connections
+
+  idle map[connectionPoolKey][]*pooledConnection
+  mutex sync.Mutex
+  evictionStarted bool
+}
+
+/*
+  Creates a new, empty connection pool with default settings.
+ */
+func NewConnectionPool() *ConnectionPool {
+  return &ConnectionPool {
+    MaxIdlePerKey: DefaultMaxIdleConnectionsPerKey,
+    IdleTimeout: DefaultPoolIdleTimeout,
+    idle: make(map[connectionPoolKey][]*pooledConnection),
+  }
+}
+
+
+var defaultConnectionPool *ConnectionPool
+var defaultConnectionPoolOnce sync.Once
+
+/*
+  Returns the connection pool shared by all clients by default.
+  The pool's settings are read from the application configuration's "client" section the first time this is called.
+ */
+func GetDefaultConnectionPool() *ConnectionPool {
+  defaultConnectionPoolOnce.Do(func() {
+    defaultConnectionPool=NewConnectionPool()
+    defaultConnectionPool.loadSettings()
+  })
+  return defaultConnectionPool
+}
+
+func (this *ConnectionPool) loadSettings() {
+  value:=utils.GetConfigValue("client.max_idle_connections_per_host")
+  if value!="" {
+    count,err:=strconv.Atoi(value)
+    if err!=nil || count<0 {
+      log.Warn("invalid idle connection limit \"%s\", using default",value)
+    } else {
+      this.MaxIdlePerKey=count
+    }
+  }
+
+  value=utils.GetConfigValue("client.idle_connection_timeout")
+  if value!="" {
+    seconds,err:=strconv.Atoi(value)
+    if err!=nil || seconds<1 {
+      log.Warn("invalid idle connection timeout \"%s\", using default",value)
+    } else {
+      this.IdleTimeout=time.Duration(seconds)*time.Second
+    }
+  }
+}
+
+
+/*
+  Fetches a healthy idle connection for the given key, returns nil if there is none. Messages are logged through the given logger,
+  e.g. with the correlation ID of the request the connection is for.
+ */
+func (this *ConnectionPool) get(key connectionPoolKey, logger log.CorrelatedLogger) *pooledConnection {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+
+  for {
+    candidates:=this.idle[key]
+    if len(candidates)==0 {
+      return nil
+    }
+    last:=len(candidates)-1
+    candidate:=candidates[last]
+    this.idle[key]=candidates[0:last]
+    if len(this.idle[key])==0 {
+      delete(this.idle,key)
+    }
+
+    if time.Since(candidate.idleSince)>this.IdleTimeout || !isConnectionAlive(candidate) {
+      logger.Trace("discarding stale pooled connection to %s",key.target)
+      candidate.conn.Close()
+      continue
+    }
+    logger.Trace("reusing pooled connection to %s",key.target)
+    return candidate
+  }
+}
+
+/*
+  Returns a connection to the pool. The connection is closed instead if the pool is full. Messages are logged through the given
+  logger.
+ */
+func (this *ConnectionPool) put(connection *pooledConnection, logger log.CorrelatedLogger) {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+
+  if len(this.idle[connection.key])>=this.MaxIdlePerKey {
+    logger.Trace("too many idle connections to %s, closing connection",connection.key.target)
+    connection.conn.Close()
+    return
+  }
+  connection.idleSince=time.Now()
+  this.idle[connection.key]=append(this.idle[connection.key],connection)
+  this.startEviction()
+}
+
+/*
+  Starts the background eviction of expired idle connections, if it isn't running yet. Requires the mutex to be locked.
+  The eviction interval is derived from IdleTimeout here, the goroutine only reads settings while holding the mutex.
+ */
+func (this *ConnectionPool) startEviction() {
+  if this.evictionStarted {
+    return
+  }
+  this.evictionStarted=true
+  interval:=this.IdleTimeout/2+time.Second
+  go func() {
+    for {
+      time.Sleep(interval)
+      if !this.evictExpired() {
+        return
+      }
+    }
+  }()
+}
+
+/*
+  Closes expired idle connections. Returns false once the pool is empty, stopping the background eviction.
+ */
+func (this *ConnectionPool) evictExpired() bool {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+
+  for key,connections:=range this.idle {
+    var remaining []*pooledConnection
+    for _,connection:=range connections {
+      if time.Since(connection.idleSince)>this.IdleTimeout {
+        log.Trace("evicting idle connection to %s",key.target)
+        connection.conn.Close()
+      } else {
+        remaining=append(remaining,connection)
+      }
+    }
+    if len(remaining)>0 {
+      this.idle[key]=remaining
+    } else {
+      delete(this.idle,key)
+    }
+  }
+
+  if len(this.idle)==0 {
+    this.evictionStarted=false
+    return false
+  }
+  return true
+}
+
+/*
+  Closes all idle connections in the pool.
+ */
+func (this *ConnectionPool) CloseIdleConnections() {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+
+  for key,connections:=range this.idle {
+    for _,connection:=range connections {
+      connection.conn.Close()
+    }
+    delete(this.idle,key)
+  }
+}
+
+/*
+  Returns the number of idle connections in the pool.
+ */
+func (this *ConnectionPool) IdleCount() int {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+
+  count:=0
+  for _,connections:=range this.idle {
+    count+=len(connections)
+  }
+  return count
+}
+
+
+/*
+  Checks whether an idle connection can still be used: the remote end mustn't have closed the connection or sent any data.
+ */
+func isConnectionAlive(connection *pooledConnection) bool {
+  if connection.buf.Reader.Buffered()>0 {
+    return false
+  }
+  connection.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+  _,err:=connection.buf.Reader.Peek(1)
+  connection.conn.SetReadDeadline(time.Time{})
+  if err,ok:=err.(net.Error);ok && err.Timeout() {
+    return true
+  }
+  return false
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "bufio"
+  "net"
+  "time"
+  "github.com/rinusser/hopgoblin/log"
+)
+
+
+func createPipedConnection(key connectionPoolKey) (*pooledConnection,net.Conn) {
+  local,remote:=net.Pipe()
+  return &pooledConnection {
+    conn: local,
+    buf: bufio.NewReadWriter(bufio.NewReader(local),bufio.NewWriter(local)),
+    key: key,
+  },remote
+}
+
+/*
+  Makes sure pooled connections are handed out only for the same key, and only once.
+ */
+func TestConnectionPoolKeys(t *testing.T) {
+  pool:=NewConnectionPool()
+  key1:=connectionPoolKey{proxy:"127.0.0.1:3128",target:"example.com:443",tls:true}
+  key2:=connectionPoolKey{proxy:"127.0.0.1:3128",target:"example.com:443",tls:false}
+
+  connection,remote:=createPipedConnection(key1)
+  defer remote.Close()
+  pool.put(connection,log.CorrelatedLogger{})
+
+  assert.Nil(t,pool.get(key2,log.CorrelatedLogger{}),"TLS-ness should be part of the key")
+  assert.Equal(t,connection,pool.get(key1,log.CorrelatedLogger{}),"connection should have been reused")
+  assert.Nil(t,pool.get(key1,log.CorrelatedLogger{}),"connection should have been handed out once only")
+}
+
+/*
+  Makes sure the pool keeps at most the configured number of idle connections per key.
+ */
+func TestConnectionPoolLimit(t *testing.T) {
+  pool:=NewConnectionPool()
+  pool.MaxIdlePerKey=2
+  key:=connectionPoolKey{proxy:"127.0.0.1:3128",target:"example.com:80"}
+
+  for tc:=0;tc<3;tc++ {
+    connection,remote:=createPipedConnection(key)
+    defer remote.Close()
+    pool.put(connection,log.CorrelatedLogger{})
+  }
+  assert.Equal(t,2,pool.IdleCount())
+
+  pool.CloseIdleConnections()
+  assert.Equal(t,0,pool.IdleCount())
+}
+
+/*
+  Makes sure connections that were closed by the remote end, sent unexpected data or idled for too long aren't reused.
+ */
+func TestConnectionPoolHealthChecks(t *testing.T) {
+  pool:=NewConnectionPool()
+  key:=connectionPoolKey{proxy:"127.0.0.1:3128",target:"example.com:80"}
+
+  connection,remote:=createPipedConnection(key)
+  pool.put(connection,log.CorrelatedLogger{})
+  remote.Close()
+  assert.Nil(t,pool.get(key,log.CorrelatedLogger{}),"closed connection shouldn't have been reused")
+
+  connection,remote=createPipedConnection(key)
+  defer remote.Close()
+  pool.put(connection,log.CorrelatedLogger{})
+  go remote.Write([]byte("HTTP/1.1 200 OK\r\n"))
+  time.Sleep(1e8)
+  assert.Nil(t,pool.get(key,log.CorrelatedLogger{}),"connection with unexpected data shouldn't have been reused")
+
+  pool.IdleTimeout=time.Millisecond
+  connection,remote=createPipedConnection(key)
+  defer remote.Close()
+  pool.put(connection,log.CorrelatedLogger{})
+  time.Sleep(1e7)
+  assert.Nil(t,pool.get(key,log.CorrelatedLogger{}),"expired connection shouldn't have been reused")
+}
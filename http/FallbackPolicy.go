@@ -0,0 +1,122 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "errors"
+  "fmt"
+  "regexp"
+  "strings"
+  "github.com/rinusser/hopgoblin/utils"
+)
+
+
+/*
+  What the server does with requests to hosts no site handler is responsible for.
+ */
+type FallbackPolicy int
+
+const (
+  FallbackDeny FallbackPolicy=iota //answer with HTTP 403
+  FallbackTunnel                   //relay CONNECT tunnels byte-for-byte without TLS interception, deny plain HTTP requests
+  FallbackForward                  //relay CONNECT tunnels like FallbackTunnel, forward plain HTTP requests unchanged
+)
+
+/*
+  Parses a fallback policy name, i.e. "deny", "tunnel" or "forward".
+ */
+func ParseFallbackPolicy(name string) (FallbackPolicy,error) {
+  switch strings.ToLower(name) {
+    case "deny":
+      return FallbackDeny,nil
+    case "tunnel":
+      return FallbackTunnel,nil
+    case "forward":
+      return FallbackForward,nil
+  }
+  return FallbackDeny,errors.New("unknown fallback policy \""+name+"\"")
+}
+
+/*
+  Returns the policy's name.
+ */
+func (this FallbackPolicy) String() string {
+  switch this {
+    case FallbackTunnel:
+      return "tunnel"
+    case FallbackForward:
+      return "forward"
+  }
+  return "deny"
+}
+
+
+/*
+  Per-host fallback policy rule.
+ */
+type FallbackRule struct {
+  Hosts *regexp.Regexp //target hostnames this rule applies to
+  Policy FallbackPolicy
+}
+
+/*
+  Fallback policies for requests to hosts without site handler: the first of the Rules matching the target host is used,
+  Default otherwise. A nil *FallbackSettings denies all such requests.
+ */
+type FallbackSettings struct {
+  Default FallbackPolicy
+  Rules []FallbackRule
+}
+
+
+/*
+  Fetches the default fallback settings from the application configuration's "fallback" section: fallback.policy sets the
+  default policy, fallback.rule.<n>=<policy> <host regex> adds per-host rules.
+ */
+func GetDefaultFallbackSettings() *FallbackSettings {
+  rv,err:=parseFallbackSettings(utils.GetConfigValue("fallback.policy"),utils.GetConfigValuesByPrefix("fallback.rule."))
+  if err!=nil {
+    panic("invalid fallback settings: "+err.Error())
+  }
+  return rv
+}
+
+func parseFallbackSettings(policy string, rules map[string]string) (*FallbackSettings,error) {
+  rv:=&FallbackSettings{}
+  if policy!="" {
+    var err error
+    rv.Default,err=ParseFallbackPolicy(policy)
+    if err!=nil {
+      return nil,err
+    }
+  }
+
+  parsed,err:=parseHostRules(rules,"fallback rule")
+  if err!=nil {
+    return nil,err
+  }
+  for _,rule:=range parsed {
+    policy,err:=ParseFallbackPolicy(rule.target)
+    if err!=nil {
+      return nil,fmt.Errorf("fallback rule %d: %s",rule.number,err)
+    }
+    rv.Rules=append(rv.Rules,FallbackRule{Hosts:rule.hosts,Policy:policy})
+  }
+  return rv,nil
+}
+
+/*
+  Determines the fallback policy for the given target host.
+ */
+func (this *FallbackSettings) GetPolicy(host string) FallbackPolicy {
+  if this==nil {
+    return FallbackDeny
+  }
+  for _,rule:=range this.Rules {
+    if rule.Hosts.MatchString(host) {
+      return rule.Policy
+    }
+  }
+  return this.Default
+}
@@ -0,0 +1,38 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+
+/*
+  Makes sure fallback policies are picked by the first matching rule, falling back to the default policy.
+ */
+func TestFallbackSettings(t *testing.T) {
+  var settings *FallbackSettings
+  assert.Equal(t,FallbackDeny,settings.GetPolicy("example.com"),"nil settings should have denied")
+
+  settings,err:=parseFallbackSettings("",nil)
+  assert.Nil(t,err)
+  assert.Equal(t,FallbackDeny,settings.GetPolicy("example.com"),"default should have been deny")
+
+  settings,err=parseFallbackSettings("Tunnel",map[string]string {
+    "2":"deny ^private\\.",
+    "1":"forward \\.example\\.com$",
+  })
+  assert.Nil(t,err)
+  assert.Equal(t,FallbackForward,settings.GetPolicy("www.example.com"))
+  assert.Equal(t,FallbackForward,settings.GetPolicy("private.example.com"),"first rule should have been used")
+  assert.Equal(t,FallbackDeny,settings.GetPolicy("private.local"))
+  assert.Equal(t,FallbackTunnel,settings.GetPolicy("example.org"))
+  assert.Equal(t,"tunnel",settings.GetPolicy("example.org").String())
+
+  _,err=parseFallbackSettings("allow",nil)
+  assert.NotNil(t,err)
+  _,err=parseFallbackSettings("deny",map[string]string{"1":"allow ."})
+  assert.NotNil(t,err)
+}
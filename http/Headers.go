@@ -4,6 +4,7 @@
 package http
 
 import (
+  "bytes"
   "fmt"
   "reflect"
   "regexp"
@@ -16,11 +17,20 @@ import (
 /*
   Type for HTTP headers.
 
-  Header name lookups are performed case-insensitively, but the original case will be preserved when generating the string
-  representation.
+  Header name lookups are performed case-insensitively. Every header field line is kept in its original order, with the name's
+  original case, so repeated headers like Set-Cookie aren't lost and the string representation reproduces the received header
+  block unless it was changed.
  */
 type Headers struct {
-  data map[string][]string
+  fields []headerField
+}
+
+/*
+  A single header field line.
+ */
+type headerField struct {
+  name string
+  value string
 }
 
 
@@ -28,72 +38,176 @@ type Headers struct {
   Creates an empty header set.
  */
 func NewHeaders() *Headers {
-  return &Headers{data:make(map[string][]string)}
+  return &Headers{}
 }
 
 /*
   Parses HTTP headers from raw request data.
-  Data needs to contain double newline to mark end of HTTP header block.
+  Data needs to contain double newline to mark end of HTTP header block. Lines may end with either CRLF or LF.
  */
 func ParseHeaders(data string) *Headers {
-  rv:=NewHeaders()
-  separator:=strings.Index(data,"\n\n")
-  if separator<0 {
-    separator=strings.Index(data,"\r\n\r\n")
-  }
-  if separator<0 {
+  raw:=[]byte(data)
+  header_end:=findHeaderEnd(raw)
+  if header_end<0 {
     log.Debug("could not find end of headers")
-    return rv
+    return NewHeaders()
   }
-  request_line_matcher:=regexp.MustCompile(`^[^ ]+ [^ ]+ http/[0-9]\.[0-9]$`)
-  for idx,value := range strings.Split(data[0:separator],"\n") {
-    if idx==0 && request_line_matcher.MatchString(strings.ToLower(strings.TrimSpace(value))) {
+  return parseHeaderBlock(raw[0:header_end])
+}
+
+var firstLineMatcher=regexp.MustCompile(`^([^ ]+ [^ ]+ http/[0-9]\.[0-9]|http/[0-9]\.[0-9] [0-9]{3}( .*)?)$`)
+
+/*
+  Parses a header block, ending either at the first empty line or the end of the data.
+  The first line is skipped if it's an HTTP request or status line. Obsolete line folding (continuation lines starting with
+  whitespace) is joined into the previous field's value.
+ */
+func parseHeaderBlock(header []byte) *Headers {
+  rv:=NewHeaders()
+  for idx,raw_line:=range bytes.Split(header,[]byte("\n")) {
+    line:=strings.TrimRight(string(raw_line),"\r")
+    if line=="" {
+      break
+    }
+    if idx==0 && firstLineMatcher.MatchString(strings.ToLower(strings.TrimSpace(line))) {
       continue
     }
-    colon:=strings.Index(value,":")
+    if (line[0]==' ' || line[0]=='\t') && len(rv.fields)>0 {
+      last:=&rv.fields[len(rv.fields)-1]
+      last.value=strings.TrimSpace(last.value+" "+strings.TrimSpace(line))
+      continue
+    }
+    colon:=strings.Index(line,":")
     if colon<0 {
       continue
     }
-    rv.Set(strings.TrimSpace(value[0:colon]),strings.TrimSpace(value[colon+1:]))
+    rv.Add(strings.TrimSpace(line[0:colon]),strings.TrimSpace(line[colon+1:]))
   }
   return rv
 }
 
 
 /*
-  Fetches a single header, lookup is case insensitive.
+  Fetches a single header, lookup is case insensitive. If the header occurs multiple times the first value is returned.
   The boolean return value is set to true if the header was found, false otherwise.
  */
 func (this *Headers) Get(key string) (string, bool) {
-  value:=""
-  parts,found:=this.data[strings.ToLower(key)]
-  if found {
-    value=parts[1]
+  for _,field:=range this.fields {
+    if strings.EqualFold(field.name,key) {
+      return field.value,true
+    }
+  }
+  return "",false
+}
+
+/*
+  Fetches all values of a header in their original order, lookup is case insensitive. Returns nil if the header wasn't found.
+ */
+func (this *Headers) GetAll(key string) []string {
+  var rv []string
+  for _,field:=range this.fields {
+    if strings.EqualFold(field.name,key) {
+      rv=append(rv,field.value)
+    }
+  }
+  return rv
+}
+
+/*
+  Fetches the elements of a comma-separated list header (e.g. "Transfer-Encoding: gzip, chunked") across all its field lines,
+  with whitespace trimmed and empty elements removed. Lookup is case insensitive.
+ */
+func (this *Headers) Values(key string) []string {
+  var rv []string
+  for _,value:=range this.GetAll(key) {
+    for _,element:=range strings.Split(value,",") {
+      element=strings.TrimSpace(element)
+      if element!="" {
+        rv=append(rv,element)
+      }
+    }
   }
-  return value,found
+  return rv
 }
 
 /*
-  Sets a header line. Key case will be preserved when calling ToString() later.
+  Sets a header line, replacing all previous values. The header keeps the position of its first previous occurrence, if any.
+  Key case will be preserved when calling ToString() later.
  */
 func (this *Headers) Set(key string, value string) {
-  this.data[strings.ToLower(key)]=[]string{key,value}
+  found:=false
+  fields:=this.fields[:0]
+  for _,field:=range this.fields {
+    if !strings.EqualFold(field.name,key) {
+      fields=append(fields,field)
+    } else if !found {
+      fields=append(fields,headerField{key,value})
+      found=true
+    }
+  }
+  if !found {
+    fields=append(fields,headerField{key,value})
+  }
+  this.fields=fields
+}
+
+/*
+  Adds a header line, keeping any previous values. Key case will be preserved when calling ToString() later.
+ */
+func (this *Headers) Add(key string, value string) {
+  this.fields=append(this.fields,headerField{key,value})
 }
 
 /*
-  Returns an alphabetically sorted list of keys.
+  Removes all lines of a header, lookup is case insensitive.
+ */
+func (this *Headers) Del(key string) {
+  fields:=this.fields[:0]
+  for _,field:=range this.fields {
+    if !strings.EqualFold(field.name,key) {
+      fields=append(fields,field)
+    }
+  }
+  this.fields=fields
+}
+
+/*
+  Calls the given function for each header field line in order, with the name's original case.
+ */
+func (this *Headers) ForEach(f func(name string, value string)) {
+  for _,field:=range this.fields {
+    f(field.name,field.value)
+  }
+}
+
+/*
+  Creates an independent copy of the headers.
+ */
+func (this *Headers) Clone() *Headers {
+  return &Headers{fields:append([]headerField(nil),this.fields...)}
+}
+
+/*
+  Returns an alphabetically sorted list of keys. Headers occurring multiple times are listed once, with the first occurrence's
+  case.
  */
 func (this *Headers) Keys() []string {
   keys:=make([]string,0)
-  for _,parts:=range this.data {
-    keys=append(keys,parts[0])
+  seen:=make(map[string]bool)
+  for _,field:=range this.fields {
+    lower:=strings.ToLower(field.name)
+    if !seen[lower] {
+      seen[lower]=true
+      keys=append(keys,field.name)
+    }
   }
   sort.Strings(keys)
   return keys
 }
 
 /*
-  Compares two Headers instances for equality. Instances are considered equal if they contain the same keys and values - both are compared case-sensitively.
+  Compares two Headers instances for equality. Instances are considered equal if they contain the same keys and values - both are
+  compared case-sensitively. The order of different headers doesn't matter, the order of a repeated header's values does.
  */
 func (this *Headers) Equals(that *Headers) bool {
   keys1:=this.Keys()
@@ -102,9 +216,7 @@ func (this *Headers) Equals(that *Headers) bool {
     return false
   }
   for _,key:=range keys1 {
-    v1,_:=this.Get(key)
-    v2,_:=that.Get(key)
-    if v1!=v2 {
+    if !reflect.DeepEqual(this.GetAll(key),that.GetAll(key)) {
       return false
     }
   }
@@ -113,13 +225,12 @@ func (this *Headers) Equals(that *Headers) bool {
 
 /*
   Renders HTTP headers into part of HTTP message ready for transmission in HTTP request/response data.
+  Header lines are rendered in their current order.
  */
 func (this *Headers) ToString() string {
   var rvs strings.Builder
-  for _,key:=range this.Keys() {
-    value,_:=this.Get(key)
-    rvs.WriteString(fmt.Sprintf("%s: %s\r\n",key,value))
+  for _,field:=range this.fields {
+    rvs.WriteString(fmt.Sprintf("%s: %s\r\n",field.name,field.value))
   }
   return rvs.String()
 }
-
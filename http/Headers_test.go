@@ -153,3 +153,96 @@ func runParseHeadersTest(t *testing.T, input string, expected *Headers, descript
   assert.True(t,expected.Equals(actual),description)
 }
 
+
+
+/*
+  Makes sure ParseHeaders() stops at the first empty line, even if the body contains more newlines.
+ */
+func TestParseHeadersStopsAtBody(t *testing.T) {
+  expected:=NewHeaders()
+  expected.Set("Host","example.com")
+
+  runParseHeadersTest(t,
+    "Host: example.com\r\n\r\nX-Body: 1\n\nX-More: 2\r\n\r\n",
+    expected,
+    "header lines in body should be ignored")
+
+  runParseHeadersTest(t,
+    "HTTP/1.1 200 OK\nHost: example.com\n\nX-Body: 1\r\n\r\n",
+    expected,
+    "LF-only header should end at first empty line")
+}
+
+
+/*
+  Makes sure repeated headers keep all their values, and .Set()/.Add()/.Del() manage them.
+ */
+func TestHeadersMultipleValues(t *testing.T) {
+  h:=NewHeaders()
+  h.Add("Set-Cookie","a=1")
+  h.Add("Via","1.1 first")
+  h.Add("set-cookie","b=2")
+  assert.Equal(t,[]string{"a=1","b=2"},h.GetAll("SET-COOKIE"))
+  assertFoundAndEqual(t,h,"Set-Cookie","a=1")
+  assert.Equal(t,[]string{"Set-Cookie","Via"},h.Keys())
+  assert.Nil(t,h.GetAll("X-Missing"))
+
+  h.Set("Set-Cookie","c=3")
+  assert.Equal(t,[]string{"c=3"},h.GetAll("set-cookie"))
+  assert.Equal(t,"Set-Cookie: c=3\r\nVia: 1.1 first\r\n",h.ToString(),"replaced header should have kept its position")
+
+  h.Del("SET-cookie")
+  _,found:=h.Get("Set-Cookie")
+  assert.False(t,found)
+  assert.Equal(t,"Via: 1.1 first\r\n",h.ToString())
+}
+
+/*
+  Makes sure comma-separated list headers are split into their elements across all lines.
+ */
+func TestHeadersValues(t *testing.T) {
+  h:=NewHeaders()
+  h.Add("Cache-Control","no-cache, max-age=0")
+  h.Add("Cache-Control"," , private")
+  assert.Equal(t,[]string{"no-cache","max-age=0","private"},h.Values("cache-control"))
+  assert.Nil(t,h.Values("Pragma"))
+}
+
+/*
+  Makes sure parsed headers are rendered again in their original order with all values.
+ */
+func TestHeadersKeepOriginalOrder(t *testing.T) {
+  input:="Host: example.com\r\nUser-Agent: test\r\nAccept: */*\r\nset-cookie: a=1\r\nAccept-Encoding: gzip\r\nSet-Cookie: b=2\r\n"
+  h:=ParseHeaders(input+"\r\n")
+  assert.Equal(t,input,h.ToString())
+
+  h2:=ParseHeaders("Set-Cookie: b=2\r\nset-cookie: a=1\r\n\r\n")
+  h3:=ParseHeaders("Set-Cookie: a=1\r\nSet-Cookie: b=2\r\n\r\n")
+  assertInequality(t,h2,h3,"order of repeated header's values should matter")
+}
+
+/*
+  Makes sure obsolete line folding is joined into the previous header's value.
+ */
+func TestParseHeadersLineFolding(t *testing.T) {
+  h:=ParseHeaders("X-Folded: first\r\n  second\r\n\tthird\r\nX-Next: 1\r\n\r\n")
+  assertFoundAndEqual(t,h,"X-Folded","first second third")
+  assertFoundAndEqual(t,h,"X-Next","1")
+}
+
+/*
+  Makes sure .Clone() creates an independent copy and .ForEach() visits all lines in order.
+ */
+func TestHeadersCloneAndForEach(t *testing.T) {
+  h:=ParseHeaders("Via: a\r\nHost: example.com\r\nvia: b\r\n\r\n")
+  clone:=h.Clone()
+  clone.Set("Host","changed")
+  clone.Add("X-New","1")
+  assertFoundAndEqual(t,h,"Host","example.com")
+
+  var lines []string
+  h.ForEach(func(name string, value string) {
+    lines=append(lines,name+"="+value)
+  })
+  assert.Equal(t,[]string{"Via=a","Host=example.com","via=b"},lines)
+}
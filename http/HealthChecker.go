@@ -0,0 +1,135 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "bufio"
+  "fmt"
+  "net"
+  "sync"
+  "time"
+  "github.com/rinusser/hopgoblin/log"
+)
+
+
+/*
+  The default time a single health check may take. Only used as fallback if no other value could be found.
+ */
+var DefaultHealthCheckTimeout=5*time.Second
+
+
+/*
+  Checks upstream proxies in the background: each check either connects to the proxy, or opens a tunnel to the Target through it
+  if set. Proxies failing the check are ejected for EjectTime, proxies passing it are available again.
+ */
+type HealthChecker struct {
+  Upstreams []*ProxyUpstream
+  Interval time.Duration  //time between checks
+  Timeout time.Duration   //maximum duration of a single check
+  Target string           //host:port to open tunnels to, empty to just connect
+  EjectTime time.Duration //how long to eject failing proxies for
+
+  stop chan struct{}
+  stopOnce sync.Once
+}
+
+/*
+  Creates a HealthChecker for the upstream proxies in the proxy settings.
+  Returns nil if health checks are disabled or there are no upstream proxies to check.
+ */
+func NewHealthChecker(settings *ProxySettings) *HealthChecker {
+  upstreams:=settings.GetAllUpstreams()
+  if len(upstreams)==0 || settings.HealthCheckInterval<=0 {
+    return nil
+  }
+  return &HealthChecker {
+    Upstreams: upstreams,
+    Interval: settings.HealthCheckInterval,
+    Timeout: DefaultHealthCheckTimeout,
+    Target: settings.HealthCheckTarget,
+    EjectTime: settings.EjectTime,
+    stop: make(chan struct{}),
+  }
+}
+
+/*
+  Starts checking in the background, the first check happens immediately. Does nothing for nil.
+ */
+func (this *HealthChecker) Start() {
+  if this==nil {
+    return
+  }
+  log.Debug("checking %d upstream proxies every %s",len(this.Upstreams),this.Interval)
+  go func() {
+    ticker:=time.NewTicker(this.Interval)
+    defer ticker.Stop()
+    for {
+      this.CheckAll()
+      select {
+        case <-this.stop:
+          return
+        case <-ticker.C:
+      }
+    }
+  }()
+}
+
+/*
+  Stops checking. Does nothing for nil.
+ */
+func (this *HealthChecker) Stop() {
+  if this==nil {
+    return
+  }
+  this.stopOnce.Do(func() {
+    close(this.stop)
+  })
+}
+
+/*
+  Checks all upstream proxies once, in parallel, and updates their state.
+ */
+func (this *HealthChecker) CheckAll() {
+  var wait sync.WaitGroup
+  for _,upstream:=range this.Upstreams {
+    wait.Add(1)
+    go func(upstream *ProxyUpstream) {
+      defer wait.Done()
+      state:=upstream.getState()
+      if err:=this.check(upstream);err!=nil {
+        log.DebugF("upstream proxy health check failed","upstream",state.address,"reason",err.Error())
+        state.eject(err,this.EjectTime,log.CorrelatedLogger{})
+      } else {
+        log.TraceF("upstream proxy health check passed","upstream",state.address)
+        state.restore(log.CorrelatedLogger{})
+      }
+    }(upstream)
+  }
+  wait.Wait()
+}
+
+func (this *HealthChecker) check(upstream *ProxyUpstream) error {
+  conn,err:=net.DialTimeout("tcp",upstream.GetAddress(),this.Timeout)
+  if err!=nil {
+    return err
+  }
+  defer conn.Close()
+  if this.Target=="" {
+    return nil
+  }
+
+  conn.SetDeadline(time.Now().Add(this.Timeout))
+  buf:=bufio.NewReadWriter(bufio.NewReader(conn),bufio.NewWriter(conn))
+  if upstream.IsSOCKS5() {
+    return socks5Connect(buf,upstream,this.Target)
+  }
+  response,err:=sendRequestAndReadResponse(newConnectRequest(this.Target,upstream),buf,nil,log.CorrelatedLogger{})
+  if err!=nil {
+    return err
+  }
+  if response.Status!=200 {
+    return fmt.Errorf("got status %d for CONNECT to %s",response.Status,this.Target)
+  }
+  return nil
+}
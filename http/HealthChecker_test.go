@@ -0,0 +1,57 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "errors"
+  "fmt"
+  "time"
+  "github.com/rinusser/hopgoblin/log"
+)
+
+
+/*
+  Makes sure health checks are only set up if enabled and there are upstream proxies to check.
+ */
+func TestNewHealthChecker(t *testing.T) {
+  assert.Nil(t,NewHealthChecker(nil))
+  settings:=NewProxySettings("127.0.0.1",3128)
+  assert.Nil(t,NewHealthChecker(settings),"health checks should have been disabled without interval")
+  settings.HealthCheckInterval=time.Minute
+  checker:=NewHealthChecker(settings)
+  if assert.NotNil(t,checker) {
+    assert.Equal(t,[]string{"127.0.0.1:3128"},getUpstreamAddresses(checker.Upstreams))
+  }
+
+  var nil_checker *HealthChecker
+  nil_checker.Start()
+  nil_checker.Stop()
+}
+
+/*
+  Makes sure failing upstream proxies are ejected and working ones restored, with and without CONNECT target.
+ */
+func TestHealthCheckerCheckAll(t *testing.T) {
+  port,_:=startKeepAliveUpstream(t,nil)
+  working:=fmt.Sprintf("127.0.0.1:%d",port)
+  closed:=getClosedAddress(t)
+  getUpstreamState(working).eject(errors.New("test"),time.Minute,log.CorrelatedLogger{})
+
+  checker:=&HealthChecker {
+    Upstreams: createTestUpstreams(working,closed),
+    Timeout: time.Second,
+    EjectTime: time.Minute,
+  }
+  checker.CheckAll()
+  assert.True(t,getUpstreamState(working).isAvailable(),"working proxy should have been restored")
+  assert.False(t,getUpstreamState(closed).isAvailable(),"closed proxy should have been ejected")
+  assert.Equal(t,float64(1),upstreamHealthy.Get(working))
+  assert.Equal(t,float64(0),upstreamHealthy.Get(closed))
+
+  checker.Target="example.com:443"
+  assert.Nil(t,checker.check(checker.Upstreams[0]),"CONNECT through working proxy should have succeeded")
+  assert.NotNil(t,checker.check(checker.Upstreams[1]))
+}
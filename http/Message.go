@@ -4,17 +4,25 @@
 package http
 
 import (
+  "bufio"
+  "bytes"
+  "io"
+  "io/ioutil"
   "strings"
 )
 
 /*
   Represents common parts of HTTP requests and responses.
+
+  The message body is either buffered in Body, or - for messages read from a connection - still waiting to be read from
+  BodyStream. Code that needs the entire body should call ReadBody() instead of accessing Body directly.
  */
 type message struct {
   firstLineParts []string  //first line of request/response split by whitespaces, e.g. {"GET","/","HTTP/1.1"}
   Protocol string          //e.g. "HTTP/1.1"
   Headers *Headers         //e.g. {"Content-Type":"application/json"}
   Body []byte              //e.g. {0x31,0x32,0x33}
+  BodyStream io.ReadCloser //raw body data not read yet, nil if the body is buffered in Body
 }
 
 
@@ -23,20 +31,133 @@ type message struct {
   Returns nil on error.
  */
 func ParseMessage(input string) *message {
-  first_newline_pos:=strings.Index(input,"\n")
+  return ParseMessageBytes([]byte(input))
+}
+
+/*
+  Reads parts common to HTTP requests/responses from raw message data. Both CRLF and LF line endings are supported in the
+  message header, the body is taken byte-exact from the data following the header.
+  Returns nil on error.
+
+  The returned message's body references the input data, it isn't copied.
+ */
+func ParseMessageBytes(input []byte) *message {
+  if bytes.IndexByte(input,'\n')<0 {
+    return nil
+  }
+  header_end:=findHeaderEnd(input)
+  if header_end<0 {
+    header_end=len(input)
+  }
+  return parseMessageHeader(input[0:header_end],input[header_end:])
+}
+
+/*
+  Parses an HTTP message header block, the body data is taken as-is.
+ */
+func parseMessageHeader(header []byte, body []byte) *message {
+  first_newline_pos:=bytes.IndexByte(header,'\n')
   if first_newline_pos<0 {
     return nil
   }
-  first_line:=strings.TrimSpace(input[0:first_newline_pos])
+  first_line:=strings.TrimSpace(string(header[0:first_newline_pos]))
   first_parts:=strings.Split(first_line," ")
 
-  headers:=ParseHeaders(input)
-
-  body:=[]byte(input[strings.Index(input,"\r\n\r\n")+4:])
+  if body==nil {
+    body=[]byte{}
+  }
 
   return &message{
     firstLineParts:first_parts,
-    Headers:headers,
+    Headers:parseHeaderBlock(header),
     Body:body,
   }
 }
+
+/*
+  Finds the end of the header block in raw HTTP message data: returns the position right after the first empty line, or -1 if
+  there is no empty line. Lines may end with either CRLF or LF.
+ */
+func findHeaderEnd(data []byte) int {
+  pos:=0
+  for pos<len(data) {
+    newline_pos:=bytes.IndexByte(data[pos:],'\n')
+    if newline_pos<0 {
+      break
+    }
+    line:=data[pos:pos+newline_pos]
+    pos+=newline_pos+1
+    if len(bytes.TrimRight(line,"\r"))==0 {
+      return pos
+    }
+  }
+  return -1
+}
+
+
+/*
+  Reads any streamed body data into the Body field and closes the stream.
+  Returns the entire (raw) message body.
+ */
+func (this *message) ReadBody() ([]byte,error) {
+  if this.BodyStream==nil {
+    return this.Body,nil
+  }
+  stream:=this.BodyStream
+  this.BodyStream=nil
+  defer stream.Close()
+
+  data,err:=ioutil.ReadAll(stream)
+  this.Body=append(this.Body,data...)
+  return this.Body,err
+}
+
+/*
+  Closes the body stream, if any, without reading the remaining data.
+ */
+func (this *message) CloseBody() error {
+  if this.BodyStream==nil {
+    return nil
+  }
+  err:=this.BodyStream.Close()
+  this.BodyStream=nil
+  return err
+}
+
+/*
+  Writes the message header and body to the output stream, flushing the output after each block of body data read.
+  Streamed bodies are passed on as they arrive and closed afterwards.
+ */
+func (this *message) writeTo(out *bufio.Writer, header string) error {
+  _,err:=out.WriteString(header)
+  if err==nil {
+    _,err=out.Write(this.Body)
+  }
+  if err==nil {
+    err=out.Flush()
+  }
+  if err!=nil || this.BodyStream==nil {
+    this.CloseBody()
+    return err
+  }
+
+  defer this.CloseBody()
+  chunk:=make([]byte,32*1024)
+  for {
+    size,read_err:=this.BodyStream.Read(chunk)
+    if size>0 {
+      _,err=out.Write(chunk[0:size])
+      if err==nil {
+        err=out.Flush()
+      }
+      if err!=nil {
+        return err
+      }
+    }
+    if read_err==io.EOF {
+      return nil
+    } else if read_err!=nil {
+      return read_err
+    }
+  }
+}
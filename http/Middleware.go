@@ -0,0 +1,91 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "bufio"
+)
+
+
+/*
+  Turns a request into a response, e.g. by forwarding it to the target host.
+ */
+type RoundTripFunc func(request *Request) (*Response,error)
+
+/*
+  Wraps a RoundTripFunc: middleware can inspect or replace the request before passing it on to the next function, and inspect or
+  replace the response afterwards. Middleware can also answer requests itself without calling the next function at all.
+
+  For example, this middleware removes the User-Agent header from all requests:
+
+    func StripUserAgent(next http.RoundTripFunc) http.RoundTripFunc {
+      return func(request *http.Request) (*http.Response,error) {
+        request.Headers.Del("User-Agent")
+        return next(request)
+      }
+    }
+ */
+type Middleware func(next RoundTripFunc) RoundTripFunc
+
+/*
+  Site handlers can implement this interface in addition to SiteHandler to have their own middleware applied to their requests,
+  after the server's global middleware.
+ */
+type MiddlewareSiteHandler interface {
+  GetMiddlewares() []Middleware
+}
+
+
+/*
+  Wraps the final RoundTripFunc in the given middleware. The first middleware in the list is the outermost, i.e. it gets to see
+  requests first and responses last.
+ */
+func ChainMiddlewares(final RoundTripFunc, middlewares []Middleware) RoundTripFunc {
+  rv:=final
+  for tc:=len(middlewares)-1;tc>=0;tc-- {
+    rv=middlewares[tc](rv)
+  }
+  return rv
+}
+
+
+/*
+  Answers a request with the given RoundTripFunc, wrapped in the server's global middleware and the site handler's own middleware
+  if it has any. If the RoundTripFunc chain fails the client gets an HTTP 502 response.
+
+  Site handlers can call this from their HandleRequest() method. The handler may be nil, in which case only the global middleware
+  is applied.
+ */
+func (server *Server) ServeRoundTrip(handler SiteHandler, buf *bufio.ReadWriter, request *Request, final RoundTripFunc) error {
+  middlewares:=server.getMiddlewares()
+  if provider,ok:=handler.(MiddlewareSiteHandler);ok {
+    middlewares=append(append([]Middleware(nil),middlewares...),provider.GetMiddlewares()...)
+  }
+
+  response,err:=ChainMiddlewares(final,middlewares)(request)
+  if err!=nil || response==nil {
+    if response!=nil && response.BodyStream!=nil {
+      response.BodyStream.Close()
+    }
+    request.Logger().Debug("could not handle %s to %s: %v",request.Method,request.Url,err)
+    response=CreateSimpleResponse(502)
+  }
+  return server.WriteResponse(buf,response)
+}
+
+/*
+  Forwards a request to its target host (through the upstream proxy, if any) and passes the response on to the client, see
+  ServeRoundTrip().
+ */
+func (server *Server) ServeForwarded(handler SiteHandler, buf *bufio.ReadWriter, request *Request) error {
+  client:=NewServerClient(server)
+  return server.ServeRoundTrip(handler,buf,request,client.RoundTrip)
+}
+
+/*
+  Forwards a request, see ForwardRequest(). Can be used as final RoundTripFunc in middleware chains.
+ */
+func (client *Client) RoundTrip(request *Request) (*Response,error) {
+  return client.ForwardRequest(*request)
+}
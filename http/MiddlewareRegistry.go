@@ -0,0 +1,40 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "strings"
+  "github.com/rinusser/hopgoblin/log"
+)
+
+
+var registeredMiddlewares=make(map[string]Middleware)
+
+/*
+  Registers middleware by name, so it can be enabled in the application configuration. Call this e.g. in other packages' init()
+  functions.
+ */
+func RegisterMiddleware(name string, middleware Middleware) {
+  registeredMiddlewares[strings.ToLower(name)]=middleware
+}
+
+/*
+  Returns previously registered middleware for a comma-separated list of names, e.g. "log,timing". Unknown names are skipped.
+ */
+func GetRegisteredMiddlewares(names string) []Middleware {
+  var rv []Middleware
+  for _,name:=range strings.Split(names,",") {
+    name=strings.ToLower(strings.TrimSpace(name))
+    if name=="" {
+      continue
+    }
+    middleware,found:=registeredMiddlewares[name]
+    if !found {
+      log.Warn("unknown middleware \"%s\"",name)
+      continue
+    }
+    rv=append(rv,middleware)
+  }
+  return rv
+}
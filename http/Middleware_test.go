@@ -0,0 +1,144 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "bufio"
+  "bytes"
+  "crypto/tls"
+  "errors"
+  "io"
+  "strings"
+)
+
+
+func createTracingMiddleware(name string, trace *[]string) Middleware {
+  return func(next RoundTripFunc) RoundTripFunc {
+    return func(request *Request) (*Response,error) {
+      *trace=append(*trace,"before "+name)
+      response,err:=next(request)
+      *trace=append(*trace,"after "+name)
+      return response,err
+    }
+  }
+}
+
+type middlewareTestSiteHandler struct {
+  middlewares []Middleware
+}
+
+func (this middlewareTestSiteHandler) HandlesHost(host string) bool {
+  return true
+}
+
+func (this middlewareTestSiteHandler) HandleRequest(server *Server, buf *bufio.ReadWriter, request *Request) {
+}
+
+func (this middlewareTestSiteHandler) GetCertificateMap() map[string]*tls.Certificate {
+  return nil
+}
+
+func (this middlewareTestSiteHandler) GetMiddlewares() []Middleware {
+  return this.middlewares
+}
+
+/*
+  Makes sure global middleware wraps the site handler's middleware, and middleware sees requests and responses in order.
+ */
+func TestServeRoundTripMiddlewareOrder(t *testing.T) {
+  var trace []string
+  server:=NewServer()
+  server.SetMiddlewares([]Middleware{createTracingMiddleware("global",&trace)})
+  handler:=middlewareTestSiteHandler{middlewares:[]Middleware{createTracingMiddleware("handler",&trace)}}
+
+  var output bytes.Buffer
+  buf:=bufio.NewReadWriter(bufio.NewReader(&output),bufio.NewWriter(&output))
+  final:=func(request *Request) (*Response,error) {
+    trace=append(trace,"final "+request.Url)
+    response:=CreateSimpleResponse(200)
+    response.Body=[]byte("done")
+    return response,nil
+  }
+  request:=createPlainRequest("/ordered")
+  server.ServeRoundTrip(handler,buf,&request,final)
+
+  assert.Equal(t,[]string{"before global","before handler","final /ordered","after handler","after global"},trace)
+  response:=ParseResponseBytes(output.Bytes())
+  assert.Equal(t,"done",string(response.Body))
+  assert.Equal(t,1,len(server.getMiddlewares()),"handler's middleware shouldn't have been added to global list")
+}
+
+type middlewareTestBody struct {
+  io.Reader
+  closed bool
+}
+
+func (this *middlewareTestBody) Close() error {
+  this.closed=true
+  return nil
+}
+
+/*
+  Makes sure middleware can replace requests and responses, and failed round trips result in HTTP 502 responses.
+ */
+func TestServeRoundTripReplacements(t *testing.T) {
+  server:=NewServer()
+  server.SetMiddlewares([]Middleware {
+    func(next RoundTripFunc) RoundTripFunc {
+      return func(request *Request) (*Response,error) {
+        replaced:=createPlainRequest("/replaced")
+        response,err:=next(&replaced)
+        if err!=nil {
+          return nil,err
+        }
+        response.Headers.Set("X-Seen","yes")
+        return response,nil
+      }
+    },
+  })
+
+  var output bytes.Buffer
+  buf:=bufio.NewReadWriter(bufio.NewReader(&output),bufio.NewWriter(&output))
+  request:=createPlainRequest("/original")
+  server.ServeRoundTrip(nil,buf,&request,func(request *Request) (*Response,error) {
+    response:=CreateSimpleResponse(200)
+    response.Body=[]byte(request.Url)
+    return response,nil
+  })
+  response:=ParseResponseBytes(output.Bytes())
+  assert.Equal(t,"/replaced",string(response.Body))
+  _,found:=response.Headers.Get("X-Seen")
+  assert.True(t,found)
+
+  output.Reset()
+  server.ServeRoundTrip(nil,buf,&request,func(request *Request) (*Response,error) {
+    return nil,errors.New("upstream unavailable")
+  })
+  response=ParseResponseBytes(output.Bytes())
+  assert.Equal(t,uint16(502),response.Status)
+
+  output.Reset()
+  body:=&middlewareTestBody{Reader:strings.NewReader("partial")}
+  NewServer().ServeRoundTrip(nil,buf,&request,func(request *Request) (*Response,error) {
+    response:=CreateSimpleResponse(200)
+    response.BodyStream=body
+    return response,errors.New("upstream failed mid-response")
+  })
+  response=ParseResponseBytes(output.Bytes())
+  assert.Equal(t,uint16(502),response.Status)
+  assert.True(t,body.closed,"body stream of failed round trip should have been closed")
+}
+
+/*
+  Makes sure registered middleware can be looked up by name, skipping unknown names.
+ */
+func TestGetRegisteredMiddlewares(t *testing.T) {
+  var trace []string
+  RegisterMiddleware("Test_Trace",createTracingMiddleware("registered",&trace))
+  middlewares:=GetRegisteredMiddlewares(" test_trace , does_not_exist,,")
+  assert.Equal(t,1,len(middlewares))
+  assert.Nil(t,GetRegisteredMiddlewares(""))
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "bufio"
+  "crypto/sha1"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/base64"
+  "errors"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "github.com/rinusser/hopgoblin/log"
+  "github.com/rinusser/hopgoblin/utils"
+)
+
+
+/*
+  Checks clients' proxy credentials, sent with HTTP Basic authentication in the Proxy-Authorization header.
+
+  Credentials are read from a file with one "user:password" entry per line. Empty lines and lines starting with "#" are ignored.
+  Passwords can be stored in plain text or hashed, in the formats written by "htpasswd -s" and similar tools:
+
+    alice:secret
+    bob:{SHA}<base64-encoded SHA-1 hash>
+    carol:{SHA256}<base64-encoded SHA-256 hash>
+ */
+type ProxyAuthenticator struct {
+  Realm string
+  passwords map[string]string //stored passwords by user name
+}
+
+/*
+  The default realm sent to clients. Only used as fallback if no other value could be found.
+ */
+var DefaultProxyAuthRealm="hopgoblin"
+
+
+/*
+  Creates a ProxyAuthenticator from a credentials file.
+ */
+func NewProxyAuthenticator(filename string, realm string) (*ProxyAuthenticator,error) {
+  file,err:=os.Open(filename)
+  if err!=nil {
+    return nil,err
+  }
+  defer file.Close()
+
+  rv:=&ProxyAuthenticator{Realm:realm,passwords:make(map[string]string)}
+  scanner:=bufio.NewScanner(file)
+  line_number:=0
+  for scanner.Scan() {
+    line_number++
+    line:=strings.TrimSpace(scanner.Text())
+    if line=="" || strings.HasPrefix(line,"#") {
+      continue
+    }
+    parts:=strings.SplitN(line,":",2)
+    if len(parts)!=2 || parts[0]=="" {
+      return nil,fmt.Errorf("invalid credentials in line %d",line_number)
+    }
+    rv.passwords[parts[0]]=parts[1]
+  }
+  if err=scanner.Err();err!=nil {
+    return nil,err
+  }
+  return rv,nil
+}
+
+/*
+  Creates a ProxyAuthenticator from the application configuration's [auth] section: "file" is the credentials file (relative to
+  resources/ unless absolute) and "realm" the realm sent to clients.
+  Returns nil without error if proxy authentication isn't configured.
+ */
+func LoadProxyAuthenticator() (*ProxyAuthenticator,error) {
+  filename:=utils.GetConfigValue("auth.file")
+  if filename=="" {
+    return nil,nil
+  }
+  if !filepath.IsAbs(filename) {
+    filename=utils.GetResourcePath(filename)
+  }
+  realm:=utils.GetConfigValue("auth.realm")
+  if realm=="" {
+    realm=DefaultProxyAuthRealm
+  }
+  return NewProxyAuthenticator(filename,realm)
+}
+
+/*
+  Loads the configured ProxyAuthenticator. If the credentials can't be read all clients are denied, rather than letting everyone
+  in.
+ */
+func getDefaultProxyAuthenticator() *ProxyAuthenticator {
+  rv,err:=LoadProxyAuthenticator()
+  if err!=nil {
+    log.Error("could not load proxy credentials, denying all clients: %s",err)
+    return &ProxyAuthenticator{Realm:DefaultProxyAuthRealm,passwords:map[string]string{}}
+  }
+  return rv
+}
+
+/*
+  Checks a request's proxy credentials. Returns the user name and whether the credentials are valid.
+ */
+func (this *ProxyAuthenticator) Authenticate(request *Request) (string,bool) {
+  user,password,err:=parseProxyAuthorization(request.Headers)
+  if err!=nil {
+    return user,false
+  }
+  stored,found:=this.passwords[user]
+  if !found {
+    return user,false
+  }
+  return user,checkPassword(stored,password)
+}
+
+/*
+  Creates the 407 response asking the client for proxy credentials.
+ */
+func (this *ProxyAuthenticator) CreateChallengeResponse() *Response {
+  rv:=CreateSimpleResponse(407)
+  rv.Headers.Set("Proxy-Authenticate",fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"",this.Realm))
+  return rv
+}
+
+func parseProxyAuthorization(headers *Headers) (string,string,error) {
+  value,found:=headers.Get("Proxy-Authorization")
+  if !found {
+    return "","",errors.New("no credentials")
+  }
+  parts:=strings.Fields(value)
+  if len(parts)!=2 || !strings.EqualFold(parts[0],"Basic") {
+    return "","",errors.New("unsupported authentication scheme")
+  }
+  decoded,err:=base64.StdEncoding.DecodeString(parts[1])
+  if err!=nil {
+    return "","",err
+  }
+  credentials:=strings.SplitN(string(decoded),":",2)
+  if len(credentials)!=2 {
+    return credentials[0],"",errors.New("missing password")
+  }
+  return credentials[0],credentials[1],nil
+}
+
+func checkPassword(stored string, password string) bool {
+  var expected,actual []byte
+  switch {
+    case strings.HasPrefix(stored,"{SHA}"):
+      hash:=sha1.Sum([]byte(password))
+      expected,actual=[]byte(stored[5:]),[]byte(base64.StdEncoding.EncodeToString(hash[:]))
+    case strings.HasPrefix(stored,"{SHA256}"):
+      hash:=sha256.Sum256([]byte(password))
+      expected,actual=[]byte(stored[8:]),[]byte(base64.StdEncoding.EncodeToString(hash[:]))
+    default:
+      expected,actual=[]byte(stored),[]byte(password)
+  }
+  return subtle.ConstantTimeCompare(expected,actual)==1
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "encoding/base64"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+)
+
+
+func writeCredentialsFile(t *testing.T, content string) (string,func()) {
+  directory,_:=ioutil.TempDir("","hopgoblin-auth")
+  filename:=filepath.Join(directory,"proxy_users")
+  if err:=ioutil.WriteFile(filename,[]byte(content),0600);err!=nil {
+    t.Fatalf("could not write credentials file: %s",err)
+  }
+  return filename,func() { os.RemoveAll(directory) }
+}
+
+func createAuthenticatedRequest(user string, password string) *Request {
+  request:=ParseRequest("GET http://example.com/ HTTP/1.1\r\n\r\n")
+  request.Headers.Set("Proxy-Authorization","Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+password)))
+  return request
+}
+
+/*
+  Makes sure plain and hashed passwords are checked, and invalid credentials are rejected.
+ */
+func TestProxyAuthenticator(t *testing.T) {
+  filename,cleanup:=writeCredentialsFile(t,"# test users\n\nalice:secret\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"+
+                                          "carol:{SHA256}K7gNU3sdo+OL0wNhqoVWhr3g6s1xYv72ol/pe/Unols=\n")
+  defer cleanup()
+  authenticator,err:=NewProxyAuthenticator(filename,"test")
+  if !assert.Nil(t,err) {
+    return
+  }
+
+  cases:=[]struct {
+    user string
+    password string
+    valid bool
+  } {
+    {"alice","secret",true},
+    {"alice","Secret",false},
+    {"bob","secret",true},
+    {"bob","{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",false},
+    {"carol","secret",true},
+    {"carol","secre",false},
+    {"dave","secret",false},
+    {"","secret",false},
+  }
+  for _,c:=range cases {
+    user,valid:=authenticator.Authenticate(createAuthenticatedRequest(c.user,c.password))
+    assert.Equal(t,c.valid,valid,"%s:%s",c.user,c.password)
+    assert.Equal(t,c.user,user)
+  }
+
+  for _,header:=range []string{"","Basic","Digest YWxpY2U6c2VjcmV0","Basic !!!","Basic YWxpY2U="} {
+    request:=ParseRequest("GET http://example.com/ HTTP/1.1\r\n\r\n")
+    if header!="" {
+      request.Headers.Set("Proxy-Authorization",header)
+    }
+    _,valid:=authenticator.Authenticate(request)
+    assert.False(t,valid,"header %q should be rejected",header)
+  }
+
+  response:=authenticator.CreateChallengeResponse()
+  assert.Equal(t,uint16(407),response.Status)
+  challenge,_:=response.Headers.Get("Proxy-Authenticate")
+  assert.Equal(t,`Basic realm="test", charset="UTF-8"`,challenge)
+}
+
+/*
+  Makes sure invalid and missing credentials files are reported.
+ */
+func TestProxyAuthenticatorInvalidFile(t *testing.T) {
+  filename,cleanup:=writeCredentialsFile(t,"alice:secret\nbob\n")
+  defer cleanup()
+  _,err:=NewProxyAuthenticator(filename,"test")
+  assert.NotNil(t,err)
+  _,err=NewProxyAuthenticator(filename+".missing","test")
+  assert.NotNil(t,err)
+}
@@ -4,17 +4,83 @@
 package http
 
 import (
+  "encoding/base64"
+  "errors"
   "fmt"
+  "net"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
   "github.com/rinusser/hopgoblin/utils"
 )
 
 
 /*
   Proxy settings for HTTP clients.
+
+  Requests are sent through the Upstreams, or the upstream proxy at Host/Port if there are none, unless one of the Routes matches
+  the target host first. Without either requests are sent to their target hosts directly. A nil *ProxySettings means all requests
+  are sent directly.
+
+  If there are multiple upstream proxies to choose from the Strategy decides which one is tried first, the others are tried in turn
+  if the proxy can't be reached. Unreachable proxies are ejected for EjectTime, i.e. only tried once all others failed as well.
  */
 type ProxySettings struct {
   Host string
   Port int
+  Scheme string               //protocol of the upstream proxy at Host/Port, see ProxyUpstream
+  User string                 //credentials for the upstream proxy at Host/Port, none are sent if User is empty
+  Password string
+  Upstreams []*ProxyUpstream  //upstream proxies to use instead of Host/Port
+  Strategy UpstreamStrategy   //how to pick from multiple upstream proxies
+  Routes []ProxyRoute         //per-host rules, checked in order before falling back to Upstreams or Host/Port
+  EjectTime time.Duration     //how long to avoid unreachable upstream proxies, 0 to keep trying them first
+  HealthCheckInterval time.Duration //time between health checks of all upstream proxies, 0 to disable health checks
+  HealthCheckTarget string    //host:port to open tunnels to for health checks, empty to just connect to the proxies
+}
+
+/*
+  Per-host upstream proxy rule.
+ */
+type ProxyRoute struct {
+  Hosts *regexp.Regexp        //target hostnames this rule applies to
+  Upstreams []*ProxyUpstream  //upstream proxies to pick from, empty for direct connections
+}
+
+/*
+  An upstream proxy along with its credentials: either an HTTP proxy, getting the credentials in the Proxy-Authorization header,
+  or a SOCKS5 proxy using username/password authentication.
+ */
+type ProxyUpstream struct {
+  Name string      //the upstream's name in the configuration, empty for unnamed upstreams
+  Host string
+  Port int
+  Scheme string    //the proxy's protocol: HTTPProxyScheme (also if empty) or SOCKS5ProxyScheme
+  User string      //user name to authenticate with, no credentials are sent if empty
+  Password string
+}
+
+/*
+  Upstream proxy schemes.
+ */
+const (
+  HTTPProxyScheme="http"     //HTTP proxy: plain requests are forwarded with absolute URLs, SSL requests use CONNECT tunnels
+  SOCKS5ProxyScheme="socks5" //SOCKS5 proxy: all requests use SOCKS5 tunnels to the target host
+)
+
+
+/*
+  The default time unreachable upstream proxies are ejected for. Only used as fallback if no other value could be found.
+ */
+var DefaultUpstreamEjectTime=30*time.Second
+
+
+func init() {
+  utils.AddConfigValidator("proxy.",func(values map[string]string) error {
+    _,err:=parseProxySettings(values)
+    return err
+  })
 }
 
 
@@ -23,27 +89,392 @@ type ProxySettings struct {
  */
 func NewProxySettings(host string, port int) *ProxySettings {
   if port<1 || port>65535 {
-    panic("invalid TCP port: "+string(port))
+    panic("invalid TCP port: "+strconv.Itoa(port))
   }
   return &ProxySettings {
     Host: host,
     Port: port,
+    EjectTime: DefaultUpstreamEjectTime,
   }
 }
 
 /*
-  Fetches the default upstream proxy settings.
+  Fetches the default upstream proxy settings. Returns nil if requests should be sent to their target hosts directly.
+
+  The proxy.mode configuration setting selects between "direct", "upstream" (a single proxy at proxy.host and proxy.port) and
+  "rules" (per-host proxy.route.<n> rules). If the mode isn't set it defaults to "upstream" if a proxy host is set, otherwise to
+  "direct". Credentials for the proxy at proxy.host are set in proxy.user and proxy.password, proxy.scheme selects between "http"
+  (default) and "socks5" proxies.
+
+  Named upstream proxies are defined in the form of proxy.upstream.<name>=[<scheme>://]<host>:<port> [<user>:<password>]. Both
+  proxy.upstreams and rules can list several upstream proxies, separated by commas, to pick from with the proxy.strategy:
+  "failover" (default), "round_robin" or "least_connections". Unreachable proxies are ejected for proxy.eject_time seconds,
+  proxy.health_check_interval enables regular health checks, through tunnels to proxy.health_check_target if set.
+
+  Panics if the settings are invalid. Reloaded configurations with invalid proxy settings are rejected, so this only happens if
+  the configuration was invalid at startup.
  */
 func GetDefaultProxySettings() *ProxySettings {
-  host:=utils.GetConfigValue("proxy.host")
-  portstr:=utils.GetConfigValue("proxy.port")
-  if len(host)<1 || len(portstr)<1 {
-    panic("invalid proxy settings: host="+host+", port="+portstr)
+  rv,err:=parseProxySettings(utils.GetConfigValuesByPrefix("proxy."))
+  if err!=nil {
+    panic("invalid proxy settings: "+err.Error())
   }
-  port:=0
-  fmt.Sscanf(portstr,"%d",&port)
-  if port<1 || port>65535 {
-    panic("invalid proxy port \""+portstr+"%s\"")
+  return rv
+}
+
+/*
+  Parses proxy settings from the values of all "proxy." settings with the prefix removed.
+ */
+func parseProxySettings(values map[string]string) (*ProxySettings,error) {
+  mode:=strings.ToLower(values["mode"])
+  host:=values["host"]
+  if mode=="" {
+    if host=="" && values["upstreams"]=="" {
+      mode="direct"
+    } else {
+      mode="upstream"
+    }
+  }
+  if mode=="direct" {
+    return nil,nil
+  } else if mode!="upstream" && mode!="rules" {
+    return nil,errors.New("unknown proxy mode \""+mode+"\"")
+  }
+
+  rv,err:=parseUpstreamSelection(values)
+  if err!=nil {
+    return nil,err
+  }
+  upstreams,err:=parseProxyUpstreams(getValuesByPrefix(values,"upstream."))
+  if err!=nil {
+    return nil,err
+  }
+  if values["upstreams"]!="" {
+    rv.Upstreams,err=resolveProxyUpstreams(values["upstreams"],upstreams)
+    if err!=nil {
+      return nil,fmt.Errorf("proxy upstreams: %s",err)
+    }
+  } else if host!="" || mode=="upstream" {
+    rv.Port,err=parseProxyPort(host,values["port"])
+    if err!=nil {
+      return nil,err
+    }
+    rv.Host=host
+    rv.Scheme,err=parseProxyScheme(values["scheme"])
+    if err!=nil {
+      return nil,err
+    }
+    rv.User,rv.Password=values["user"],values["password"]
+  }
+  if mode=="rules" {
+    rv.Routes,err=parseProxyRoutes(getValuesByPrefix(values,"route."),upstreams)
+    if err!=nil {
+      return nil,err
+    }
+  }
+  return rv,nil
+}
+
+/*
+  Parses the settings for picking from multiple upstream proxies and ejecting unreachable ones.
+ */
+func parseUpstreamSelection(values map[string]string) (*ProxySettings,error) {
+  rv:=&ProxySettings{EjectTime:DefaultUpstreamEjectTime}
+  var err error
+  if values["strategy"]!="" {
+    rv.Strategy,err=ParseUpstreamStrategy(values["strategy"])
+    if err!=nil {
+      return nil,err
+    }
+  }
+  if values["eject_time"]!="" {
+    rv.EjectTime,err=parseProxySeconds("eject_time",values["eject_time"])
+    if err!=nil {
+      return nil,err
+    }
+  }
+  if values["health_check_interval"]!="" {
+    rv.HealthCheckInterval,err=parseProxySeconds("health_check_interval",values["health_check_interval"])
+    if err!=nil {
+      return nil,err
+    }
+  }
+  if target:=values["health_check_target"];target!="" {
+    if _,_,err=net.SplitHostPort(target);err!=nil {
+      return nil,fmt.Errorf("invalid health_check_target \"%s\"",target)
+    }
+    rv.HealthCheckTarget=target
+  }
+  return rv,nil
+}
+
+func parseProxySeconds(name string, value string) (time.Duration,error) {
+  seconds,err:=strconv.Atoi(value)
+  if err!=nil || seconds<0 {
+    return 0,fmt.Errorf("invalid %s \"%s\"",name,value)
+  }
+  return time.Duration(seconds)*time.Second,nil
+}
+
+func getValuesByPrefix(values map[string]string, prefix string) map[string]string {
+  rv:=make(map[string]string)
+  for key,value:=range values {
+    if strings.HasPrefix(key,prefix) {
+      rv[key[len(prefix):]]=value
+    }
+  }
+  return rv
+}
+
+func parseProxyPort(host string, portstr string) (int,error) {
+  if host=="" {
+    return 0,errors.New("missing proxy host")
+  }
+  port,err:=strconv.Atoi(portstr)
+  if err!=nil || port<1 || port>65535 {
+    return 0,errors.New("invalid proxy port \""+portstr+"\"")
+  }
+  return port,nil
+}
+
+func parseProxyScheme(scheme string) (string,error) {
+  switch strings.ToLower(scheme) {
+    case "",HTTPProxyScheme:
+      return HTTPProxyScheme,nil
+    case SOCKS5ProxyScheme:
+      return SOCKS5ProxyScheme,nil
+  }
+  return "",errors.New("unknown proxy scheme \""+scheme+"\"")
+}
+
+/*
+  Parses an upstream proxy's address and optional credentials, in the form of [<scheme>://]<host>:<port> [<user>:<password>].
+ */
+func parseProxyUpstream(name string, definition string) (*ProxyUpstream,error) {
+  fields:=strings.Fields(definition)
+  if len(fields)<1 || len(fields)>2 {
+    return nil,errors.New("must consist of address and optional credentials")
+  }
+  scheme,address:="",fields[0]
+  if pos:=strings.Index(address,"://");pos>=0 {
+    scheme,address=address[:pos],address[pos+3:]
+  }
+  host,portstr,err:=net.SplitHostPort(address)
+  if err!=nil {
+    return nil,fmt.Errorf("invalid address \"%s\"",address)
+  }
+  port,err:=parseProxyPort(host,portstr)
+  if err!=nil {
+    return nil,err
+  }
+  rv:=&ProxyUpstream{Name:name,Host:host,Port:port}
+  rv.Scheme,err=parseProxyScheme(scheme)
+  if err!=nil {
+    return nil,err
+  }
+  if len(fields)>1 {
+    parts:=strings.SplitN(fields[1],":",2)
+    if len(parts)!=2 || parts[0]=="" {
+      return nil,errors.New("credentials must be in the form of <user>:<password>")
+    }
+    rv.User,rv.Password=parts[0],parts[1]
+  }
+  return rv,nil
+}
+
+/*
+  Parses named upstream proxies, in the form of <name>=<host>:<port> [<user>:<password>]. Names are case-insensitive.
+ */
+func parseProxyUpstreams(upstreams map[string]string) (map[string]*ProxyUpstream,error) {
+  rv:=make(map[string]*ProxyUpstream)
+  for name,definition:=range upstreams {
+    name=strings.ToLower(name)
+    if name=="direct" || strings.Contains(name,":") {
+      return nil,fmt.Errorf("invalid proxy upstream name \"%s\"",name)
+    }
+    upstream,err:=parseProxyUpstream(name,definition)
+    if err!=nil {
+      return nil,fmt.Errorf("proxy upstream %s: %s",name,err)
+    }
+    rv[name]=upstream
+  }
+  return rv,nil
+}
+
+/*
+  Resolves a comma-separated list of upstream proxies, each either the name of an upstream proxy or an upstream proxy's host:port.
+ */
+func resolveProxyUpstreams(list string, upstreams map[string]*ProxyUpstream) ([]*ProxyUpstream,error) {
+  var rv []*ProxyUpstream
+  for _,item:=range strings.Split(list,",") {
+    if upstream,found:=upstreams[strings.ToLower(item)];found {
+      rv=append(rv,upstream)
+      continue
+    }
+    if !strings.Contains(item,":") {
+      return nil,fmt.Errorf("unknown upstream \"%s\"",item)
+    }
+    upstream,err:=parseProxyUpstream("",item)
+    if err!=nil {
+      return nil,err
+    }
+    rv=append(rv,upstream)
+  }
+  return rv,nil
+}
+
+/*
+  Parses per-host rules, in the form of <n>=<target> <host regex>. Targets are either "direct" or a comma-separated list of
+  upstream proxies, each either the name of an upstream proxy or an upstream proxy's host:port. Rules are sorted by their number.
+ */
+func parseProxyRoutes(routes map[string]string, upstreams map[string]*ProxyUpstream) ([]ProxyRoute,error) {
+  rules,err:=parseHostRules(routes,"proxy route")
+  if err!=nil {
+    return nil,err
+  }
+
+  var rv []ProxyRoute
+  for _,rule:=range rules {
+    route:=ProxyRoute{Hosts:rule.hosts}
+    if strings.ToLower(rule.target)!="direct" {
+      route.Upstreams,err=resolveProxyUpstreams(rule.target,upstreams)
+      if err!=nil {
+        return nil,fmt.Errorf("proxy route %d: %s",rule.number,err)
+      }
+    }
+    rv=append(rv,route)
+  }
+  return rv,nil
+}
+
+
+/*
+  Returns a snapshot copy of the settings, nil stays nil.
+ */
+func (this *ProxySettings) Copy() *ProxySettings {
+  if this==nil {
+    return nil
+  }
+  rv:=*this
+  rv.Routes=append([]ProxyRoute(nil),this.Routes...)
+  return &rv
+}
+
+/*
+  Determines the upstream proxies responsible for requests to the given target host, in the order they should be tried in
+  according to the Strategy. Ejected upstream proxies come last.
+  Returns an empty list if the target host should be connected to directly.
+ */
+func (this *ProxySettings) GetUpstreams(target string) []*ProxyUpstream {
+  if this==nil {
+    return nil
+  }
+  upstreams:=this.getDefaultUpstreams()
+  for _,route:=range this.Routes {
+    if route.Hosts.MatchString(target) {
+      upstreams=route.Upstreams
+      break
+    }
+  }
+  return orderUpstreams(upstreams,this.Strategy)
+}
+
+/*
+  Determines the upstream proxy to try first for requests to the given target host.
+  Returns nil if the target host should be connected to directly.
+ */
+func (this *ProxySettings) GetUpstream(target string) *ProxyUpstream {
+  upstreams:=this.GetUpstreams(target)
+  if len(upstreams)==0 {
+    return nil
+  }
+  return upstreams[0]
+}
+
+/*
+  Determines the upstream proxy address ("host:port") to try first for requests to the given target host.
+  Returns an empty string if the target host should be connected to directly.
+ */
+func (this *ProxySettings) GetUpstreamAddress(target string) string {
+  return this.GetUpstream(target).GetAddress()
+}
+
+/*
+  Returns all distinct upstream proxies the settings refer to, e.g. for health checks.
+ */
+func (this *ProxySettings) GetAllUpstreams() []*ProxyUpstream {
+  if this==nil {
+    return nil
+  }
+  var rv []*ProxyUpstream
+  known:=make(map[string]bool)
+  lists:=[][]*ProxyUpstream{this.getDefaultUpstreams()}
+  for _,route:=range this.Routes {
+    lists=append(lists,route.Upstreams)
+  }
+  for _,list:=range lists {
+    for _,upstream:=range list {
+      if !known[upstream.GetAddress()] {
+        known[upstream.GetAddress()]=true
+        rv=append(rv,upstream)
+      }
+    }
+  }
+  return rv
+}
+
+func (this *ProxySettings) getDefaultUpstreams() []*ProxyUpstream {
+  if len(this.Upstreams)>0 {
+    return this.Upstreams
+  } else if this.Host=="" {
+    return nil
+  }
+  return []*ProxyUpstream{&ProxyUpstream{Host:this.Host,Port:this.Port,Scheme:this.Scheme,User:this.User,Password:this.Password}}
+}
+
+func (this *ProxySettings) getEjectTime() time.Duration {
+  if this==nil {
+    return 0
+  }
+  return this.EjectTime
+}
+
+
+/*
+  Returns the upstream proxy's address ("host:port"), or an empty string for nil.
+ */
+func (this *ProxyUpstream) GetAddress() string {
+  if this==nil {
+    return ""
+  }
+  return net.JoinHostPort(this.Host,strconv.Itoa(this.Port))
+}
+
+/*
+  Whether the upstream proxy is a SOCKS5 proxy, false for nil.
+ */
+func (this *ProxyUpstream) IsSOCKS5() bool {
+  return this!=nil && this.Scheme==SOCKS5ProxyScheme
+}
+
+/*
+  Returns the upstream proxy's identity for the connection pool: connections through proxies with the same address but different
+  schemes can't be used interchangeably.
+ */
+func (this *ProxyUpstream) getPoolAddress() string {
+  if this.IsSOCKS5() {
+    return SOCKS5ProxyScheme+"://"+this.GetAddress()
+  }
+  return this.GetAddress()
+}
+
+/*
+  Returns the Proxy-Authorization header value for the upstream proxy's credentials, or an empty string if there are none or the
+  upstream proxy isn't an HTTP proxy.
+ */
+func (this *ProxyUpstream) GetAuthorization() string {
+  if this==nil || this.User=="" || this.IsSOCKS5() {
+    return ""
   }
-  return NewProxySettings(host,port)
+  return "Basic "+base64.StdEncoding.EncodeToString([]byte(this.User+":"+this.Password))
 }
@@ -0,0 +1,239 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "time"
+)
+
+
+/*
+  Makes sure the proxy mode is selected correctly, and missing upstream settings don't cause errors in direct mode.
+ */
+func TestParseProxySettingsModes(t *testing.T) {
+  settings,err:=parseProxySettings(nil)
+  assert.Nil(t,err)
+  assert.Nil(t,settings,"missing proxy host should have defaulted to direct mode")
+
+  settings,err=parseProxySettings(map[string]string{"mode":"Direct","host":"127.0.0.1","port":"3128"})
+  assert.Nil(t,err)
+  assert.Nil(t,settings,"direct mode should have ignored proxy host")
+
+  settings,err=parseProxySettings(map[string]string{"host":"127.0.0.1","port":"3128"})
+  assert.Nil(t,err)
+  assert.Equal(t,"127.0.0.1:3128",settings.GetUpstreamAddress("example.com"))
+
+  cases:=[][]string {
+    //mode        host          port
+    {"upstream",  "",           "3128"},
+    {"upstream",  "127.0.0.1",  ""},
+    {"upstream",  "127.0.0.1",  "65536"},
+    {"rules",     "127.0.0.1",  "x"},
+    {"sideways",  "",           ""},
+  }
+  for _,c:=range cases {
+    _,err=parseProxySettings(map[string]string{"mode":c[0],"host":c[1],"port":c[2]})
+    assert.NotNil(t,err,"%v should have failed",c)
+  }
+}
+
+/*
+  Makes sure per-host rules are checked in numerical order, falling back to the default upstream proxy if there is one.
+ */
+func TestProxySettingsRoutes(t *testing.T) {
+  routes:=map[string]string {
+    "mode":"rules",
+    "route.10":"direct \\.local$",
+    "route.2":"10.0.0.1:8080 ^proxied\\.local$",
+    "route.3":"[::1]:3128 ^ipv6\\.",
+  }
+  settings,err:=parseProxySettings(routes)
+  assert.Nil(t,err)
+  assert.Equal(t,"10.0.0.1:8080",settings.GetUpstreamAddress("proxied.local"))
+  assert.Equal(t,"",settings.GetUpstreamAddress("direct.local"))
+  assert.Equal(t,"[::1]:3128",settings.GetUpstreamAddress("ipv6.example.com"))
+  assert.Equal(t,"",settings.GetUpstreamAddress("example.com"),"unmatched host should have been direct without default")
+
+  routes["host"]="127.0.0.1"
+  routes["port"]="3128"
+  settings,err=parseProxySettings(routes)
+  assert.Nil(t,err)
+  assert.Equal(t,"127.0.0.1:3128",settings.GetUpstreamAddress("example.com"),"unmatched host should have used default")
+  assert.Equal(t,"",settings.GetUpstreamAddress("direct.local"))
+
+  invalid:=[]map[string]string {
+    {"route.x":"direct ."},
+    {"route.1":"direct"},
+    {"route.1":"direct ("},
+    {"route.1":"localhost ."},
+    {"route.1":"localhost:0 ."},
+  }
+  for _,routes:=range invalid {
+    routes["mode"]="rules"
+    _,err=parseProxySettings(routes)
+    assert.NotNil(t,err,"%v should have failed",routes)
+  }
+}
+
+/*
+  Makes sure nil settings mean direct connections.
+ */
+func TestNilProxySettings(t *testing.T) {
+  var settings *ProxySettings
+  assert.Equal(t,"",settings.GetUpstreamAddress("example.com"))
+  assert.Nil(t,settings.Copy())
+}
+
+/*
+  Makes sure upstream proxy credentials are parsed and routes can refer to named upstream proxies.
+ */
+func TestProxySettingsUpstreams(t *testing.T) {
+  settings,err:=parseProxySettings(map[string]string{"host":"127.0.0.1","port":"3128","user":"alice","password":"s:cret"})
+  assert.Nil(t,err)
+  upstream:=settings.GetUpstream("example.com")
+  assert.Equal(t,"127.0.0.1:3128",upstream.GetAddress())
+  assert.Equal(t,"Basic YWxpY2U6czpjcmV0",upstream.GetAuthorization())
+
+  settings,err=parseProxySettings(map[string]string {
+    "mode":"rules",
+    "host":"127.0.0.1",
+    "port":"3128",
+    "upstream.corp":"10.0.0.1:8080 bob:pa:ss",
+    "upstream.open":"[::1]:3129",
+    "route.1":"direct ^intranet\\.",
+    "route.2":"Corp \\.corp\\.example$",
+    "route.3":"open \\.example$",
+  })
+  assert.Nil(t,err)
+  upstream=settings.GetUpstream("www.corp.example")
+  if assert.NotNil(t,upstream) {
+    assert.Equal(t,"corp",upstream.Name)
+    assert.Equal(t,"10.0.0.1:8080",upstream.GetAddress())
+    assert.Equal(t,"bob",upstream.User)
+    assert.Equal(t,"pa:ss",upstream.Password)
+  }
+  assert.Equal(t,"[::1]:3129",settings.GetUpstreamAddress("www.example"))
+  assert.Equal(t,"",settings.GetUpstream("www.example").GetAuthorization(),"upstream without credentials shouldn't have authorization")
+  assert.Nil(t,settings.GetUpstream("intranet.example"),"direct route should have returned no upstream")
+  assert.Equal(t,"",settings.GetUpstream("example.com").GetAuthorization(),"default upstream has no credentials")
+
+  invalid:=[]map[string]string {
+    {"route.1":"missing ."},
+    {"upstream.direct":"127.0.0.1:3128","route.1":"direct ."},
+    {"upstream.corp":"127.0.0.1","route.1":"corp ."},
+    {"upstream.corp":"127.0.0.1:3128 bob","route.1":"corp ."},
+    {"upstream.corp":"127.0.0.1:3128 :pass","route.1":"corp ."},
+    {"upstream.corp":"127.0.0.1:3128 bob:pass extra","route.1":"corp ."},
+  }
+  for _,values:=range invalid {
+    values["mode"]="rules"
+    _,err=parseProxySettings(values)
+    assert.NotNil(t,err,"%v should have failed",values)
+  }
+}
+
+/*
+  Makes sure lists of upstream proxies and the settings for picking from them are parsed.
+ */
+func TestProxySettingsUpstreamLists(t *testing.T) {
+  settings,err:=parseProxySettings(map[string]string {
+    "upstreams":"first,10.0.0.2:3128",
+    "upstream.first":"10.0.0.1:3128 alice:secret",
+    "strategy":"Round_Robin",
+    "eject_time":"5",
+    "health_check_interval":"10",
+    "health_check_target":"example.com:443",
+  })
+  if !assert.Nil(t,err) {
+    return
+  }
+  assert.Equal(t,UpstreamRoundRobin,settings.Strategy)
+  assert.Equal(t,5*time.Second,settings.EjectTime)
+  assert.Equal(t,10*time.Second,settings.HealthCheckInterval)
+  assert.Equal(t,"example.com:443",settings.HealthCheckTarget)
+  if assert.Equal(t,2,len(settings.Upstreams)) {
+    assert.Equal(t,"first",settings.Upstreams[0].Name)
+    assert.Equal(t,"alice",settings.Upstreams[0].User)
+    assert.Equal(t,"10.0.0.2:3128",settings.Upstreams[1].GetAddress())
+  }
+
+  settings,err=parseProxySettings(map[string]string {
+    "mode":"rules",
+    "upstreams":"10.0.0.1:3128",
+    "host":"127.0.0.1",
+    "port":"3128",
+    "upstream.corp":"10.0.1.1:3128",
+    "route.1":"corp,10.0.1.2:3128 \\.corp$",
+  })
+  if !assert.Nil(t,err) {
+    return
+  }
+  assert.Equal(t,UpstreamFailover,settings.Strategy,"strategy should have defaulted to failover")
+  assert.Equal(t,DefaultUpstreamEjectTime,settings.EjectTime)
+  assert.Equal(t,time.Duration(0),settings.HealthCheckInterval,"health checks should have been disabled by default")
+  assert.Equal(t,"",settings.Host,"upstream list should have replaced proxy host")
+  var addresses []string
+  for _,upstream:=range settings.GetAllUpstreams() {
+    addresses=append(addresses,upstream.GetAddress())
+  }
+  assert.Equal(t,[]string{"10.0.0.1:3128","10.0.1.1:3128","10.0.1.2:3128"},addresses)
+
+  invalid:=[]map[string]string {
+    {"upstreams":"missing"},
+    {"upstreams":"10.0.0.1:3128,"},
+    {"host":"127.0.0.1","port":"3128","strategy":"random"},
+    {"host":"127.0.0.1","port":"3128","eject_time":"-1"},
+    {"host":"127.0.0.1","port":"3128","health_check_interval":"x"},
+    {"host":"127.0.0.1","port":"3128","health_check_target":"example.com"},
+    {"mode":"rules","route.1":"direct,10.0.0.1:3128 ."},
+  }
+  for _,values:=range invalid {
+    _,err=parseProxySettings(values)
+    assert.NotNil(t,err,"%v should have failed",values)
+  }
+}
+
+/*
+  Makes sure upstream proxy schemes are parsed, and SOCKS5 proxies don't get Proxy-Authorization headers.
+ */
+func TestProxySettingsSchemes(t *testing.T) {
+  settings,err:=parseProxySettings(map[string]string{"host":"127.0.0.1","port":"1080","scheme":"SOCKS5","user":"alice"})
+  if assert.Nil(t,err) {
+    upstream:=settings.GetUpstream("example.com")
+    assert.True(t,upstream.IsSOCKS5())
+    assert.Equal(t,"alice",upstream.User)
+    assert.Equal(t,"",upstream.GetAuthorization(),"SOCKS5 proxy shouldn't get an HTTP authorization")
+    assert.Equal(t,"socks5://127.0.0.1:1080",upstream.getPoolAddress())
+  }
+
+  settings,err=parseProxySettings(map[string]string {
+    "mode":"rules",
+    "upstream.egress":"socks5://10.0.0.1:1080 bob:secret",
+    "route.1":"egress,http://10.0.0.2:3128,socks5://[::1]:1080 .",
+  })
+  if assert.Nil(t,err) {
+    upstreams:=settings.Routes[0].Upstreams
+    assert.Equal(t,[]string{"10.0.0.1:1080","10.0.0.2:3128","[::1]:1080"},getUpstreamAddresses(upstreams))
+    assert.True(t,upstreams[0].IsSOCKS5())
+    assert.Equal(t,"bob",upstreams[0].User)
+    assert.Equal(t,HTTPProxyScheme,upstreams[1].Scheme)
+    assert.True(t,upstreams[2].IsSOCKS5())
+  }
+
+  var upstream *ProxyUpstream
+  assert.False(t,upstream.IsSOCKS5())
+  assert.False(t,NewProxySettings("127.0.0.1",3128).GetUpstream("example.com").IsSOCKS5(),"scheme should have defaulted to HTTP")
+
+  invalid:=[]map[string]string {
+    {"host":"127.0.0.1","port":"1080","scheme":"socks4"},
+    {"upstreams":"ftp://127.0.0.1:1080"},
+    {"upstreams":"socks5://127.0.0.1"},
+  }
+  for _,values:=range invalid {
+    _,err=parseProxySettings(values)
+    assert.NotNil(t,err,"%v should have failed",values)
+  }
+}
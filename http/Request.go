@@ -4,6 +4,9 @@
 package http
 
 import (
+  "bufio"
+  "bytes"
+  "errors"
   "fmt"
   "strings"
   "github.com/rinusser/hopgoblin/log"
@@ -17,6 +20,8 @@ type Request struct {
   Method string  //e.g. "PUT"
   Url string     //e.g. "/api/items/new"
   IsSSL bool     //e.g. true
+  ID string      //correlation ID assigned by the Server, e.g. "5f3a9c01-17-2"; empty for requests created elsewhere
+  User string    //the proxy user the client authenticated as, empty without proxy authentication
   message
 }
 
@@ -24,10 +29,23 @@ type Request struct {
   Parses a string into a Request instance.
  */
 func ParseRequest(input string) *Request {
+  return ParseRequestBytes([]byte(input))
+}
+
+/*
+  Parses raw message data into a Request instance. The body is kept byte-exact.
+ */
+func ParseRequestBytes(input []byte) *Request {
+  rv:=parseRequestMessage(ParseMessageBytes(input))
+  if rv==nil {
+    log.Debug("could not parse HTTP request")
+  }
+  return rv
+}
+
+func parseRequestMessage(message *message) *Request {
   var rv Request
-  message:=ParseMessage(input)
   if message==nil || len(message.firstLineParts)!=3 {
-    log.Debug("could not parse HTTP request")
     return nil
   }
 
@@ -40,13 +58,106 @@ func ParseRequest(input string) *Request {
 }
 
 /*
-  Turns a Request instance into a string, ready for transmission to a server.
+  Returned by ReadRequest() for requests whose transfer codings don't frame the body, see hasValidRequestFraming(). The request's
+  end can't be determined, so the connection can't be used for further requests.
  */
-func (request *Request) ToString() string {
+var errUnframedRequestBody=errors.New("request body framed by unsupported Transfer-Encoding")
+
+/*
+  Reads an HTTP request from the input stream.
+  Only the request header is read: the body is left in the stream and made available in the request's BodyStream.
+  Requests with transfer codings other than a final "chunked" are rejected, since their body's end is unknown. So are requests
+  without transfer codings whose Content-Length header is invalid, see getContentLength().
+ */
+func ReadRequest(in *bufio.Reader) (*Request,error) {
+  return readRequest(in,log.CorrelatedLogger{})
+}
+
+func readRequest(in *bufio.Reader, logger log.CorrelatedLogger) (*Request,error) {
+  header,err:=readHTTPMessageHeaderBytes(in,logger)
+  if err!=nil {
+    return nil,err
+  }
+  request:=parseRequestMessage(parseMessageHeader(header,nil))
+  if request==nil {
+    return nil,errors.New("could not parse request")
+  }
+  if !hasValidRequestFraming(request.Headers) {
+    return nil,errUnframedRequestBody
+  }
+  if _,found:=getTransferFraming(request.Headers);!found {
+    if _,_,err=getContentLength(request.Headers);err!=nil {
+      return nil,err
+    }
+  }
+  request.BodyStream=newBodyReader(in,request.Headers,false,nil,logger)
+  return request,nil
+}
+
+/*
+  Returns a logger including the request's correlation ID in each message. Site handlers and middleware should log messages about
+  the request through it.
+ */
+func (request *Request) Logger() log.CorrelatedLogger {
+  return log.WithCorrelationID(request.ID)
+}
+
+/*
+  Determines the request's target hostname, without port: SSL requests use the Host header, plain requests the request URL (or
+  the Host header for relative URLs). Returns an empty string if the target host can't be determined.
+ */
+func (request *Request) GetTargetHost() string {
+  host,_,_:=getTargetAddress(request)
+  return host
+}
+
+/*
+  Builds the request's absolute URL: requests received inside CONNECT tunnels, or sent to origin servers, only contain the path
+  and are completed with the Host header.
+ */
+func (request *Request) GetAbsoluteUrl() string {
+  if strings.Contains(request.Url,"://") {
+    return request.Url
+  }
+  scheme:="http://"
+  if request.IsSSL {
+    scheme="https://"
+  }
+  host,_:=request.Headers.Get("Host")
+  return scheme+host+request.Url
+}
+
+func (request *Request) headerString() string {
   var rvs strings.Builder
   rvs.WriteString(fmt.Sprintf("%s %s HTTP/1.1\r\n",request.Method,request.Url))
   rvs.WriteString(request.Headers.ToString())
   rvs.WriteString("\r\n")
-  rvs.Write(request.Body)
   return rvs.String()
 }
+
+/*
+  Turns a Request instance into a string, ready for transmission to a server.
+  Any streamed body will be read into the Body field first.
+ */
+func (request *Request) ToString() string {
+  return string(request.Bytes())
+}
+
+/*
+  Turns a Request instance into raw message data, ready for transmission to a server. The body is kept byte-exact.
+  Any streamed body will be read into the Body field first.
+ */
+func (request *Request) Bytes() []byte {
+  request.ReadBody()
+  var rv bytes.Buffer
+  rv.WriteString(request.headerString())
+  rv.Write(request.Body)
+  return rv.Bytes()
+}
+
+/*
+  Sends the request to the given output, streaming the body as it is read.
+ */
+func (request *Request) Write(out *bufio.Writer) error {
+  return request.writeTo(out,request.headerString())
+}
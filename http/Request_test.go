@@ -6,6 +6,10 @@ package http
 import (
   "testing"
   "github.com/stretchr/testify/assert"
+  "bufio"
+  "bytes"
+  "strconv"
+  "strings"
 )
 
 
@@ -27,7 +31,8 @@ func TestParseRequest(t *testing.T) {
   expected_headers:=NewHeaders()
   expected_headers.Set("Accept-Encoding","plain")
   expected_headers.Set("X-Some-Header","yoyo: 1")
-  assert.Equal(t,expected_headers,actual.Headers,"headers")
+  assert.True(t,expected_headers.Equals(actual.Headers),"headers")
+  assert.Equal(t,"X-Some-Header: yoyo: 1\r\nAccept-Encoding: plain\r\n",actual.Headers.ToString(),"header order")
   assert.Equal(t,[]byte("invalid body\rxx\nasdf\r\nfin"),actual.Body,"request body")
 }
 
@@ -62,7 +67,117 @@ func TestRequestToString(t *testing.T) {
   input.Headers.Set("Im-A-Header","true")
 
   actual:=input.ToString()
-  expected:="DOALREADY uri://some/crap HTTP/1.1\r\nIm-A-Header: true\r\nLet-It-Be: atles\r\n\r\nyou\nhit\rpay\n\rdirt\t"
+  expected:="DOALREADY uri://some/crap HTTP/1.1\r\nLet-It-Be: atles\r\nIm-A-Header: true\r\n\r\nyou\nhit\rpay\n\rdirt\t"
   assert.Equal(t,expected,actual,"request body")
 }
 
+
+
+/*
+  Makes sure ReadRequest() leaves the request body in the body stream, and stops reading at the end of the request.
+ */
+func TestReadRequest(t *testing.T) {
+  input:="POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\ndataGET /next HTTP/1.1\r\n\r\n"
+  in:=bufio.NewReader(strings.NewReader(input))
+
+  request,err:=ReadRequest(in)
+  assert.Nil(t,err)
+  assert.Equal(t,"POST",request.Method)
+  assert.Equal(t,"/upload",request.Url)
+  assert.Equal(t,0,len(request.Body),"body shouldn't have been read yet")
+  body,err:=request.ReadBody()
+  assert.Nil(t,err)
+  assert.Equal(t,"data",string(body))
+
+  request,err=ReadRequest(in)
+  assert.Nil(t,err)
+  assert.Equal(t,"/next",request.Url)
+  body,_=request.ReadBody()
+  assert.Equal(t,0,len(body))
+}
+
+/*
+  Makes sure ReadRequest() rejects requests with invalid or conflicting Content-Length headers, unless transfer codings frame the
+  body instead.
+ */
+func TestReadRequestInvalidContentLength(t *testing.T) {
+  headers:=[]string {
+    "Content-Length: abc",
+    "Content-Length: -5",
+    "Content-Length: 10, 20",
+    "Content-Length: 10\r\nContent-Length: 20",
+  }
+  for _,header:=range headers {
+    _,err:=ReadRequest(bufio.NewReader(strings.NewReader("POST /upload HTTP/1.1\r\n"+header+"\r\n\r\n0123456789")))
+    assert.Equal(t,errInvalidContentLength,err,header)
+  }
+
+  input:="POST /upload HTTP/1.1\r\nContent-Length: 10, 20\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nab\r\n0\r\n\r\n"
+  request,err:=ReadRequest(bufio.NewReader(strings.NewReader(input)))
+  if assert.Nil(t,err,"Content-Length should have been ignored for chunked request") {
+    body,_:=request.ReadBody()
+    assert.Equal(t,"2\r\nab\r\n0\r\n\r\n",string(body))
+  }
+}
+
+
+func allByteValues() []byte {
+  rv:=make([]byte,256)
+  for tc:=range rv {
+    rv[tc]=byte(tc)
+  }
+  return append(rv,[]byte("\r\n\r\n\n\n\x00\xff")...)
+}
+
+/*
+  Makes sure ParseRequestBytes() keeps binary bodies byte-exact, regardless of the header's line endings.
+ */
+func TestParseRequestBytesBinaryBody(t *testing.T) {
+  body:=allByteValues()
+  headers:=[]string {
+    "PUT /upload HTTP/1.1\r\nContent-Type: application/octet-stream\r\n\r\n",
+    "PUT /upload HTTP/1.1\nContent-Type: application/octet-stream\n\n",
+    "PUT /upload HTTP/1.1\r\nContent-Type: application/octet-stream\n\r\n",
+  }
+  for _,header:=range headers {
+    actual:=ParseRequestBytes(append([]byte(header),body...))
+    assert.NotNil(t,actual,"%q",header)
+    assert.Equal(t,"/upload",actual.Url,"%q",header)
+    value,_:=actual.Headers.Get("Content-Type")
+    assert.Equal(t,"application/octet-stream",value,"%q",header)
+    assert.Equal(t,body,actual.Body,"body of %q",header)
+  }
+}
+
+/*
+  Makes sure .Bytes() writes binary bodies byte-exact, and ReadRequest() reads them back the same.
+ */
+func TestRequestBytesRoundTrip(t *testing.T) {
+  input:=Request {
+    Method:"POST",
+    Url:"/binary",
+    message: message {
+      Headers:NewHeaders(),
+      Body:allByteValues(),
+    },
+  }
+  input.Headers.Set("Content-Length",strconv.Itoa(len(input.Body)))
+
+  actual,err:=ReadRequest(bufio.NewReader(bytes.NewReader(input.Bytes())))
+  assert.Nil(t,err)
+  body,err:=actual.ReadBody()
+  assert.Nil(t,err)
+  assert.Equal(t,input.Body,body)
+}
+
+/*
+  Makes sure .GetAbsoluteUrl() completes paths with scheme and Host header.
+ */
+func TestRequestGetAbsoluteUrl(t *testing.T) {
+  request:=ParseRequest("GET /path?q=1 HTTP/1.1\r\nHost: example.com:8080\r\n\r\n")
+  assert.Equal(t,"http://example.com:8080/path?q=1",request.GetAbsoluteUrl())
+  request.IsSSL=true
+  assert.Equal(t,"https://example.com:8080/path?q=1",request.GetAbsoluteUrl())
+  request.Url="http://other.com/"
+  assert.Equal(t,"http://other.com/",request.GetAbsoluteUrl(),"absolute URLs should be kept")
+}
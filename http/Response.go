@@ -4,10 +4,11 @@
 package http
 
 import (
+  "bufio"
   "bytes"
-  "compress/gzip"
+  "errors"
   "fmt"
-  "io/ioutil"
+  "strconv"
   "strings"
   "github.com/rinusser/hopgoblin/log"
 )
@@ -19,10 +20,12 @@ import (
 type Response struct {
   Status uint16  //e.g. 301
   message
+  timings *ExchangeTimings //upstream timings if the response was received by Client.ForwardRequest(), for captures
 }
 
 var statusMessages = map[uint16]string {
   200:"OK",
+  202:"Accepted",
   206:"Partial Content",
   301:"Moved Permanently",
   302:"Found",
@@ -34,12 +37,22 @@ var statusMessages = map[uint16]string {
   401:"Unauthorized",
   403:"Forbidden",
   404:"Not Found",
+  405:"Method Not Allowed",
+  407:"Proxy Authentication Required",
+  431:"Request Header Fields Too Large",
   500:"Internal Server Error",
   502:"Bad Gateway",
   503:"Service Unavailable",
   504:"Gateway Timeout",
 }
 
+/*
+  Returns the reason phrase for a status code, e.g. "Not Found" for 404. Returns an empty string for unknown codes.
+ */
+func StatusText(code uint16) string {
+  return statusMessages[code]
+}
+
 /*
   Creates a new HTTP instance, defaulting to status 200 (OK).
  */
@@ -75,9 +88,24 @@ func CreateSimpleResponse(code uint16) *Response {
   Parses a string into a Response instance.
  */
 func ParseResponse(input string) Response {
-  var rv Response
-  message:=ParseMessage(input)  //TODO: null check
+  return ParseResponseBytes([]byte(input))
+}
+
+/*
+  Parses raw message data into a Response instance. The body is kept byte-exact.
+  If the input isn't a valid HTTP response the returned instance has status 0 and no headers.
+ */
+func ParseResponseBytes(input []byte) Response {
+  parsed:=ParseMessageBytes(input)
+  if parsed==nil || len(parsed.firstLineParts)<2 {
+    log.Debug("could not parse HTTP response")
+    return Response{message:message{Headers:NewHeaders(),Body:[]byte{}}}
+  }
+  return parseResponseMessage(parsed)
+}
 
+func parseResponseMessage(message *message) Response {
+  var rv Response
   fmt.Sscanf(message.firstLineParts[1],"%d",&rv.Status)
   rv.Protocol=message.firstLineParts[0]
   rv.Headers=message.Headers
@@ -87,9 +115,91 @@ func ParseResponse(input string) Response {
 }
 
 /*
-  Generates a string representation of a Response instance into a string ready for transmission.
+  Reads an HTTP response from the input stream.
+  Only the response header is read: the body is left in the stream and made available in the response's BodyStream.
+
+  The request method is required to determine whether the response has a body, e.g. responses to HEAD requests never do.
  */
-func (response *Response) ToString() string {
+func ReadResponse(in *bufio.Reader, request_method string) (*Response,error) {
+  return readResponse(in,request_method,nil,log.CorrelatedLogger{})
+}
+
+func readResponse(in *bufio.Reader, request_method string, closer func() error, logger log.CorrelatedLogger) (*Response,error) {
+  header,err:=readHTTPMessageHeaderBytes(in,logger)
+  if err!=nil {
+    return nil,err
+  }
+  message:=parseMessageHeader(header,nil)
+  if message==nil || len(message.firstLineParts)<2 {
+    return nil,errors.New("could not parse response")
+  }
+  response:=parseResponseMessage(message)
+  if response.hasBody(request_method) {
+    if _,found:=getTransferFraming(response.Headers);!found {
+      if _,_,err=getContentLength(response.Headers);err!=nil {
+        return nil,err
+      }
+    }
+    response.BodyStream=newBodyReader(in,response.Headers,true,closer,logger)
+  } else {
+    response.BodyStream=newEmptyBodyReader(closer)
+  }
+  return &response,nil
+}
+
+func (response *Response) hasBody(request_method string) bool {
+  if request_method=="HEAD" || (request_method=="CONNECT" && response.Status>=200 && response.Status<300) {
+    return false
+  }
+  return response.Status>=200 && response.Status!=204 && response.Status!=304
+}
+
+/*
+  Makes sure the response's end can be determined without closing the connection: buffered bodies will get a Content-Length
+  header if neither it nor a Transfer-Encoding is set.
+  Returns false if the response body ends only when the connection is closed, e.g. because its last transfer coding isn't
+  "chunked".
+ */
+func (response *Response) makeSelfDelimiting(request_method string) bool {
+  if !response.hasBody(request_method) {
+    return true
+  }
+  if chunked,found_xfer_encoding:=getTransferFraming(response.Headers);found_xfer_encoding {
+    return chunked
+  }
+  if _,found_content_length:=response.Headers.Get("Content-Length");found_content_length {
+    return true
+  }
+  if response.BodyStream!=nil {
+    return false
+  }
+  response.Headers.Set("Content-Length",strconv.Itoa(len(response.Body)))
+  return true
+}
+
+/*
+  Checks whether the connection the response was received on can be used for further requests once the body is read.
+ */
+func (response *Response) allowsConnectionReuse(request_method string) bool {
+  connection,_:=response.Headers.Get("Connection")
+  connection=strings.ToLower(connection)
+  if strings.Contains(connection,"close") {
+    return false
+  }
+  if response.Protocol=="HTTP/1.0" && !strings.Contains(connection,"keep-alive") {
+    return false
+  }
+  if !response.hasBody(request_method) {
+    return true
+  }
+  if chunked,found_xfer_encoding:=getTransferFraming(response.Headers);found_xfer_encoding {
+    return chunked
+  }
+  _,found_content_length:=response.Headers.Get("Content-Length")
+  return found_content_length
+}
+
+func (response *Response) headerString() string {
   var rvs strings.Builder
   status_text,found:=statusMessages[response.Status]
   if !found {
@@ -98,56 +208,102 @@ func (response *Response) ToString() string {
   rvs.WriteString(fmt.Sprintf("%s %03d %s\r\n",response.Protocol,response.Status,status_text))
   rvs.WriteString(response.Headers.ToString())
   rvs.WriteString("\r\n")
-  rvs.Write(response.Body)
   return rvs.String()
 }
 
 /*
-  Gets the response body, with any transfer encoding and compression stripped off.
+  Generates a string representation of a Response instance into a string ready for transmission.
+  Any streamed body will be read into the Body field first.
  */
-func (this *Response) GetPlainTextBodyString() string {
-  body:=this.Body
-
-  transfer_decoders:=map[string]bodyDecoder {
-    "chunked":ChunkDecodeBody,
-  }
+func (response *Response) ToString() string {
+  return string(response.Bytes())
+}
 
-  content_decoders:=map[string]bodyDecoder {
-    "gzip":decompressGzip,
-  }
+/*
+  Turns a Response instance into raw message data, ready for transmission. The body is kept byte-exact.
+  Any streamed body will be read into the Body field first.
+ */
+func (response *Response) Bytes() []byte {
+  response.ReadBody()
+  var rv bytes.Buffer
+  rv.WriteString(response.headerString())
+  rv.Write(response.Body)
+  return rv.Bytes()
+}
 
-  body=decodeBody(body,this.Headers,"transfer-encoding",transfer_decoders)
-  body=decodeBody(body,this.Headers,"content-encoding",content_decoders)
+/*
+  Sends the response to the given output, streaming the body as it is read.
+ */
+func (response *Response) Write(out *bufio.Writer) error {
+  return response.writeTo(out,response.headerString())
+}
 
+/*
+  Gets the response body, with any transfer encoding and compression stripped off.
+ */
+func (this *Response) GetPlainTextBodyString() string {
+  body,err:=this.DecodeBody()
+  if err!=nil {
+    log.Warn("can't decode response body: %s",err)
+  }
   return string(body)
 }
 
-type bodyDecoder func([]byte)[]byte
-
-func decodeBody(body []byte, headers *Headers, header string, funcs map[string]bodyDecoder) []byte {
-  encoding,_:=headers.Get(header)
-  log.Trace("%s: '%s'",header,encoding)
-  f,found:=funcs[encoding]
-  if found {
-    body=f(body)
-  } else if encoding!="" {
-    log.Warn("unsupported %s \"%s\"",header,encoding)
+/*
+  Gets the response body with all transfer and content codings removed, e.g. "chunked" and "gzip". Any streamed body will be
+  read into the Body field first, the Body field itself stays unchanged.
+  Returns the body decoded as far as possible along with an error if a coding is unsupported or the data is invalid.
+ */
+func (this *Response) DecodeBody() ([]byte,error) {
+  body,err:=this.ReadBody()
+  if err!=nil {
+    return body,err
+  }
+  body,err=DecodeCodings(body,this.Headers.Values("Transfer-Encoding"))
+  if err!=nil {
+    return body,err
   }
-  return body
+  return DecodeCodings(body,this.Headers.Values("Content-Encoding"))
 }
 
-func decompressGzip(input []byte) []byte {
-  bytes_reader:=bytes.NewReader(input)
-  gzip_reader,err:=gzip.NewReader(bytes_reader)
+/*
+  Replaces the response body with the given plain data, encoded with a comma-separated list of content codings, e.g. "gzip" or
+  "deflate, br". An empty list sends the data unencoded.
+  The Content-Encoding and Content-Length headers are updated to match, any Transfer-Encoding is removed.
+ */
+func (this *Response) EncodeBody(plain []byte, content_encoding string) error {
+  var codings []string
+  for _,coding:=range strings.Split(content_encoding,",") {
+    coding=strings.ToLower(strings.TrimSpace(coding))
+    if coding!="" && coding!="identity" {
+      codings=append(codings,coding)
+    }
+  }
+  body,err:=EncodeCodings(plain,codings)
   if err!=nil {
-    log.Error("can't create gzip reader")
-    return input
+    return err
+  }
+
+  this.CloseBody()
+  this.Body=body
+  this.Headers.Del("Transfer-Encoding")
+  if len(codings)>0 {
+    this.Headers.Set("Content-Encoding",strings.Join(codings,", "))
+  } else {
+    this.Headers.Del("Content-Encoding")
   }
-  defer gzip_reader.Close()
-  plain,err:=ioutil.ReadAll(gzip_reader)
+  this.Headers.Set("Content-Length",strconv.Itoa(len(body)))
+  return nil
+}
+
+/*
+  Decodes the response body, passes it to the modifier and encodes the result again with the response's original content
+  codings. The body is left unchanged if it can't be decoded.
+ */
+func (this *Response) ModifyBody(modifier func([]byte) []byte) error {
+  plain,err:=this.DecodeBody()
   if err!=nil {
-    log.Warn("invalid gzip encoding")
-    return input
+    return err
   }
-  return plain
+  return this.EncodeBody(modifier(plain),strings.Join(this.Headers.Values("Content-Encoding"),","))
 }
@@ -6,7 +6,12 @@ package http
 import (
   "testing"
   "github.com/stretchr/testify/assert"
+  "bufio"
+  "bytes"
   "fmt"
+  "io"
+  "strconv"
+  "strings"
 )
 
 
@@ -30,6 +35,34 @@ func TestParseResponse(t *testing.T) {
   assert.Equal(t,[]byte("invalid body\rxx\nasdf\r\nfin"),actual.Body,"response body")
 }
 
+/*
+  Makes sure ParseResponse() returns an empty response with status 0 for invalid input instead of panicking.
+ */
+func TestParseResponseInvalid(t *testing.T) {
+  for _,input:=range []string{"","garbage","HTTP/1.1\r\n\r\n","\r\nX-Header: 1\r\n\r\n"} {
+    actual:=ParseResponse(input)
+    assert.Equal(t,uint16(0),actual.Status,"%q",input)
+    assert.Equal(t,0,len(actual.Headers.Keys()),"%q",input)
+  }
+}
+
+/*
+  Makes sure repeated headers from upstream survive parsing and serialization in their original order.
+ */
+func TestResponseRepeatedHeaders(t *testing.T) {
+  input:="HTTP/1.1 200 OK\r\n"+
+         "Set-Cookie: a=1; Path=/\r\n"+
+         "Via: 1.1 first\r\n"+
+         "Set-Cookie: b=2\r\n"+
+         "Via: 1.1 second\r\n"+
+         "Content-Length: 0\r\n"+
+         "\r\n"
+
+  actual:=ParseResponse(input)
+  assert.Equal(t,[]string{"a=1; Path=/","b=2"},actual.Headers.GetAll("Set-Cookie"))
+  assert.Equal(t,input,actual.ToString())
+}
+
 /*
   Makes sure .ToString() formats the message correctly.
  */
@@ -46,7 +79,7 @@ func TestResponseToString(t *testing.T) {
   input.Headers.Set("Im-A-Header","true")
 
   actual:=input.ToString()
-  expected:="HTTP/1.2 403 Forbidden\r\nIm-A-Header: true\r\nLet-It-Be: atles\r\n\r\nyou\nhit\rpay\n\rdirt\t"
+  expected:="HTTP/1.2 403 Forbidden\r\nLet-It-Be: atles\r\nIm-A-Header: true\r\n\r\nyou\nhit\rpay\n\rdirt\t"
   assert.Equal(t,expected,actual,"response body")
 }
 
@@ -118,3 +151,143 @@ func TestGetPlainTextBodyString(t *testing.T) {
     }
   }
 }
+
+
+/*
+  Makes sure .DecodeBody() handles stacked content and transfer codings and reports unsupported codings.
+ */
+func TestResponseDecodeBody(t *testing.T) {
+  response:=NewResponse()
+  response.Headers.Set("Content-Encoding","deflate, br")
+  response.Headers.Set("Transfer-Encoding","gzip, chunked")
+  response.Body,_=EncodeCodings([]byte("stacked"),[]string{"deflate","br","gzip","chunked"})
+
+  actual,err:=response.DecodeBody()
+  assert.Nil(t,err)
+  assert.Equal(t,"stacked",string(actual))
+
+  response=NewResponse()
+  response.Headers.Set("Content-Encoding","compress")
+  response.Body=[]byte("raw")
+  actual,err=response.DecodeBody()
+  assert.NotNil(t,err)
+  assert.Equal(t,"raw",string(actual),"undecodable bodies should be returned as-is")
+}
+
+/*
+  Makes sure .EncodeBody() sets the body and fixes up the encoding and length headers.
+ */
+func TestResponseEncodeBody(t *testing.T) {
+  response,err:=ReadResponse(bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nContent-Encoding: gzip\r\n\r\n3\r\nabc\r\n0\r\n\r\n")),"GET")
+  assert.Nil(t,err)
+
+  err=response.EncodeBody([]byte("replaced"),"BR")
+  assert.Nil(t,err)
+  assert.Nil(t,response.BodyStream)
+  assert.Equal(t,[]string{"br"},response.Headers.GetAll("Content-Encoding"))
+  assert.Nil(t,response.Headers.GetAll("Transfer-Encoding"))
+  length,_:=response.Headers.Get("Content-Length")
+  assert.Equal(t,strconv.Itoa(len(response.Body)),length)
+  assert.Equal(t,"replaced",response.GetPlainTextBodyString())
+
+  err=response.EncodeBody([]byte("plain"),"identity")
+  assert.Nil(t,err)
+  assert.Nil(t,response.Headers.GetAll("Content-Encoding"))
+  assert.Equal(t,"plain",string(response.Body))
+
+  err=response.EncodeBody([]byte("x"),"compress")
+  assert.NotNil(t,err)
+  assert.Equal(t,"plain",string(response.Body),"body should stay unchanged on errors")
+}
+
+/*
+  Makes sure .ModifyBody() re-encodes modified bodies with the original content codings.
+ */
+func TestResponseModifyBody(t *testing.T) {
+  response:=NewResponse()
+  response.Headers.Set("Content-Encoding","gzip")
+  response.Headers.Set("Transfer-Encoding","chunked")
+  response.Body,_=EncodeCodings([]byte("hello world"),[]string{"gzip","chunked"})
+
+  err:=response.ModifyBody(func(body []byte) []byte {
+    return bytes.ToUpper(body)
+  })
+  assert.Nil(t,err)
+  assert.Equal(t,"gzip",response.Headers.GetAll("Content-Encoding")[0])
+  assert.Nil(t,response.Headers.GetAll("Transfer-Encoding"))
+  decoded,err:=GetCodec("gzip").Decode(response.Body)
+  assert.Nil(t,err)
+  assert.Equal(t,"HELLO WORLD",string(decoded))
+}
+
+
+/*
+  Makes sure ReadResponse() reads only the response header and leaves the body in the response's body stream.
+ */
+func TestReadResponse(t *testing.T) {
+  cases:=[]struct {
+    method string
+    input string
+    body string
+  } {
+    {"GET", "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\nabcdef","abc"},
+    {"GET", "HTTP/1.1 200 OK\r\n\r\nuntil\r\n\r\nclosed","until\r\n\r\nclosed"},
+    {"HEAD","HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\n",""},
+    {"GET", "HTTP/1.1 204 No Content\r\n\r\n",""},
+    {"GET", "HTTP/1.1 304 Not Modified\r\n\r\n",""},
+    {"CONNECT","HTTP/1.1 200 Connection established\r\n\r\n",""},
+  }
+  for _,c:=range cases {
+    response,err:=ReadResponse(bufio.NewReader(strings.NewReader(c.input)),c.method)
+    assert.Nil(t,err,c.input)
+    assert.Equal(t,0,len(response.Body),"body shouldn't have been read yet: %q",c.input)
+    assert.NotNil(t,response.BodyStream,c.input)
+    body,err:=response.ReadBody()
+    assert.Nil(t,err,c.input)
+    assert.Equal(t,c.body,string(body),c.input)
+    assert.Nil(t,response.BodyStream,"body stream should have been consumed: %q",c.input)
+  }
+
+  _,err:=ReadResponse(bufio.NewReader(strings.NewReader("")),"GET")
+  assert.Equal(t,io.EOF,err,"empty input should return EOF")
+
+  _,err=ReadResponse(bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nContent-Length: 3, 4\r\n\r\nabcd")),"GET")
+  assert.Equal(t,errInvalidContentLength,err,"conflicting Content-Length should have been rejected")
+}
+
+/*
+  Makes sure .Write() passes streamed bodies on unchanged and closes the stream.
+ */
+func TestResponseWriteStreamsBody(t *testing.T) {
+  input:="HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n"
+  response,err:=ReadResponse(bufio.NewReader(strings.NewReader(input)),"GET")
+  assert.Nil(t,err)
+
+  var output bytes.Buffer
+  writer:=bufio.NewWriter(&output)
+  err=response.Write(writer)
+  assert.Nil(t,err)
+  assert.Equal(t,input,output.String())
+  assert.Nil(t,response.BodyStream,"body stream should have been closed")
+}
+
+
+/*
+  Makes sure binary response bodies survive parsing and serialization byte-exact.
+ */
+func TestResponseBinaryBody(t *testing.T) {
+  gzip_data:=[]byte {
+    0x1f, 0x8b, 0x08, 0x00, 0x29, 0x13, 0x7f, 0x5b,
+    0x00, 0x03, 0x2b, 0x2e, 0x4d, 0x4e, 0x4e, 0x2d,
+    0x2e, 0x06, 0x00, 0xb2, 0xdf, 0x00, 0x6f, 0x07,
+    0x00, 0x00, 0x00, 0x0d, 0x0a, 0x0d, 0x0a, 0x0a,
+  }
+  for _,header:=range []string{"HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\n\r\n","HTTP/1.1 200 OK\nContent-Encoding: gzip\n\n"} {
+    parsed:=ParseResponseBytes(append([]byte(header),gzip_data...))
+    assert.Equal(t,uint16(200),parsed.Status,"%q",header)
+    assert.Equal(t,gzip_data,parsed.Body,"body of %q",header)
+
+    serialized:=parsed.Bytes()
+    assert.Equal(t,gzip_data,serialized[len(serialized)-len(gzip_data):],"serialized body of %q",header)
+  }
+}
@@ -5,11 +5,19 @@ package http
 
 import (
   "bufio"
+  "context"
+  "crypto/rand"
   "crypto/tls"
-  "errors"
+  "encoding/hex"
+  "io"
+  "io/ioutil"
   "net"
   "regexp"
+  "sort"
+  "strconv"
   "strings"
+  "sync"
+  "sync/atomic"
   "time"
   "github.com/rinusser/hopgoblin/log"
   "github.com/rinusser/hopgoblin/utils"
@@ -22,21 +30,56 @@ import (
 type Server struct {
   listener net.Listener      //will be set to low-level socket listener
   siteHandlers []SiteHandler //list of site handlers; register with AddSiteHandler()
-  Shutdown chan bool         //used to shut down the server instance during tests
-  *ProxySettings             //upstream proxy settings
   SupportsEncryption bool    //whether SSL/TLS support is enabled
   tlsconfig tls.Config       //the TLS configuration to use for incoming connections
+  CertificateAuthority *utils.CertificateAuthority //issues certificates for hosts without explicit certificate, nil to disable
+  CaptureHooks []CaptureHook //receive all exchanges handled by the server
+
+  proxySettings *ProxySettings        //upstream proxy settings, nil to connect directly
+  fallbackSettings *FallbackSettings  //what to do with requests to hosts without site handler
+  middlewares []Middleware            //global middleware for ServeRoundTrip() and ServeForwarded()
+  authenticator *ProxyAuthenticator   //checks clients' proxy credentials, nil to accept all clients
+  accessList *AccessList              //client addresses allowed to connect, nil to accept all clients
+  idleTimeout time.Duration           //how long to keep idle client connections open
+  shutdownTimeout time.Duration       //how long shutdowns requested by signals or the admin API wait for active connections
+  settingsMutex sync.RWMutex          //guards the settings above, they're replaced by Reload() and setters while serving
+  healthChecker *HealthChecker //checks the upstream proxies while listening, guarded by settingsMutex
+
+  connections map[*bufio.ReadWriter]*serverConnection //open client connections, by I/O buffer
+  activeHandlers int                                  //running handleConnection() calls
+  shuttingDown bool                                   //set by Shutdown()
+  connectionsMutex sync.Mutex                         //guards the above and the listener
+  done chan struct{}                                  //closed once Shutdown() is finished
+  doneOnce sync.Once
 }
 
+/*
+  The default time to keep idle client connections open. Only used as fallback if no other value could be found.
+ */
+var DefaultIdleTimeout=60*time.Second
+
+/*
+  The default time shutdowns wait for active connections. Only used as fallback if no other value could be found.
+ */
+var DefaultShutdownTimeout=10*time.Second
+
 /*
   Create a new server instance with defaults.
  */
 func NewServer() *Server {
   rv:=&Server {
     listener: nil,
-    Shutdown: make(chan bool),
-    ProxySettings: GetDefaultProxySettings(),
+    proxySettings: GetDefaultProxySettings(),
+    fallbackSettings: GetDefaultFallbackSettings(),
+    middlewares: GetRegisteredMiddlewares(utils.GetConfigValue("server.middlewares")),
+    authenticator: getDefaultProxyAuthenticator(),
+    accessList: GetDefaultAccessList(),
+    CaptureHooks: GetRegisteredCaptureHooks(),
     SupportsEncryption: false,
+    idleTimeout: loadTimeout("server.idle_timeout",DefaultIdleTimeout),
+    shutdownTimeout: loadTimeout("server.shutdown_timeout",DefaultShutdownTimeout),
+    connections: make(map[*bufio.ReadWriter]*serverConnection),
+    done: make(chan struct{}),
   }
 
   rv.loadTLSConfig()
@@ -47,24 +90,230 @@ func NewServer() *Server {
 func (this *Server) loadTLSConfig() {
   this.SupportsEncryption=false
   resdir:=utils.GetResourcePath("certs")
+  this.tlsconfig=tls.Config {
+    ClientAuth: tls.VerifyClientCertIfGiven,
+    NameToCertificate: map[string]*tls.Certificate{},
+    ServerName: "hopgoblin.localhost",
+  }
+
+  caname:=utils.GetConfigValue("server.ca_certificate_file")
+  if caname!="" {
+    this.CertificateAuthority=utils.LoadCertificateAuthority(resdir,caname)
+    cachedir:=utils.GetConfigValue("server.certificate_cache_directory")
+    if this.CertificateAuthority!=nil && cachedir!="" {
+      this.CertificateAuthority.CacheDirectory=utils.GetResourcePath(cachedir)
+    }
+  }
+
   certname:=utils.GetConfigValue("server.default_certificate_file")
-  if certname=="" {
-    log.Warn("no default TLS certificate name set, disabling encryption support")
-    return
+  if certname!="" {
+    default_cert:=utils.LoadCertificate(resdir,certname)
+    if default_cert!=nil {
+      this.tlsconfig.Certificates=[]tls.Certificate{*default_cert}
+    }
   }
 
-  default_cert:=utils.LoadCertificate(resdir,certname)
-  if default_cert==nil {
+  if len(this.tlsconfig.Certificates)==0 && this.CertificateAuthority==nil {
+    log.Warn("no usable default TLS certificate or CA set, disabling encryption support")
     return
   }
+  this.SupportsEncryption=true
+}
 
-  this.tlsconfig=tls.Config {
-    Certificates: []tls.Certificate{*default_cert},
-    ClientAuth: tls.VerifyClientCertIfGiven,
-    NameToCertificate: map[string]*tls.Certificate{},
-    ServerName: "hopgoblin.localhost",
+/*
+  Reads a timeout in seconds from the application configuration, returns the fallback if it isn't set or invalid.
+ */
+func loadTimeout(key string, fallback time.Duration) time.Duration {
+  value:=utils.GetConfigValue(key)
+  if value=="" {
+    return fallback
   }
-  this.SupportsEncryption=true
+  seconds,err:=strconv.Atoi(value)
+  if err!=nil || seconds<1 {
+    log.Warn("invalid %s \"%s\", using default",key,value)
+    return fallback
+  }
+  return time.Duration(seconds)*time.Second
+}
+
+/*
+  Re-reads settings from the application configuration while the server is running: upstream proxies, fallback policies, global
+  middleware, proxy credentials, access list and timeouts. Invalid settings are logged and the previous ones kept. Site handlers
+  and TLS settings aren't reloaded. Upstream proxy health checks are restarted with the new proxy settings.
+
+  Call bootstrap.Reload() first to re-read the configuration file.
+ */
+func (this *Server) Reload() {
+  proxy_settings,err:=parseProxySettings(utils.GetConfigValuesByPrefix("proxy."))
+  if err!=nil {
+    log.Error("keeping previous proxy settings: %s",err)
+  }
+  fallback_settings,fallback_err:=parseFallbackSettings(utils.GetConfigValue("fallback.policy"),
+                                                        utils.GetConfigValuesByPrefix("fallback.rule."))
+  if fallback_err!=nil {
+    log.Error("keeping previous fallback settings: %s",fallback_err)
+  }
+  middlewares:=GetRegisteredMiddlewares(utils.GetConfigValue("server.middlewares"))
+  authenticator,auth_err:=LoadProxyAuthenticator()
+  if auth_err!=nil {
+    log.Error("keeping previous proxy credentials: %s",auth_err)
+  }
+  access_list,access_err:=parseAccessList(utils.GetConfigValue("access.allow"),utils.GetConfigValue("access.deny"))
+  if access_err!=nil {
+    log.Error("keeping previous access list: %s",access_err)
+  }
+
+  this.settingsMutex.Lock()
+  defer this.settingsMutex.Unlock()
+  if err==nil {
+    this.proxySettings=proxy_settings
+    this.restartHealthChecker()
+  }
+  if fallback_err==nil {
+    this.fallbackSettings=fallback_settings
+  }
+  this.middlewares=middlewares
+  if auth_err==nil {
+    this.authenticator=authenticator
+  }
+  if access_err==nil {
+    this.accessList=access_list
+  }
+  this.idleTimeout=loadTimeout("server.idle_timeout",DefaultIdleTimeout)
+  this.shutdownTimeout=loadTimeout("server.shutdown_timeout",DefaultShutdownTimeout)
+}
+
+/*
+  Starts checking the current upstream proxies if the server is listening. Needs the settings mutex to be locked, so the settings
+  can't change and a shutdown can't finish in the meantime.
+ */
+func (this *Server) restartHealthChecker() {
+  this.connectionsMutex.Lock()
+  listening:=this.listener!=nil && !this.shuttingDown
+  this.connectionsMutex.Unlock()
+  if listening {
+    this.replaceHealthChecker(NewHealthChecker(this.proxySettings))
+  }
+}
+
+/*
+  Stops the current health checker, if any, and starts the new one. Needs the settings mutex to be locked.
+ */
+func (this *Server) replaceHealthChecker(checker *HealthChecker) {
+  this.healthChecker.Stop()
+  this.healthChecker=checker
+  this.healthChecker.Start()
+}
+
+func (this *Server) getProxySettings() *ProxySettings {
+  this.settingsMutex.RLock()
+  defer this.settingsMutex.RUnlock()
+  return this.proxySettings
+}
+
+func (this *Server) getFallbackSettings() *FallbackSettings {
+  this.settingsMutex.RLock()
+  defer this.settingsMutex.RUnlock()
+  return this.fallbackSettings
+}
+
+func (this *Server) getMiddlewares() []Middleware {
+  this.settingsMutex.RLock()
+  defer this.settingsMutex.RUnlock()
+  return this.middlewares
+}
+
+func (this *Server) getAuthenticator() *ProxyAuthenticator {
+  this.settingsMutex.RLock()
+  defer this.settingsMutex.RUnlock()
+  return this.authenticator
+}
+
+func (this *Server) getAccessList() *AccessList {
+  this.settingsMutex.RLock()
+  defer this.settingsMutex.RUnlock()
+  return this.accessList
+}
+
+func (this *Server) getIdleTimeout() time.Duration {
+  this.settingsMutex.RLock()
+  defer this.settingsMutex.RUnlock()
+  return this.idleTimeout
+}
+
+/*
+  Returns the time shutdowns requested by signals or the admin API should wait for active connections.
+ */
+func (this *Server) GetShutdownTimeout() time.Duration {
+  this.settingsMutex.RLock()
+  defer this.settingsMutex.RUnlock()
+  return this.shutdownTimeout
+}
+
+/*
+  Replaces the upstream proxy settings, nil connects directly. Safe to call while the server is running: health checks are
+  restarted with the new settings.
+ */
+func (this *Server) SetProxySettings(settings *ProxySettings) {
+  this.settingsMutex.Lock()
+  defer this.settingsMutex.Unlock()
+  this.proxySettings=settings
+  this.restartHealthChecker()
+}
+
+/*
+  Replaces the fallback settings for hosts without site handler. Safe to call while the server is running.
+ */
+func (this *Server) SetFallbackSettings(settings *FallbackSettings) {
+  this.settingsMutex.Lock()
+  defer this.settingsMutex.Unlock()
+  this.fallbackSettings=settings
+}
+
+/*
+  Replaces the global middleware. Safe to call while the server is running.
+ */
+func (this *Server) SetMiddlewares(middlewares []Middleware) {
+  this.settingsMutex.Lock()
+  defer this.settingsMutex.Unlock()
+  this.middlewares=middlewares
+}
+
+/*
+  Replaces the proxy authenticator, nil accepts all clients. Safe to call while the server is running.
+ */
+func (this *Server) SetAuthenticator(authenticator *ProxyAuthenticator) {
+  this.settingsMutex.Lock()
+  defer this.settingsMutex.Unlock()
+  this.authenticator=authenticator
+}
+
+/*
+  Replaces the client access list, nil accepts all clients. Safe to call while the server is running.
+ */
+func (this *Server) SetAccessList(access_list *AccessList) {
+  this.settingsMutex.Lock()
+  defer this.settingsMutex.Unlock()
+  this.accessList=access_list
+}
+
+/*
+  Sets how long to keep idle client connections open. Safe to call while the server is running.
+ */
+func (this *Server) SetIdleTimeout(timeout time.Duration) {
+  this.settingsMutex.Lock()
+  defer this.settingsMutex.Unlock()
+  this.idleTimeout=timeout
+}
+
+/*
+  Sets how long shutdowns requested by signals or the admin API wait for active connections. Safe to call while the server is
+  running.
+ */
+func (this *Server) SetShutdownTimeout(timeout time.Duration) {
+  this.settingsMutex.Lock()
+  defer this.settingsMutex.Unlock()
+  this.shutdownTimeout=timeout
 }
 
 
@@ -91,61 +340,313 @@ func (this *Server) AddAllRegisteredSiteHandlers() {
   }
 }
 
+/*
+  Returns the server's site handlers, in the order they're asked whether they handle a host.
+ */
+func (this *Server) GetSiteHandlers() []SiteHandler {
+  return append([]SiteHandler(nil),this.siteHandlers...)
+}
+
 
 /*
   Starts listening to incoming connections on the given local address.
 
-  This method won't return until a boolean "true" is received sent over the Server.Shutdown channel.
+  This method won't return until the server was shut down with Shutdown() or Close(), or the listener failed.
+
+  Connections from client addresses the access list doesn't allow are closed right after accepting them. Upstream proxies are
+  health checked while listening, if the proxy settings enable health checks.
  */
 func (server *Server) Listen(addr *net.TCPAddr) error {
-  var err error
   listener,err:=net.ListenTCP("tcp",addr)
-  server.listener=listener
   if err!=nil {
     log.Fatal("unable to listen: %s",err)
     return err
   }
+  server.connectionsMutex.Lock()
+  server.listener=listener
+  shutting_down:=server.shuttingDown
+  server.connectionsMutex.Unlock()
+  if shutting_down {
+    listener.Close()
+  } else {
+    server.settingsMutex.Lock()
+    server.restartHealthChecker()
+    server.settingsMutex.Unlock()
+  }
+
   log.Debug("listening on %s.\n",listener.Addr().String())
+  log.Trace("waiting for connections...")
   for {
-    listener.SetDeadline(time.Now().Add(1e9))
-    log.Trace("waiting for connection...")
     conn,err:=listener.AcceptTCP()
-    if err,ok:=err.(net.Error);ok&&err.Timeout() {
-      select {
-        case <-server.Shutdown:
-          log.Debug("received shutdown signal")
-          return nil
-        default:
-          continue
+    if err!=nil {
+      if server.isShuttingDown() {
+        <-server.done
+        return nil
       }
-    } else if err!=nil {
-      log.Error("failed to accept connection",err)
+      if err,ok:=err.(net.Error);ok&&err.Temporary() {
+        log.Error("failed to accept connection: %s",err)
+        time.Sleep(10*time.Millisecond)
+        continue
+      }
+      log.Fatal("unable to accept connections: %s",err)
+      return err
+    }
+    id:=newConnectionID()
+    logger:=log.WithCorrelationID(id)
+    if address:=conn.RemoteAddr().(*net.TCPAddr);!server.getAccessList().Allows(address.IP) {
+      logger.InfoF("rejected connection","remote",address.String())
+      rejectedConnections.Inc()
+      conn.Close()
       continue
     }
-    log.Trace("got connection, spawning handler")
-    go server.handleConnection(conn)
+
+    server.connectionsMutex.Lock()
+    accepted:=!server.shuttingDown
+    if accepted {
+      server.activeHandlers++
+    }
+    server.connectionsMutex.Unlock()
+    if !accepted {
+      conn.Close()
+      continue
+    }
+    logger.Trace("got connection, spawning handler")
+    go server.handleConnection(conn,id)
   }
-  return nil
 }
 
-func (server *Server) handleConnection(conn net.Conn) {
-  log.Trace("handler spawned, waiting for data...")
-  defer conn.Close()
+/*
+  Shuts the server down gracefully: stops accepting connections, closes idle client connections and waits for active ones to
+  finish their current request. If the context expires first the remaining connections are closed forcibly and the context's
+  error is returned.
+
+  Listen() returns once the shutdown is finished.
+ */
+func (server *Server) Shutdown(ctx context.Context) error {
+  server.connectionsMutex.Lock()
+  listener:=server.listener
+  first:=!server.shuttingDown
+  server.shuttingDown=true
+  for _,state:=range server.connections {
+    if state.idle {
+      state.conn.Close()
+    }
+  }
+  server.connectionsMutex.Unlock()
+  if first && listener!=nil {
+    log.Info("shutting down, waiting for active connections")
+    listener.Close()
+  }
+
+  ticker:=time.NewTicker(50*time.Millisecond)
+  defer ticker.Stop()
+  for {
+    server.connectionsMutex.Lock()
+    active:=server.activeHandlers
+    server.connectionsMutex.Unlock()
+    if active==0 {
+      server.finishShutdown()
+      return nil
+    }
+    select {
+      case <-ctx.Done():
+        log.Warn("closing %d active connections",active)
+        server.connectionsMutex.Lock()
+        for _,state:=range server.connections {
+          state.conn.Close()
+        }
+        server.connectionsMutex.Unlock()
+        server.finishShutdown()
+        return ctx.Err()
+      case <-ticker.C:
+    }
+  }
+}
+
+/*
+  Shuts the server down immediately, closing all client connections. See Shutdown() for a graceful shutdown.
+ */
+func (server *Server) Close() error {
+  ctx,cancel:=context.WithCancel(context.Background())
+  cancel()
+  err:=server.Shutdown(ctx)
+  if err==context.Canceled {
+    err=nil
+  }
+  return err
+}
+
+func (server *Server) finishShutdown() {
+  server.doneOnce.Do(func() {
+    server.settingsMutex.Lock()
+    server.replaceHealthChecker(nil)
+    server.settingsMutex.Unlock()
+    close(server.done)
+  })
+}
+
+func (server *Server) isShuttingDown() bool {
+  server.connectionsMutex.Lock()
+  defer server.connectionsMutex.Unlock()
+  return server.shuttingDown
+}
+
+func (server *Server) handleConnection(conn net.Conn, id string) {
+  log.WithCorrelationID(id).Trace("handler spawned, waiting for data...")
+  defer func() {
+    conn.Close()
+    server.connectionsMutex.Lock()
+    server.activeHandlers--
+    server.connectionsMutex.Unlock()
+  }()
 
   buf:=bufio.NewReadWriter(bufio.NewReader(conn),bufio.NewWriter(conn))
-  request,err:=server.readRequest(buf)
-  if err!=nil || request==nil {
-    return
+  server.serveRequests(conn,buf,id,"",nil)
+}
+
+var correlationPrefix=newCorrelationPrefix()
+var connectionCounter uint64
+
+/*
+  Creates a random prefix for correlation IDs, so IDs are unique across restarts.
+ */
+func newCorrelationPrefix() string {
+  data:=make([]byte,4)
+  rand.Read(data)
+  return hex.EncodeToString(data)
+}
+
+func newConnectionID() string {
+  return correlationPrefix+"-"+strconv.FormatUint(atomic.AddUint64(&connectionCounter,1),10)
+}
+
+/*
+  Handles requests on a plain or TLS connection until either side wants to close the connection, or the client didn't send a new
+  request within the idle timeout.
+
+  tunnelHost is empty for plain connections, for connections inside a CONNECT tunnel it's the tunnel's target host and tunnel is
+  the CONNECT request. Requests inside tunnels inherit the CONNECT request's proxy user.
+
+  Connections get correlation IDs, requests get IDs with their sequence number appended: the connection "5f3a9c01-17" gets
+  requests "5f3a9c01-17-1", "5f3a9c01-17-2" and so on. Connections inside CONNECT tunnels use the CONNECT request's ID. All
+  messages logged while serving a request include its ID, starting with reading the request.
+ */
+func (server *Server) serveRequests(conn net.Conn, buf *bufio.ReadWriter, id string, tunnelHost string, tunnel *Request) {
+  user:=""
+  if tunnel!=nil {
+    user=tunnel.User
   }
+  state:=server.registerConnection(conn,buf,tunnelHost,id,user)
+  defer server.unregisterConnection(buf)
 
-  host:=""
+  request_count:=0
+  for {
+    logger:=log.WithCorrelationID(id+"-"+strconv.Itoa(request_count+1))
+    state.logger=logger
+    if !server.setIdle(state,true) {
+      return
+    }
+    conn.SetReadDeadline(time.Now().Add(server.getIdleTimeout()))
+    request,err:=server.readRequest(buf,logger)
+    server.setIdle(state,false)
+    if err==errUnframedRequestBody || err==errInvalidContentLength || err==errHeaderTooLarge {
+      logger.Debug("rejecting request: %s",err)
+      state.keepAlive,state.requestMethod,state.handler,state.started=false,"","none",time.Now()
+      status:=uint16(400)
+      if err==errHeaderTooLarge {
+        status=431
+      }
+      server.WriteResponse(buf,CreateSimpleResponse(status))
+      return
+    } else if err!=nil {
+      if err!=io.EOF && !server.isShuttingDown() {
+        logger.Debug("could not read request: %s",err)
+      }
+      return
+    }
+    conn.SetReadDeadline(time.Time{})
+    request.IsSSL=tunnelHost!=""
+    request_count++
+    request.ID=logger.CorrelationID
+    request.User=user
+    state.capture=server.startCapture(request,tunnelHost)
+    body:=request.BodyStream
+
+    state.keepAlive=wantsKeepAlive(request)
+    state.requestMethod=request.Method
+    state.reusable=false
+    state.handler="none"
+    state.started=time.Now()
+    server.updateConnectionInfo(state,func(info *ConnectionInfo) {
+      info.Requests++
+      info.Method,info.Url=request.Method,request.Url
+    })
+
+    if !server.dispatchRequest(conn,buf,request,tunnelHost) {
+      return
+    }
+    server.updateConnectionInfo(state,func(info *ConnectionInfo) {
+      info.Method,info.Url="",""
+    })
+    if !state.keepAlive || !state.reusable {
+      logger.Trace("closing connection after response")
+      return
+    }
+    _,err=io.Copy(ioutil.Discard,body)
+    if err!=nil {
+      logger.Debug("could not skip rest of request body: %s",err)
+      return
+    }
+    logger.Trace("keeping connection alive, waiting for next request...")
+  }
+}
+
+/*
+  Determines whether the client wants to keep the connection open after the request.
+  HTTP/1.1 connections are persistent unless closed explicitly, HTTP/1.0 connections need to ask for it.
+ */
+func wantsKeepAlive(request *Request) bool {
+  connection,found:=request.Headers.Get("Connection")
+  if !found {
+    connection,found=request.Headers.Get("Proxy-Connection")
+  }
+  connection=strings.ToLower(connection)
+  if strings.Contains(connection,"close") {
+    return false
+  }
+  if request.Protocol=="HTTP/1.0" {
+    return strings.Contains(connection,"keep-alive")
+  }
+  return true
+}
+
+func getRequestHost(request *Request) string {
   if request.Method=="CONNECT" {
     url_parts:=strings.Split(request.Url,":")
-    host=url_parts[0]
-  } else {
-    regex:=regexp.MustCompile(`^([a-z]+://)?([^:/]+)?(:[0-9]+)?/`)
-    matches:=regex.FindAllStringSubmatch(request.Url,-1)
-    host=matches[0][2]
+    return url_parts[0]
+  }
+  matches:=requestHostMatcher.FindStringSubmatch(request.Url)
+  if matches==nil {
+    return ""
+  }
+  return matches[2]
+}
+
+var requestHostMatcher=regexp.MustCompile(`^([a-z]+://)?([^:/]+)?(:[0-9]+)?/`)
+
+/*
+  Passes a single request on to the responsible site handler, or denies it.
+  Returns false if the connection can't be used for further requests.
+ */
+func (server *Server) dispatchRequest(conn net.Conn, buf *bufio.ReadWriter, request *Request, tunnelHost string) bool {
+  logger:=request.Logger()
+  if tunnelHost=="" && !server.authenticate(buf,request) {
+    return server.WriteResponse(buf,server.getAuthenticator().CreateChallengeResponse())==nil
+  }
+
+  host:=tunnelHost
+  if host=="" {
+    host=getRequestHost(request)
   }
 
   var handler *SiteHandler=nil
@@ -156,55 +657,134 @@ func (server *Server) handleConnection(conn net.Conn) {
     }
   }
 
+  state:=server.getConnection(buf)
+  if handler==nil && tunnelHost=="" {
+    policy:=server.getFallbackSettings().GetPolicy(host)
+    if request.Method=="CONNECT" && policy!=FallbackDeny {
+      logger.Debug("tunneling %s (no handler)",request.Url)
+      if state!=nil {
+        state.handler="fallback"
+      }
+      return server.tunnelRequest(conn,buf,request)
+    } else if request.Method!="CONNECT" && policy==FallbackForward {
+      logger.Debug("forwarding %s to %s (no handler)",request.Method,request.Url)
+      if state!=nil {
+        state.handler="fallback"
+      }
+      server.forwardRequest(buf,request)
+      return true
+    }
+  }
+
   response:=NewResponse()
   deny_reason:=""
   if handler==nil {
     deny_reason="no handler"
+  } else if request.Method=="CONNECT" && tunnelHost!="" {
+    deny_reason="already tunneled"
   } else if !server.SupportsEncryption && request.Method=="CONNECT" {
     deny_reason="encryption disabled"
   }
 
   if deny_reason!="" {
     if host!="detectportal.firefox.com" {
-      log.Debug("denied %s to %s (%s)",request.Method,request.Url,deny_reason)
+      logger.DebugF("denied request","method",request.Method,"url",request.Url,"reason",deny_reason,"status",403)
     }
     response.Status=403
     response.Body=[]byte("go away")
-    server.WriteAndFlush(buf,response.ToString())
-    return
+    return server.WriteResponse(buf,response)==nil
   }
 
-  log.Debug("allowing %s to %s",request.Method,request.Url)
+  logger.Debug("allowing %s to %s",request.Method,request.Url)
 
+  if state!=nil {
+    state.handler=GetSiteHandlerName(*handler)
+  }
   if request.Method=="CONNECT" {
     response.Status=200
     server.WriteAndFlush(buf,response.ToString())
-    host:=request.Url
-    colon_pos:=strings.Index(host,":")
-    if colon_pos>0 {
-      host=host[0:colon_pos]
+    if state!=nil {
+      recordRequest(state,200)
     }
-    buf,request,err=server.startSSLServer(conn,host)
+    tlsconn,tlsbuf,err:=server.startSSLServer(conn,host,logger)
     if err!=nil {
-      return
+      return false
     }
+    server.serveRequests(tlsconn,tlsbuf,request.ID,host,request)
+    return false
   }
 
+  if state!=nil && state.capture!=nil {
+    state.capture.setSiteHandler(*handler)
+  }
   (*handler).HandleRequest(server,buf,request)
+  return true
+}
+
+/*
+  Checks the request's proxy credentials if proxy authentication is enabled. On success the user name is attached to the request
+  and the credentials are removed, so they aren't forwarded upstream.
+ */
+func (server *Server) authenticate(buf *bufio.ReadWriter, request *Request) bool {
+  authenticator:=server.getAuthenticator()
+  if authenticator==nil {
+    return true
+  }
+  logger:=request.Logger()
+  user,ok:=authenticator.Authenticate(request)
+  if !ok {
+    if user=="" {
+      logger.Debug("no proxy credentials for %s %s",request.Method,request.Url)
+    } else {
+      logger.WarnF("proxy authentication failed","user",user,"method",request.Method,"url",request.Url)
+    }
+    return false
+  }
+  request.User=user
+  request.Headers.Del("Proxy-Authorization")
+  if state:=server.getConnection(buf);state!=nil {
+    server.updateConnectionInfo(state,func(info *ConnectionInfo) {
+      info.User=user
+    })
+  }
+  logger.TraceF("authenticated proxy user","user",user)
+  return true
 }
 
 /*
   Performs the server-side part of an SSL/TLS handshake on an existing connection.
 
+  Site handlers' certificates are used for the hosts they're registered for. For any other host a certificate is issued by the
+  server's CertificateAuthority if there is one, otherwise the default certificate is used. The host is taken from the client's
+  SNI extension, or from the host parameter if the client didn't send one.
+
   This function returns new net.Conn and bufio.ReadWriter instances for the encrypted connection: use only those after a successful
   handshake.
  */
 func (this *Server) UpgradeServerConnectionToSSL(conn net.Conn, host string) (net.Conn,*bufio.ReadWriter,error) {
+  return this.upgradeServerConnectionToSSL(conn,host,log.CorrelatedLogger{})
+}
+
+func (this *Server) upgradeServerConnectionToSSL(conn net.Conn, host string, logger log.CorrelatedLogger) (net.Conn,*bufio.ReadWriter,error) {
   var tlsconn *tls.Conn
-  tlsconfig:=*(&this.tlsconfig) //TODO: this is a bug, it doesn't make a copy as intended
+  tlsconfig:=this.tlsconfig.Clone()
   tlsconfig.ServerName=host
-  tlsconn=tls.Server(conn,&tlsconfig)
-  log.Debug("performing TLS handshake...")
+  if this.CertificateAuthority!=nil {
+    tlsconfig.Certificates=nil
+    tlsconfig.GetCertificate=func(hello *tls.ClientHelloInfo) (*tls.Certificate,error) {
+      name:=hello.ServerName
+      if name=="" {
+        name=host
+      }
+      cert:=getExplicitCertificate(tlsconfig,name)
+      if cert!=nil {
+        return cert,nil
+      }
+      return this.CertificateAuthority.GetCertificateLogged(name,logger)
+    }
+  }
+  tlsconn=tls.Server(conn,tlsconfig)
+  logger.Debug("performing TLS handshake...")
 
   err:=tlsconn.Handshake()
   if err!=nil {
@@ -216,49 +796,195 @@ func (this *Server) UpgradeServerConnectionToSSL(conn net.Conn, host string) (ne
   return tlsconn,buf,nil
 }
 
-func (server *Server) startSSLServer(conn net.Conn, host string) (*bufio.ReadWriter,*Request,error) {
-  _,buf,err:=server.UpgradeServerConnectionToSSL(conn,host)
-  if err!=nil {
-    log.Debug("TLS handshake failed: %s",err)
-    return nil,nil,err
+/*
+  Fetches the certificate a site handler registered for the given host, either directly or as wildcard.
+  Returns nil if there is none.
+ */
+func getExplicitCertificate(tlsconfig *tls.Config, host string) *tls.Certificate {
+  host=strings.ToLower(host)
+  if cert,found:=tlsconfig.NameToCertificate[host];found {
+    return cert
+  }
+  dot_pos:=strings.Index(host,".")
+  if dot_pos<0 {
+    return nil
   }
+  return tlsconfig.NameToCertificate["*"+host[dot_pos:]]
+}
 
-  request,err:=server.readRequest(buf)
+func (server *Server) startSSLServer(conn net.Conn, host string, logger log.CorrelatedLogger) (net.Conn,*bufio.ReadWriter,error) {
+  tlsconn,buf,err:=server.upgradeServerConnectionToSSL(conn,host,logger)
   if err!=nil {
-    log.Debug("could not read TLS'd request: %s",err)
+    logger.Debug("TLS handshake failed: %s",err)
+    tlsHandshakeFailures.Inc()
     return nil,nil,err
   }
-  request.IsSSL=true
-  return buf,request,nil
+  return tlsconn,buf,nil
 }
 
-func (server *Server) readRequest(buf *bufio.ReadWriter) (*Request,error) {
-  log.Trace("reading http request..")
-  request_text,err:=ReadHTTPMessageAsString(buf)
-  if err!=nil {
-    return nil,err
-  }
+func (server *Server) readRequest(buf *bufio.ReadWriter, logger log.CorrelatedLogger) (*Request,error) {
+  logger.Trace("reading http request..")
+  return readRequest(buf.Reader,logger)
+}
 
-  request:=ParseRequest(request_text)
-  if request!=nil {
-    return request,nil
-  } else {
-    return nil,errors.New("could not parse request")
+/*
+  Returns the logger for messages about the connection's current request, see serveRequests().
+ */
+func (server *Server) getLogger(state *serverConnection) log.CorrelatedLogger {
+  if state==nil {
+    return log.CorrelatedLogger{}
   }
+  return state.logger
 }
 
 /*
   Send data to a connected client.
+  Since the server can't tell where raw data ends, the connection will be closed after the current request.
  */
 func (server *Server) WriteAndFlush(buf *bufio.ReadWriter, response string) error { //TODO: why public?
+  state:=server.getConnection(buf)
+  if state!=nil {
+    state.reusable=false
+  }
   _,err:=buf.WriteString(response)
   if err!=nil {
-    log.Debug("can't write to connection",err)
+    server.getLogger(state).Debug("can't write to connection: %s",err)
   }
   err=buf.Flush()
   if err!=nil {
-    log.Debug("flush failed",err)
+    server.getLogger(state).Debug("flush failed: %s",err)
   }
   return err
 }
 
+/*
+  Sends a response to a connected client.
+  Streamed response bodies are passed on to the client as they arrive.
+
+  The Connection header will be set according to whether the client connection will be kept alive: this is the case if the client
+  asked for it and the response's end can be determined without closing the connection. Buffered bodies will get a
+  Content-Length header if they don't have one yet.
+ */
+func (server *Server) WriteResponse(buf *bufio.ReadWriter, response *Response) error {
+  state:=server.getConnection(buf)
+  if state!=nil {
+    state.reusable=state.keepAlive && response.makeSelfDelimiting(state.requestMethod) && !server.isShuttingDown()
+    if state.reusable {
+      response.Headers.Set("Connection","keep-alive")
+    } else {
+      response.Headers.Set("Connection","close")
+    }
+  }
+
+  var err error
+  if state!=nil && state.capture!=nil {
+    err=state.capture.writeResponse(response,buf.Writer)
+    state.capture=nil
+  } else {
+    err=response.Write(buf.Writer)
+  }
+  if err!=nil {
+    server.getLogger(state).Debug("can't write response to connection: %s",err)
+    if state!=nil {
+      state.reusable=false
+    }
+  }
+  if state!=nil {
+    recordRequest(state,response.Status)
+  }
+  return err
+}
+
+
+/*
+  Snapshot of a client connection's state, see Server.GetConnections().
+ */
+type ConnectionInfo struct {
+  ID string            //the connection's correlation ID, see Request.ID
+  RemoteAddress string //the client's address, e.g. "127.0.0.1:51234"
+  Opened time.Time
+  User string          //the authenticated proxy user, empty without proxy authentication
+  TunnelHost string    //the CONNECT tunnel's target host for intercepted TLS connections, empty for plain connections
+  Relaying string      //the target of a CONNECT tunnel relayed byte-for-byte, empty if there is none
+  Requests int         //the number of requests received so far
+  Method string        //the current request's method, empty while idle
+  Url string           //the current request's URL, empty while idle
+}
+
+/*
+  State of a client connection.
+ */
+type serverConnection struct {
+  keepAlive bool              //whether the client wants to keep the connection open after the current request
+  reusable bool               //whether the response to the current request allows keeping the connection open
+  requestMethod string        //the current request's method
+  capture *captureState       //the current request's capture, nil if it isn't captured
+  handler string              //the current request's site handler name for metrics, "none" if there is none
+  started time.Time           //when the current request was received
+  isSSL bool                  //whether the connection is inside a CONNECT tunnel
+  logger log.CorrelatedLogger //logs messages with the current request's correlation ID
+  info ConnectionInfo         //guarded by Server.connectionsMutex since it's read by other goroutines
+  conn net.Conn               //the client connection, closed by Shutdown()
+  idle bool                   //whether the connection is waiting for the next request, guarded by Server.connectionsMutex
+}
+
+/*
+  Returns snapshots of all open client connections, oldest first. Intercepted CONNECT tunnels are listed as separate connections
+  in addition to the connection they were opened on.
+ */
+func (server *Server) GetConnections() []ConnectionInfo {
+  server.connectionsMutex.Lock()
+  rv:=make([]ConnectionInfo,0,len(server.connections))
+  for _,state:=range server.connections {
+    rv=append(rv,state.info)
+  }
+  server.connectionsMutex.Unlock()
+  sort.SliceStable(rv,func(a int, b int) bool {
+    return rv[a].Opened.Before(rv[b].Opened)
+  })
+  return rv
+}
+
+func (server *Server) updateConnectionInfo(state *serverConnection, update func(info *ConnectionInfo)) {
+  server.connectionsMutex.Lock()
+  defer server.connectionsMutex.Unlock()
+  update(&state.info)
+}
+
+func (server *Server) registerConnection(conn net.Conn, buf *bufio.ReadWriter, tunnelHost string, id string, user string) *serverConnection {
+  state:=&serverConnection{info:ConnectionInfo{ID:id,User:user,RemoteAddress:conn.RemoteAddr().String(),Opened:time.Now(),
+                                                TunnelHost:tunnelHost}}
+  state.isSSL=tunnelHost!=""
+  state.conn=conn
+  openConnections.Inc(strconv.FormatBool(state.isSSL))
+  server.connectionsMutex.Lock()
+  defer server.connectionsMutex.Unlock()
+  server.connections[buf]=state
+  return state
+}
+
+/*
+  Marks a connection as idle or active. Returns false if the connection shouldn't wait for further requests because the server is
+  shutting down.
+ */
+func (server *Server) setIdle(state *serverConnection, idle bool) bool {
+  server.connectionsMutex.Lock()
+  defer server.connectionsMutex.Unlock()
+  state.idle=idle
+  return !server.shuttingDown
+}
+
+func (server *Server) unregisterConnection(buf *bufio.ReadWriter) {
+  server.connectionsMutex.Lock()
+  defer server.connectionsMutex.Unlock()
+  if state:=server.connections[buf];state!=nil {
+    openConnections.Dec(strconv.FormatBool(state.isSSL))
+  }
+  delete(server.connections,buf)
+}
+
+func (server *Server) getConnection(buf *bufio.ReadWriter) *serverConnection {
+  server.connectionsMutex.Lock()
+  defer server.connectionsMutex.Unlock()
+  return server.connections[buf]
+}
@@ -7,8 +7,11 @@ import (
   "testing"
   "github.com/stretchr/testify/assert"
   "bufio"
+  "context"
   "crypto/tls"
+  "crypto/x509"
   "fmt"
+  "io"
   "io/ioutil"
   "net"
   go_http "net/http"
@@ -16,6 +19,7 @@ import (
   "os"
   "regexp"
   "strings"
+  "sync"
   "time"
   "github.com/rinusser/hopgoblin/http/dummyproxy"
   "github.com/rinusser/hopgoblin/log"
@@ -33,14 +37,14 @@ func (h ServerTestProxySiteHandler) HandlesHost(host string) bool {
 func (h ServerTestProxySiteHandler) HandleRequest(server *Server, browserio *bufio.ReadWriter, request *Request) {
   log.Debug("handling request")
   log.Trace("request.IsSSL=%t",request.IsSSL)
-  client:=NewClient()
-  client.CopyProxySettings(server)
+  client:=NewServerClient(server)
+  client.Pool=nil //each test case starts a new dummy proxy, possibly on a previously used port
   response,err:=client.ForwardRequest(*request)
   if err!=nil {
     log.Fatal("could not forward request")
     panic(err)
   }
-  server.WriteAndFlush(browserio,response.ToString())
+  server.WriteResponse(browserio,response)
 }
 
 func (this ServerTestProxySiteHandler) GetCertificateMap() map[string]*tls.Certificate {
@@ -71,7 +75,7 @@ func (h ServerTestDirectSiteHandler) HandleRequest(server *Server, browserio *bu
   } else {
     panic("unhandled encoding")
   }
-  server.WriteAndFlush(browserio,response.ToString())
+  server.WriteResponse(browserio,response)
 }
 
 func (this ServerTestDirectSiteHandler) GetCertificateMap() map[string]*tls.Certificate {
@@ -86,7 +90,7 @@ func runServer(port int) (*Server, *go_http.Client) {
   server:=NewServer()
   server.AddSiteHandler(ServerTestProxySiteHandler{})
   server.AddSiteHandler(ServerTestDirectSiteHandler{})
-  addr:=net.TCPAddr{net.IPv4(127,0,0,1),port,"tcp"}
+  addr:=net.TCPAddr{IP:net.IPv4(127,0,0,1),Port:port}
   go server.Listen(&addr)
 
   proxy_url:=fmt.Sprintf("http://127.0.0.1:%d",port)
@@ -109,7 +113,7 @@ func runServer(port int) (*Server, *go_http.Client) {
  */
 func TestServerHTTP403(t *testing.T) {
   server,client:=runServer(64080)
-  defer func() { server.Shutdown<-true }()
+  defer server.Close()
 
   response,err:=client.Get("http://does.not.exist/asdf")
   assert.Nil(t,err,"http request should have worked")
@@ -124,10 +128,13 @@ func TestServerHTTP403(t *testing.T) {
  */
 func TestServerHTTPS403(t *testing.T) {
   server,client:=runServer(64081)
-  defer func() { server.Shutdown<-true }()
+  defer server.Close()
 
   _,err:=client.Get("https://does.not.exist/asdf")
-  assert.Equal(t,"Get https://does.not.exist/asdf: Forbidden",err.Error(),"error response")
+  assert.NotNil(t,err,"request should have failed")
+  if err!=nil {
+    assert.True(t,strings.HasSuffix(err.Error(),": Forbidden"),"error response")
+  }
 }
 
 
@@ -150,7 +157,7 @@ func TestServerDirect(t *testing.T) {
 
 func runServerDirectTest(t *testing.T, port int, url string, expectation string) {
   server,client:=runServer(port)
-  defer func() { server.Shutdown<-true }()
+  defer server.Close()
   if !server.SupportsEncryption && url[0:8]=="https://" {
     log.Warn("skipping test case: encryption not supported")
     return
@@ -228,7 +235,7 @@ func TestServerHTTPProxyCases(t *testing.T) {
 
 func runServerProxyTest(t *testing.T, port int, c serverProxyTestCase) {
   server,client:=runServer(port)
-  defer func() { server.Shutdown<-true }()
+  defer server.Close()
   if !server.SupportsEncryption && c.url[0:8]=="https://" {
     log.Warn("skipping test case '"+c.description+"': encryption not supported")
     return
@@ -236,16 +243,19 @@ func runServerProxyTest(t *testing.T, port int, c serverProxyTestCase) {
 
   proxyrunner:=dummyproxy.NewDummyProxyRunner()
   proxyrunner.StartRandom()
-  server.ProxySettings=NewProxySettings("127.0.0.1",proxyrunner.Port)
+  server.SetProxySettings(NewProxySettings("127.0.0.1",proxyrunner.Port))
 
   time.Sleep(5e8)
 
   log.Trace("starting http POST..")
   postbody:="some/body"
   result,err:=client.Post(c.url,"text/plain",strings.NewReader(postbody))
-  defer result.Body.Close()
   log.Trace("finished http POST")
   assert.Nil(t,err,"http.Post() should have succeeded: "+c.description)
+  if err!=nil {
+    return
+  }
+  defer result.Body.Close()
 
   proxyresult,proxyerrout,err:=proxyrunner.ReadAndWait()
   if len(proxyerrout)>0 {
@@ -300,7 +310,7 @@ func TestConnectionAborts(t *testing.T) {
 func runAbortTest(t *testing.T, num int) {
   port:=64100+num
   server,client:=runServer(port)
-  defer func() { server.Shutdown<-true }()
+  defer server.Close()
   if !server.SupportsEncryption {
     log.Warn("skipping test case: encryption not supported")
     return
@@ -308,7 +318,7 @@ func runAbortTest(t *testing.T, num int) {
 
   proxyrunner:=dummyproxy.NewDummyProxyRunner()
   proxyrunner.StartRandom()
-  server.ProxySettings=NewProxySettings("127.0.0.1",proxyrunner.Port)
+  server.SetProxySettings(NewProxySettings("127.0.0.1",proxyrunner.Port))
 
   openAbortedConnection(t,port,num)
   runServerDirectAssertions(t,client,port,"http://direct.local/no_encoding/http","http://direct.local/no_encoding/http")
@@ -344,3 +354,836 @@ func openAbortedConnection(t *testing.T, port int, num int) {
   conn.Close()
   time.Sleep(5e9)
 }
+
+
+func dialServer(t *testing.T, port int) (net.Conn,*bufio.ReadWriter) {
+  conn,err:=net.Dial("tcp",fmt.Sprintf("127.0.0.1:%d",port))
+  if err!=nil {
+    t.Fatalf("could not connect to server: %s",err)
+  }
+  return conn,bufio.NewReadWriter(bufio.NewReader(conn),bufio.NewWriter(conn))
+}
+
+func sendRequestOnConnection(t *testing.T, buf *bufio.ReadWriter, request string) *Response {
+  buf.WriteString(request)
+  buf.Flush()
+  response,err:=ReadResponse(buf.Reader,"GET")
+  assert.Nil(t,err,"reading response to %q",request)
+  if err!=nil {
+    t.FailNow()
+  }
+  return response
+}
+
+func assertConnectionClosed(t *testing.T, conn net.Conn, buf *bufio.ReadWriter, message string) {
+  conn.SetReadDeadline(time.Now().Add(3*time.Second))
+  _,err:=buf.ReadByte()
+  assert.Equal(t,io.EOF,err,message)
+}
+
+/*
+  Makes sure client connections are kept open for further requests as long as both the client and the responses allow it.
+ */
+func TestServerKeepAlive(t *testing.T) {
+  server,_:=runServer(64140)
+  defer server.Close()
+
+  conn,buf:=dialServer(t,64140)
+  defer conn.Close()
+  for _,path:=range []string{"/no_encoding/1","/chunked/2","/no_encoding/3"} {
+    response:=sendRequestOnConnection(t,buf,"GET http://direct.local"+path+" HTTP/1.1\r\nHost: direct.local\r\n\r\n")
+    assert.Equal(t,"http://direct.local"+path,response.GetPlainTextBodyString(),"response body")
+    connection,_:=response.Headers.Get("Connection")
+    assert.Equal(t,"keep-alive",connection,"Connection header")
+  }
+
+  response:=sendRequestOnConnection(t,buf,"GET http://does.not.exist/ HTTP/1.1\r\n\r\n")
+  assert.Equal(t,uint16(403),response.Status,"denied requests should keep the connection alive too")
+  response.ReadBody()
+
+  response=sendRequestOnConnection(t,buf,"GET http://direct.local/no_encoding/4 HTTP/1.1\r\nConnection: close\r\n\r\n")
+  assert.Equal(t,"http://direct.local/no_encoding/4",response.GetPlainTextBodyString())
+  assertConnectionClosed(t,conn,buf,"connection should have been closed as requested")
+}
+
+/*
+  Makes sure HTTP/1.0 connections are closed after the response unless the client asked to keep them alive.
+ */
+func TestServerKeepAliveHTTP10(t *testing.T) {
+  server,_:=runServer(64141)
+  defer server.Close()
+
+  conn,buf:=dialServer(t,64141)
+  defer conn.Close()
+  response:=sendRequestOnConnection(t,buf,"GET http://direct.local/no_encoding/1 HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+  assert.Equal(t,"http://direct.local/no_encoding/1",response.GetPlainTextBodyString())
+  response=sendRequestOnConnection(t,buf,"GET http://direct.local/no_encoding/2 HTTP/1.0\r\n\r\n")
+  assert.Equal(t,"http://direct.local/no_encoding/2",response.GetPlainTextBodyString())
+  assertConnectionClosed(t,conn,buf,"HTTP/1.0 connection should have been closed")
+}
+
+/*
+  Makes sure request bodies are framed by the last transfer coding, so stacked codings can't smuggle requests on kept-alive
+  connections, and requests with transfer codings that don't frame the body are rejected.
+ */
+func TestServerKeepAliveTransferEncoding(t *testing.T) {
+  server,_:=runServer(64156)
+  defer server.Close()
+
+  conn,buf:=dialServer(t,64156)
+  defer conn.Close()
+  smuggled:="GET http://direct.local/no_encoding/smuggled HTTP/1.1\r\n\r\n"
+  buf.WriteString("POST http://direct.local/no_encoding/1 HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n")
+  buf.WriteString(fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n",len(smuggled),smuggled))
+  buf.WriteString("GET http://direct.local/no_encoding/2 HTTP/1.1\r\n\r\n")
+  buf.Flush()
+  for _,path:=range []string{"/no_encoding/1","/no_encoding/2"} {
+    response,err:=ReadResponse(buf.Reader,"GET")
+    if !assert.Nil(t,err,path) {
+      return
+    }
+    assert.Equal(t,"http://direct.local"+path,response.GetPlainTextBodyString(),"body shouldn't have been read as request")
+  }
+
+  response:=sendRequestOnConnection(t,buf,"POST http://direct.local/no_encoding/3 HTTP/1.1\r\nTransfer-Encoding: chunked, gzip\r\n\r\n")
+  assert.Equal(t,uint16(400),response.Status,"request with unframed body should have been rejected")
+  response.ReadBody()
+  assertConnectionClosed(t,conn,buf,"connection should have been closed after unframed request")
+}
+
+/*
+  Makes sure requests with invalid or conflicting Content-Length headers are answered with 400 and the connection is closed, so
+  their bodies can't be read as further requests.
+ */
+func TestServerRejectsInvalidContentLength(t *testing.T) {
+  server,_:=runServer(64158)
+  defer server.Close()
+
+  for _,header:=range []string{"Content-Length: -5","Content-Length: 4, 41","Content-Length: 4\r\nContent-Length: 41"} {
+    conn,buf:=dialServer(t,64158)
+    smuggled:="GET http://direct.local/no_encoding/smuggled HTTP/1.1\r\n\r\n"
+    response:=sendRequestOnConnection(t,buf,"POST http://direct.local/no_encoding/1 HTTP/1.1\r\n"+header+"\r\n\r\n"+smuggled)
+    assert.Equal(t,uint16(400),response.Status,header)
+    response.ReadBody()
+    assertConnectionClosed(t,conn,buf,"connection should have been closed after "+header)
+    conn.Close()
+  }
+}
+
+/*
+  Makes sure a stray CRLF between requests on a persistent connection is skipped instead of ending the connection.
+ */
+func TestServerSkipsEmptyLinesBetweenRequests(t *testing.T) {
+  server,_:=runServer(64159)
+  defer server.Close()
+
+  conn,buf:=dialServer(t,64159)
+  defer conn.Close()
+  response:=sendRequestOnConnection(t,buf,"GET http://direct.local/no_encoding/1 HTTP/1.1\r\n\r\n")
+  assert.Equal(t,"http://direct.local/no_encoding/1",response.GetPlainTextBodyString())
+  response=sendRequestOnConnection(t,buf,"\r\n\r\nGET http://direct.local/no_encoding/2 HTTP/1.1\r\n\r\n")
+  assert.Equal(t,uint16(200),response.Status)
+  assert.Equal(t,"http://direct.local/no_encoding/2",response.GetPlainTextBodyString(),"request after empty lines should have been served")
+}
+
+/*
+  Makes sure requests with oversized headers on a persistent connection get a 431 response and the connection is closed.
+ */
+func TestServerRejectsOversizedHeader(t *testing.T) {
+  server,_:=runServer(64160)
+  defer server.Close()
+
+  conn,buf:=dialServer(t,64160)
+  defer conn.Close()
+  response:=sendRequestOnConnection(t,buf,"GET http://direct.local/no_encoding/1 HTTP/1.1\r\n\r\n")
+  assert.Equal(t,"http://direct.local/no_encoding/1",response.GetPlainTextBodyString())
+  filler:=strings.Repeat("X-Filler: 0123456789abcdef\r\n",maxHeaderSize/28+1)
+  response=sendRequestOnConnection(t,buf,"GET http://direct.local/no_encoding/2 HTTP/1.1\r\n"+filler+"\r\n")
+  assert.Equal(t,uint16(431),response.Status)
+  response.ReadBody()
+  assertConnectionClosed(t,conn,buf,"connection should have been closed after oversized header")
+}
+
+/*
+  Makes sure idle client connections are closed after the configured timeout.
+ */
+func TestServerIdleTimeout(t *testing.T) {
+  server,_:=runServer(64142)
+  defer server.Close()
+  server.SetIdleTimeout(time.Second)
+
+  conn,buf:=dialServer(t,64142)
+  defer conn.Close()
+  response:=sendRequestOnConnection(t,buf,"GET http://direct.local/no_encoding/1 HTTP/1.1\r\n\r\n")
+  response.ReadBody()
+  time.Sleep(1500*time.Millisecond)
+  assertConnectionClosed(t,conn,buf,"idle connection should have been closed")
+}
+
+/*
+  Makes sure connections inside CONNECT tunnels are kept alive as well.
+ */
+func TestServerKeepAliveInTunnel(t *testing.T) {
+  server,_:=runServer(64143)
+  defer server.Close()
+  if !server.SupportsEncryption {
+    log.Warn("skipping test case: encryption not supported")
+    return
+  }
+
+  conn,buf:=dialServer(t,64143)
+  defer conn.Close()
+  buf.WriteString("CONNECT direct.local:443 HTTP/1.1\r\n\r\n")
+  buf.Flush()
+  response,err:=ReadResponse(buf.Reader,"CONNECT")
+  assert.Nil(t,err)
+  assert.Equal(t,uint16(200),response.Status)
+
+  tlsconn:=tls.Client(conn,&tls.Config{InsecureSkipVerify:true,ServerName:"direct.local"})
+  tlsbuf:=bufio.NewReadWriter(bufio.NewReader(tlsconn),bufio.NewWriter(tlsconn))
+  for _,path:=range []string{"/no_encoding/1","/chunked/2"} {
+    response=sendRequestOnConnection(t,tlsbuf,"GET "+path+" HTTP/1.1\r\nHost: direct.local\r\n\r\n")
+    assert.Equal(t,path,response.GetPlainTextBodyString(),"response body")
+  }
+}
+
+
+type ServerTestCertificatelessSiteHandler struct {
+}
+
+func (h ServerTestCertificatelessSiteHandler) HandlesHost(host string) bool {
+  return host=="minted.local"
+}
+
+func (h ServerTestCertificatelessSiteHandler) HandleRequest(server *Server, browserio *bufio.ReadWriter, request *Request) {
+  response:=NewResponse()
+  response.Status=200
+  response.Body=[]byte(request.Url)
+  server.WriteResponse(browserio,response)
+}
+
+func (this ServerTestCertificatelessSiteHandler) GetCertificateMap() map[string]*tls.Certificate {
+  return map[string]*tls.Certificate{}
+}
+
+func openTunnel(t *testing.T, port int, host string, tlsconfig *tls.Config) (*tls.Conn,*bufio.ReadWriter) {
+  conn,buf:=dialServer(t,port)
+  buf.WriteString("CONNECT "+host+":443 HTTP/1.1\r\n\r\n")
+  buf.Flush()
+  response,err:=ReadResponse(buf.Reader,"CONNECT")
+  assert.Nil(t,err)
+  assert.Equal(t,uint16(200),response.Status)
+
+  tlsconn:=tls.Client(conn,tlsconfig)
+  err=tlsconn.Handshake()
+  assert.Nil(t,err,"TLS handshake for %s",host)
+  return tlsconn,bufio.NewReadWriter(bufio.NewReader(tlsconn),bufio.NewWriter(tlsconn))
+}
+
+/*
+  Makes sure the server issues certificates for hosts without site handler certificate if it has a certificate authority.
+ */
+func TestServerIssuesCertificates(t *testing.T) {
+  server,_:=runServer(64144)
+  defer server.Close()
+  server.AddSiteHandler(ServerTestCertificatelessSiteHandler{})
+  ca,err:=utils.GenerateCertificateAuthority("hopgoblin test CA",time.Hour)
+  assert.Nil(t,err)
+  server.CertificateAuthority=ca
+  server.SupportsEncryption=true
+  pool:=x509.NewCertPool()
+  pool.AddCert(ca.Certificate)
+
+  tlsconn,tlsbuf:=openTunnel(t,64144,"minted.local",&tls.Config{RootCAs:pool,ServerName:"minted.local"})
+  response:=sendRequestOnConnection(t,tlsbuf,"GET /minted HTTP/1.1\r\nHost: minted.local\r\n\r\n")
+  assert.Equal(t,"/minted",response.GetPlainTextBodyString())
+  tlsconn.Close()
+
+  tlsconn,_=openTunnel(t,64144,"minted.local",&tls.Config{InsecureSkipVerify:true})
+  assert.Equal(t,[]string{"minted.local"},tlsconn.ConnectionState().PeerCertificates[0].DNSNames,"CONNECT host should have been used without SNI")
+  tlsconn.Close()
+
+  if len(server.tlsconfig.NameToCertificate)>0 {
+    tlsconn,_=openTunnel(t,64144,"direct.local",&tls.Config{InsecureSkipVerify:true,ServerName:"direct.local"})
+    err=tlsconn.ConnectionState().PeerCertificates[0].CheckSignatureFrom(ca.Certificate)
+    assert.NotNil(t,err,"site handler's certificate should have been used")
+    tlsconn.Close()
+  }
+}
+
+
+/*
+  Starts a TCP server on a random port that echoes all data back. If asProxy is set, each connection first expects a CONNECT
+  request and answers it with the given status.
+ */
+func startEchoServer(t *testing.T, asProxy bool, status int) int {
+  listener,err:=net.Listen("tcp","127.0.0.1:0")
+  if err!=nil {
+    t.Fatalf("could not start echo server: %s",err)
+  }
+  go func() {
+    for {
+      conn,err:=listener.Accept()
+      if err!=nil {
+        return
+      }
+      go func() {
+        defer conn.Close()
+        reader:=bufio.NewReader(conn)
+        if asProxy {
+          request,err:=ReadRequest(reader)
+          if err!=nil || request.Method!="CONNECT" {
+            return
+          }
+          fmt.Fprintf(conn,"HTTP/1.1 %d Whatever\r\nContent-Length: 0\r\n\r\n",status)
+          if status!=200 {
+            return
+          }
+        }
+        io.Copy(conn,reader)
+      }()
+    }
+  }()
+  return listener.Addr().(*net.TCPAddr).Port
+}
+
+func assertEchoTunnel(t *testing.T, port int, target string) {
+  conn,buf:=dialServer(t,port)
+  defer conn.Close()
+  buf.WriteString("CONNECT "+target+" HTTP/1.1\r\n\r\nraw data")
+  buf.Flush()
+  response,err:=ReadResponse(buf.Reader,"CONNECT")
+  assert.Nil(t,err)
+  assert.Equal(t,uint16(200),response.Status)
+  buf.WriteString(" more data")
+  buf.Flush()
+  conn.(*net.TCPConn).CloseWrite()
+  echo,_:=ioutil.ReadAll(buf.Reader)
+  assert.Equal(t,"raw data more data",string(echo),"tunnel should have relayed data byte-for-byte")
+}
+
+/*
+  Makes sure CONNECT requests to hosts without site handler are relayed blindly if the fallback policy allows it.
+ */
+func TestServerFallbackTunnel(t *testing.T) {
+  server,_:=runServer(64145)
+  defer server.Close()
+  server.SetProxySettings(nil)
+  fallback_settings,_:=parseFallbackSettings("deny",map[string]string{"1":"tunnel ^127\\.0\\.0\\.1$"})
+  server.SetFallbackSettings(fallback_settings)
+
+  target:=fmt.Sprintf("127.0.0.1:%d",startEchoServer(t,false,0))
+  assertEchoTunnel(t,64145,target)
+
+  conn,buf:=dialServer(t,64145)
+  defer conn.Close()
+  response:=sendRequestOnConnection(t,buf,"GET http://"+target+"/ HTTP/1.1\r\n\r\n")
+  assert.Equal(t,uint16(403),response.Status,"plain request should have been denied")
+  response.ReadBody()
+  buf.WriteString("CONNECT unhandled.local:443 HTTP/1.1\r\n\r\n")
+  buf.Flush()
+  response,_=ReadResponse(buf.Reader,"CONNECT")
+  assert.Equal(t,uint16(403),response.Status,"unmatched host should have been denied")
+
+  server.SetProxySettings(NewProxySettings("127.0.0.1",startEchoServer(t,true,200)))
+  assertEchoTunnel(t,64145,target)
+
+  server.SetProxySettings(NewProxySettings("127.0.0.1",startEchoServer(t,true,403)))
+  conn,buf=dialServer(t,64145)
+  defer conn.Close()
+  buf.WriteString("CONNECT "+target+" HTTP/1.1\r\n\r\n")
+  buf.Flush()
+  response,_=ReadResponse(buf.Reader,"CONNECT")
+  assert.Equal(t,uint16(403),response.Status,"upstream proxy's response should have been passed on")
+}
+
+/*
+  Makes sure plain requests to hosts without site handler are passed on unchanged if the fallback policy allows it.
+ */
+func TestServerFallbackForward(t *testing.T) {
+  server,_:=runServer(64146)
+  defer server.Close()
+  server.SetProxySettings(nil)
+  fallback_settings,_:=parseFallbackSettings("forward",nil)
+  server.SetFallbackSettings(fallback_settings)
+
+  port,_:=startKeepAliveUpstream(t,nil)
+  conn,buf:=dialServer(t,64146)
+  defer conn.Close()
+  for _,path:=range []string{"/forwarded/1","/forwarded/2"} {
+    response:=sendRequestOnConnection(t,buf,fmt.Sprintf("GET http://127.0.0.1:%d%s HTTP/1.1\r\n\r\n",port,path))
+    assert.Equal(t,uint16(200),response.Status)
+    body,_:=response.ReadBody()
+    assert.Equal(t,path,string(body))
+  }
+}
+
+
+type serverTestCaptureHook struct {
+  exchanges chan *Exchange
+}
+
+func (this *serverTestCaptureHook) CapturesHost(host string) bool {
+  return host!="ignored.local"
+}
+
+func (this *serverTestCaptureHook) CaptureExchange(exchange *Exchange) {
+  this.exchanges<-exchange
+}
+
+func (this *serverTestCaptureHook) next(t *testing.T) *Exchange {
+  select {
+    case exchange:=<-this.exchanges:
+      return exchange
+    case <-time.After(2*time.Second):
+      t.Fatal("no exchange captured")
+  }
+  return nil
+}
+
+/*
+  Makes sure capture hooks receive handled exchanges with bodies, timings, site handler and tunnel information.
+ */
+func TestServerCapturesExchanges(t *testing.T) {
+  server,_:=runServer(64147)
+  defer server.Close()
+  server.SetProxySettings(nil)
+  fallback_settings,_:=parseFallbackSettings("forward",nil)
+  server.SetFallbackSettings(fallback_settings)
+  hook:=&serverTestCaptureHook{exchanges:make(chan *Exchange,10)}
+  server.CaptureHooks=[]CaptureHook{hook}
+
+  port,_:=startKeepAliveUpstream(t,nil)
+  conn,buf:=dialServer(t,64147)
+  defer conn.Close()
+  url:=fmt.Sprintf("http://127.0.0.1:%d/captured",port)
+  sendRequestOnConnection(t,buf,"POST "+url+" HTTP/1.1\r\nContent-Length: 7\r\n\r\npayload")
+  exchange:=hook.next(t)
+  assert.Equal(t,url,exchange.Url)
+  assert.Equal(t,"POST",exchange.Request.Method)
+  assert.Equal(t,"payload",string(exchange.Request.Body))
+  assert.Equal(t,uint16(200),exchange.Response.Status)
+  assert.Equal(t,"/captured",string(exchange.Response.Body))
+  assert.False(t,exchange.Tunneled)
+  assert.Equal(t,"",exchange.SiteHandler)
+  assert.True(t,exchange.Timings.Connect>=0,"new upstream connection should have connect timing")
+  assert.Equal(t,time.Duration(-1),exchange.Timings.TLS)
+
+  sendRequestOnConnection(t,buf,"GET "+url+"/2 HTTP/1.1\r\n\r\n")
+  exchange=hook.next(t)
+  assert.Equal(t,"/captured/2",string(exchange.Response.Body))
+  assert.Equal(t,time.Duration(-1),exchange.Timings.Connect,"pooled upstream connection shouldn't have connect timing")
+
+  response:=sendRequestOnConnection(t,buf,"GET http://ignored.local/ HTTP/1.1\r\n\r\n")
+  assert.NotNil(t,response)
+  select {
+    case exchange=<-hook.exchanges:
+      t.Errorf("excluded host shouldn't have been captured: %s",exchange.Url)
+    case <-time.After(100*time.Millisecond):
+  }
+
+  if !server.SupportsEncryption {
+    log.Warn("skipping tunnel test: encryption not supported")
+    return
+  }
+  tlsconn,tlsbuf:=openTunnel(t,64147,"direct.local",&tls.Config{InsecureSkipVerify:true,ServerName:"direct.local"})
+  defer tlsconn.Close()
+  sendRequestOnConnection(t,tlsbuf,"GET /chunked/3?a=1 HTTP/1.1\r\nHost: direct.local\r\n\r\n")
+  exchange=hook.next(t)
+  assert.Equal(t,"https://direct.local/chunked/3?a=1",exchange.Url)
+  assert.True(t,exchange.Tunneled)
+  assert.Equal(t,"http.ServerTestDirectSiteHandler",exchange.SiteHandler)
+  body,err:=exchange.Response.DecodeBody()
+  assert.Nil(t,err)
+  assert.Equal(t,"/chunked/3?a=1",string(body))
+}
+
+/*
+  Makes sure answered requests are counted in metrics.
+ */
+func TestServerRecordsMetrics(t *testing.T) {
+  server,_:=runServer(64149)
+  defer server.Close()
+  denied:=requestsTotal.Get("GET","403","none","false")
+  handled:=requestsTotal.Get("GET","200","http.ServerTestDirectSiteHandler","false")
+
+  conn,buf:=dialServer(t,64149)
+  response:=sendRequestOnConnection(t,buf,"GET http://does.not.exist/ HTTP/1.1\r\n\r\n")
+  response.ReadBody()
+  response=sendRequestOnConnection(t,buf,"GET http://direct.local/no_encoding/metrics HTTP/1.1\r\nConnection: close\r\n\r\n")
+  response.ReadBody()
+  assertConnectionClosed(t,conn,buf,"connection should have been closed after the response was counted")
+  conn.Close()
+
+  assert.Equal(t,denied+1,requestsTotal.Get("GET","403","none","false"))
+  assert.Equal(t,handled+1,requestsTotal.Get("GET","200","http.ServerTestDirectSiteHandler","false"))
+}
+
+
+type serverTestSlowSiteHandler struct {
+  delay time.Duration
+}
+
+func (this serverTestSlowSiteHandler) HandlesHost(host string) bool {
+  return host=="slow.local"
+}
+
+func (this serverTestSlowSiteHandler) HandleRequest(server *Server, browserio *bufio.ReadWriter, request *Request) {
+  time.Sleep(this.delay)
+  response:=NewResponse()
+  response.Status=200
+  response.Body=[]byte("done")
+  server.WriteResponse(browserio,response)
+}
+
+func (this serverTestSlowSiteHandler) GetCertificateMap() map[string]*tls.Certificate {
+  return map[string]*tls.Certificate{}
+}
+
+func runSlowServer(port int, delay time.Duration) (*Server,chan error) {
+  server:=NewServer()
+  server.AddSiteHandler(serverTestSlowSiteHandler{delay:delay})
+  listening:=make(chan error,1)
+  go func() {
+    listening<-server.Listen(&net.TCPAddr{IP:net.IPv4(127,0,0,1),Port:port})
+  }()
+  time.Sleep(2e8)
+  return server,listening
+}
+
+/*
+  Makes sure shutdowns close idle connections and wait for active requests to finish.
+ */
+func TestServerShutdownDrainsConnections(t *testing.T) {
+  server,listening:=runSlowServer(64150,500*time.Millisecond)
+  defer server.Close()
+
+  idle_conn,idle_buf:=dialServer(t,64150)
+  defer idle_conn.Close()
+  conn,buf:=dialServer(t,64150)
+  defer conn.Close()
+  buf.WriteString("GET http://slow.local/ HTTP/1.1\r\n\r\n")
+  buf.Flush()
+  time.Sleep(1e8)
+
+  responses:=make(chan *Response,1)
+  go func() {
+    response,err:=ReadResponse(buf.Reader,"GET")
+    assert.Nil(t,err)
+    responses<-response
+  }()
+  ctx,cancel:=context.WithTimeout(context.Background(),3*time.Second)
+  defer cancel()
+  assert.Nil(t,server.Shutdown(ctx))
+
+  response:=<-responses
+  if assert.NotNil(t,response) {
+    assert.Equal(t,uint16(200),response.Status)
+    connection,_:=response.Headers.Get("Connection")
+    assert.Equal(t,"close",connection)
+  }
+  assertConnectionClosed(t,idle_conn,idle_buf,"idle connection should have been closed")
+  select {
+    case err:=<-listening:
+      assert.Nil(t,err)
+    case <-time.After(time.Second):
+      t.Errorf("Listen() should have returned")
+  }
+  _,err:=net.Dial("tcp","127.0.0.1:64150")
+  assert.NotNil(t,err,"server shouldn't accept connections anymore")
+}
+
+/*
+  Makes sure shutdowns close active connections once the context expires.
+ */
+func TestServerShutdownClosesConnections(t *testing.T) {
+  server,listening:=runSlowServer(64151,5*time.Second)
+  defer server.Close()
+
+  conn,buf:=dialServer(t,64151)
+  defer conn.Close()
+  buf.WriteString("GET http://slow.local/ HTTP/1.1\r\n\r\n")
+  buf.Flush()
+  time.Sleep(1e8)
+
+  ctx,cancel:=context.WithTimeout(context.Background(),200*time.Millisecond)
+  defer cancel()
+  assert.Equal(t,context.DeadlineExceeded,server.Shutdown(ctx))
+  assertConnectionClosed(t,conn,buf,"active connection should have been closed")
+  select {
+    case err:=<-listening:
+      assert.Nil(t,err)
+    case <-time.After(time.Second):
+      t.Errorf("Listen() should have returned")
+  }
+}
+
+
+type serverTestCorrelationSiteHandler struct {
+  ids chan string
+}
+
+func (this serverTestCorrelationSiteHandler) HandlesHost(host string) bool {
+  return host=="correlated.local"
+}
+
+func (this serverTestCorrelationSiteHandler) HandleRequest(server *Server, browserio *bufio.ReadWriter, request *Request) {
+  this.ids<-request.ID
+  response:=NewResponse()
+  response.Status=200
+  server.WriteResponse(browserio,response)
+}
+
+func (this serverTestCorrelationSiteHandler) GetCertificateMap() map[string]*tls.Certificate {
+  return map[string]*tls.Certificate{}
+}
+
+/*
+  Makes sure requests get correlation IDs made of their connection's ID and sequence number.
+ */
+func TestServerCorrelationIDs(t *testing.T) {
+  handler:=serverTestCorrelationSiteHandler{ids:make(chan string,4)}
+  server:=NewServer()
+  server.AddSiteHandler(handler)
+  go server.Listen(&net.TCPAddr{IP:net.IPv4(127,0,0,1),Port:64152})
+  defer server.Close()
+  time.Sleep(2e8)
+
+  var connection_ids []string
+  for count:=0;count<2;count++ {
+    conn,buf:=dialServer(t,64152)
+    for request:=1;request<=2;request++ {
+      sendRequestOnConnection(t,buf,"GET http://correlated.local/ HTTP/1.1\r\n\r\n").ReadBody()
+      id:=<-handler.ids
+      assert.Regexp(t,regexp.MustCompile(fmt.Sprintf(`^[0-9a-f]{8}-\d+-%d$`,request)),id)
+      connection_ids=append(connection_ids,id[:strings.LastIndex(id,"-")])
+    }
+    conn.Close()
+  }
+  assert.Equal(t,connection_ids[0],connection_ids[1],"requests on the same connection should share the connection ID")
+  assert.NotEqual(t,connection_ids[1],connection_ids[2],"connections should have different IDs")
+}
+
+
+type serverTestLogSink struct {
+  lines []string
+  mutex sync.Mutex
+}
+
+func (this *serverTestLogSink) Write(level log.Level, message string) error {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  this.lines=append(this.lines,message)
+  return nil
+}
+
+func (this *serverTestLogSink) Close() error {
+  return nil
+}
+
+func (this *serverTestLogSink) getLines() []string {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  return append([]string(nil),this.lines...)
+}
+
+type serverTestForwardingSiteHandler struct {
+  ids chan string
+}
+
+func (this serverTestForwardingSiteHandler) HandlesHost(host string) bool {
+  return host=="logged.local"
+}
+
+func (this serverTestForwardingSiteHandler) HandleRequest(server *Server, browserio *bufio.ReadWriter, request *Request) {
+  this.ids<-request.ID
+  server.ServeForwarded(this,browserio,request)
+}
+
+func (this serverTestForwardingSiteHandler) GetCertificateMap() map[string]*tls.Certificate {
+  return map[string]*tls.Certificate{}
+}
+
+/*
+  Makes sure every message logged while serving a request includes its correlation ID, or its connection's ID before the request
+  was read: from accepting the connection through the site handler, middleware, upstream connection and connection pool until
+  the connection is closed.
+ */
+func TestServerLogsCorrelationIDs(t *testing.T) {
+  listener,err:=net.Listen("tcp","127.0.0.1:0")
+  if err!=nil {
+    t.Fatalf("could not start upstream: %s",err)
+  }
+  defer listener.Close()
+  go go_http.Serve(listener,go_http.HandlerFunc(func(writer go_http.ResponseWriter, request *go_http.Request) {
+    writer.Write([]byte("upstream"))
+  }))
+
+  handler:=serverTestForwardingSiteHandler{ids:make(chan string,1)}
+  server:=NewServer()
+  server.AddSiteHandler(handler)
+  server.SetProxySettings(NewProxySettings("127.0.0.1",listener.Addr().(*net.TCPAddr).Port))
+  server.SetMiddlewares([]Middleware{func(next RoundTripFunc) RoundTripFunc {
+    return func(request *Request) (*Response,error) {
+      request.Logger().Debug("passing request on")
+      return next(request)
+    }
+  }})
+  go server.Listen(&net.TCPAddr{IP:net.IPv4(127,0,0,1),Port:64157})
+  defer server.Close()
+  time.Sleep(2e8)
+
+  sink:=&serverTestLogSink{}
+  previous:=log.CurrentSettings
+  settings:=log.MergeSettings(log.NewSettings(),previous)
+  settings.Format=log.TEXT
+  settings.Prefixes["hopgoblin/"]=log.TRACE
+  settings.Sinks=map[string][]log.Sink{"hopgoblin/":[]log.Sink{sink}}
+  log.ReplaceSettings(settings)
+  defer log.ReplaceSettings(previous)
+
+  conn,err:=net.Dial("tcp","127.0.0.1:64157")
+  if err!=nil {
+    t.Fatalf("could not connect to server: %s",err)
+  }
+  io.WriteString(conn,"GET http://logged.local/ HTTP/1.1\r\nHost: logged.local\r\n\r\n") //not using this package, it would log too
+  response,err:=go_http.ReadResponse(bufio.NewReader(conn),nil)
+  if assert.Nil(t,err) {
+    body,_:=ioutil.ReadAll(response.Body)
+    assert.Equal(t,"upstream",string(body))
+  }
+  conn.Close()
+  time.Sleep(2e8)
+  log.ReplaceSettings(previous)
+
+  request_id:=<-handler.ids
+  connection_id:=request_id[:strings.LastIndex(request_id,"-")]
+  matcher:=regexp.MustCompile(`: \[`+regexp.QuoteMeta(connection_id)+`(-\d+)?\] `)
+  lines:=sink.getLines()
+  messages:=strings.Join(lines,"\n")
+  for _,line:=range lines {
+    assert.Regexp(t,matcher,line,"message should have included correlation ID")
+  }
+  for _,expected:=range []string{"got connection","["+request_id+"] got line","passing request on","connecting to 127.0.0.1:",
+                                  "starting to read response","got Content-Length header"} {
+    assert.Contains(t,messages,expected)
+  }
+}
+
+type serverTestUserSiteHandler struct {
+}
+
+func (this serverTestUserSiteHandler) HandlesHost(host string) bool {
+  return host=="users.local"
+}
+
+func (this serverTestUserSiteHandler) HandleRequest(server *Server, browserio *bufio.ReadWriter, request *Request) {
+  _,found:=request.Headers.Get("Proxy-Authorization")
+  response:=NewResponse()
+  response.Status=200
+  response.Body=[]byte(fmt.Sprintf("%s %t",request.User,found))
+  server.WriteResponse(browserio,response)
+}
+
+func (this serverTestUserSiteHandler) GetCertificateMap() map[string]*tls.Certificate {
+  return map[string]*tls.Certificate {
+    "users.local":utils.LoadCertificate(utils.GetResourcePath("certs"),"test"),
+  }
+}
+
+/*
+  Makes sure clients need valid proxy credentials for both plain and CONNECT requests if proxy authentication is enabled, and site
+  handlers see the user name instead of the credentials.
+ */
+func TestServerProxyAuthentication(t *testing.T) {
+  filename,cleanup:=writeCredentialsFile(t,"alice:secret\n")
+  defer cleanup()
+  server,_:=runServer(64153)
+  defer server.Close()
+  server.AddSiteHandler(serverTestUserSiteHandler{})
+  authenticator,_:=NewProxyAuthenticator(filename,"test")
+  server.SetAuthenticator(authenticator)
+  credentials:="Proxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n"
+
+  conn,buf:=dialServer(t,64153)
+  defer conn.Close()
+  response:=sendRequestOnConnection(t,buf,"GET http://users.local/ HTTP/1.1\r\n\r\n")
+  response.ReadBody()
+  assert.Equal(t,uint16(407),response.Status)
+  challenge,_:=response.Headers.Get("Proxy-Authenticate")
+  assert.Equal(t,`Basic realm="test", charset="UTF-8"`,challenge)
+  response=sendRequestOnConnection(t,buf,"GET http://users.local/ HTTP/1.1\r\nProxy-Authorization: Basic YWxpY2U6d3Jvbmc=\r\n\r\n")
+  response.ReadBody()
+  assert.Equal(t,uint16(407),response.Status,"wrong password should have been rejected")
+  response=sendRequestOnConnection(t,buf,"GET http://users.local/ HTTP/1.1\r\n"+credentials+"\r\n")
+  assert.Equal(t,uint16(200),response.Status,"client should be able to retry on the same connection")
+  assert.Equal(t,"alice false",response.GetPlainTextBodyString(),"user should have been set and credentials removed")
+
+  response=sendRequestOnConnection(t,buf,"CONNECT users.local:443 HTTP/1.1\r\n\r\n")
+  assert.Equal(t,uint16(407),response.Status,"CONNECT requests should need credentials too")
+  response.ReadBody()
+  if !server.SupportsEncryption {
+    log.Warn("skipping tunnel test: encryption not supported")
+    return
+  }
+  buf.WriteString("CONNECT users.local:443 HTTP/1.1\r\n"+credentials+"\r\n")
+  buf.Flush()
+  response,err:=ReadResponse(buf.Reader,"CONNECT")
+  if !assert.Nil(t,err) || !assert.Equal(t,uint16(200),response.Status) {
+    return
+  }
+  tlsconn:=tls.Client(conn,&tls.Config{InsecureSkipVerify:true})
+  tlsbuf:=bufio.NewReadWriter(bufio.NewReader(tlsconn),bufio.NewWriter(tlsconn))
+  response=sendRequestOnConnection(t,tlsbuf,"GET / HTTP/1.1\r\nHost: users.local\r\n\r\n")
+  assert.Equal(t,"alice false",response.GetPlainTextBodyString(),"requests inside the tunnel should inherit the user")
+}
+
+/*
+  Makes sure connections from addresses the access list doesn't allow are closed right away and counted.
+ */
+func TestServerAccessList(t *testing.T) {
+  server,_:=runServer(64154)
+  defer server.Close()
+  rejected:=rejectedConnections.Get()
+
+  access_list,_:=parseAccessList("","127.0.0.0/8")
+  server.SetAccessList(access_list)
+  conn,buf:=dialServer(t,64154)
+  assertConnectionClosed(t,conn,buf,"connection from denied address should have been closed")
+  conn.Close()
+  assert.Equal(t,rejected+1,rejectedConnections.Get())
+
+  access_list,_=parseAccessList("127.0.0.1","")
+  server.SetAccessList(access_list)
+  conn,buf=dialServer(t,64154)
+  defer conn.Close()
+  response:=sendRequestOnConnection(t,buf,"GET http://direct.local/no_encoding/allowed HTTP/1.1\r\n\r\n")
+  assert.Equal(t,uint16(200),response.Status)
+  assert.Equal(t,rejected+1,rejectedConnections.Get())
+}
+
+/*
+  Makes sure reloading a configuration with invalid proxy settings is rejected, and the server keeps serving requests with the
+  previous settings instead of failing once a request needs a client.
+ */
+func TestServerReloadInvalidProxySettings(t *testing.T) {
+  server,_:=runServer(64155)
+  defer server.Close()
+  defer utils.ReplaceAppConfiguration(utils.ParseINIFile(utils.GetResourcePath("application.ini")))
+
+  valid:=map[string]string{"proxy.mode":"direct","fallback.policy":"forward"}
+  assert.Nil(t,utils.ReplaceAppConfiguration(&valid))
+  server.Reload()
+  invalid:=map[string]string{"proxy.mode":"upstream","proxy.host":"127.0.0.1","proxy.port":"invalid","fallback.policy":"forward"}
+  assert.NotNil(t,utils.ReplaceAppConfiguration(&invalid),"invalid proxy settings should have been rejected")
+  server.Reload()
+  assert.Nil(t,server.getProxySettings(),"previous proxy settings should have been kept")
+
+  port,_:=startKeepAliveUpstream(t,nil)
+  conn,buf:=dialServer(t,64155)
+  defer conn.Close()
+  response:=sendRequestOnConnection(t,buf,fmt.Sprintf("GET http://127.0.0.1:%d/reloaded HTTP/1.1\r\n\r\n",port))
+  assert.Equal(t,uint16(200),response.Status)
+  body,_:=response.ReadBody()
+  assert.Equal(t,"/reloaded",string(body))
+}
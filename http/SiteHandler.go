@@ -6,6 +6,8 @@ package http
 import (
   "bufio"
   "crypto/tls"
+  "fmt"
+  "strings"
 )
 
 
@@ -24,3 +26,18 @@ type SiteHandler interface {
   HandleRequest(server *Server, buf *bufio.ReadWriter, request *Request) //TODO: clear up, probably change buf to Writer
   GetCertificateMap() map[string]*tls.Certificate
 }
+
+/*
+  Site handlers can implement this interface in addition to SiteHandler to list the host regexes they're responsible for, e.g. in
+  the admin API.
+ */
+type HostPatternSiteHandler interface {
+  GetHostPatterns() []string
+}
+
+/*
+  Returns a site handler's type name, e.g. "sitehandlers.RuleHandler".
+ */
+func GetSiteHandlerName(handler SiteHandler) string {
+  return strings.TrimPrefix(fmt.Sprintf("%T",handler),"*")
+}
@@ -0,0 +1,276 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "bufio"
+  "errors"
+  "io"
+  "strconv"
+  "strings"
+  "github.com/rinusser/hopgoblin/log"
+)
+
+
+/*
+  Message body stream: reads the raw body data (including any transfer encoding) from the underlying connection.
+  Closing the stream invokes the optional closer, e.g. to close the connection the body is read from.
+ */
+type bodyReader struct {
+  reader io.Reader
+  closer func() error
+  closed bool
+  complete bool //whether the entire body was read
+}
+
+/*
+  Creates a stream for a message without body.
+ */
+func newEmptyBodyReader(closer func() error) *bodyReader {
+  return &bodyReader {
+    reader: strings.NewReader(""),
+    closer: closer,
+    complete: true,
+  }
+}
+
+/*
+  required by io.Reader interface
+ */
+func (this *bodyReader) Read(out []byte) (int,error) {
+  size,err:=this.reader.Read(out)
+  if err==io.EOF {
+    this.complete=true
+  }
+  return size,err
+}
+
+/*
+  required by io.Closer interface
+ */
+func (this *bodyReader) Close() error {
+  if this.closed {
+    return nil
+  }
+  this.closed=true
+  if this.closer!=nil {
+    return this.closer()
+  }
+  return nil
+}
+
+
+/*
+  Checks whether a body stream is known to contain no further data, without reading from it. Messages without body stream count
+  as empty too, since their body is buffered.
+ */
+func isBodyKnownEmpty(stream io.ReadCloser) bool {
+  if stream==nil {
+    return true
+  }
+  if recorder,ok:=stream.(*recordingReader);ok {
+    stream=recorder.ReadCloser
+  }
+  reader,ok:=stream.(*bodyReader)
+  return ok && reader.complete
+}
+
+
+/*
+  Reads a message body in "chunked" transfer encoding, returning the raw data including the chunk framing.
+  The reader stops after the last chunk's trailer, so any following message in the input stream stays untouched.
+ */
+type chunkedPassthroughReader struct {
+  in *bufio.Reader
+  remaining int      //bytes left in current chunk, including the CRLF after the chunk data
+  pending []byte     //framing data that wasn't returned to the caller yet
+  lastChunk bool     //whether the 0-length chunk was found
+  done bool
+  logger log.CorrelatedLogger
+}
+
+func newChunkedPassthroughReader(in *bufio.Reader, logger log.CorrelatedLogger) *chunkedPassthroughReader {
+  return &chunkedPassthroughReader{in:in,logger:logger}
+}
+
+/*
+  required by io.Reader interface
+ */
+func (this *chunkedPassthroughReader) Read(out []byte) (int,error) {
+  if len(this.pending)>0 {
+    size:=copy(out,this.pending)
+    this.pending=this.pending[size:]
+    return size,nil
+  }
+  if this.done {
+    return 0,io.EOF
+  }
+
+  if this.remaining<=0 {
+    err:=this.readFraming()
+    if err!=nil {
+      return 0,err
+    }
+    return this.Read(out)
+  }
+
+  if len(out)>this.remaining {
+    out=out[0:this.remaining]
+  }
+  size,err:=this.in.Read(out)
+  this.remaining-=size
+  if err==io.EOF {
+    err=io.ErrUnexpectedEOF
+  }
+  return size,err
+}
+
+func (this *chunkedPassthroughReader) readFraming() error {
+  line,err:=this.in.ReadString('\n')
+  if err!=nil {
+    if err==io.EOF {
+      err=io.ErrUnexpectedEOF
+    }
+    return err
+  }
+  this.pending=[]byte(line)
+
+  if this.lastChunk {
+    if strings.TrimSpace(line)=="" {
+      this.logger.Trace("handled end chunk trailer, stopping read")
+      this.done=true
+    }
+    return nil
+  }
+
+  size,err:=parseChunkSize(line)
+  if err!=nil {
+    return err
+  }
+  this.logger.Trace("found chunk with size %d (%sh)",size,strings.TrimSpace(line))
+
+  if size==0 {
+    this.lastChunk=true
+  } else {
+    this.remaining=int(size)+2 //includes \r\n at end of chunk
+  }
+  return nil
+}
+
+
+/*
+  Determines how the Transfer-Encoding header frames the message body. Returns whether the last transfer coding is "chunked", so
+  the body ends with the last chunk, and whether there are any transfer codings at all: if there are, any Content-Length header
+  must be ignored.
+ */
+func getTransferFraming(headers *Headers) (chunked bool, found bool) {
+  codings:=headers.Values("Transfer-Encoding")
+  if len(codings)==0 {
+    return false,false
+  }
+  return strings.EqualFold(codings[len(codings)-1],"chunked"),true
+}
+
+/*
+  Checks whether a request's body can be framed: requests with transfer codings must have "chunked" as their last and only chunked
+  coding, otherwise the request's end can't be determined (RFC 7230, section 3.3.3).
+ */
+func hasValidRequestFraming(headers *Headers) bool {
+  chunked,found:=getTransferFraming(headers)
+  if !found {
+    return true
+  }
+  if !chunked {
+    return false
+  }
+  codings:=headers.Values("Transfer-Encoding")
+  for _,coding:=range codings[:len(codings)-1] {
+    if strings.EqualFold(coding,"chunked") {
+      return false
+    }
+  }
+  return true
+}
+
+/*
+  Returned for messages with invalid Content-Length headers, see getContentLength().
+ */
+var errInvalidContentLength=errors.New("invalid Content-Length")
+
+/*
+  Determines the body length given in the Content-Length header, and whether there is one. Every value must be a non-negative
+  decimal number, and multiple values (in a list or repeated headers) must all be identical: anything else could be interpreted
+  differently by other recipients, so it's an error (RFC 7230, section 3.3.3).
+ */
+func getContentLength(headers *Headers) (int64,bool,error) {
+  if len(headers.GetAll("Content-Length"))==0 {
+    return 0,false,nil
+  }
+  values:=headers.Values("Content-Length")
+  if len(values)==0 {
+    return 0,true,errInvalidContentLength
+  }
+  for _,value:=range values {
+    if value!=values[0] || strings.TrimLeft(value,"0123456789")!="" {
+      return 0,true,errInvalidContentLength
+    }
+  }
+  length,err:=strconv.ParseInt(values[0],10,64)
+  if err!=nil {
+    return 0,true,errInvalidContentLength
+  }
+  return length,true,nil
+}
+
+/*
+  Reader failing with the given error, for bodies that can't be read.
+ */
+type failingReader struct {
+  err error
+}
+
+/*
+  required by io.Reader interface
+ */
+func (this failingReader) Read(out []byte) (int,error) {
+  return 0,this.err
+}
+
+/*
+  Creates a stream for the message body following the given headers.
+
+  The body is framed by the "chunked" transfer coding if it's the last one in the Transfer-Encoding header, otherwise by the
+  Content-Length header. If neither is present the message is considered to have no body, unless readUntilEOF is set: then the
+  body extends until the connection is closed (as is the case with some HTTP responses). Messages with other transfer codings
+  extend until the connection is closed too, their Content-Length is ignored. Reading bodies with an invalid Content-Length fails,
+  see getContentLength().
+  Messages about the body are logged through the given logger.
+ */
+func newBodyReader(in *bufio.Reader, headers *Headers, readUntilEOF bool, closer func() error, logger log.CorrelatedLogger) *bodyReader {
+  length,found_content_length,length_err:=getContentLength(headers)
+  chunked,found_xfer_encoding:=getTransferFraming(headers)
+
+  var reader io.Reader
+  if chunked {
+    reader=newChunkedPassthroughReader(in,logger)
+  } else if found_xfer_encoding && readUntilEOF {
+    reader=in
+  } else if found_xfer_encoding {
+    return newEmptyBodyReader(closer)
+  } else if length_err!=nil {
+    reader=failingReader{length_err}
+  } else if found_content_length {
+    logger.Trace("got Content-Length header: value=%d",length)
+    reader=io.LimitReader(in,length)
+  } else if readUntilEOF {
+    reader=in
+  } else {
+    return newEmptyBodyReader(closer)
+  }
+
+  return &bodyReader {
+    reader: reader,
+    closer: closer,
+  }
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "bufio"
+  "io/ioutil"
+  "strings"
+  "github.com/rinusser/hopgoblin/log"
+)
+
+
+/*
+  Makes sure body streams stop at the end of the message body, leaving any following data in the input stream.
+ */
+func TestBodyReaderStopsAtEndOfBody(t *testing.T) {
+  cases:=[][]string {
+    //header                                                  body                                     following data
+    {"Content-Length: 4",                                     "abcd",                                  "GET / HTTP/1.1\r\n\r\n"},
+    {"Transfer-Encoding: chunked",                            "3\r\nabc\r\n1;ext=1\r\nd\r\n0\r\n\r\n", "GET / HTTP/1.1\r\n\r\n"},
+    {"Transfer-Encoding: chunked",                            "2\r\nab\r\n0\r\nX-Trailer: 1\r\n\r\n",  "next"},
+    {"Transfer-Encoding: gzip, chunked",                      "2\r\nab\r\n0\r\n\r\n",                  "GET / HTTP/1.1\r\n\r\n"},
+    {"Transfer-Encoding: gzip\r\nTransfer-Encoding: Chunked", "2\r\nab\r\n0\r\n\r\n",                  "next"},
+    {"Transfer-Encoding: chunked\r\nContent-Length: 1",       "2\r\nab\r\n0\r\n\r\n",                  "next"},
+    {"X-Nothing: here",                                       "",                                      "GET / HTTP/1.1\r\n\r\n"},
+  }
+  for _,c:=range cases {
+    headers:=ParseHeaders(c[0]+"\r\n\r\n")
+    in:=bufio.NewReader(strings.NewReader(c[1]+c[2]))
+    body,err:=ioutil.ReadAll(newBodyReader(in,headers,false,nil,log.CorrelatedLogger{}))
+    assert.Nil(t,err,c[0])
+    assert.Equal(t,c[1],string(body),"body: "+c[0])
+    rest,_:=ioutil.ReadAll(in)
+    assert.Equal(t,c[2],string(rest),"remaining input: "+c[0])
+  }
+}
+
+/*
+  Makes sure bodies without length information are read until the end of the input if requested.
+ */
+func TestBodyReaderUntilEOF(t *testing.T) {
+  in:=bufio.NewReader(strings.NewReader("all\r\nthe\r\n\r\nrest"))
+  body,err:=ioutil.ReadAll(newBodyReader(in,NewHeaders(),true,nil,log.CorrelatedLogger{}))
+  assert.Nil(t,err)
+  assert.Equal(t,"all\r\nthe\r\n\r\nrest",string(body))
+}
+
+/*
+  Makes sure bodies with transfer codings not ending in "chunked" are read until the end of the input, ignoring Content-Length.
+ */
+func TestBodyReaderUnchunkedTransferEncoding(t *testing.T) {
+  headers:=ParseHeaders("Transfer-Encoding: chunked, gzip\r\nContent-Length: 2\r\n\r\n")
+  in:=bufio.NewReader(strings.NewReader("2\r\nab\r\n0\r\n\r\nrest"))
+  body,err:=ioutil.ReadAll(newBodyReader(in,headers,true,nil,log.CorrelatedLogger{}))
+  assert.Nil(t,err)
+  assert.Equal(t,"2\r\nab\r\n0\r\n\r\nrest",string(body))
+}
+
+/*
+  Makes sure Content-Length headers are only accepted if all their values are the same non-negative decimal number.
+ */
+func TestGetContentLength(t *testing.T) {
+  valid:=map[string]int64 {
+    "Content-Length: 4":                        4,
+    "Content-Length: 0":                        0,
+    "Content-Length:  12 ":                     12,
+    "Content-Length: 10, 10":                   10,
+    "Content-Length: 10\r\nContent-Length: 10": 10,
+  }
+  for header,expected:=range valid {
+    length,found,err:=getContentLength(ParseHeaders(header+"\r\n\r\n"))
+    assert.Nil(t,err,header)
+    assert.True(t,found,header)
+    assert.Equal(t,expected,length,header)
+  }
+
+  invalid:=[]string {
+    "Content-Length: abc",
+    "Content-Length: -5",
+    "Content-Length: +5",
+    "Content-Length: 0x10",
+    "Content-Length: 4 bytes",
+    "Content-Length: 10, 20",
+    "Content-Length: 10\r\nContent-Length: 20",
+    "Content-Length: 10\r\nContent-Length: 010",
+    "Content-Length: ",
+    "Content-Length: 99999999999999999999",
+  }
+  for _,header:=range invalid {
+    _,found,err:=getContentLength(ParseHeaders(header+"\r\n\r\n"))
+    assert.Equal(t,errInvalidContentLength,err,header)
+    assert.True(t,found,header)
+  }
+
+  _,found,err:=getContentLength(NewHeaders())
+  assert.Nil(t,err)
+  assert.False(t,found)
+
+  headers:=ParseHeaders("Content-Length: 1, 2\r\n\r\n")
+  _,err=ioutil.ReadAll(newBodyReader(bufio.NewReader(strings.NewReader("ab")),headers,false,nil,log.CorrelatedLogger{}))
+  assert.Equal(t,errInvalidContentLength,err,"reading body with invalid Content-Length should have failed")
+}
+
+/*
+  Makes sure requests are only accepted if their transfer codings end with a single "chunked".
+ */
+func TestValidRequestFraming(t *testing.T) {
+  cases:=map[string]bool {
+    "Content-Length: 4":                                   true,
+    "Transfer-Encoding: chunked":                          true,
+    "Transfer-Encoding: gzip, chunked":                    true,
+    "Transfer-Encoding: gzip\r\nTransfer-Encoding: chunked": true,
+    "Transfer-Encoding: gzip":                             false,
+    "Transfer-Encoding: chunked, gzip":                    false,
+    "Transfer-Encoding: chunked, chunked":                 false,
+  }
+  for header,expected:=range cases {
+    assert.Equal(t,expected,hasValidRequestFraming(ParseHeaders(header+"\r\n\r\n")),header)
+  }
+}
+
+/*
+  Makes sure invalid or truncated chunked bodies result in errors instead of panics.
+ */
+func TestChunkedPassthroughReaderErrors(t *testing.T) {
+  cases:=[]string {
+    "x\r\nabc\r\n0\r\n\r\n",
+    "5\r\nabc",
+    "3\r\nabc\r\n",
+  }
+  headers:=NewHeaders()
+  headers.Set("Transfer-Encoding","chunked")
+  for _,input:=range cases {
+    _,err:=ioutil.ReadAll(newBodyReader(bufio.NewReader(strings.NewReader(input)),headers,false,nil,log.CorrelatedLogger{}))
+    assert.NotNil(t,err,"input %q should have failed",input)
+  }
+}
+
+/*
+  Makes sure closing a body stream calls the closer exactly once.
+ */
+func TestBodyReaderClose(t *testing.T) {
+  calls:=0
+  reader:=newBodyReader(bufio.NewReader(strings.NewReader("")),NewHeaders(),false,func() error {
+    calls++
+    return nil
+  },log.CorrelatedLogger{})
+  reader.Close()
+  reader.Close()
+  assert.Equal(t,1,calls)
+}
@@ -7,6 +7,7 @@ import (
   "bufio"
   "bytes"
   "fmt"
+  "io"
   "strconv"
   "strings"
   "github.com/rinusser/hopgoblin/log"
@@ -45,63 +46,84 @@ func ChunkEncodeBody(input string, initial_chunk_size int, size_delta int) []byt
   return []byte(builder.String())
 }
 
+/*
+  Upper bound for a single chunk's size, larger sizes are treated as malformed input.
+ */
+const maxChunkSize=1<<31-1
+
+/*
+  Parses a chunk's size line, ignoring any chunk extensions (";name=value").
+ */
+func parseChunkSize(line string) (int64,error) {
+  size_text:=strings.TrimSpace(line)
+  extension_pos:=strings.Index(size_text,";")
+  if extension_pos>=0 {
+    size_text=strings.TrimSpace(size_text[0:extension_pos])
+  }
+  size,err:=strconv.ParseUint(size_text,16,64)
+  if err!=nil || size>maxChunkSize {
+    return 0,fmt.Errorf("got invalid chunk size text '%v'",line)
+  }
+  return int64(size),nil
+}
+
 func chunkDecodeBody(in *bufio.Reader, data_out *bytes.Buffer, encoding_out *bytes.Buffer) error {
   for {
     chunk_size_text,err:=in.ReadString('\n')
-    if err!=nil { panic(err) }
+    if err!=nil { return err }
     if encoding_out!=nil {
       encoding_out.WriteString(chunk_size_text)
     }
-    chunk_size_uint64,err:=strconv.ParseInt(strings.TrimSpace(chunk_size_text),16,32)
-    if err!=nil { panic(fmt.Sprintf("got invalid chunk size text '%v'",chunk_size_text)) }
-    chunk_size:=int(chunk_size_uint64)
+    chunk_size,err:=parseChunkSize(chunk_size_text)
+    if err!=nil { return err }
     log.Trace("found chunk with size %d (%sh)",chunk_size,strings.TrimSpace(chunk_size_text))
 
-    remaining:=chunk_size+2 //includes \r\n at end of chunk
-    for {
-      burst:=make([]byte,remaining)
-      size,err:=in.Read(burst)
-      if err!=nil { panic(err) }
-      log.Debug("got chunk data: read %d of %d bytes left in chunk",size,remaining)
-      remaining-=size
-      payload:=[]byte{}
-      encoding:=[]byte{}
-      if remaining>=2 {
-        payload=burst[0:size]
-      } else {
-        log.Trace("size=%d, remaining=%d",size,remaining)
-        if size>=2 {
-          payload=burst[0:size-2+remaining]
-          encoding=burst[size-2+remaining:size]
-        } else {
-          encoding=burst[:size]
-        }
-      }
-      data_out.Write(payload)
-      if encoding_out!=nil {
-        encoding_out.Write(encoding)
-      }
-      if remaining<=0 {
-        break
-      }
+    if chunk_size==0 {
+      break
+    }
+
+    _,err=io.CopyN(data_out,in,chunk_size)
+    if err==io.EOF {
+      err=io.ErrUnexpectedEOF
+    }
+    if err!=nil { return err }
+    chunk_end,err:=in.ReadString('\n')
+    if err!=nil { return err }
+    if strings.TrimSpace(chunk_end)!="" {
+      return fmt.Errorf("got unexpected data after chunk: '%v'",chunk_end)
     }
+    if encoding_out!=nil {
+      encoding_out.WriteString(chunk_end)
+    }
+  }
 
-    if chunk_size==0 {
-      log.Trace("handled end chunk, stopping read")
+  //the last chunk is followed by optional trailer fields and an empty line
+  for {
+    line,err:=in.ReadString('\n')
+    if err!=nil { return err }
+    if encoding_out!=nil {
+      encoding_out.WriteString(line)
+    }
+    if strings.TrimSpace(line)=="" {
       break
     }
+    log.Trace("skipping chunk trailer field: %s",strings.TrimSpace(line))
   }
+  log.Trace("handled end chunk, stopping read")
 
   return nil
 }
 
 /*
   Decodes HTTP body with "chunked" transfer encoding.
-  Will panic if data isn't encoded properly.
+  Returns an error if the data isn't encoded properly.
  */
-func ChunkDecodeBody(input []byte) []byte {
+func ChunkDecodeBody(input []byte) ([]byte,error) {
   buf:=&bytes.Buffer{}
   in:=bufio.NewReader(bytes.NewReader(input))
-  /*err:=*/chunkDecodeBody(in,buf,nil)
-  return buf.Bytes()
+  err:=chunkDecodeBody(in,buf,nil)
+  if err!=nil {
+    return nil,err
+  }
+  return buf.Bytes(),nil
 }
@@ -24,11 +24,34 @@ func TestChunkEncodeBody(t *testing.T) {
  */
 func TestChunkDecodeBody(t *testing.T) {
   cases:=[][]string {
-    {"10\r\nABCDEFGHIJKLMNOP\r\n5\r\nQRSTU\r\n0\r\n\r\n","ABCDEFGHIJKLMNOPQRSTU"},
+    {"10\r\nABCDEFGHIJKLMNOP\r\n5\r\nQRSTU\r\n0\r\n\r\n",          "ABCDEFGHIJKLMNOPQRSTU"},
+    {"3;name=value\r\nabc\r\n2 ; x\r\nde\r\n0;last\r\n\r\n",         "abcde"},
+    {"3\r\nabc\r\n0\r\nExpires: never\r\nX-Checksum: 1\r\n\r\n","abc"},
   }
   for _,c:=range cases {
     input:=[]byte(c[0])
-    actual:=string(ChunkDecodeBody(input))
-    assert.Equal(t,c[1],actual)
+    actual,err:=ChunkDecodeBody(input)
+    assert.Nil(t,err)
+    assert.Equal(t,c[1],string(actual))
+  }
+}
+
+/*
+  Makes sure ChunkDecodeBody() returns errors for malformed input instead of panicking.
+ */
+func TestChunkDecodeBodyErrors(t *testing.T) {
+  cases:=[]string {
+    "x\r\nabc\r\n0\r\n\r\n",
+    "5\r\nabc",
+    "3\r\nabc\r\n",
+    "-3\r\nabc\r\n0\r\n\r\n",
+    "ffffffffff\r\nabc\r\n0\r\n\r\n",
+    "3\r\nabcdef\r\n0\r\n\r\n",
+    "3\r\nabc\r\n0\r\nExpires: never\r\n",
+    "",
+  }
+  for _,input:=range cases {
+    _,err:=ChunkDecodeBody([]byte(input))
+    assert.NotNil(t,err,"input %q should have failed",input)
   }
 }
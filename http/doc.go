@@ -5,6 +5,17 @@
   Package handles HTTP messages and network I/O.
   Handles HTTP requests/responses, communication with proxy servers, TLS encryption and so on.
 
+  Message bodies are streamed: ReadRequest() and ReadResponse() only read the message header and leave the body in the message's
+  BodyStream, Request.Write() and Response.Write() pass streamed bodies on as they arrive. Call ReadBody() if you need the entire
+  body in memory.
+
+  Response.DecodeBody() removes transfer and content codings (chunked, gzip, deflate, br or any stack thereof) from response
+  bodies, Response.EncodeBody() and Response.ModifyBody() write modified bodies back encoded. Additional codings can be added with
+  RegisterCodec().
+
+  The Server assigns each connection and request a correlation ID (see Request.ID) and includes it in all messages logged while
+  serving the request. Site handlers and middleware should log through Request.Logger() so their messages include it too.
+
   The Client code will use a CA certificate pool to validate remote certificates consisting of the system's list of CA
   certificates, and any additional certificate files from the resources/certs/ directory that start with "CA-". Currently there's
   no need to add additional CA certificates, as remote certificate checks are disabled.
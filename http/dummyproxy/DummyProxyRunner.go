@@ -39,10 +39,13 @@ func initHook() {
 
 /*
   Wrapper for dummy proxy.
-  Change port as required.
+  Change port as required, set SOCKS5 to run the proxy in SOCKS5 mode.
  */
 type DummyProxyRunner struct {
   Port int
+  SOCKS5 bool     //whether to start the proxy in SOCKS5 mode
+  User string     //SOCKS5 user name to require, empty to not require authentication
+  Password string
   proc *exec.Cmd
   stdout io.ReadCloser
   stderr io.ReadCloser
@@ -63,7 +66,11 @@ func NewDummyProxyRunner() DummyProxyRunner {
   Will spawn a new process that waits and handles one connection, then exits.
  */
 func (this *DummyProxyRunner) Start() error {
-  proc:=exec.Command(proxyPath,fmt.Sprintf("--port=%d",this.Port),log.AssemblePassthroughArg())
+  args:=[]string{fmt.Sprintf("--port=%d",this.Port)}
+  if this.SOCKS5 {
+    args=append(args,"--socks5","--socks5-user="+this.User,"--socks5-password="+this.Password)
+  }
+  proc:=exec.Command(proxyPath,append(args,log.AssemblePassthroughArg())...)
   this.proc=proc
 
   this.stdout,_=proc.StdoutPipe()
@@ -5,9 +5,12 @@ package main
 
 import (
   "bufio"
+  "errors"
   "fmt"
+  "io"
   "net"
   "os"
+  "strconv"
   "strings"
   "time"
   "github.com/rinusser/hopgoblin/http"
@@ -20,8 +23,14 @@ import (
 
   This would be better suited in the "dummyproxy" package, but needs parts of the "http" package. In package http's tests this
   results in import loops. So either the http package needs to be messed up, or this - better this.
+
+  In SOCKS5 mode connections start with a SOCKS5 handshake instead, the requested target address is printed as
+  "SOCKS5 CONNECT <host>:<port>". Tunnels to port 443 are upgraded to TLS, requests inside the tunnel are answered as usual.
 */
 type DummyHTTPProxy struct {
+  SOCKS5 bool     //whether to act as SOCKS5 proxy
+  User string     //SOCKS5 user name to require, empty to not require authentication
+  Password string
 }
 
 /*
@@ -36,7 +45,7 @@ func NewHTTPProxy() *DummyHTTPProxy {
   Starts the dummy proxy, will listen on the passed TCP port, handle a connection and return.
  */
 func (proxy *DummyHTTPProxy) Listen(port int) error {
-  addr:=net.TCPAddr{net.IPv4(127,0,0,1),port,""}
+  addr:=net.TCPAddr{IP:net.IPv4(127,0,0,1),Port:port}
   listener,err:=net.ListenTCP("tcp",&addr)
   if err!=nil {
     log.Error("proxy listener error: %s",err)
@@ -49,7 +58,7 @@ func (proxy *DummyHTTPProxy) Listen(port int) error {
   log.Debug("waiting for connection on port %d",port)
   conn,err:=listener.AcceptTCP()
   if err!=nil {
-    log.Error("proxy error: ",err)
+    log.Error("proxy error: %s",err)
     return err
   }
   log.Debug("proxy got connection")
@@ -59,6 +68,21 @@ func (proxy *DummyHTTPProxy) Listen(port int) error {
 func (proxy *DummyHTTPProxy) handleConnection(conn net.Conn) error {
   defer conn.Close()
   buf:=bufio.NewReadWriter(bufio.NewReader(conn),bufio.NewWriter(conn))
+  if proxy.SOCKS5 {
+    target,err:=proxy.acceptSOCKS5(buf)
+    if err!=nil {
+      log.Error("SOCKS5 handshake failed: %s",err)
+      return err
+    }
+    fmt.Printf("SOCKS5 CONNECT %s\n",target)
+    if strings.HasSuffix(target,":443") {
+      buf,err=upgradeToTLS(conn)
+      if err!=nil {
+        return nil
+      }
+    }
+  }
+
   text,err:=http.ReadHTTPMessageAsString(buf)
   if err!=nil {
     return err
@@ -69,9 +93,7 @@ func (proxy *DummyHTTPProxy) handleConnection(conn net.Conn) error {
     buf.WriteString("HTTP/1.1 200 OK\r\n\r\n")
     buf.Flush()
 
-    log.Debug("upgrading to TLS..")
-    server:=http.NewServer()
-    _,buf,err=server.UpgradeServerConnectionToSSL(conn,"dummyproxy.local")
+    buf,err=upgradeToTLS(conn)
     if err!=nil {
       return nil
     }
@@ -108,3 +130,109 @@ func (proxy *DummyHTTPProxy) handleConnection(conn net.Conn) error {
   buf.Flush()
   return nil
 }
+
+func upgradeToTLS(conn net.Conn) (*bufio.ReadWriter,error) {
+  log.Debug("upgrading to TLS..")
+  server:=http.NewServer()
+  _,buf,err:=server.UpgradeServerConnectionToSSL(conn,"dummyproxy.local")
+  return buf,err
+}
+
+/*
+  Performs the server side of the SOCKS5 handshake, returns the requested target address.
+ */
+func (proxy *DummyHTTPProxy) acceptSOCKS5(buf *bufio.ReadWriter) (string,error) {
+  header:=make([]byte,2)
+  if _,err:=io.ReadFull(buf,header);err!=nil {
+    return "",err
+  }
+  methods:=make([]byte,header[1])
+  if _,err:=io.ReadFull(buf,methods);err!=nil {
+    return "",err
+  }
+  method:=byte(0x00)
+  if proxy.User!="" {
+    method=0x02
+  }
+  if header[0]!=0x05 || strings.IndexByte(string(methods),method)<0 {
+    buf.Write([]byte{0x05,0xFF})
+    buf.Flush()
+    return "",errors.New("client didn't offer required authentication method")
+  }
+  buf.Write([]byte{0x05,method})
+  buf.Flush()
+
+  if method==0x02 {
+    user,password,err:=readSOCKS5Credentials(buf)
+    if err!=nil {
+      return "",err
+    }
+    if user!=proxy.User || password!=proxy.Password {
+      buf.Write([]byte{0x01,0x01})
+      buf.Flush()
+      return "",errors.New("invalid credentials for user \""+user+"\"")
+    }
+    buf.Write([]byte{0x01,0x00})
+    buf.Flush()
+  }
+
+  request:=make([]byte,4)
+  if _,err:=io.ReadFull(buf,request);err!=nil {
+    return "",err
+  }
+  var host string
+  switch request[3] {
+    case 0x01,0x04:
+      address:=make([]byte,4)
+      if request[3]==0x04 {
+        address=make([]byte,16)
+      }
+      if _,err:=io.ReadFull(buf,address);err!=nil {
+        return "",err
+      }
+      host=net.IP(address).String()
+    case 0x03:
+      name,err:=readSOCKS5String(buf)
+      if err!=nil {
+        return "",err
+      }
+      host=name
+    default:
+      return "",fmt.Errorf("unknown address type %d",request[3])
+  }
+  port:=make([]byte,2)
+  if _,err:=io.ReadFull(buf,port);err!=nil {
+    return "",err
+  }
+  if request[1]!=0x01 {
+    buf.Write([]byte{0x05,0x07,0x00,0x01,0,0,0,0,0,0})
+    buf.Flush()
+    return "",fmt.Errorf("unsupported command %d",request[1])
+  }
+  buf.Write([]byte{0x05,0x00,0x00,0x01,127,0,0,1,0,0})
+  buf.Flush()
+  return net.JoinHostPort(host,strconv.Itoa(int(port[0])<<8|int(port[1]))),nil
+}
+
+func readSOCKS5Credentials(buf *bufio.ReadWriter) (string,string,error) {
+  version:=make([]byte,1)
+  if _,err:=io.ReadFull(buf,version);err!=nil {
+    return "","",err
+  }
+  user,err:=readSOCKS5String(buf)
+  if err!=nil {
+    return "","",err
+  }
+  password,err:=readSOCKS5String(buf)
+  return user,password,err
+}
+
+func readSOCKS5String(buf *bufio.ReadWriter) (string,error) {
+  length:=make([]byte,1)
+  if _,err:=io.ReadFull(buf,length);err!=nil {
+    return "",err
+  }
+  data:=make([]byte,length[0])
+  _,err:=io.ReadFull(buf,data)
+  return string(data),err
+}
@@ -15,6 +15,10 @@
     $ dummyproxy --port 0
     port: 54321
 
+  With --socks5 the proxy acts as SOCKS5 proxy instead, requiring username/password authentication if --socks5-user is set:
+
+    dummyproxy --socks5 --socks5-user <user> --socks5-password <password>
+
   As this is intended for automated tests, the server will only handle one connection and then exit. There's a test helper
   (hopgoblin/http/dummyproxy.DummyProxyRunner) that simplifies usage in tests.
 
@@ -31,11 +35,17 @@ import (
 
 
 var port=flag.Int("port",64086,"TCP port to listen on")
+var socks5=flag.Bool("socks5",false,"act as SOCKS5 proxy")
+var socks5User=flag.String("socks5-user","","SOCKS5 user name to require, empty to not require authentication")
+var socks5Password=flag.String("socks5-password","","SOCKS5 password to require")
 
 
 func main() {
   bootstrap.Init()
   proxy:=NewHTTPProxy()
+  proxy.SOCKS5=*socks5
+  proxy.User=*socks5User
+  proxy.Password=*socks5Password
   proxy.Listen(findPort())
 }
 
@@ -0,0 +1,49 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "fmt"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+
+/*
+  A numbered per-host rule from the application configuration, in the form of <n>=<target> <host regex>.
+ */
+type hostRule struct {
+  number int
+  target string
+  hosts *regexp.Regexp
+}
+
+/*
+  Parses per-host rules, e.g. the values of all "proxy.route." settings with the prefix removed. Rules are sorted by their number.
+  The kind of rule is used in error messages only.
+ */
+func parseHostRules(rules map[string]string, kind string) ([]hostRule,error) {
+  var rv []hostRule
+  for key,value:=range rules {
+    number,err:=strconv.Atoi(key)
+    if err!=nil {
+      return nil,fmt.Errorf("invalid %s number \"%s\"",kind,key)
+    }
+    fields:=strings.Fields(value)
+    if len(fields)!=2 {
+      return nil,fmt.Errorf("%s %d must consist of target and host regex",kind,number)
+    }
+    regex,err:=regexp.Compile(fields[1])
+    if err!=nil {
+      return nil,fmt.Errorf("%s %d has invalid host regex: %s",kind,number,err)
+    }
+    rv=append(rv,hostRule{number:number,target:fields[0],hosts:regex})
+  }
+  sort.Slice(rv,func(a int, b int) bool {
+    return rv[a].number<rv[b].number
+  })
+  return rv,nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "strconv"
+  "time"
+  "github.com/rinusser/hopgoblin/metrics"
+)
+
+
+var requestsTotal=metrics.NewCounter("hopgoblin_requests_total",
+  "Requests answered by the server, CONNECT requests are counted once the tunnel is established.",
+  "method","status","handler","ssl")
+
+var requestDuration=metrics.NewHistogram("hopgoblin_request_duration_seconds",
+  "Time from receiving a request until its response was sent.",metrics.DefaultBuckets,"handler")
+
+var openConnections=metrics.NewGauge("hopgoblin_open_connections",
+  "Open client connections, intercepted CONNECT tunnels are counted separately.","ssl")
+
+var rejectedConnections=metrics.NewCounter("hopgoblin_rejected_connections_total",
+  "Client connections closed right after accepting them because the access list doesn't allow the client's address.")
+
+var tlsHandshakeFailures=metrics.NewCounter("hopgoblin_tls_handshake_failures_total",
+  "Failed TLS handshakes with clients.")
+
+var upstreamFailures=metrics.NewCounter("hopgoblin_upstream_failures_total",
+  "Failed attempts to open upstream connections, by stage: connect, proxy (CONNECT through the upstream proxy) or tls.","stage")
+
+var upstreamConnectDuration=metrics.NewHistogram("hopgoblin_upstream_connect_duration_seconds",
+  "Time to open new upstream connections, including CONNECT tunnels but not TLS handshakes.",metrics.DefaultBuckets)
+
+var upstreamHealthy=metrics.NewGauge("hopgoblin_upstream_healthy",
+  "Whether an upstream proxy could be reached the last time it was used or checked: 1 if so, 0 if it's ejected.","upstream")
+
+var upstreamConnections=metrics.NewGauge("hopgoblin_upstream_connections",
+  "Open connections to an upstream proxy, including idle pooled connections.","upstream")
+
+var upstreamEjections=metrics.NewCounter("hopgoblin_upstream_ejections_total",
+  "Times an upstream proxy was ejected after failing to connect or failing a health check.","upstream")
+
+
+var knownMethods=map[string]bool{"GET":true,"HEAD":true,"POST":true,"PUT":true,"DELETE":true,"CONNECT":true,"OPTIONS":true,
+                                 "TRACE":true,"PATCH":true}
+
+/*
+  Counts a request once its response was sent. Unknown methods are counted as "OTHER" to keep the number of series bounded.
+ */
+func recordRequest(state *serverConnection, status uint16) {
+  method:=state.requestMethod
+  if !knownMethods[method] {
+    method="OTHER"
+  }
+  requestsTotal.Inc(method,strconv.Itoa(int(status)),state.handler,strconv.FormatBool(state.isSSL))
+  requestDuration.Observe(time.Since(state.started).Seconds(),state.handler)
+}
@@ -6,91 +6,132 @@ package http
 import (
   "bufio"
   "bytes"
-  "fmt"
+  "errors"
   "io"
-  "strings"
+  "io/ioutil"
   "github.com/rinusser/hopgoblin/log"
 )
 
 
-func readHTTPMessageHeader(buf *bufio.ReadWriter, builder *strings.Builder) error {
+/*
+  Upper bound for a message header's total size in bytes, including its start line and any empty lines before it.
+ */
+const maxHeaderSize=64*1024
+
+/*
+  Returned while reading message headers exceeding maxHeaderSize. The rest of the header is left in the stream, so the connection
+  can't be used for further messages.
+ */
+var errHeaderTooLarge=errors.New("message header too large")
+
+/*
+  Reads a single line, including its line break. Returns errHeaderTooLarge if the line is longer than limit bytes.
+ */
+func readHeaderLine(in *bufio.Reader, limit int) ([]byte,error) {
+  var line []byte
   for {
-    line,err:=buf.ReadString('\n')
-    log.Trace("got line: %s",line)
-    if err==io.EOF {
-      log.Trace("got EOF, stopping read")
-      break
-    } else if err!=nil {
-      log.Error("can't read from buffer: %v",err) //TODO: write test to trigger this, then reduce severity
-      return err
+    fragment,err:=in.ReadSlice('\n')
+    if len(line)+len(fragment)>limit {
+      return nil,errHeaderTooLarge
     }
-//    fmt.Println("ReadHTTPMessageAsString: got line: ",strings.TrimSpace(line))
-    builder.WriteString(line)
-    if line=="\r\n" {
-      log.Trace("found empty line, stopping read")
-      break
+    line=append(line,fragment...)
+    if err!=bufio.ErrBufferFull {
+      return line,err
     }
   }
-  return nil
 }
 
-func readHTTPMessageBodyWithLength(buf *bufio.ReadWriter, builder *strings.Builder, length_text string) error {
-  length:=0
-  fmt.Sscanf(strings.TrimSpace(length_text),"%d",&length)
-  log.Trace("got Content-Length header: raw=%q => value=%d",length_text,length)
+func readHTTPMessageHeader(in *bufio.Reader, out *bytes.Buffer, logger log.CorrelatedLogger) error {
+  remaining:=maxHeaderSize
+  started:=false
   for {
-    if length==0 {
+    line,err:=readHeaderLine(in,remaining)
+    logger.Trace("got line: %q",line)
+    if err==io.EOF {
+      logger.Trace("got EOF, stopping read")
       break
+    } else if err==errHeaderTooLarge {
+      logger.Debug("header exceeds %d bytes, stopping read",maxHeaderSize)
+      return err
+    } else if err!=nil {
+      logger.Error("can't read from buffer: %v",err) //TODO: write test to trigger this, then reduce severity
+      return err
     }
-    bufsize:=4096
-    if length<bufsize {
-      bufsize=length
+    remaining-=len(line)
+    empty:=len(bytes.TrimRight(line,"\r\n"))==0
+    if !started && empty {
+      logger.Trace("skipping empty line before start line")
+      continue
     }
-    chunk:=make([]byte,bufsize)
-    length-=len(chunk)
-    log.Trace("built buffer with size %d, %d remaining",len(chunk),length)
-    size,err:=buf.Read(chunk)
-    if size==0 || err==io.EOF {
+    started=true
+    out.Write(line)
+    if empty {
+      logger.Trace("found empty line, stopping read")
       break
-    } else if err!=nil {
-      return err
     }
-    builder.Write(chunk[0:size])
   }
   return nil
 }
 
-func readHTTPMessageChunkedBody(in *bufio.ReadWriter, builder *strings.Builder) error { //TODO: change in to bufio.Reader
-  buf:=&bytes.Buffer{}
-  err:=chunkDecodeBody(in.Reader,buf,buf)
-  builder.Write(buf.Bytes())
-  return err
+/*
+  Reads an HTTP request/response header from the input stream, up to and including the empty line marking the end of the header.
+  Lines may end with either CRLF or LF. Empty lines before the start line are skipped, e.g. a stray CRLF after the previous
+  message's body. Any message body is left in the input stream.
+
+  Returns io.EOF if the stream ended before any data was read, and an error if the header exceeds 64KiB.
+ */
+func ReadHTTPMessageHeaderBytes(in *bufio.Reader) ([]byte,error) {
+  return readHTTPMessageHeaderBytes(in,log.CorrelatedLogger{})
+}
+
+func readHTTPMessageHeaderBytes(in *bufio.Reader, logger log.CorrelatedLogger) ([]byte,error) {
+  var rv bytes.Buffer
+  err:=readHTTPMessageHeader(in,&rv,logger)
+  if err==nil && rv.Len()==0 {
+    err=io.EOF
+  }
+  return rv.Bytes(),err
+}
+
+/*
+  Reads an HTTP request/response header from the input stream as a string, see ReadHTTPMessageHeaderBytes().
+ */
+func ReadHTTPMessageHeader(in *bufio.Reader) (string,error) {
+  header,err:=ReadHTTPMessageHeaderBytes(in)
+  return string(header),err
 }
 
 /*
   Reads an entire HTTP request/response from the input stream.
 
-  This function currently requires either the Content-Length header to be included, or the Transfer-Encoding set to "chunked".
+  This function currently requires either the Content-Length header to be included, or the Transfer-Encoding to end with "chunked".
   If neither condition is satisfied any message body after the HTTP headers will be ignored.
+
+  The entire message is buffered in memory: use ReadRequest() or ReadResponse() instead to stream message bodies.
  */
-func ReadHTTPMessageAsString(buf *bufio.ReadWriter) (string,error) { //TODO: change to IO reader
+func ReadHTTPMessage(buf *bufio.ReadWriter) ([]byte,error) {
   log.Trace("starting to read http message from buffer")
-  var rv strings.Builder
-  err:=readHTTPMessageHeader(buf,&rv)
+  var rv bytes.Buffer
+  err:=readHTTPMessageHeader(buf.Reader,&rv,log.CorrelatedLogger{})
   if err!=nil {
-    return "",err
+    return nil,err
   }
   log.Trace("finished reading headers")
-  headers:=ParseHeaders(rv.String())
+  headers:=parseHeaderBlock(rv.Bytes())
   log.Trace("got headers")
-  length_text,found_content_length:=headers.Get("Content-Length")
-  xfer_encoding_text,found_xfer_encoding:=headers.Get("Transfer-Encoding")
-  if found_content_length {
-    readHTTPMessageBodyWithLength(buf,&rv,length_text)
-  } else if (found_xfer_encoding && xfer_encoding_text=="chunked") {
-    readHTTPMessageChunkedBody(buf,&rv)
+  body,err:=ioutil.ReadAll(newBodyReader(buf.Reader,headers,false,nil,log.CorrelatedLogger{}))
+  rv.Write(body)
+  if err!=nil {
+    log.Debug("could not read message body: %v",err)
   }
   log.Trace("finished reading message, returning..")
-  return rv.String(),nil
+  return rv.Bytes(),nil
 }
 
+/*
+  Reads an entire HTTP request/response from the input stream as a string, see ReadHTTPMessage().
+ */
+func ReadHTTPMessageAsString(buf *bufio.ReadWriter) (string,error) {
+  data,err:=ReadHTTPMessage(buf)
+  return string(data),err
+}
@@ -8,6 +8,7 @@ import (
   "github.com/stretchr/testify/assert"
   "bufio"
   "io"
+  "strings"
   "time"
 )
 
@@ -50,6 +51,8 @@ func TestReadHTTPMessageAsString(t *testing.T) {
     createRHMASTestcase(chunked_text,"",[]int{},"chunked transfer encoding; chunk lengths need to be parsed as hex numbers!"),
     createRHMASTestcase(chunked_text,"",[]int{47,13,11,2,13},"reader should wait for delayed chunks"),
     createRHMASTestcase("GET / HTTP/1.1\r\n\r\n","GET / HTTP/1.1\r\n\r\nasdf",[]int{},"HTTP body without content-length should be dropped"),
+    createRHMASTestcase("POST / HTTP/1.1\nContent-Length:6\n\n\r\n\r\n\xff\x00","",[]int{},"LF-only header with binary body"),
+    createRHMASTestcase("POST / HTTP/1.1\r\nContent-Length:4\r\n\r\n\n\n\r\n","",[]int{9,11,1},"binary body with newlines"),
 
     //the following lines test whether the server gracefully handles partially received chunked encoding - for example when the
     // 2 bytes of an expected CRLF newline are transmitted with a pause in between
@@ -99,3 +102,34 @@ func runReadHTTPMessageAsStringTest(t *testing.T, c ReadHTTPMessageAsStringTestc
   assert.Nil(t,err,c.message)
   assert.Equal(t,c.expectation,result,c.message)
 }
+
+/*
+  Makes sure ReadHTTPMessageHeader() skips empty lines before the start line, e.g. a stray CRLF after a previous message.
+ */
+func TestReadHTTPMessageHeaderSkipsLeadingEmptyLines(t *testing.T) {
+  in:=bufio.NewReader(strings.NewReader("\r\n\n\r\nGET / HTTP/1.1\r\nHost: x\r\n\r\nbody"))
+  header,err:=ReadHTTPMessageHeader(in)
+  assert.Nil(t,err)
+  assert.Equal(t,"GET / HTTP/1.1\r\nHost: x\r\n\r\n",header)
+
+  _,err=ReadHTTPMessageHeader(bufio.NewReader(strings.NewReader("\r\n\r\n")))
+  assert.Equal(t,io.EOF,err,"stream with only empty lines should count as empty")
+}
+
+/*
+  Makes sure ReadHTTPMessageHeader() stops reading headers exceeding the size limit, both for many and for long header lines.
+ */
+func TestReadHTTPMessageHeaderSizeLimit(t *testing.T) {
+  many_lines:="GET / HTTP/1.1\r\n"+strings.Repeat("X-Filler: 0123456789abcdef\r\n",maxHeaderSize/28+1)+"\r\n"
+  long_line:="GET / HTTP/1.1\r\nX-Filler: "+strings.Repeat("x",maxHeaderSize)+"\r\n\r\n"
+  empty_lines:=strings.Repeat("\r\n",maxHeaderSize/2+1)+"GET / HTTP/1.1\r\n\r\n"
+  for _,input:=range []string{many_lines,long_line,empty_lines} {
+    _,err:=ReadHTTPMessageHeader(bufio.NewReader(strings.NewReader(input)))
+    assert.Equal(t,errHeaderTooLarge,err)
+  }
+
+  fitting:="GET / HTTP/1.1\r\nX-Filler: "+strings.Repeat("x",maxHeaderSize-100)+"\r\n\r\n"
+  header,err:=ReadHTTPMessageHeader(bufio.NewReader(strings.NewReader(fitting)))
+  assert.Nil(t,err)
+  assert.Equal(t,fitting,header)
+}
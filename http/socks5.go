@@ -0,0 +1,169 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "strconv"
+)
+
+
+const (
+  socks5Version=0x05
+  socks5AuthNone=0x00
+  socks5AuthPassword=0x02
+  socks5AuthNoneAcceptable=0xFF
+  socks5PasswordVersion=0x01
+  socks5CommandConnect=0x01
+  socks5AddressIPv4=0x01
+  socks5AddressDomain=0x03
+  socks5AddressIPv6=0x04
+)
+
+/*
+  SOCKS5 reply messages, by reply code.
+ */
+var socks5Replies=map[byte]string {
+  0x01: "general SOCKS server failure",
+  0x02: "connection not allowed by ruleset",
+  0x03: "network unreachable",
+  0x04: "host unreachable",
+  0x05: "connection refused",
+  0x06: "TTL expired",
+  0x07: "command not supported",
+  0x08: "address type not supported",
+}
+
+
+/*
+  Performs the SOCKS5 handshake (RFC 1928) on a connection to the upstream proxy, asking it to connect to the target address
+  ("host:port"). Username/password authentication (RFC 1929) is offered if the upstream proxy has credentials.
+  Once this returns without error the connection is a tunnel to the target address.
+ */
+func socks5Connect(buf *bufio.ReadWriter, upstream *ProxyUpstream, target string) error {
+  methods:=[]byte{socks5AuthNone}
+  if upstream.User!="" {
+    methods=append(methods,socks5AuthPassword)
+  }
+  buf.Write(append([]byte{socks5Version,byte(len(methods))},methods...))
+  if err:=buf.Flush();err!=nil {
+    return err
+  }
+  reply:=make([]byte,2)
+  if _,err:=io.ReadFull(buf,reply);err!=nil {
+    return err
+  }
+  if reply[0]!=socks5Version {
+    return fmt.Errorf("unsupported SOCKS version %d",reply[0])
+  }
+  switch reply[1] {
+    case socks5AuthNone:
+    case socks5AuthPassword:
+      if upstream.User=="" {
+        return errors.New("proxy selected username/password authentication, but there are no credentials")
+      }
+      if err:=socks5Authenticate(buf,upstream.User,upstream.Password);err!=nil {
+        return err
+      }
+    case socks5AuthNoneAcceptable:
+      return errors.New("proxy didn't accept any offered authentication method")
+    default:
+      return fmt.Errorf("proxy selected unsupported authentication method %d",reply[1])
+  }
+
+  request,err:=createSOCKS5ConnectRequest(target)
+  if err!=nil {
+    return err
+  }
+  buf.Write(request)
+  if err=buf.Flush();err!=nil {
+    return err
+  }
+  return readSOCKS5Reply(buf)
+}
+
+func socks5Authenticate(buf *bufio.ReadWriter, user string, password string) error {
+  if len(user)>255 || len(password)>255 {
+    return errors.New("SOCKS5 user name and password can't be longer than 255 bytes")
+  }
+  request:=append([]byte{socks5PasswordVersion,byte(len(user))},user...)
+  request=append(append(request,byte(len(password))),password...)
+  buf.Write(request)
+  if err:=buf.Flush();err!=nil {
+    return err
+  }
+  reply:=make([]byte,2)
+  if _,err:=io.ReadFull(buf,reply);err!=nil {
+    return err
+  }
+  if reply[1]!=0x00 {
+    return errors.New("proxy rejected credentials")
+  }
+  return nil
+}
+
+func createSOCKS5ConnectRequest(target string) ([]byte,error) {
+  host,portstr,err:=net.SplitHostPort(target)
+  if err!=nil {
+    return nil,err
+  }
+  port,err:=strconv.Atoi(portstr)
+  if err!=nil || port<1 || port>65535 {
+    return nil,errors.New("invalid target port \""+portstr+"\"")
+  }
+
+  rv:=[]byte{socks5Version,socks5CommandConnect,0x00}
+  if ip:=net.ParseIP(host);ip==nil {
+    if len(host)>255 {
+      return nil,errors.New("target hostname is too long")
+    }
+    rv=append(append(rv,socks5AddressDomain,byte(len(host))),host...)
+  } else if ip4:=ip.To4();ip4!=nil {
+    rv=append(append(rv,socks5AddressIPv4),ip4...)
+  } else {
+    rv=append(append(rv,socks5AddressIPv6),ip.To16()...)
+  }
+  return append(rv,byte(port>>8),byte(port&0xFF)),nil
+}
+
+/*
+  Reads the reply to a CONNECT request, including the bound address.
+ */
+func readSOCKS5Reply(reader io.Reader) error {
+  header:=make([]byte,4)
+  if _,err:=io.ReadFull(reader,header);err!=nil {
+    return err
+  }
+  if header[0]!=socks5Version {
+    return fmt.Errorf("unsupported SOCKS version %d",header[0])
+  }
+  if header[1]!=0x00 {
+    if message,found:=socks5Replies[header[1]];found {
+      return errors.New(message)
+    }
+    return fmt.Errorf("unknown SOCKS5 reply %d",header[1])
+  }
+
+  var length int
+  switch header[3] {
+    case socks5AddressIPv4:
+      length=net.IPv4len
+    case socks5AddressIPv6:
+      length=net.IPv6len
+    case socks5AddressDomain:
+      size:=make([]byte,1)
+      if _,err:=io.ReadFull(reader,size);err!=nil {
+        return err
+      }
+      length=int(size[0])
+    default:
+      return fmt.Errorf("unknown SOCKS5 address type %d",header[3])
+  }
+  _,err:=io.ReadFull(reader,make([]byte,length+2))
+  return err
+}
@@ -0,0 +1,48 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "bytes"
+)
+
+
+/*
+  Makes sure CONNECT requests encode IPv4, IPv6 and domain name targets.
+ */
+func TestCreateSOCKS5ConnectRequest(t *testing.T) {
+  cases:=map[string][]byte {
+    "10.0.0.1:80":      {5,1,0,1,10,0,0,1,0,80},
+    "[::1]:443":        {5,1,0,4,0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,1,1,187},
+    "example.com:8080": {5,1,0,3,11,'e','x','a','m','p','l','e','.','c','o','m',0x1F,0x90},
+  }
+  for target,expected:=range cases {
+    request,err:=createSOCKS5ConnectRequest(target)
+    assert.Nil(t,err)
+    assert.Equal(t,expected,request,target)
+  }
+
+  for _,target:=range []string{"example.com","example.com:0","example.com:x"} {
+    _,err:=createSOCKS5ConnectRequest(target)
+    assert.NotNil(t,err,"%s should have failed",target)
+  }
+}
+
+/*
+  Makes sure CONNECT replies are read entirely, and failures are reported.
+ */
+func TestReadSOCKS5Reply(t *testing.T) {
+  reader:=bytes.NewReader([]byte{5,0,0,3,4,'h','o','s','t',0,80,'x'})
+  assert.Nil(t,readSOCKS5Reply(reader))
+  assert.Equal(t,1,reader.Len(),"bound address should have been read")
+
+  err:=readSOCKS5Reply(bytes.NewReader([]byte{5,5,0,1,0,0,0,0,0,0}))
+  if assert.NotNil(t,err) {
+    assert.Equal(t,"connection refused",err.Error())
+  }
+  assert.NotNil(t,readSOCKS5Reply(bytes.NewReader([]byte{4,0,0,1,0,0,0,0,0,0})),"wrong version should have failed")
+  assert.NotNil(t,readSOCKS5Reply(bytes.NewReader([]byte{5,0,0,1,0,0})),"truncated reply should have failed")
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "bufio"
+  "io"
+  "net"
+  "github.com/rinusser/hopgoblin/log"
+)
+
+
+/*
+  Relays a CONNECT request's tunnel to the target host byte-for-byte, without intercepting TLS.
+  The tunnel is opened through the upstream proxy if there is one. Returns once both sides closed the tunnel.
+
+  Returns true if the tunnel couldn't be opened and the client connection can be used for further requests.
+ */
+func (server *Server) tunnelRequest(conn net.Conn, buf *bufio.ReadWriter, request *Request) bool {
+  logger:=request.Logger()
+  client:=NewServerClient(server)
+  upstream,upstream_reader,response,err:=client.OpenTunnel(request.Url,request.ID)
+  if upstream==nil {
+    if err!=nil {
+      logger.Debug("could not open tunnel to %s: %s",request.Url,err)
+    }
+    if response==nil {
+      response=CreateSimpleResponse(502)
+    }
+    return server.WriteResponse(buf,response)==nil
+  }
+  defer upstream.Close()
+
+  response=NewResponse()
+  response.Status=200
+  err=server.WriteAndFlush(buf,response.ToString())
+  if err!=nil {
+    return false
+  }
+  if state:=server.getConnection(buf);state!=nil {
+    recordRequest(state,200)
+    server.updateConnectionInfo(state,func(info *ConnectionInfo) {
+      info.Relaying=request.Url
+    })
+  }
+  logger.Trace("relaying tunnel to %s",request.Url)
+  relay(conn,buf.Reader,upstream,upstream_reader,logger)
+  logger.Trace("tunnel to %s closed",request.Url)
+  return false
+}
+
+/*
+  Passes a plain HTTP request on to its target host, only the server's global middleware is applied.
+ */
+func (server *Server) forwardRequest(buf *bufio.ReadWriter, request *Request) {
+  server.ServeForwarded(nil,buf,request)
+}
+
+/*
+  Copies data between two connections in both directions until both sides are done. The readers are used for incoming data,
+  so any data already buffered is relayed too. Messages are logged through the given logger, in both relaying goroutines.
+ */
+func relay(a net.Conn, a_reader io.Reader, b net.Conn, b_reader io.Reader, logger log.CorrelatedLogger) {
+  done:=make(chan bool,2)
+  go copyAndCloseWrite(b,a_reader,done,logger)
+  go copyAndCloseWrite(a,b_reader,done,logger)
+  <-done
+  <-done
+}
+
+func copyAndCloseWrite(out net.Conn, in io.Reader, done chan bool, logger log.CorrelatedLogger) {
+  _,err:=io.Copy(out,in)
+  if err!=nil {
+    logger.Trace("tunnel relay stopped: %s",err)
+  }
+  switch conn:=out.(type) {
+    case *net.TCPConn:
+      conn.CloseWrite()
+    case *trackedConn:
+      conn.CloseWrite()
+    default:
+      out.Close()
+  }
+  done<-true
+}
@@ -0,0 +1,232 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "errors"
+  "net"
+  "sort"
+  "strings"
+  "sync"
+  "time"
+  "github.com/rinusser/hopgoblin/log"
+)
+
+
+/*
+  How requests are distributed across multiple upstream proxies.
+ */
+type UpstreamStrategy int
+
+const (
+  UpstreamFailover UpstreamStrategy=iota //use the first available upstream proxy, in the configured order
+  UpstreamRoundRobin                     //take turns between available upstream proxies
+  UpstreamLeastConnections               //use the available upstream proxy with the fewest open connections
+)
+
+/*
+  Parses an upstream strategy name, i.e. "failover", "round_robin" or "least_connections".
+ */
+func ParseUpstreamStrategy(name string) (UpstreamStrategy,error) {
+  switch strings.ToLower(name) {
+    case "failover":
+      return UpstreamFailover,nil
+    case "round_robin":
+      return UpstreamRoundRobin,nil
+    case "least_connections":
+      return UpstreamLeastConnections,nil
+  }
+  return UpstreamFailover,errors.New("unknown upstream strategy \""+name+"\"")
+}
+
+/*
+  Returns the strategy's name.
+ */
+func (this UpstreamStrategy) String() string {
+  switch this {
+    case UpstreamRoundRobin:
+      return "round_robin"
+    case UpstreamLeastConnections:
+      return "least_connections"
+  }
+  return "failover"
+}
+
+
+/*
+  Runtime state of an upstream proxy. The state is shared by all clients using the same proxy address, regardless of which
+  settings they got the proxy from.
+ */
+type upstreamState struct {
+  address string
+  ejected bool            //whether the proxy failed and didn't succeed since
+  ejectedUntil time.Time  //when to start trying the proxy first again
+  connections int         //open connections to the proxy
+  mutex sync.Mutex
+}
+
+var upstreamStates=make(map[string]*upstreamState)
+var upstreamStatesMutex sync.Mutex
+
+var roundRobinCounters=make(map[string]int)
+var roundRobinMutex sync.Mutex
+
+func getUpstreamState(address string) *upstreamState {
+  upstreamStatesMutex.Lock()
+  defer upstreamStatesMutex.Unlock()
+  rv:=upstreamStates[address]
+  if rv==nil {
+    rv=&upstreamState{address:address}
+    upstreamStates[address]=rv
+  }
+  return rv
+}
+
+func (this *ProxyUpstream) getState() *upstreamState {
+  return getUpstreamState(this.GetAddress())
+}
+
+/*
+  Whether the proxy should be tried before ejected ones.
+ */
+func (this *upstreamState) isAvailable() bool {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  return !this.ejected || time.Now().After(this.ejectedUntil)
+}
+
+/*
+  Marks the proxy as failed, so it's tried last for the given duration. Durations of 0 or less don't eject the proxy.
+  The ejection is logged through the given logger, e.g. with the correlation ID of the request that found the proxy failing.
+ */
+func (this *upstreamState) eject(reason error, duration time.Duration, logger log.CorrelatedLogger) {
+  if duration<=0 {
+    return
+  }
+  this.mutex.Lock()
+  was_ejected:=this.ejected
+  this.ejected=true
+  this.ejectedUntil=time.Now().Add(duration)
+  this.mutex.Unlock()
+
+  upstreamHealthy.Set(0,this.address)
+  if !was_ejected {
+    logger.WarnF("ejecting upstream proxy","upstream",this.address,"duration",duration.String(),"reason",reason.Error())
+    upstreamEjections.Inc(this.address)
+  }
+}
+
+/*
+  Marks the proxy as working, see eject().
+ */
+func (this *upstreamState) restore(logger log.CorrelatedLogger) {
+  this.mutex.Lock()
+  was_ejected:=this.ejected
+  this.ejected=false
+  this.mutex.Unlock()
+
+  upstreamHealthy.Set(1,this.address)
+  if was_ejected {
+    logger.InfoF("upstream proxy available again","upstream",this.address)
+  }
+}
+
+func (this *upstreamState) getConnections() int {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  return this.connections
+}
+
+/*
+  Counts the connection as open until it's closed.
+ */
+func (this *upstreamState) trackConnection(conn net.Conn) net.Conn {
+  this.mutex.Lock()
+  this.connections++
+  this.mutex.Unlock()
+  upstreamConnections.Inc(this.address)
+  return &trackedConn{Conn:conn,state:this}
+}
+
+/*
+  An upstream proxy connection counted in its upstreamState.
+ */
+type trackedConn struct {
+  net.Conn
+  state *upstreamState
+  closeOnce sync.Once
+}
+
+/*
+  required by net.Conn interface
+ */
+func (this *trackedConn) Close() error {
+  this.closeOnce.Do(func() {
+    this.state.mutex.Lock()
+    this.state.connections--
+    this.state.mutex.Unlock()
+    upstreamConnections.Dec(this.state.address)
+  })
+  return this.Conn.Close()
+}
+
+/*
+  Shuts down the writing side of the connection. Closes the connection entirely if it can't be half-closed.
+ */
+func (this *trackedConn) CloseWrite() error {
+  if conn,ok:=this.Conn.(*net.TCPConn);ok {
+    return conn.CloseWrite()
+  }
+  return this.Close()
+}
+
+
+/*
+  Orders upstream proxies by the strategy, available ones first.
+ */
+func orderUpstreams(upstreams []*ProxyUpstream, strategy UpstreamStrategy) []*ProxyUpstream {
+  var available,ejected []*ProxyUpstream
+  for _,upstream:=range upstreams {
+    if upstream.getState().isAvailable() {
+      available=append(available,upstream)
+    } else {
+      ejected=append(ejected,upstream)
+    }
+  }
+
+  switch strategy {
+    case UpstreamRoundRobin:
+      if len(available)>1 {
+        offset:=nextRoundRobinOffset(upstreams)%len(available)
+        available=append(append([]*ProxyUpstream(nil),available[offset:]...),available[:offset]...)
+      }
+    case UpstreamLeastConnections:
+      connections:=make(map[*ProxyUpstream]int)
+      for _,upstream:=range available {
+        connections[upstream]=upstream.getState().getConnections()
+      }
+      sort.SliceStable(available,func(a int, b int) bool {
+        return connections[available[a]]<connections[available[b]]
+      })
+  }
+  return append(available,ejected...)
+}
+
+/*
+  Returns the next turn for the list of upstream proxies. Turns are counted by the list's addresses, so clients with separately
+  loaded settings take turns together.
+ */
+func nextRoundRobinOffset(upstreams []*ProxyUpstream) int {
+  var addresses []string
+  for _,upstream:=range upstreams {
+    addresses=append(addresses,upstream.GetAddress())
+  }
+  key:=strings.Join(addresses,",")
+
+  roundRobinMutex.Lock()
+  defer roundRobinMutex.Unlock()
+  rv:=roundRobinCounters[key]
+  roundRobinCounters[key]=rv+1
+  return rv
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package http
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "errors"
+  "net"
+  "time"
+  "github.com/rinusser/hopgoblin/log"
+)
+
+
+func createTestUpstreams(addresses ...string) []*ProxyUpstream {
+  var rv []*ProxyUpstream
+  for _,address:=range addresses {
+    host,portstr,_:=net.SplitHostPort(address)
+    port,_:=parseProxyPort(host,portstr)
+    rv=append(rv,&ProxyUpstream{Host:host,Port:port})
+  }
+  return rv
+}
+
+func getUpstreamAddresses(upstreams []*ProxyUpstream) []string {
+  var rv []string
+  for _,upstream:=range upstreams {
+    rv=append(rv,upstream.GetAddress())
+  }
+  return rv
+}
+
+/*
+  Makes sure strategy names are parsed case-insensitively and converted back.
+ */
+func TestParseUpstreamStrategy(t *testing.T) {
+  for _,name:=range []string{"failover","round_robin","least_connections"} {
+    strategy,err:=ParseUpstreamStrategy(name)
+    assert.Nil(t,err)
+    assert.Equal(t,name,strategy.String())
+  }
+  strategy,err:=ParseUpstreamStrategy("Least_Connections")
+  assert.Nil(t,err)
+  assert.Equal(t,UpstreamLeastConnections,strategy)
+  _,err=ParseUpstreamStrategy("random")
+  assert.NotNil(t,err)
+}
+
+/*
+  Makes sure each strategy orders upstream proxies as expected, with ejected proxies last until they're restored.
+ */
+func TestOrderUpstreams(t *testing.T) {
+  upstreams:=createTestUpstreams("192.0.2.1:3128","192.0.2.2:3128","192.0.2.3:3128")
+
+  expected:=[]string{"192.0.2.1:3128","192.0.2.2:3128","192.0.2.3:3128"}
+  assert.Equal(t,expected,getUpstreamAddresses(orderUpstreams(upstreams,UpstreamFailover)))
+  assert.Equal(t,expected,getUpstreamAddresses(orderUpstreams(upstreams,UpstreamFailover)),"failover order should be stable")
+
+  first:=getUpstreamAddresses(orderUpstreams(upstreams,UpstreamRoundRobin))[0]
+  second:=getUpstreamAddresses(orderUpstreams(upstreams,UpstreamRoundRobin))[0]
+  third:=getUpstreamAddresses(orderUpstreams(upstreams,UpstreamRoundRobin))[0]
+  assert.ElementsMatch(t,expected,[]string{first,second,third},"round robin should have taken turns")
+
+  conn1,conn2:=net.Pipe()
+  defer conn2.Close()
+  tracked:=upstreams[0].getState().trackConnection(conn1)
+  assert.Equal(t,1,upstreams[0].getState().getConnections())
+  assert.Equal(t,[]string{"192.0.2.2:3128","192.0.2.3:3128","192.0.2.1:3128"},
+               getUpstreamAddresses(orderUpstreams(upstreams,UpstreamLeastConnections)))
+  tracked.Close()
+  tracked.Close()
+  assert.Equal(t,0,upstreams[0].getState().getConnections(),"closing twice should have been counted once")
+
+  upstreams[1].getState().eject(errors.New("test"),time.Minute,log.CorrelatedLogger{})
+  assert.Equal(t,[]string{"192.0.2.1:3128","192.0.2.3:3128","192.0.2.2:3128"},
+               getUpstreamAddresses(orderUpstreams(upstreams,UpstreamFailover)))
+  assert.Equal(t,float64(0),upstreamHealthy.Get("192.0.2.2:3128"))
+  assert.Equal(t,float64(1),upstreamEjections.Get("192.0.2.2:3128"))
+  upstreams[1].getState().restore(log.CorrelatedLogger{})
+  assert.Equal(t,expected,getUpstreamAddresses(orderUpstreams(upstreams,UpstreamFailover)))
+  assert.Equal(t,float64(1),upstreamHealthy.Get("192.0.2.2:3128"))
+
+  upstreams[2].getState().eject(errors.New("test"),time.Nanosecond,log.CorrelatedLogger{})
+  time.Sleep(time.Millisecond)
+  assert.Equal(t,expected,getUpstreamAddresses(orderUpstreams(upstreams,UpstreamFailover)),"ejection should have expired")
+}
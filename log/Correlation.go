@@ -0,0 +1,107 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package log
+
+
+/*
+  Logs messages with a correlation ID, e.g. the ID of the request being served. The zero value logs messages without ID.
+
+  The ID isn't tied to the calling goroutine: pass the logger (or the ID) on to any code, including goroutines it starts, that
+  should include the ID in its messages.
+ */
+type CorrelatedLogger struct {
+  CorrelationID string
+}
+
+/*
+  Creates a logger including the given correlation ID in each message.
+ */
+func WithCorrelationID(id string) CorrelatedLogger {
+  return CorrelatedLogger{CorrelationID:id}
+}
+
+
+/*
+  Logs a message at TRACE level.
+ */
+func (this CorrelatedLogger) Trace(format string, data...interface{}) {
+  _log(TRACE,this.CorrelationID,format,data...)
+}
+
+/*
+  Logs a message with structured fields at TRACE level, see DebugF().
+ */
+func (this CorrelatedLogger) TraceF(message string, fields...interface{}) {
+  _logFields(TRACE,this.CorrelationID,message,fields)
+}
+
+/*
+  Logs a message at DEBUG level.
+ */
+func (this CorrelatedLogger) Debug(format string, data...interface{}) {
+  _log(DEBUG,this.CorrelationID,format,data...)
+}
+
+/*
+  Logs a message with structured fields at DEBUG level, see the package-level DebugF().
+ */
+func (this CorrelatedLogger) DebugF(message string, fields...interface{}) {
+  _logFields(DEBUG,this.CorrelationID,message,fields)
+}
+
+/*
+  Logs a message at INFO level.
+ */
+func (this CorrelatedLogger) Info(format string, data...interface{}) {
+  _log(INFO,this.CorrelationID,format,data...)
+}
+
+/*
+  Logs a message with structured fields at INFO level, see DebugF().
+ */
+func (this CorrelatedLogger) InfoF(message string, fields...interface{}) {
+  _logFields(INFO,this.CorrelationID,message,fields)
+}
+
+/*
+  Logs a message at WARN level.
+ */
+func (this CorrelatedLogger) Warn(format string, data...interface{}) {
+  _log(WARN,this.CorrelationID,format,data...)
+}
+
+/*
+  Logs a message with structured fields at WARN level, see DebugF().
+ */
+func (this CorrelatedLogger) WarnF(message string, fields...interface{}) {
+  _logFields(WARN,this.CorrelationID,message,fields)
+}
+
+/*
+  Logs a message at ERROR level.
+ */
+func (this CorrelatedLogger) Error(format string, data...interface{}) {
+  _log(ERROR,this.CorrelationID,format,data...)
+}
+
+/*
+  Logs a message with structured fields at ERROR level, see DebugF().
+ */
+func (this CorrelatedLogger) ErrorF(message string, fields...interface{}) {
+  _logFields(ERROR,this.CorrelationID,message,fields)
+}
+
+/*
+  Logs a message at FATAL level.
+ */
+func (this CorrelatedLogger) Fatal(format string, data...interface{}) {
+  _log(FATAL,this.CorrelationID,format,data...)
+}
+
+/*
+  Logs a message with structured fields at FATAL level, see DebugF().
+ */
+func (this CorrelatedLogger) FatalF(message string, fields...interface{}) {
+  _logFields(FATAL,this.CorrelationID,message,fields)
+}
@@ -0,0 +1,38 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package log
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "encoding/json"
+  "strings"
+)
+
+
+/*
+  Makes sure correlated loggers include their ID in log messages, regardless of the goroutine logging them.
+ */
+func TestCorrelationID(t *testing.T) {
+  logger:=WithCorrelationID("text-1")
+  lines:=captureOutput(TEXT,func() {
+    logger.ErrorF("with id","key",1)
+    Error("without id")
+  })
+  assert.True(t,strings.HasSuffix(lines[0],": [text-1] with id key=1"),lines[0])
+  assert.True(t,strings.HasSuffix(lines[1],": without id"),lines[1])
+  assert.True(t,strings.Contains(lines[0],"TestCorrelationID"),"calling function should have been logged: "+lines[0])
+
+  lines=captureOutput(JSON,func() {
+    WithCorrelationID("json-1").Error("with id")
+    CorrelatedLogger{}.Error("without id")
+  })
+  var entry map[string]interface{}
+  assert.Nil(t,json.Unmarshal([]byte(lines[0]),&entry))
+  assert.Equal(t,"json-1",entry["correlationId"])
+  entry=nil
+  assert.Nil(t,json.Unmarshal([]byte(lines[1]),&entry))
+  _,found:=entry["correlationId"]
+  assert.False(t,found,"zero value shouldn't log a correlation ID")
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package log
+
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "sync"
+  "time"
+)
+
+
+/*
+  Sink appending messages to a file, with rotation by size and age.
+
+  Once the file would grow beyond MaxSize bytes, or it was opened longer than MaxAge ago, it's rotated: existing files are renamed
+  to <Filename>.1, <Filename>.2 and so on, keeping at most MaxFiles files in total. Zero limits disable the respective rotation.
+  A file left over from a previous run is appended to.
+ */
+type FileSink struct {
+  Filename string
+  MaxSize int64         //a file always gets at least one message, regardless of its size
+  MaxAge time.Duration  //counted from when the file was opened
+  MaxFiles int
+
+  file *os.File
+  size int64
+  opened time.Time
+  mutex sync.Mutex
+}
+
+/*
+  Creates a new FileSink instance with default limits.
+ */
+func NewFileSink(filename string) *FileSink {
+  return &FileSink {
+    Filename: filename,
+    MaxSize: 10*1024*1024,
+    MaxAge: 0,
+    MaxFiles: 5,
+  }
+}
+
+/*
+  required by Sink interface
+ */
+func (this *FileSink) Write(level Level, message string) error {
+  data:=[]byte(message+"\n")
+
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+
+  if this.file!=nil && this.needsRotation(int64(len(data))) {
+    this.file.Close()
+    this.file=nil
+    this.rotate()
+  }
+  if this.file==nil {
+    err:=this.open()
+    if err!=nil {
+      return err
+    }
+  }
+
+  written,err:=this.file.Write(data)
+  this.size+=int64(written)
+  return err
+}
+
+/*
+  required by Sink interface
+ */
+func (this *FileSink) Close() error {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  if this.file==nil {
+    return nil
+  }
+  err:=this.file.Close()
+  this.file=nil
+  return err
+}
+
+/*
+  Returns the filename of the current file (index 0) or a rotated file (index 1 and up).
+ */
+func (this *FileSink) GetFilename(index int) string {
+  if index>0 {
+    return fmt.Sprintf("%s.%d",this.Filename,index)
+  }
+  return this.Filename
+}
+
+func (this *FileSink) needsRotation(length int64) bool {
+  if this.MaxSize>0 && this.size>0 && this.size+length>this.MaxSize {
+    return true
+  }
+  return this.MaxAge>0 && time.Since(this.opened)>=this.MaxAge
+}
+
+func (this *FileSink) open() error {
+  err:=os.MkdirAll(filepath.Dir(this.Filename),0700)
+  if err!=nil {
+    return err
+  }
+  file,err:=os.OpenFile(this.Filename,os.O_WRONLY|os.O_CREATE|os.O_APPEND,0600)
+  if err!=nil {
+    return err
+  }
+  info,err:=file.Stat()
+  if err!=nil {
+    file.Close()
+    return err
+  }
+  this.file=file
+  this.size=info.Size()
+  this.opened=time.Now()
+  return nil
+}
+
+func (this *FileSink) rotate() {
+  if this.MaxFiles<2 {
+    os.Remove(this.GetFilename(0))
+    return
+  }
+  os.Remove(this.GetFilename(this.MaxFiles-1))
+  for index:=this.MaxFiles-2;index>=0;index-- {
+    os.Rename(this.GetFilename(index),this.GetFilename(index+1))
+  }
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package log
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "time"
+)
+
+
+func readSinkFile(t *testing.T, filename string) string {
+  data,err:=ioutil.ReadFile(filename)
+  assert.Nil(t,err,"%s should exist",filename)
+  return string(data)
+}
+
+/*
+  Makes sure messages are appended to files left over from previous runs.
+ */
+func TestFileSinkAppends(t *testing.T) {
+  directory,_:=ioutil.TempDir("","hopgoblin-log")
+  defer os.RemoveAll(directory)
+  filename:=filepath.Join(directory,"logs","test.log")
+  os.MkdirAll(filepath.Dir(filename),0700)
+  ioutil.WriteFile(filename,[]byte("left over\n"),0600)
+
+  sink:=NewFileSink(filename)
+  defer sink.Close()
+  assert.Nil(t,sink.Write(INFO,"first"))
+  assert.Nil(t,sink.Write(INFO,"second"))
+  assert.Equal(t,"left over\nfirst\nsecond\n",readSinkFile(t,filename))
+}
+
+/*
+  Makes sure files are rotated once they grow too large, and old files are removed.
+ */
+func TestFileSinkRotatesBySize(t *testing.T) {
+  directory,_:=ioutil.TempDir("","hopgoblin-log")
+  defer os.RemoveAll(directory)
+  sink:=NewFileSink(filepath.Join(directory,"test.log"))
+  sink.MaxSize=10
+  sink.MaxFiles=3
+  defer sink.Close()
+
+  for _,message:=range []string{"1","2","message 3","a much longer message 4","5"} {
+    assert.Nil(t,sink.Write(INFO,message))
+  }
+  assert.Equal(t,"5\n",readSinkFile(t,sink.GetFilename(0)))
+  assert.Equal(t,"a much longer message 4\n",readSinkFile(t,sink.GetFilename(1)))
+  assert.Equal(t,"message 3\n",readSinkFile(t,sink.GetFilename(2)))
+  _,err:=os.Stat(sink.GetFilename(3))
+  assert.True(t,os.IsNotExist(err),"there should be at most 3 files")
+}
+
+/*
+  Makes sure files are rotated once they're too old.
+ */
+func TestFileSinkRotatesByAge(t *testing.T) {
+  directory,_:=ioutil.TempDir("","hopgoblin-log")
+  defer os.RemoveAll(directory)
+  sink:=NewFileSink(filepath.Join(directory,"test.log"))
+  sink.MaxAge=100*time.Millisecond
+  defer sink.Close()
+
+  assert.Nil(t,sink.Write(INFO,"old"))
+  assert.Nil(t,sink.Write(INFO,"still current"))
+  time.Sleep(150*time.Millisecond)
+  assert.Nil(t,sink.Write(INFO,"new"))
+  assert.Equal(t,"new\n",readSinkFile(t,sink.GetFilename(0)))
+  assert.Equal(t,"old\nstill current\n",readSinkFile(t,sink.GetFilename(1)))
+}
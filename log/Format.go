@@ -0,0 +1,34 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package log
+
+import (
+  "errors"
+  "strings"
+)
+
+
+/*
+  Type for log output formats. An empty Format means the setting wasn't made, messages are written as TEXT then.
+ */
+type Format string
+const (
+  TEXT Format = "text" //one human-readable line per message
+  JSON Format = "json" //one JSON object per line, for log collectors
+)
+
+
+/*
+  Converts string to Format.
+  Input string is case insensitive, returns an error if value is invalid.
+ */
+func ParseFormat(input string) (Format,error) {
+  switch Format(strings.ToLower(strings.TrimSpace(input))) {
+    case TEXT:
+      return TEXT,nil
+    case JSON:
+      return JSON,nil
+  }
+  return "",errors.New("invalid log format '"+input+"'")
+}
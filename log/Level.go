@@ -4,6 +4,7 @@
 package log
 
 import (
+  "errors"
   "strings"
 )
 
@@ -35,21 +36,33 @@ func (l Level) String() string {
   Input string is case insensitive, will panic if value is invalid.
  */
 func FromString(input string) Level {
+  level,err:=ParseLevel(input)
+  if err!=nil {
+    panic(err.Error())
+  }
+  return level
+}
+
+/*
+  Converts string to Level.
+  Input string is case insensitive, returns an error if value is invalid.
+ */
+func ParseLevel(input string) (Level,error) {
   switch(strings.ToUpper(strings.TrimSpace(input))) {
     case "TRACE":
-      return TRACE
+      return TRACE,nil
     case "DEBUG":
-      return DEBUG
+      return DEBUG,nil
     case "INFO":
-      return INFO
+      return INFO,nil
     case "WARN":
-      return WARN
+      return WARN,nil
     case "ERROR":
-      return ERROR
+      return ERROR,nil
     case "FATAL":
-      return FATAL
+      return FATAL,nil
     case "OFF":
-      return OFF
+      return OFF,nil
   }
-  panic("invalid level '"+input+"'")
+  return OFF,errors.New("invalid level '"+input+"'")
 }
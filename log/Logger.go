@@ -4,12 +4,15 @@
 package log
 
 import (
+  "encoding/json"
   "fmt"
   "log"
   "os"
   "regexp"
   "runtime"
+  "strconv"
   "strings"
+  "sync"
   "time"
 )
 
@@ -25,10 +28,18 @@ var DefaultLevel=INFO
 var DefaultTimestampFormat="2006-01-02 15:04:05.000"
 
 /*
-  The currently active log settings.
+  The currently active log settings. Use SetPrefixLevel() and RemovePrefixLevel() to change levels while messages are logged.
  */
 var CurrentSettings Settings
 
+var settingsMutex sync.RWMutex
+
+
+/*
+  The format for timestamps in JSON log messages, see time.Time.Format(). The timestamp_format setting only applies to text
+  messages.
+ */
+var JSONTimestampFormat="2006-01-02T15:04:05.000Z07:00"
 
 var methodNameMangler=regexp.MustCompile(`\(\*([a-zA-Z0-9]+)\)`)
 
@@ -73,20 +84,83 @@ func AssembleLogSettingsArg(settings Settings) string {
   Turns the current log settings into a command-line argument string.
  */
 func AssemblePassthroughArg() string {
+  settingsMutex.RLock()
+  defer settingsMutex.RUnlock()
   return AssembleLogSettingsArg(CurrentSettings)
 }
 
+/*
+  Returns a copy of the current levels by prefix.
+ */
+func GetPrefixLevels() map[string]Level {
+  settingsMutex.RLock()
+  defer settingsMutex.RUnlock()
+  rv:=make(map[string]Level,len(CurrentSettings.Prefixes))
+  for prefix,level:=range CurrentSettings.Prefixes {
+    rv[prefix]=level
+  }
+  return rv
+}
+
+/*
+  Sets the level for a prefix at runtime, "*" sets the default level.
+ */
+func SetPrefixLevel(prefix string, level Level) {
+  settingsMutex.Lock()
+  defer settingsMutex.Unlock()
+  if CurrentSettings.Prefixes==nil {
+    CurrentSettings.Prefixes=make(map[string]Level)
+  }
+  CurrentSettings.Prefixes[prefix]=level
+}
+
+/*
+  Removes a prefix's level at runtime, so messages fall back to shorter prefixes or the default level.
+ */
+func RemovePrefixLevel(prefix string) {
+  settingsMutex.Lock()
+  defer settingsMutex.Unlock()
+  delete(CurrentSettings.Prefixes,prefix)
+}
+
 
-func _log(level Level, format string, data...interface{}) {
-  pc,_,/*line*/_,_:=runtime.Caller(2)
+func _log(level Level, correlation_id string, format string, data...interface{}) {
+  write(level,correlation_id,func() string { return fmt.Sprintf(format,data...) },nil)
+}
+
+func _logFields(level Level, correlation_id string, message string, fields []interface{}) {
+  write(level,correlation_id,func() string { return message },fields)
+}
+
+/*
+  Writes a log message if it's at or above the caller's threshold. The message is only assembled if it will be written.
+  Must be called by _log() or _logFields() only, the caller's caller is the function shown in log messages.
+ */
+func write(level Level, correlation_id string, message func() string, fields []interface{}) {
+  pc,_,/*line*/_,_:=runtime.Caller(3)
   function_pretty:=getMethodName(pc)
 
+  settingsMutex.RLock()
+  defer settingsMutex.RUnlock() //also keeps sinks from being closed by ReplaceSettings() while writing
   if level<getEffectiveLevel(CurrentSettings,function_pretty) {
     return
   }
+  timestamp_format:=getCurrentTimestampFormat()
+  format:=CurrentSettings.Format
+  sinks:=getEffectiveSinks(CurrentSettings,function_pretty)
 
-  msg:=fmt.Sprintf(format,data...)
-  log.Printf("%s% 6d %- 5s %s: %s",time.Now().Format(getCurrentTimestampFormat()),os.Getpid(),level.String(),function_pretty,msg)
+  now:=time.Now()
+  var line string
+  if format==JSON {
+    line=formatJSON(now,level,function_pretty,correlation_id,message(),fields)
+  } else {
+    if correlation_id!="" {
+      correlation_id="["+correlation_id+"] "
+    }
+    line=fmt.Sprintf("%s% 6d %- 5s %s: %s%s%s",now.Format(timestamp_format),os.Getpid(),level.String(),function_pretty,
+                     correlation_id,message(),formatTextFields(fields))
+  }
+  writeToSinks(sinks,level,line)
 }
 
 func getCurrentTimestampFormat() string { //XXX could cache this
@@ -107,44 +181,161 @@ func getMethodName(pc uintptr) string {
 }
 
 
+/*
+  Converts structured fields (alternating keys and values) into ordered key/value pairs. Non-string keys are converted, a missing
+  last value is logged as nil.
+ */
+func getFieldPairs(fields []interface{}) ([]string,[]interface{}) {
+  var keys []string
+  var values []interface{}
+  for index:=0;index<len(fields);index+=2 {
+    key,ok:=fields[index].(string)
+    if !ok {
+      key=fmt.Sprint(fields[index])
+    }
+    var value interface{}
+    if index+1<len(fields) {
+      value=fields[index+1]
+    }
+    if err,ok:=value.(error);ok {
+      value=err.Error()
+    }
+    keys=append(keys,key)
+    values=append(values,value)
+  }
+  return keys,values
+}
+
+func formatTextFields(fields []interface{}) string {
+  rv:=""
+  keys,values:=getFieldPairs(fields)
+  for index,key:=range keys {
+    value:=fmt.Sprint(values[index])
+    if value=="" || strings.ContainsAny(value," \t\r\n\"=") {
+      value=strconv.Quote(value)
+    }
+    rv+=" "+key+"="+value
+  }
+  return rv
+}
+
+func formatJSON(now time.Time, level Level, function string, correlation_id string, message string, fields []interface{}) string {
+  entry:=jsonEntry {
+    Time: now.Format(JSONTimestampFormat),
+    Pid: os.Getpid(),
+    Level: level.String(),
+    Function: function,
+    CorrelationID: correlation_id,
+    Message: message,
+  }
+  keys,values:=getFieldPairs(fields)
+  if len(keys)>0 {
+    entry.Fields=make(map[string]json.RawMessage,len(keys))
+    for index,key:=range keys {
+      value,err:=json.Marshal(values[index])
+      if err!=nil {
+        value,_=json.Marshal(fmt.Sprint(values[index]))
+      }
+      entry.Fields[key]=value
+    }
+  }
+  data,_:=json.Marshal(entry)
+  return string(data)
+}
+
+type jsonEntry struct {
+  Time string `json:"time"`
+  Pid int `json:"pid"`
+  Level string `json:"level"`
+  Function string `json:"function"`
+  CorrelationID string `json:"correlationId,omitempty"`
+  Message string `json:"message"`
+  Fields map[string]json.RawMessage `json:"fields,omitempty"`
+}
+
+
 /*
   Logs a message at TRACE level.
  */
 func Trace(format string, data...interface{}) {
-  _log(TRACE,format,data...)
+  _log(TRACE,"",format,data...)
+}
+
+/*
+  Logs a message with structured fields at TRACE level, see DebugF().
+ */
+func TraceF(message string, fields...interface{}) {
+  _logFields(TRACE,"",message,fields)
 }
 
 /*
   Logs a message at DEBUG level.
  */
 func Debug(format string, data...interface{}) {
-  _log(DEBUG,format,data...)
+  _log(DEBUG,"",format,data...)
+}
+
+/*
+  Logs a message with structured fields at DEBUG level. Fields are passed as alternating keys and values, e.g.
+
+    log.DebugF("request denied","host",host,"status",403)
+ */
+func DebugF(message string, fields...interface{}) {
+  _logFields(DEBUG,"",message,fields)
 }
 
 /*
   Logs a message at INFO level.
  */
 func Info(format string, data...interface{}) {
-  _log(INFO,format,data...)
+  _log(INFO,"",format,data...)
+}
+
+/*
+  Logs a message with structured fields at INFO level, see DebugF().
+ */
+func InfoF(message string, fields...interface{}) {
+  _logFields(INFO,"",message,fields)
 }
 
 /*
   Logs a message at WARN level.
  */
 func Warn(format string, data...interface{}) {
-  _log(WARN,format,data...)
+  _log(WARN,"",format,data...)
+}
+
+/*
+  Logs a message with structured fields at WARN level, see DebugF().
+ */
+func WarnF(message string, fields...interface{}) {
+  _logFields(WARN,"",message,fields)
 }
 
 /*
   Logs a message at ERROR level.
  */
 func Error(format string, data...interface{}) {
-  _log(ERROR,format,data...)
+  _log(ERROR,"",format,data...)
+}
+
+/*
+  Logs a message with structured fields at ERROR level, see DebugF().
+ */
+func ErrorF(message string, fields...interface{}) {
+  _logFields(ERROR,"",message,fields)
 }
 
 /*
   Logs a message at FATAL level.
  */
 func Fatal(format string, data...interface{}) {
-  _log(FATAL,format,data...)
+  _log(FATAL,"",format,data...)
+}
+
+/*
+  Logs a message with structured fields at FATAL level, see DebugF().
+ */
+func FatalF(message string, fields...interface{}) {
+  _logFields(FATAL,"",message,fields)
 }
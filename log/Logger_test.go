@@ -6,6 +6,8 @@ package log
 import (
   "testing"
   "github.com/stretchr/testify/assert"
+  "encoding/json"
+  "errors"
   "io"
   "io/ioutil"
   go_log "log"
@@ -90,3 +92,112 @@ func assertMethodName(t *testing.T, expected string, actual string) {
   }
   assert.Equal(t,expected,parts[4])
 }
+
+/*
+  Makes sure prefix levels can be changed at runtime.
+ */
+func TestSetPrefixLevel(t *testing.T) {
+  previous:=GetPrefixLevels()
+  defer func() {
+    settingsMutex.Lock()
+    CurrentSettings.Prefixes=previous
+    settingsMutex.Unlock()
+  }()
+
+  SetPrefixLevel("hopgoblin/log.Test",OFF)
+  assert.Equal(t,OFF,GetPrefixLevels()["hopgoblin/log.Test"])
+  assert.Equal(t,OFF,getEffectiveLevel(CurrentSettings,"hopgoblin/log.TestSetPrefixLevel"))
+  RemovePrefixLevel("hopgoblin/log.Test")
+  _,found:=GetPrefixLevels()["hopgoblin/log.Test"]
+  assert.False(t,found)
+
+  _,err:=ParseLevel("loud")
+  assert.NotNil(t,err)
+  level,err:=ParseLevel(" debug")
+  assert.Nil(t,err)
+  assert.Equal(t,DEBUG,level)
+}
+
+func captureOutput(format Format, callback func()) []string {
+  settingsMutex.Lock()
+  previous:=CurrentSettings.Format
+  CurrentSettings.Format=format
+  settingsMutex.Unlock()
+  defer func() {
+    settingsMutex.Lock()
+    CurrentSettings.Format=previous
+    settingsMutex.Unlock()
+  }()
+
+  reader,writer:=io.Pipe()
+  go_log.SetOutput(writer)
+  defer go_log.SetOutput(os.Stderr)
+  go func() {
+    callback()
+    writer.Close()
+  }()
+  data,_:=ioutil.ReadAll(reader)
+  return strings.Split(strings.TrimSuffix(string(data),"\n"),"\n")
+}
+
+/*
+  Makes sure structured fields are appended to text messages as key=value pairs.
+ */
+func TestTextFields(t *testing.T) {
+  lines:=captureOutput(TEXT,func() {
+    ErrorF("request denied","host","example.com","status",403,"reason","not allowed","missing")
+  })
+  assert.Equal(t,1,len(lines))
+  assert.True(t,strings.HasSuffix(lines[0],`: request denied host=example.com status=403 reason="not allowed" missing=<nil>`),lines[0])
+}
+
+/*
+  Makes sure messages are written as JSON lines in JSON format, with structured fields if there are any.
+ */
+func TestJSONFormat(t *testing.T) {
+  lines:=captureOutput(JSON,func() {
+    Error("plain %d",1)
+    ErrorF("request denied","host","example.com","status",403,"error",errors.New("failed"),"channel",make(chan int))
+  })
+  if !assert.Equal(t,2,len(lines)) {
+    return
+  }
+
+  var plain map[string]interface{}
+  assert.Nil(t,json.Unmarshal([]byte(lines[0]),&plain),lines[0])
+  assert.Equal(t,"ERROR",plain["level"])
+  assert.Equal(t,"plain 1",plain["message"])
+  assert.Equal(t,float64(os.Getpid()),plain["pid"])
+  assert.NotEmpty(t,plain["time"])
+  _,found:=plain["fields"]
+  assert.False(t,found,"fields should be omitted if there are none")
+
+  var structured struct {
+    Function string
+    Message string
+    Fields map[string]interface{}
+  }
+  assert.Nil(t,json.Unmarshal([]byte(lines[1]),&structured),lines[1])
+  assert.Equal(t,"hopgoblin/log.TestJSONFormat.func1",structured.Function)
+  assert.Equal(t,"request denied",structured.Message)
+  assert.Equal(t,"example.com",structured.Fields["host"])
+  assert.Equal(t,float64(403),structured.Fields["status"])
+  assert.Equal(t,"failed",structured.Fields["error"])
+  assert.IsType(t,"",structured.Fields["channel"],"values that can't be encoded should be converted to strings")
+}
+
+/*
+  Makes sure log formats are parsed case insensitively, and set formats take precedence when merging.
+ */
+func TestFormatSettings(t *testing.T) {
+  format,err:=ParseFormat(" JSON")
+  assert.Nil(t,err)
+  assert.Equal(t,JSON,format)
+  _,err=ParseFormat("xml")
+  assert.NotNil(t,err)
+
+  s1:=NewSettings()
+  s1.Format=JSON
+  assert.Equal(t,JSON,MergeSettings(s1,NewSettings()).Format)
+  assert.Equal(t,TEXT,MergeSettings(s1,Settings{Prefixes:map[string]Level{},Format:TEXT}).Format)
+}
@@ -14,6 +14,8 @@ import (
 type Settings struct {
   Prefixes map[string]Level
   TimestampFormat string
+  Format Format
+  Sinks map[string][]Sink //where messages are written, by prefix; "*" sets the default, see DefaultSink
 }
 
 /*
@@ -23,6 +25,8 @@ func NewSettings() Settings {
   return Settings {
     Prefixes:make(map[string]Level,0),
     TimestampFormat:"",
+    Format:"",
+    Sinks:make(map[string][]Sink,0),
   }
 }
 
@@ -38,6 +42,18 @@ func (this *Settings) getSortedPrefixes() []string { //XXX: could cache this
   return keys
 }
 
+/*
+  Returns the prefixes with routed sinks, sorted by descending length.
+ */
+func (this *Settings) getSortedSinkPrefixes() []string {
+  keys:=make([]string,0)
+  for key,_:=range this.Sinks {
+    keys=append(keys,key)
+  }
+  sort.Sort(prefixesType(keys))
+  return keys
+}
+
 
 /*
   Takes 2 sets of settings and combines them, with settings in the second parameter (s2) taking precedence.
@@ -53,6 +69,17 @@ func MergeSettings(s1 Settings, s2 Settings) Settings {
     rv.TimestampFormat=s2.TimestampFormat
   }
 
+  if s2.Format!="" {
+    rv.Format=s2.Format
+  }
+
+  if rv.Sinks==nil && len(s2.Sinks)>0 {
+    rv.Sinks=make(map[string][]Sink)
+  }
+  for key,value:=range s2.Sinks {
+    rv.Sinks[key]=value
+  }
+
   return rv
 }
 
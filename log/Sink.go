@@ -0,0 +1,184 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package log
+
+import (
+  "errors"
+  "fmt"
+  "log"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "time"
+)
+
+
+/*
+  Interface for log message destinations.
+
+  Sinks receive complete messages in the configured format, without trailing newline. Implementations must be safe for
+  concurrent use and must not log messages themselves.
+ */
+type Sink interface {
+  Write(level Level, message string) error
+  Close() error
+}
+
+
+/*
+  Sink writing messages through Go's built-in "log" package, i.e. to stderr unless a different writer was set there.
+  Messages are written here unless routed elsewhere.
+ */
+type StderrSink struct {
+}
+
+/*
+  The default sink, used for all prefixes without a route.
+ */
+var DefaultSink Sink=StderrSink{}
+
+/*
+  required by Sink interface
+ */
+func (this StderrSink) Write(level Level, message string) error {
+  log.Print(message)
+  return nil
+}
+
+/*
+  required by Sink interface
+ */
+func (this StderrSink) Close() error {
+  return nil
+}
+
+
+/*
+  Creates a sink from a definition string: the sink type followed by whitespace-separated options. Relative filenames are
+  resolved against the given directory.
+
+    stderr
+    file path=<filename> [max_size=<bytes>] [max_age=<seconds>] [max_files=<count>]
+    syslog [address=<socket path>] [tag=<program name>] [facility=<code>]
+ */
+func ParseSink(definition string, directory string) (Sink,error) {
+  fields:=strings.Fields(definition)
+  if len(fields)==0 {
+    return nil,errors.New("missing sink type")
+  }
+  options:=make(map[string]string)
+  for _,field:=range fields[1:] {
+    parts:=strings.SplitN(field,"=",2)
+    if len(parts)!=2 {
+      return nil,errors.New("invalid sink option '"+field+"'")
+    }
+    options[strings.ToLower(parts[0])]=parts[1]
+  }
+
+  switch strings.ToLower(fields[0]) {
+    case "stderr":
+      return DefaultSink,nil
+    case "file":
+      return parseFileSink(options,directory)
+    case "syslog":
+      return parseSyslogSink(options)
+  }
+  return nil,errors.New("unknown sink type '"+fields[0]+"'")
+}
+
+func parseFileSink(options map[string]string, directory string) (Sink,error) {
+  path:=options["path"]
+  if path=="" {
+    return nil,errors.New("missing file sink path")
+  }
+  if !filepath.IsAbs(path) {
+    path=filepath.Join(directory,path)
+  }
+  rv:=NewFileSink(path)
+  if value,found:=options["max_size"];found {
+    size,err:=strconv.ParseInt(value,10,64)
+    if err!=nil || size<0 {
+      return nil,errors.New("invalid max_size '"+value+"'")
+    }
+    rv.MaxSize=size
+  }
+  if value,found:=options["max_age"];found {
+    seconds,err:=strconv.Atoi(value)
+    if err!=nil || seconds<0 {
+      return nil,errors.New("invalid max_age '"+value+"'")
+    }
+    rv.MaxAge=time.Duration(seconds)*time.Second
+  }
+  if value,found:=options["max_files"];found {
+    count,err:=strconv.Atoi(value)
+    if err!=nil || count<1 {
+      return nil,errors.New("invalid max_files '"+value+"'")
+    }
+    rv.MaxFiles=count
+  }
+  return rv,nil
+}
+
+func parseSyslogSink(options map[string]string) (Sink,error) {
+  rv:=NewSyslogSink(DefaultSyslogAddress,"hopgoblin")
+  if value,found:=options["address"];found {
+    rv.Address=value
+  }
+  if value,found:=options["tag"];found {
+    rv.Tag=value
+  }
+  if value,found:=options["facility"];found {
+    facility,err:=strconv.Atoi(value)
+    if err!=nil || facility<0 || facility>23 {
+      return nil,errors.New("invalid facility '"+value+"'")
+    }
+    rv.Facility=facility
+  }
+  return rv,nil
+}
+
+
+/*
+  Determines the sinks for a given (qualified) function name, matching prefixes the same way as levels.
+ */
+func getEffectiveSinks(settings Settings, function string) []Sink {
+  for _,prefix:=range settings.getSortedSinkPrefixes() {
+    if strings.HasPrefix(function,prefix) {
+      return settings.Sinks[prefix]
+    }
+  }
+  if sinks,found:=settings.Sinks["*"];found {
+    return sinks
+  }
+  return []Sink{DefaultSink}
+}
+
+func writeToSinks(sinks []Sink, level Level, message string) {
+  for _,sink:=range sinks {
+    if err:=sink.Write(level,message);err!=nil {
+      fmt.Fprintf(os.Stderr,"could not write log message to %T: %s\n%s\n",sink,err,message)
+    }
+  }
+}
+
+/*
+  Closes sinks that were used in the previous settings but aren't used in the current ones anymore.
+ */
+func closeUnusedSinks(previous Settings, current Settings) {
+  used:=make(map[Sink]bool)
+  for _,sinks:=range current.Sinks {
+    for _,sink:=range sinks {
+      used[sink]=true
+    }
+  }
+  for _,sinks:=range previous.Sinks {
+    for _,sink:=range sinks {
+      if !used[sink] {
+        used[sink]=true //closes each sink once
+        sink.Close()
+      }
+    }
+  }
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package log
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "strings"
+  "sync"
+  "time"
+)
+
+
+type testSink struct {
+  messages []string
+  closed bool
+  mutex sync.Mutex
+}
+
+func (this *testSink) Write(level Level, message string) error {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  this.messages=append(this.messages,level.String()+" "+message)
+  return nil
+}
+
+func (this *testSink) Close() error {
+  this.closed=true
+  return nil
+}
+
+
+/*
+  Makes sure messages are written to the sinks routed for the longest matching prefix.
+ */
+func TestSinkRouting(t *testing.T) {
+  sink1:=&testSink{}
+  sink2:=&testSink{}
+  settings:=NewSettings()
+  settings.Sinks=map[string][]Sink {
+    "hopgoblin/log.TestSink":[]Sink{sink1},
+    "hopgoblin/log.TestSinkRouting":[]Sink{sink1,sink2},
+    "*":[]Sink{sink2},
+  }
+  assert.Equal(t,[]Sink{sink1,sink2},getEffectiveSinks(settings,"hopgoblin/log.TestSinkRouting"))
+  assert.Equal(t,[]Sink{sink1},getEffectiveSinks(settings,"hopgoblin/log.TestSinkOther"))
+  assert.Equal(t,[]Sink{sink2},getEffectiveSinks(settings,"hopgoblin/http.Server"))
+  assert.Equal(t,[]Sink{DefaultSink},getEffectiveSinks(NewSettings(),"hopgoblin/http.Server"))
+
+  settingsMutex.Lock()
+  previous:=CurrentSettings
+  CurrentSettings=MergeSettings(NewSettings(),previous)
+  CurrentSettings.Sinks=map[string][]Sink{"hopgoblin/log.TestSinkRouting":[]Sink{sink1}}
+  settingsMutex.Unlock()
+  defer func() {
+    settingsMutex.Lock()
+    CurrentSettings=previous
+    settingsMutex.Unlock()
+  }()
+  ErrorF("routed","key","value")
+  if assert.Equal(t,1,len(sink1.messages)) {
+    assert.True(t,strings.HasPrefix(sink1.messages[0],"ERROR "),sink1.messages[0])
+    assert.True(t,strings.HasSuffix(sink1.messages[0],"hopgoblin/log.TestSinkRouting: routed key=value"),sink1.messages[0])
+  }
+}
+
+/*
+  Makes sure replaced sinks are closed, but sinks still in use aren't.
+ */
+func TestCloseUnusedSinks(t *testing.T) {
+  kept:=&testSink{}
+  removed:=&testSink{}
+  previous:=NewSettings()
+  previous.Sinks=map[string][]Sink{"a":[]Sink{kept,removed},"b":[]Sink{removed}}
+  current:=NewSettings()
+  current.Sinks=map[string][]Sink{"*":[]Sink{kept}}
+  closeUnusedSinks(previous,current)
+  assert.False(t,kept.closed)
+  assert.True(t,removed.closed)
+}
+
+/*
+  Makes sure sink definitions are parsed with their options, and invalid ones are rejected.
+ */
+func TestParseSink(t *testing.T) {
+  sink,err:=ParseSink("STDERR","/tmp")
+  assert.Nil(t,err)
+  assert.Equal(t,DefaultSink,sink)
+
+  sink,err=ParseSink(" file  path=logs/http.log max_size=100 max_age=60 max_files=3","/base")
+  if assert.Nil(t,err) {
+    file:=sink.(*FileSink)
+    assert.Equal(t,"/base/logs/http.log",file.Filename)
+    assert.Equal(t,int64(100),file.MaxSize)
+    assert.Equal(t,time.Minute,file.MaxAge)
+    assert.Equal(t,3,file.MaxFiles)
+  }
+  sink,err=ParseSink("file path=/var/log/hopgoblin.log","/base")
+  if assert.Nil(t,err) {
+    assert.Equal(t,"/var/log/hopgoblin.log",sink.(*FileSink).Filename)
+  }
+
+  sink,err=ParseSink("syslog tag=test facility=16","/base")
+  if assert.Nil(t,err) {
+    syslog:=sink.(*SyslogSink)
+    assert.Equal(t,DefaultSyslogAddress,syslog.Address)
+    assert.Equal(t,"test",syslog.Tag)
+    assert.Equal(t,16,syslog.Facility)
+  }
+
+  invalid:=[]string {
+    "",
+    "console",
+    "file",
+    "file path=x max_size=big",
+    "file path=x max_files=0",
+    "file path=x max_age",
+    "syslog facility=24",
+  }
+  for _,definition:=range invalid {
+    _,err=ParseSink(definition,"/base")
+    assert.NotNil(t,err,"definition %q should be invalid",definition)
+  }
+}
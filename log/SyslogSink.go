@@ -0,0 +1,111 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package log
+
+import (
+  "fmt"
+  "net"
+  "os"
+  "sync"
+  "time"
+)
+
+
+/*
+  The default local syslog socket.
+ */
+var DefaultSyslogAddress="/dev/log"
+
+/*
+  Sink sending messages to the local syslog daemon over a Unix socket, in the traditional BSD syslog format.
+
+  Both datagram and stream sockets are supported. The connection is established on the first message and re-established once if
+  sending fails.
+ */
+type SyslogSink struct {
+  Address string //path to the Unix socket
+  Tag string     //program name shown in syslog
+  Facility int   //syslog facility code, e.g. 1 for "user" or 16 for "local0"
+
+  conn net.Conn
+  mutex sync.Mutex
+}
+
+/*
+  Creates a new SyslogSink instance, logging to the "user" facility.
+ */
+func NewSyslogSink(address string, tag string) *SyslogSink {
+  return &SyslogSink {
+    Address: address,
+    Tag: tag,
+    Facility: 1,
+  }
+}
+
+/*
+  required by Sink interface
+ */
+func (this *SyslogSink) Write(level Level, message string) error {
+  data:=[]byte(fmt.Sprintf("<%d>%s %s[%d]: %s\n",this.Facility*8+getSyslogSeverity(level),time.Now().Format(time.Stamp),this.Tag,
+                           os.Getpid(),message))
+
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+
+  var err error
+  for attempt:=0;attempt<2;attempt++ {
+    if this.conn==nil {
+      this.conn,err=dialSyslog(this.Address)
+      if err!=nil {
+        return err
+      }
+    }
+    _,err=this.conn.Write(data)
+    if err==nil {
+      return nil
+    }
+    this.conn.Close()
+    this.conn=nil
+  }
+  return err
+}
+
+/*
+  required by Sink interface
+ */
+func (this *SyslogSink) Close() error {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  if this.conn==nil {
+    return nil
+  }
+  err:=this.conn.Close()
+  this.conn=nil
+  return err
+}
+
+func dialSyslog(address string) (net.Conn,error) {
+  conn,err:=net.Dial("unixgram",address)
+  if err!=nil {
+    conn,err=net.Dial("unix",address)
+  }
+  return conn,err
+}
+
+/*
+  Maps log levels to syslog severities.
+ */
+func getSyslogSeverity(level Level) int {
+  switch level {
+    case TRACE,DEBUG:
+      return 7
+    case INFO:
+      return 6
+    case WARN:
+      return 4
+    case ERROR:
+      return 3
+  }
+  return 2
+}
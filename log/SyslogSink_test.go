@@ -0,0 +1,60 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package log
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "fmt"
+  "io/ioutil"
+  "net"
+  "os"
+  "path/filepath"
+  "regexp"
+  "runtime"
+  "time"
+)
+
+
+/*
+  Makes sure messages are sent to the syslog socket with the level's severity, and the connection is re-established if the
+  daemon restarts.
+ */
+func TestSyslogSink(t *testing.T) {
+  if runtime.GOOS=="windows" {
+    t.Skip("Unix datagram sockets aren't supported")
+  }
+  directory,_:=ioutil.TempDir("","hopgoblin-log")
+  defer os.RemoveAll(directory)
+  address:=filepath.Join(directory,"log.sock")
+  listen:=func() net.PacketConn {
+    conn,err:=net.ListenPacket("unixgram",address)
+    if err!=nil {
+      t.Fatalf("could not listen: %s",err)
+    }
+    return conn
+  }
+  receive:=func(conn net.PacketConn) string {
+    buffer:=make([]byte,1024)
+    conn.SetReadDeadline(time.Now().Add(time.Second))
+    length,_,err:=conn.ReadFrom(buffer)
+    assert.Nil(t,err)
+    return string(buffer[:length])
+  }
+
+  daemon:=listen()
+  sink:=NewSyslogSink(address,"test")
+  defer sink.Close()
+  assert.Nil(t,sink.Write(WARN,"first message"))
+  pattern:=fmt.Sprintf(`^<12>[A-Z][a-z]{2} [ 0-9]\d \d\d:\d\d:\d\d test\[%d\]: first message\n$`,os.Getpid())
+  assert.Regexp(t,regexp.MustCompile(pattern),receive(daemon))
+
+  daemon.Close()
+  os.Remove(address)
+  daemon=listen()
+  defer daemon.Close()
+  sink.Facility=16
+  assert.Nil(t,sink.Write(DEBUG,"second message"))
+  assert.Regexp(t,regexp.MustCompile(`^<135>.* test\[\d+\]: second message\n$`),receive(daemon))
+}
@@ -4,6 +4,7 @@
 package appconfig
 
 import (
+  "strings"
   "github.com/rinusser/hopgoblin/bootstrap"
   "github.com/rinusser/hopgoblin/log"
   "github.com/rinusser/hopgoblin/utils"
@@ -12,12 +13,25 @@ import (
 
 func init() {
   bootstrap.AfterFlagParse(initHook)
+  bootstrap.OnReload(reloadHook)
 }
 
 func initHook() {
   log.CurrentSettings=log.MergeSettings(ParseApplicationConfiguration(),log.CurrentSettings)
 }
 
+/*
+  Applies the reloaded application configuration. Keeps the previous settings if the new ones are invalid.
+ */
+func reloadHook() {
+  defer func() {
+    if err:=recover();err!=nil {
+      log.Error("keeping previous log settings: %s",err)
+    }
+  }()
+  log.ReplaceSettings(ParseApplicationConfiguration())
+}
+
 
 /*
   Reads log settings from the application configuration (resources/application.ini).
@@ -34,6 +48,15 @@ func initHook() {
 
     ; sets the log timestamp format, see Go's time.Time.Format() documentation
     timestamp_format = 2006-01-02 15:04:05.000
+
+    ; writes messages as JSON lines instead of text
+    format = json
+
+    ; defines a rotating log file named "http", see log.ParseSink() for all sink types and options
+    sinks.http = file path=logs/http.log max_size=10485760 max_age=86400 max_files=5
+
+    ; routes messages prefixed "hopgoblin/http" to the "http" sink instead of stderr
+    routes.hopgoblin/http = http
  */
 func ParseApplicationConfiguration() log.Settings {
   rv:=log.NewSettings()
@@ -49,6 +72,35 @@ func ParseApplicationConfiguration() log.Settings {
 
   rv.TimestampFormat=utils.GetConfigValue("log.timestamp_format")
 
+  formatstr:=utils.GetConfigValue("log.format")
+  if formatstr!="" {
+    format,err:=log.ParseFormat(formatstr)
+    if err!=nil {
+      panic(err.Error())
+    }
+    rv.Format=format
+  }
+
+  sinks:=map[string]log.Sink{"stderr":log.DefaultSink}
+  for name,definition:=range utils.GetConfigValuesByPrefix("log.sinks.") {
+    sink,err:=log.ParseSink(definition,utils.GetRelativePath("resources"))
+    if err!=nil {
+      panic("invalid log sink "+name+": "+err.Error())
+    }
+    sinks[name]=sink
+  }
+  for prefix,names:=range utils.GetConfigValuesByPrefix("log.routes.") {
+    var routed []log.Sink
+    for _,name:=range strings.Split(names,",") {
+      sink,found:=sinks[strings.ToLower(strings.TrimSpace(name))]
+      if !found {
+        panic("unknown log sink '"+strings.TrimSpace(name)+"' for prefix "+prefix)
+      }
+      routed=append(routed,sink)
+    }
+    rv.Sinks[prefix]=routed
+  }
+
   return rv
 }
 
@@ -12,15 +12,45 @@ import (
 
 
 var levelArguments LevelArguments
+var formatArgument string
 
 
 func init() {
   flag.Var(&levelArguments,"log","comma-separated log levels: prefix=level; prefix '*' for global setting")
+  flag.StringVar(&formatArgument,"log-format","","log output format: text or json")
   bootstrap.AfterFlagParse(initHook)
 }
 
 func initHook() {
-  CurrentSettings=MergeSettings(CurrentSettings,ParseArguments(levelArguments))
+  CurrentSettings=MergeSettings(CurrentSettings,getArgumentSettings())
+}
+
+/*
+  Returns the settings given on the command line.
+ */
+func getArgumentSettings() Settings {
+  rv:=ParseArguments(levelArguments)
+  if formatArgument!="" {
+    format,err:=ParseFormat(formatArgument)
+    if err!=nil {
+      panic(err.Error())
+    }
+    rv.Format=format
+  }
+  return rv
+}
+
+
+/*
+  Replaces the current settings at runtime, e.g. after the application configuration was reloaded.
+  Settings given on the command line still take precedence. Sinks that aren't used anymore are closed.
+ */
+func ReplaceSettings(settings Settings) {
+  settings=MergeSettings(settings,getArgumentSettings())
+  settingsMutex.Lock()
+  defer settingsMutex.Unlock()
+  closeUnusedSinks(CurrentSettings,settings)
+  CurrentSettings=settings
 }
 
 
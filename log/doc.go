@@ -24,8 +24,28 @@
 
   Prefixes are case sensitive, levels are not.
 
-  This logging facility routes logs message through Go's built-in "log" package, although none of its features are used. You can
-  redirect the log output by setting a custom log writer in Go's "log" package.
+  Messages can carry structured fields, passed as alternating keys and values to the functions ending in "F":
+
+    log.DebugF("request denied","host",host,"status",403)
+
+  By default messages are written as text lines, with fields appended as key=value pairs. For log collectors messages can be
+  written as JSON lines instead, with the keys "time", "pid", "level", "function", "message" and "fields" (if there are any):
+
+    app --log-format=json
+
+  Messages about a request can carry its correlation ID: they're logged through a CorrelatedLogger holding the ID, which is
+  included in brackets before the message in text lines, as "correlationId" in JSON lines. Code serving a request passes the
+  logger on explicitly, including to goroutines it starts:
+
+    logger:=log.WithCorrelationID(request.ID)
+    logger.Debug("forwarding request to %s",host)
+
+  Messages can be routed to different sinks by prefix, matched the same way as levels: see the Sink interface and its StderrSink,
+  FileSink (rotated by size and age) and SyslogSink implementations. Routes are set in Settings.Sinks, applications using the
+  log/appconfig package can define them in the application configuration.
+
+  By default messages are written to StderrSink, which routes them through Go's built-in "log" package, although none of its
+  features are used. You can redirect that output by setting a custom log writer in Go's "log" package.
 
   Go's built-in log facility doesn't allow changing the date format in log messages. This package does, and will by default show
   dates in yyyy-mm-dd format (the international standard), and times with millisecond precision.
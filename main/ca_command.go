@@ -0,0 +1,143 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package main
+
+import (
+  "flag"
+  "fmt"
+  "os"
+  "strings"
+  "time"
+  "github.com/rinusser/hopgoblin/utils"
+)
+
+
+/*
+  The CA keypair name used by the "ca" subcommand if none is configured.
+ */
+var DefaultCAName="CA-hopgoblin"
+
+/*
+  The hostnames the "ca" subcommand issues the default server certificate for.
+ */
+var DefaultCertificateHosts=[]string{"hopgoblin.localhost","direct.local","proxied.local"}
+
+
+/*
+  Runs the "ca" subcommand, returns the process exit code.
+
+  "ca init" creates a new CA keypair along with a default server certificate in resources/certs/, "ca export" prints the CA
+  certificate in PEM or DER format for importing into browsers.
+ */
+func runCACommand(args []string) int {
+  if len(args)<1 {
+    printCAUsage()
+    return 2
+  }
+  switch args[0] {
+    case "init":
+      return runCAInit(args[1:])
+    case "export":
+      return runCAExport(args[1:])
+  }
+  printCAUsage()
+  return 2
+}
+
+func printCAUsage() {
+  fmt.Fprintln(os.Stderr,"usage: hopgoblin ca init [-force] [-days N]")
+  fmt.Fprintln(os.Stderr,"       hopgoblin ca export [-format pem|der]")
+}
+
+func getCAName() string {
+  name:=utils.GetConfigValue("server.ca_certificate_file")
+  if name=="" {
+    name=DefaultCAName
+  }
+  if !strings.HasPrefix(name,"CA-") {
+    fmt.Fprintf(os.Stderr,"warning: CA name \"%s\" doesn't start with \"CA-\", it won't be trusted by hopgoblin's own client\n",name)
+  }
+  return name
+}
+
+func getDefaultCertificateName() string {
+  name:=utils.GetConfigValue("server.default_certificate_file")
+  if name=="" {
+    name="test"
+  }
+  return name
+}
+
+func runCAInit(args []string) int {
+  flags:=flag.NewFlagSet("ca init",flag.ContinueOnError)
+  force:=flags.Bool("force",false,"overwrite existing files")
+  days:=flags.Int("days",3650,"CA validity in days")
+  if flags.Parse(args)!=nil {
+    return 2
+  }
+
+  directory:=utils.GetResourcePath("certs")
+  caname:=getCAName()
+  certname:=getDefaultCertificateName()
+  if !*force {
+    for _,name:=range []string{caname,certname} {
+      if _,err:=os.Stat(directory+string(os.PathSeparator)+name+".pem");err==nil {
+        fmt.Fprintf(os.Stderr,"%s.pem already exists in %s, use -force to overwrite\n",name,directory)
+        return 1
+      }
+    }
+  }
+
+  err:=os.MkdirAll(directory,0700)
+  if err!=nil {
+    fmt.Fprintf(os.Stderr,"can't create certificate directory: %s\n",err)
+    return 1
+  }
+  ca,err:=utils.GenerateCertificateAuthority("hopgoblin CA",time.Duration(*days)*24*time.Hour)
+  if err==nil {
+    err=utils.SaveCertificate(directory,caname,ca.Keypair())
+  }
+  if err!=nil {
+    fmt.Fprintf(os.Stderr,"can't create CA: %s\n",err)
+    return 1
+  }
+  keypair,err:=ca.IssueCertificate(DefaultCertificateHosts)
+  if err==nil {
+    err=utils.SaveCertificate(directory,certname,keypair)
+  }
+  if err!=nil {
+    fmt.Fprintf(os.Stderr,"can't create server certificate: %s\n",err)
+    return 1
+  }
+
+  fmt.Fprintf(os.Stderr,"wrote %s.pem/.key and %s.pem/.key to %s\n",caname,certname,directory)
+  fmt.Fprintf(os.Stderr,"set server.ca_certificate_file=%s in application.ini to issue certificates on the fly\n",caname)
+  fmt.Fprintln(os.Stderr,"import this CA certificate into your browser:")
+  os.Stdout.Write(ca.CertificatePEM())
+  return 0
+}
+
+func runCAExport(args []string) int {
+  flags:=flag.NewFlagSet("ca export",flag.ContinueOnError)
+  format:=flags.String("format","pem","output format, either pem or der")
+  if flags.Parse(args)!=nil {
+    return 2
+  }
+
+  ca:=utils.LoadCertificateAuthority(utils.GetResourcePath("certs"),getCAName())
+  if ca==nil {
+    fmt.Fprintln(os.Stderr,"can't load CA, run \"hopgoblin ca init\" first")
+    return 1
+  }
+  switch strings.ToLower(*format) {
+    case "pem":
+      os.Stdout.Write(ca.CertificatePEM())
+    case "der":
+      os.Stdout.Write(ca.Certificate.Raw)
+    default:
+      fmt.Fprintf(os.Stderr,"unknown format \"%s\"\n",*format)
+      return 2
+  }
+  return 0
+}
@@ -7,8 +7,11 @@ import (
   "flag"
   "fmt"
   "net"
+  "os"
   "strings"
+  _ "github.com/rinusser/hopgoblin/admin" //keep: enables the admin API if configured in application.ini
   "github.com/rinusser/hopgoblin/bootstrap"
+  _ "github.com/rinusser/hopgoblin/capture" //keep: enables HAR capturing if configured in application.ini
   "github.com/rinusser/hopgoblin/http"
   "github.com/rinusser/hopgoblin/log"
   _ "github.com/rinusser/hopgoblin/log/appconfig" //keep: allows log configuration in application.ini
@@ -34,6 +37,10 @@ var portarg = flag.String("port","","TCP port to listen on")
 
 func main() {
   bootstrap.Init()
+  if flag.Arg(0)=="ca" {
+    os.Exit(runCACommand(flag.Args()[1:]))
+  }
+
   server:=http.NewServer()
   server.AddAllRegisteredSiteHandlers()
 
@@ -42,6 +49,7 @@ func main() {
     return
   }
 
+  go handleSignals(server)
   log.Info("starting server")
   server.Listen(addr)
 }
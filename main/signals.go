@@ -0,0 +1,47 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package main
+
+import (
+  "context"
+  "os"
+  "os/signal"
+  "syscall"
+  "github.com/rinusser/hopgoblin/bootstrap"
+  "github.com/rinusser/hopgoblin/http"
+  "github.com/rinusser/hopgoblin/log"
+)
+
+
+/*
+  Handles process signals: SIGINT and SIGTERM shut the server down gracefully, a second one closes all connections immediately.
+  SIGHUP reloads the application configuration.
+ */
+func handleSignals(server *http.Server) {
+  signals:=make(chan os.Signal,1)
+  signal.Notify(signals,syscall.SIGINT,syscall.SIGTERM,syscall.SIGHUP)
+  shutting_down:=false
+  for received:=range signals {
+    if received==syscall.SIGHUP {
+      log.Info("received %s, reloading configuration",received)
+      bootstrap.Reload()
+      server.Reload()
+      continue
+    }
+    if shutting_down {
+      log.Info("received %s again, closing all connections",received)
+      server.Close()
+      continue
+    }
+    shutting_down=true
+    log.Info("received %s, shutting down",received)
+    go func() {
+      ctx,cancel:=context.WithTimeout(context.Background(),server.GetShutdownTimeout())
+      defer cancel()
+      if err:=server.Shutdown(ctx);err!=nil {
+        log.Warn("shutdown incomplete: %s",err)
+      }
+    }()
+  }
+}
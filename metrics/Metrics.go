@@ -0,0 +1,179 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package metrics
+
+import (
+  "sort"
+)
+
+
+/*
+  A value that only goes up, e.g. the number of requests handled.
+ */
+type Counter struct {
+  metric *metric
+}
+
+/*
+  A value that can go up and down, e.g. the number of open connections.
+ */
+type Gauge struct {
+  metric *metric
+}
+
+/*
+  Counts observations, e.g. request durations in seconds, in buckets by value.
+ */
+type Histogram struct {
+  metric *metric
+}
+
+/*
+  Default histogram buckets, suitable for durations in seconds.
+ */
+var DefaultBuckets=[]float64{0.005,0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5,10}
+
+
+/*
+  Creates a counter in the default registry.
+ */
+func NewCounter(name string, help string, labels ...string) *Counter {
+  return DefaultRegistry.NewCounter(name,help,labels...)
+}
+
+/*
+  Creates a gauge in the default registry.
+ */
+func NewGauge(name string, help string, labels ...string) *Gauge {
+  return DefaultRegistry.NewGauge(name,help,labels...)
+}
+
+/*
+  Creates a histogram in the default registry.
+ */
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+  return DefaultRegistry.NewHistogram(name,help,buckets,labels...)
+}
+
+/*
+  Creates a counter in this registry. Counter names should end in "_total".
+ */
+func (this *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+  return &Counter{metric:this.register(name,help,"counter",labels)}
+}
+
+/*
+  Creates a gauge in this registry.
+ */
+func (this *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+  return &Gauge{metric:this.register(name,help,"gauge",labels)}
+}
+
+/*
+  Creates a histogram in this registry. The buckets are the upper bounds, the "+Inf" bucket is added automatically.
+ */
+func (this *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+  rv:=&Histogram{metric:this.register(name,help,"histogram",labels)}
+  rv.metric.buckets=append([]float64(nil),buckets...)
+  sort.Float64s(rv.metric.buckets)
+  return rv
+}
+
+
+/*
+  Increments the counter by 1.
+ */
+func (this *Counter) Inc(label_values ...string) {
+  this.Add(1,label_values...)
+}
+
+/*
+  Increments the counter by the given amount, negative amounts are ignored.
+ */
+func (this *Counter) Add(delta float64, label_values ...string) {
+  if delta<0 {
+    return
+  }
+  this.metric.update(label_values,func(entry *series) {
+    entry.value+=delta
+  })
+}
+
+/*
+  Returns the counter's current value, 0 if it wasn't incremented yet.
+ */
+func (this *Counter) Get(label_values ...string) float64 {
+  if entry:=this.metric.get(label_values);entry!=nil {
+    return entry.value
+  }
+  return 0
+}
+
+
+/*
+  Sets the gauge to the given value.
+ */
+func (this *Gauge) Set(value float64, label_values ...string) {
+  this.metric.update(label_values,func(entry *series) {
+    entry.value=value
+  })
+}
+
+/*
+  Changes the gauge by the given amount.
+ */
+func (this *Gauge) Add(delta float64, label_values ...string) {
+  this.metric.update(label_values,func(entry *series) {
+    entry.value+=delta
+  })
+}
+
+/*
+  Increments the gauge by 1.
+ */
+func (this *Gauge) Inc(label_values ...string) {
+  this.Add(1,label_values...)
+}
+
+/*
+  Decrements the gauge by 1.
+ */
+func (this *Gauge) Dec(label_values ...string) {
+  this.Add(-1,label_values...)
+}
+
+/*
+  Returns the gauge's current value, 0 if it wasn't set yet.
+ */
+func (this *Gauge) Get(label_values ...string) float64 {
+  if entry:=this.metric.get(label_values);entry!=nil {
+    return entry.value
+  }
+  return 0
+}
+
+
+/*
+  Records an observation.
+ */
+func (this *Histogram) Observe(value float64, label_values ...string) {
+  this.metric.update(label_values,func(entry *series) {
+    entry.value+=value
+    entry.count++
+    index:=sort.SearchFloat64s(this.metric.buckets,value)
+    if index<len(entry.bucketCounts) {
+      entry.bucketCounts[index]++
+    }
+  })
+}
+
+/*
+  Returns the number of observations recorded.
+ */
+func (this *Histogram) Count(label_values ...string) uint64 {
+  if entry:=this.metric.get(label_values);entry!=nil {
+    return entry.count
+  }
+  return 0
+}
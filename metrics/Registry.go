@@ -0,0 +1,214 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package metrics
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "math"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+
+/*
+  A set of metrics exported together.
+ */
+type Registry struct {
+  metrics []*metric
+  mutex sync.Mutex
+}
+
+/*
+  The registry used by the package-level metric constructors.
+ */
+var DefaultRegistry=NewRegistry()
+
+/*
+  Creates an empty registry.
+ */
+func NewRegistry() *Registry {
+  return &Registry{}
+}
+
+
+var nameMatcher=regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+/*
+  Common state of all metric types: a value series for each combination of label values.
+ */
+type metric struct {
+  name string
+  help string
+  kind string         //"counter", "gauge" or "histogram"
+  labels []string
+  buckets []float64   //upper bucket bounds for histograms, ascending
+  series map[string]*series
+  mutex sync.Mutex
+}
+
+type series struct {
+  labelValues []string
+  value float64       //the counter or gauge value, the sum of observations for histograms
+  count uint64        //the number of observations, histograms only
+  bucketCounts []uint64
+}
+
+/*
+  Adds a new metric to the registry. Panics if the name or a label name is invalid or the name is already taken, like
+  regexp.MustCompile() these are programming errors.
+ */
+func (this *Registry) register(name string, help string, kind string, labels []string) *metric {
+  if !nameMatcher.MatchString(name) {
+    panic("invalid metric name '"+name+"'")
+  }
+  for _,label:=range labels {
+    if !nameMatcher.MatchString(label) || strings.Contains(label,":") || label=="le" {
+      panic("invalid label name '"+label+"' for metric '"+name+"'")
+    }
+  }
+  rv:=&metric{name:name,help:help,kind:kind,labels:labels,series:make(map[string]*series)}
+
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  for _,existing:=range this.metrics {
+    if existing.name==name {
+      panic("metric '"+name+"' is already registered")
+    }
+  }
+  this.metrics=append(this.metrics,rv)
+  return rv
+}
+
+/*
+  Runs the update function on the series for the given label values, creating the series if necessary.
+ */
+func (this *metric) update(label_values []string, update func(*series)) {
+  if len(label_values)!=len(this.labels) {
+    panic(fmt.Sprintf("metric '%s' expects %d label values, got %d",this.name,len(this.labels),len(label_values)))
+  }
+  key:=strings.Join(label_values,"\xff")
+
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  entry:=this.series[key]
+  if entry==nil {
+    entry=&series{labelValues:append([]string(nil),label_values...)}
+    if this.buckets!=nil {
+      entry.bucketCounts=make([]uint64,len(this.buckets))
+    }
+    this.series[key]=entry
+  }
+  update(entry)
+}
+
+/*
+  Returns a copy of the series for the given label values, or nil if there is none yet.
+ */
+func (this *metric) get(label_values []string) *series {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  entry:=this.series[strings.Join(label_values,"\xff")]
+  if entry==nil {
+    return nil
+  }
+  rv:=*entry
+  rv.bucketCounts=append([]uint64(nil),entry.bucketCounts...)
+  return &rv
+}
+
+
+/*
+  Writes all metrics in the Prometheus text exposition format, in the order they were registered. Series are sorted by their
+  label values.
+ */
+func (this *Registry) WriteText(out io.Writer) error {
+  this.mutex.Lock()
+  metrics:=append([]*metric(nil),this.metrics...)
+  this.mutex.Unlock()
+
+  writer:=bufio.NewWriter(out)
+  for _,metric:=range metrics {
+    metric.writeText(writer)
+  }
+  return writer.Flush()
+}
+
+/*
+  The content type of the text exposition format written by WriteText().
+ */
+const TextContentType="text/plain; version=0.0.4; charset=utf-8"
+
+func (this *metric) writeText(out *bufio.Writer) {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+
+  fmt.Fprintf(out,"# HELP %s %s\n",this.name,escapeHelp(this.help))
+  fmt.Fprintf(out,"# TYPE %s %s\n",this.name,this.kind)
+  keys:=make([]string,0,len(this.series))
+  for key:=range this.series {
+    keys=append(keys,key)
+  }
+  sort.Strings(keys)
+
+  for _,key:=range keys {
+    entry:=this.series[key]
+    if this.kind!="histogram" {
+      fmt.Fprintf(out,"%s%s %s\n",this.name,this.formatLabels(entry.labelValues,""),formatValue(entry.value))
+      continue
+    }
+    cumulative:=uint64(0)
+    for index,bound:=range this.buckets {
+      cumulative+=entry.bucketCounts[index]
+      fmt.Fprintf(out,"%s_bucket%s %d\n",this.name,this.formatLabels(entry.labelValues,formatValue(bound)),cumulative)
+    }
+    fmt.Fprintf(out,"%s_bucket%s %d\n",this.name,this.formatLabels(entry.labelValues,"+Inf"),entry.count)
+    fmt.Fprintf(out,"%s_sum%s %s\n",this.name,this.formatLabels(entry.labelValues,""),formatValue(entry.value))
+    fmt.Fprintf(out,"%s_count%s %d\n",this.name,this.formatLabels(entry.labelValues,""),entry.count)
+  }
+}
+
+/*
+  Formats label names and values, e.g. {method="GET",status="200"}. The le label is added for histogram buckets if not empty.
+ */
+func (this *metric) formatLabels(values []string, le string) string {
+  var parts []string
+  for index,name:=range this.labels {
+    parts=append(parts,name+"=\""+escapeLabelValue(values[index])+"\"")
+  }
+  if le!="" {
+    parts=append(parts,"le=\""+le+"\"")
+  }
+  if len(parts)==0 {
+    return ""
+  }
+  return "{"+strings.Join(parts,",")+"}"
+}
+
+var helpEscaper=strings.NewReplacer("\\","\\\\","\n","\\n")
+var labelValueEscaper=strings.NewReplacer("\\","\\\\","\n","\\n","\"","\\\"")
+
+func escapeHelp(help string) string {
+  return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+  return labelValueEscaper.Replace(value)
+}
+
+func formatValue(value float64) string {
+  switch {
+    case math.IsInf(value,1):
+      return "+Inf"
+    case math.IsInf(value,-1):
+      return "-Inf"
+    case math.IsNaN(value):
+      return "NaN"
+  }
+  return strconv.FormatFloat(value,'g',-1,64)
+}
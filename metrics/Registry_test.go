@@ -0,0 +1,68 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package metrics
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "strings"
+)
+
+
+/*
+  Makes sure all metric types are written in the text exposition format, with series sorted and label values escaped.
+ */
+func TestRegistryWriteText(t *testing.T) {
+  registry:=NewRegistry()
+  requests:=registry.NewCounter("test_requests_total","Requests\nhandled.","method","status")
+  open:=registry.NewGauge("test_open","Open connections.")
+  durations:=registry.NewHistogram("test_duration_seconds","Durations.",[]float64{1,0.1},"handler")
+
+  requests.Inc("POST","200")
+  requests.Add(2,"GET","200")
+  requests.Add(-5,"GET","200")
+  requests.Inc("GET","say \"hi\"\\")
+  open.Inc()
+  open.Inc()
+  open.Dec()
+  durations.Observe(0.1,"a")
+  durations.Observe(0.5,"a")
+  durations.Observe(3,"a")
+
+  var output strings.Builder
+  assert.Nil(t,registry.WriteText(&output))
+  expected:=`# HELP test_requests_total Requests\nhandled.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",status="200"} 2
+test_requests_total{method="GET",status="say \"hi\"\\"} 1
+test_requests_total{method="POST",status="200"} 1
+# HELP test_open Open connections.
+# TYPE test_open gauge
+test_open 1
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{handler="a",le="0.1"} 1
+test_duration_seconds_bucket{handler="a",le="1"} 2
+test_duration_seconds_bucket{handler="a",le="+Inf"} 3
+test_duration_seconds_sum{handler="a"} 3.6
+test_duration_seconds_count{handler="a"} 3
+`
+  assert.Equal(t,expected,output.String())
+  assert.Equal(t,float64(2),requests.Get("GET","200"))
+  assert.Equal(t,float64(0),requests.Get("PUT","200"))
+  assert.Equal(t,uint64(3),durations.Count("a"))
+}
+
+/*
+  Makes sure invalid and duplicate metrics, and wrong numbers of label values are rejected.
+ */
+func TestRegistryRejectsInvalidMetrics(t *testing.T) {
+  registry:=NewRegistry()
+  counter:=registry.NewCounter("test_total","Test.","label")
+  assert.Panics(t,func() { registry.NewGauge("test_total","Duplicate.") })
+  assert.Panics(t,func() { registry.NewGauge("invalid-name","Invalid.") })
+  assert.Panics(t,func() { registry.NewHistogram("test_seconds","Reserved label.",DefaultBuckets,"le") })
+  assert.Panics(t,func() { counter.Inc() })
+  assert.Panics(t,func() { counter.Inc("a","b") })
+}
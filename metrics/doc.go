@@ -0,0 +1,19 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+/*
+  Counters, gauges and histograms with labels, exported in the Prometheus text exposition format.
+
+  Metrics are created once, usually as package variables, and registered with a Registry - the package-level constructors use
+  DefaultRegistry:
+
+    var requests=metrics.NewCounter("myapp_requests_total","Requests handled.","method","status")
+    ...
+    requests.Inc("GET","200")
+
+  Label values are passed in the order the label names were declared in. The server's metrics are served by the admin API's
+  /metrics endpoint.
+
+  This package only depends on Go's standard library.
+ */
+package metrics
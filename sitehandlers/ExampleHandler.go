@@ -34,15 +34,25 @@ func (h ExampleHandler) HandlesHost(host string) bool {
   required by http.SiteHandler interface
  */
 func (h ExampleHandler) HandleRequest(server *http.Server, browserio *bufio.ReadWriter, request *http.Request) {
-  var response *http.Response
-  var err error
-  client:=http.NewClient()
-  client.CopyProxySettings(server)
-  response,err=client.ForwardRequest(*request)
-  if err!=nil {
-    return
+  server.ServeForwarded(h,browserio,request)
+}
+
+/*
+  optional http.HostPatternSiteHandler interface
+ */
+func (h ExampleHandler) GetHostPatterns() []string {
+  return h.GetRegexes()
+}
+
+/*
+  optional http.MiddlewareSiteHandler interface: this handler's own middleware, applied after the server's global middleware
+ */
+func (h ExampleHandler) GetMiddlewares() []http.Middleware {
+  //uncommented lines would e.g. keep browsers from sending the referring page to asdf.com
+
+  return []http.Middleware {
+  //  StripRequestHeaders("Referer"),
   }
-  server.WriteAndFlush(browserio,response.ToString())
 }
 
 /*
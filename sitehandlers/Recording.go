@@ -0,0 +1,290 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package sitehandlers
+
+import (
+  "bufio"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/hex"
+  "io"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "github.com/rinusser/hopgoblin/capture"
+  "github.com/rinusser/hopgoblin/http"
+)
+
+
+/*
+  Recorded exchanges for the ReplayHandler, loaded from and appended to either a HAR file (filename ending in ".har") or a native
+  recording file (any other filename). Native recordings contain raw HTTP requests with absolute URLs, each followed by its
+  response, as sent over the wire.
+
+  Requests are matched by method and absolute URL, optionally additionally by selected header values and the body's hash. If a
+  request was recorded multiple times its responses are replayed in order, the last one is repeated after that.
+ */
+type Recording struct {
+  Filename string
+  MatchHeaders []string //request headers that must match in addition to method and URL
+  MatchBody bool        //whether request bodies must match, compared by SHA-256 hash
+
+  responses map[string]*recordedResponses //raw responses by request key
+  document *capture.Document              //the HAR document for HAR recordings
+  mutex sync.Mutex
+}
+
+type recordedResponses struct {
+  data [][]byte
+  next int
+}
+
+/*
+  Creates an empty recording.
+ */
+func NewRecording(filename string, match_headers []string, match_body bool) *Recording {
+  rv:=&Recording {
+    Filename: filename,
+    MatchHeaders: match_headers,
+    MatchBody: match_body,
+    responses: make(map[string]*recordedResponses),
+  }
+  if rv.isHAR() {
+    rv.document=capture.NewDocument()
+  }
+  return rv
+}
+
+/*
+  Loads a recording from file. A missing file results in an empty recording, the file will be created once exchanges are
+  appended.
+ */
+func LoadRecording(filename string, match_headers []string, match_body bool) (*Recording,error) {
+  rv:=NewRecording(filename,match_headers,match_body)
+  if _,err:=os.Stat(filename);os.IsNotExist(err) {
+    return rv,nil
+  }
+  var err error
+  if rv.isHAR() {
+    err=rv.loadHAR()
+  } else {
+    err=rv.loadNative()
+  }
+  if err!=nil {
+    return nil,err
+  }
+  return rv,nil
+}
+
+func (this *Recording) isHAR() bool {
+  return strings.EqualFold(filepath.Ext(this.Filename),".har")
+}
+
+func (this *Recording) loadHAR() error {
+  document,err:=capture.ReadHARFile(this.Filename)
+  if err!=nil {
+    return err
+  }
+  this.document=document
+  for _,entry:=range document.Log.Entries {
+    headers:=http.NewHeaders()
+    for _,header:=range entry.Request.Headers {
+      headers.Add(header.Name,header.Value)
+    }
+    var body []byte
+    if entry.Request.PostData!=nil {
+      body=decodeHARText(entry.Request.PostData.Text,entry.Request.PostData.Encoding)
+    }
+    response,err:=newResponseFromHAR(&entry.Response)
+    if err!=nil {
+      return err
+    }
+    this.add(this.getKey(entry.Request.Method,entry.Request.Url,headers,body),response.Bytes())
+  }
+  return nil
+}
+
+/*
+  Builds a response from a HAR entry. HAR files contain decoded bodies, so the content is encoded again according to the
+  Content-Encoding header.
+ */
+func newResponseFromHAR(entry *capture.EntryResponse) (*http.Response,error) {
+  rv:=http.NewResponse()
+  rv.Status=uint16(entry.Status)
+  if strings.HasPrefix(entry.HTTPVersion,"HTTP/1.") {
+    rv.Protocol=entry.HTTPVersion
+  }
+  for _,header:=range entry.Headers {
+    name:=strings.ToLower(header.Name)
+    if strings.HasPrefix(name,":") || name=="content-length" || name=="transfer-encoding" {
+      continue
+    }
+    rv.Headers.Add(header.Name,header.Value)
+  }
+  body:=decodeHARText(entry.Content.Text,entry.Content.Encoding)
+  err:=rv.EncodeBody(body,strings.Join(rv.Headers.Values("Content-Encoding"),","))
+  return rv,err
+}
+
+func decodeHARText(text string, encoding string) []byte {
+  if encoding=="base64" {
+    data,err:=base64.StdEncoding.DecodeString(text)
+    if err==nil {
+      return data
+    }
+  }
+  return []byte(text)
+}
+
+func (this *Recording) loadNative() error {
+  file,err:=os.Open(this.Filename)
+  if err!=nil {
+    return err
+  }
+  defer file.Close()
+  reader:=bufio.NewReader(file)
+  for {
+    request,err:=http.ReadRequest(reader)
+    if err==io.EOF {
+      return nil
+    } else if err!=nil {
+      return err
+    }
+    body,err:=request.ReadBody()
+    if err!=nil {
+      return err
+    }
+    response,err:=http.ReadResponse(reader,request.Method)
+    if err!=nil {
+      return err
+    }
+    response.ReadBody()
+    this.add(this.getKey(request.Method,request.Url,request.Headers,body),response.Bytes())
+  }
+}
+
+
+/*
+  Builds the lookup key for a request.
+ */
+func (this *Recording) getKey(method string, url string, headers *http.Headers, body []byte) string {
+  parts:=[]string{strings.ToUpper(method),url}
+  for _,name:=range this.MatchHeaders {
+    parts=append(parts,strings.Join(headers.GetAll(name),"\n"))
+  }
+  if this.MatchBody {
+    hash:=sha256.Sum256(body)
+    parts=append(parts,hex.EncodeToString(hash[:]))
+  }
+  return strings.Join(parts,"\x00")
+}
+
+func (this *Recording) getRequestKey(request *http.Request) string {
+  body,_:=request.ReadBody()
+  return this.getKey(request.Method,request.GetAbsoluteUrl(),request.Headers,body)
+}
+
+func (this *Recording) add(key string, response []byte) {
+  if this.responses[key]==nil {
+    this.responses[key]=&recordedResponses{}
+  }
+  this.responses[key].data=append(this.responses[key].data,response)
+}
+
+/*
+  Returns the number of recorded exchanges.
+ */
+func (this *Recording) Count() int {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  rv:=0
+  for _,responses:=range this.responses {
+    rv+=len(responses.data)
+  }
+  return rv
+}
+
+/*
+  Finds the next recorded response for a request. The request body is read if it's still streamed.
+  Returns nil if the request wasn't recorded or the recorded response can't be parsed.
+ */
+func (this *Recording) Find(request *http.Request) *http.Response {
+  key:=this.getRequestKey(request)
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  responses:=this.responses[key]
+  if responses==nil {
+    return nil
+  }
+  data:=responses.data[responses.next]
+  if responses.next<len(responses.data)-1 {
+    responses.next++
+  }
+  response:=http.ParseResponseBytes(data)
+  if response.Status==0 {
+    request.Logger().Warn("could not parse recorded response for %s",key)
+    return nil
+  }
+  return &response
+}
+
+/*
+  Adds an exchange to the recording and its file. Both request and response bodies are read if they're still streamed, so the
+  response can be passed on afterwards.
+ */
+func (this *Recording) Append(request *http.Request, response *http.Response) error {
+  url:=request.GetAbsoluteUrl()
+  key:=this.getRequestKey(request)
+  body,err:=response.ReadBody()
+  if err!=nil {
+    return err
+  }
+  _,found_content_length:=response.Headers.Get("Content-Length")
+  _,found_xfer_encoding:=response.Headers.Get("Transfer-Encoding")
+  if !found_content_length && !found_xfer_encoding {
+    response.Headers.Set("Content-Length",strconv.Itoa(len(body)))
+  }
+
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  this.add(key,response.Bytes())
+  if this.isHAR() {
+    entry:=capture.NewEntry(&http.Exchange {
+      Started: time.Now(),
+      Url: url,
+      Request: request,
+      Response: response,
+      Timings: http.ExchangeTimings{Connect:-1,TLS:-1},
+      Tunneled: request.IsSSL,
+    })
+    this.document.Log.Entries=append(this.document.Log.Entries,*entry)
+    return capture.WriteHARFile(this.Filename,this.document)
+  }
+  return this.appendNative(request,url,response)
+}
+
+func (this *Recording) appendNative(request *http.Request, url string, response *http.Response) error {
+  recorded:=*request
+  recorded.Url=url
+  recorded.Headers=request.Headers.Clone()
+  _,found_content_length:=recorded.Headers.Get("Content-Length")
+  _,found_xfer_encoding:=recorded.Headers.Get("Transfer-Encoding")
+  if len(recorded.Body)>0 && !found_content_length && !found_xfer_encoding {
+    recorded.Headers.Set("Content-Length",strconv.Itoa(len(recorded.Body)))
+  }
+
+  file,err:=os.OpenFile(this.Filename,os.O_WRONLY|os.O_CREATE|os.O_APPEND,0600)
+  if err!=nil {
+    return err
+  }
+  _,err=file.Write(append(recorded.Bytes(),response.Bytes()...))
+  close_err:=file.Close()
+  if err==nil {
+    err=close_err
+  }
+  return err
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package sitehandlers
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "github.com/rinusser/hopgoblin/http"
+)
+
+
+func createRecordedResponse(body string) *http.Response {
+  response:=http.NewResponse()
+  response.Headers.Set("Content-Type","text/plain")
+  response.Body=[]byte(body)
+  return response
+}
+
+func getRecordedBody(t *testing.T, recording *Recording, raw string) string {
+  response:=recording.Find(http.ParseRequest(raw))
+  if !assert.NotNil(t,response,"request should have been recorded:\n%s",raw) {
+    return ""
+  }
+  return response.GetPlainTextBodyString()
+}
+
+/*
+  Makes sure exchanges are appended to recording files and can be loaded again, in both native and HAR format.
+ */
+func TestRecordingFiles(t *testing.T) {
+  directory,_:=ioutil.TempDir("","hopgoblin-recording")
+  defer os.RemoveAll(directory)
+
+  for _,name:=range []string{"recording.txt","recording.har"} {
+    filename:=filepath.Join(directory,name)
+    recording,err:=LoadRecording(filename,nil,false)
+    if !assert.Nil(t,err,"missing files should result in empty recordings") {
+      continue
+    }
+    assert.Equal(t,0,recording.Count())
+
+    assert.Nil(t,recording.Append(http.ParseRequest("GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"),createRecordedResponse("first")))
+    assert.Nil(t,recording.Append(http.ParseRequest("GET http://example.com/a HTTP/1.1\r\nHost: example.com\r\n\r\n"),createRecordedResponse("second")))
+    compressed:=createRecordedResponse("")
+    compressed.EncodeBody([]byte("compressed"),"gzip")
+    post:=http.ParseRequest("POST /b HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n\r\ndata")
+    post.IsSSL=true
+    assert.Nil(t,recording.Append(post,compressed))
+
+    recording,err=LoadRecording(filename,nil,false)
+    if !assert.Nil(t,err,"%s should be readable",name) {
+      continue
+    }
+    assert.Equal(t,3,recording.Count(),name)
+    get:="GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n"
+    assert.Equal(t,"first",getRecordedBody(t,recording,get),name)
+    assert.Equal(t,"second",getRecordedBody(t,recording,get),name)
+    assert.Equal(t,"second",getRecordedBody(t,recording,get),"%s: the last response should be repeated",name)
+    assert.Equal(t,"compressed",getRecordedBody(t,recording,"POST https://example.com/b HTTP/1.1\r\nHost: example.com\r\n\r\n"),name)
+    assert.Nil(t,recording.Find(http.ParseRequest("GET /b HTTP/1.1\r\nHost: example.com\r\n\r\n")),name)
+  }
+}
+
+/*
+  Makes sure selected request headers and bodies are matched if configured.
+ */
+func TestRecordingMatching(t *testing.T) {
+  recording:=NewRecording(filepath.Join(os.TempDir(),"unused.har"),[]string{"Accept"},true)
+  recording.add(recording.getRequestKey(http.ParseRequest("POST http://example.com/ HTTP/1.1\r\nAccept: a\r\n\r\n1")),
+                createRecordedResponse("1a").Bytes())
+  recording.add(recording.getRequestKey(http.ParseRequest("POST http://example.com/ HTTP/1.1\r\nAccept: b\r\n\r\n1")),
+                createRecordedResponse("1b").Bytes())
+  recording.add(recording.getRequestKey(http.ParseRequest("POST http://example.com/ HTTP/1.1\r\nAccept: a\r\n\r\n2")),
+                createRecordedResponse("2a").Bytes())
+
+  assert.Equal(t,"1b",getRecordedBody(t,recording,"POST http://example.com/ HTTP/1.1\r\nAccept: b\r\nX-Other: x\r\n\r\n1"))
+  assert.Equal(t,"2a",getRecordedBody(t,recording,"POST http://example.com/ HTTP/1.1\r\nAccept: a\r\n\r\n2"))
+  assert.Nil(t,recording.Find(http.ParseRequest("POST http://example.com/ HTTP/1.1\r\n\r\n1")))
+  assert.Nil(t,recording.Find(http.ParseRequest("POST http://example.com/ HTTP/1.1\r\nAccept: b\r\n\r\n2")))
+}
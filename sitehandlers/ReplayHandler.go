@@ -0,0 +1,210 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package sitehandlers
+
+import (
+  "bufio"
+  "crypto/tls"
+  "errors"
+  "fmt"
+  "path/filepath"
+  "regexp"
+  "strconv"
+  "strings"
+  "github.com/rinusser/hopgoblin/bootstrap"
+  "github.com/rinusser/hopgoblin/http"
+  "github.com/rinusser/hopgoblin/log"
+  "github.com/rinusser/hopgoblin/utils"
+)
+
+
+func init() {
+  bootstrap.AfterFlagParse(registerReplayHandler)
+}
+
+func registerReplayHandler() {
+  handler,err:=LoadReplayHandler()
+  if err!=nil {
+    log.Error("replay disabled: %s",err)
+  } else if handler!=nil {
+    http.RegisterSiteHandler(handler)
+  }
+}
+
+
+/*
+  What the ReplayHandler does with requests that weren't recorded.
+ */
+type ReplayMissPolicy int
+
+const (
+  ReplayMissNotFound ReplayMissPolicy=iota //answer with HTTP 404
+  ReplayMissPass                           //forward the request
+  ReplayMissRecord                         //forward the request and append the exchange to the recording
+)
+
+/*
+  Parses a replay miss policy name, i.e. "404", "pass" or "record".
+ */
+func ParseReplayMissPolicy(name string) (ReplayMissPolicy,error) {
+  switch strings.ToLower(name) {
+    case "404":
+      return ReplayMissNotFound,nil
+    case "pass":
+      return ReplayMissPass,nil
+    case "record":
+      return ReplayMissRecord,nil
+  }
+  return ReplayMissNotFound,errors.New("unknown replay miss policy \""+name+"\"")
+}
+
+/*
+  Returns the policy's name.
+ */
+func (this ReplayMissPolicy) String() string {
+  switch this {
+    case ReplayMissPass:
+      return "pass"
+    case ReplayMissRecord:
+      return "record"
+  }
+  return "404"
+}
+
+
+/*
+  Site handler answering requests with previously recorded responses, e.g. from a HAR capture. See Recording for how requests are
+  matched.
+
+  The handler is configured in the [replay] section of application.ini:
+
+    file            recording to replay, a HAR file if it ends in ".har" and a native recording otherwise; relative to
+                    resources/ unless absolute, required
+    hosts           whitespace-separated list of host regexes to replay, required
+    match_headers   whitespace-separated list of request header names that must match as well, optional
+    match_body      whether request bodies must match as well, defaults to false
+    miss            what to do with requests that weren't recorded: "404" (default), "pass" or "record"
+ */
+type ReplayHandler struct {
+  Hosts utils.MultiRegexMatcher
+  Recording *Recording
+  Miss ReplayMissPolicy
+}
+
+/*
+  Creates a new ReplayHandler instance.
+ */
+func NewReplayHandler(hosts []string, recording *Recording, miss ReplayMissPolicy) *ReplayHandler {
+  return &ReplayHandler{Hosts:utils.NewMultiRegexMatcher(hosts),Recording:recording,Miss:miss}
+}
+
+/*
+  Creates a ReplayHandler from the application configuration.
+  Returns nil without error if replaying isn't configured.
+ */
+func LoadReplayHandler() (*ReplayHandler,error) {
+  return parseReplayHandler(utils.GetConfigValuesByPrefix("replay."))
+}
+
+func parseReplayHandler(values map[string]string) (*ReplayHandler,error) {
+  filename:=values["file"]
+  if filename=="" {
+    return nil,nil
+  }
+  if !filepath.IsAbs(filename) {
+    filename=utils.GetResourcePath(filename)
+  }
+
+  hosts:=strings.Fields(values["hosts"])
+  if len(hosts)==0 {
+    return nil,errors.New("missing hosts")
+  }
+  for _,host:=range hosts {
+    if _,err:=regexp.Compile(host);err!=nil {
+      return nil,fmt.Errorf("invalid host regex: %s",err)
+    }
+  }
+
+  match_body:=false
+  if values["match_body"]!="" {
+    var err error
+    match_body,err=strconv.ParseBool(values["match_body"])
+    if err!=nil {
+      return nil,errors.New("invalid match_body value \""+values["match_body"]+"\"")
+    }
+  }
+  miss:=ReplayMissNotFound
+  if values["miss"]!="" {
+    var err error
+    miss,err=ParseReplayMissPolicy(values["miss"])
+    if err!=nil {
+      return nil,err
+    }
+  }
+
+  recording,err:=LoadRecording(filename,strings.Fields(values["match_headers"]),match_body)
+  if err!=nil {
+    return nil,fmt.Errorf("could not load recording %s: %s",filename,err)
+  }
+  log.Info("replaying %d recorded exchanges from %s",recording.Count(),filename)
+  return NewReplayHandler(hosts,recording,miss),nil
+}
+
+
+/*
+  required by http.SiteHandler interface
+ */
+func (this *ReplayHandler) HandlesHost(host string) bool {
+  return this.Hosts.MatchesAnyRegex(host)
+}
+
+/*
+  required by http.SiteHandler interface
+ */
+func (this *ReplayHandler) HandleRequest(server *http.Server, browserio *bufio.ReadWriter, request *http.Request) {
+  client:=http.NewServerClient(server)
+  server.ServeRoundTrip(this,browserio,request,func(request *http.Request) (*http.Response,error) {
+    return this.replay(client,request)
+  })
+}
+
+/*
+  optional http.HostPatternSiteHandler interface
+ */
+func (this *ReplayHandler) GetHostPatterns() []string {
+  return this.Hosts.GetRegexes()
+}
+
+/*
+  required by http.SiteHandler interface
+ */
+func (this *ReplayHandler) GetCertificateMap() map[string]*tls.Certificate {
+  return map[string]*tls.Certificate{}
+}
+
+func (this *ReplayHandler) replay(client *http.Client, request *http.Request) (*http.Response,error) {
+  if response:=this.Recording.Find(request);response!=nil {
+    request.Logger().Debug("replaying recorded response for %s %s",request.Method,request.GetAbsoluteUrl())
+    return response,nil
+  }
+
+  switch this.Miss {
+    case ReplayMissPass:
+      return client.RoundTrip(request)
+    case ReplayMissRecord:
+      snapshot:=*request
+      snapshot.Url=request.GetAbsoluteUrl()
+      snapshot.Headers=request.Headers.Clone()
+      response,err:=client.RoundTrip(request)
+      if err!=nil || response==nil {
+        return response,err
+      }
+      if err=this.Recording.Append(&snapshot,response);err!=nil {
+        request.Logger().Error("could not record %s: %s",snapshot.Url,err)
+      }
+      return response,nil
+  }
+  request.Logger().Debug("no recorded response for %s %s",request.Method,request.GetAbsoluteUrl())
+  return http.CreateSimpleResponse(404),nil
+}
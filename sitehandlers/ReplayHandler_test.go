@@ -0,0 +1,128 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package sitehandlers
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "bufio"
+  "bytes"
+  "fmt"
+  "io/ioutil"
+  "net"
+  "os"
+  "path/filepath"
+  "github.com/rinusser/hopgoblin/http"
+)
+
+
+/*
+  Makes sure replay settings are validated.
+ */
+func TestParseReplayHandler(t *testing.T) {
+  handler,err:=parseReplayHandler(map[string]string{})
+  assert.Nil(t,handler,"replaying should be disabled without file")
+  assert.Nil(t,err)
+
+  filename:=filepath.Join(os.TempDir(),"hopgoblin-missing.har")
+  for _,values:=range []map[string]string {
+    {"file":filename},
+    {"file":filename,"hosts":"("},
+    {"file":filename,"hosts":".","match_body":"maybe"},
+    {"file":filename,"hosts":".","miss":"ignore"},
+  } {
+    handler,err=parseReplayHandler(values)
+    assert.Nil(t,handler)
+    assert.NotNil(t,err,"%v should be invalid",values)
+  }
+
+  handler,err=parseReplayHandler(map[string]string {
+    "file":filename,
+    "hosts":"^a\\.local$ ^b\\.local$",
+    "match_headers":"Accept Cookie",
+    "match_body":"true",
+    "miss":"Record",
+  })
+  if assert.Nil(t,err) {
+    assert.True(t,handler.HandlesHost("b.local"))
+    assert.False(t,handler.HandlesHost("c.local"))
+    assert.Equal(t,[]string{"Accept","Cookie"},handler.Recording.MatchHeaders)
+    assert.True(t,handler.Recording.MatchBody)
+    assert.Equal(t,ReplayMissRecord,handler.Miss)
+  }
+}
+
+func runReplayHandler(handler *ReplayHandler, raw string) *http.Response {
+  var output bytes.Buffer
+  buf:=bufio.NewReadWriter(bufio.NewReader(&output),bufio.NewWriter(&output))
+  server:=http.NewServer()
+  server.SetProxySettings(nil)
+  handler.HandleRequest(server,buf,http.ParseRequest(raw))
+  response:=http.ParseResponseBytes(output.Bytes())
+  return &response
+}
+
+/*
+  Starts an upstream server on a random port answering each request with a counter.
+  Returns the server's address.
+ */
+func startReplayUpstream(t *testing.T) string {
+  listener,err:=net.Listen("tcp","127.0.0.1:0")
+  if err!=nil {
+    t.Fatalf("could not start upstream: %s",err)
+  }
+  count:=0
+  go func() {
+    for {
+      conn,err:=listener.Accept()
+      if err!=nil {
+        return
+      }
+      request,err:=http.ReadRequest(bufio.NewReader(conn))
+      if err==nil {
+        request.ReadBody()
+        count++
+        body:=fmt.Sprintf("upstream %d",count)
+        fmt.Fprintf(conn,"HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: %d\r\n\r\n%s",len(body),body)
+      }
+      conn.Close()
+    }
+  }()
+  return listener.Addr().String()
+}
+
+/*
+  Makes sure recorded responses are replayed and misses are handled according to the policy.
+ */
+func TestReplayHandler(t *testing.T) {
+  directory,_:=ioutil.TempDir("","hopgoblin-replay")
+  defer os.RemoveAll(directory)
+  address:=startReplayUpstream(t)
+  recording,_:=LoadRecording(filepath.Join(directory,"replay.har"),nil,false)
+  recording.Append(http.ParseRequest("GET http://"+address+"/recorded HTTP/1.1\r\nHost: "+address+"\r\n\r\n"),
+                   createRecordedResponse("recorded"))
+  handler:=NewReplayHandler([]string{"."},recording,ReplayMissNotFound)
+  request:=func(path string) string {
+    return "GET http://"+address+path+" HTTP/1.1\r\nHost: "+address+"\r\nConnection: close\r\n\r\n"
+  }
+
+  response:=runReplayHandler(handler,request("/recorded"))
+  assert.Equal(t,uint16(200),response.Status)
+  assert.Equal(t,"recorded",response.GetPlainTextBodyString())
+  assert.Equal(t,uint16(404),runReplayHandler(handler,request("/new")).Status)
+
+  handler.Miss=ReplayMissPass
+  assert.Equal(t,"upstream 1",runReplayHandler(handler,request("/new")).GetPlainTextBodyString())
+  assert.Equal(t,1,recording.Count(),"passed requests shouldn't be recorded")
+
+  handler.Miss=ReplayMissRecord
+  assert.Equal(t,"upstream 2",runReplayHandler(handler,request("/new")).GetPlainTextBodyString())
+  assert.Equal(t,"upstream 2",runReplayHandler(handler,request("/new")).GetPlainTextBodyString(),"the recorded response should be replayed")
+  assert.Equal(t,2,recording.Count())
+
+  reloaded,err:=LoadRecording(recording.Filename,nil,false)
+  if assert.Nil(t,err) {
+    assert.Equal(t,"upstream 2",getRecordedBody(t,reloaded,request("/new")))
+  }
+}
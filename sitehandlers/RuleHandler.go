@@ -0,0 +1,393 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package sitehandlers
+
+import (
+  "bufio"
+  "crypto/tls"
+  "errors"
+  "fmt"
+  "mime"
+  "os"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "github.com/rinusser/hopgoblin/bootstrap"
+  "github.com/rinusser/hopgoblin/http"
+  "github.com/rinusser/hopgoblin/log"
+  "github.com/rinusser/hopgoblin/utils"
+)
+
+
+func init() {
+  bootstrap.AfterFlagParse(registerRuleHandler)
+}
+
+func registerRuleHandler() {
+  rules:=LoadRules()
+  if len(rules)>0 {
+    http.RegisterSiteHandler(NewRuleHandler(rules))
+  }
+}
+
+
+/*
+  A declarative site handler rule, see RuleHandler.
+ */
+type Rule struct {
+  Name string
+  Hosts utils.MultiRegexMatcher
+  Path *regexp.Regexp          //matched against the request path including query string, nil matches all paths
+  Action string                //one of "forward", "block", "redirect" or "file"
+  Status uint16                //response status for "block" and "redirect"
+  Location string              //redirect target for "redirect"
+  Body string                  //response body for "block"
+  File string                  //local file to serve for "file"
+  ContentType string           //content type for "file", determined by file extension if empty
+  SetRequestHeaders [][]string //header name/value pairs to set in requests
+  RemoveRequestHeaders []string
+  SetResponseHeaders [][]string
+  RemoveResponseHeaders []string
+}
+
+/*
+  Generic site handler acting on declarative rules from the application configuration, so common cases don't require writing a
+  site handler.
+
+  Rules are configured as INI sections, either in application.ini as [rule.<name>] or in a separate file set in rules.file as
+  [<name>]. Rule names mustn't contain dots. For each request the first rule (in alphabetical order of their names) matching both
+  host and path is applied. Requests to handled hosts not matching any rule's path are forwarded unchanged. Settings per rule:
+
+    hosts                   whitespace-separated list of host regexes, required
+    path                    regex matched against the request path including query string, optional
+    action                  "forward" (default), "block", "redirect" or "file"
+    status                  response status for "block" (default 403) and "redirect" (default 302)
+    location                redirect target for "redirect", required there
+    body                    response body for "block", optional
+    file                    local file to serve for "file", relative to resources/ unless absolute
+    content_type            content type for "file", optional
+    set_request_header.<n>  "Name: value" header to set in requests, <n> is any unique suffix
+    remove_request_headers  whitespace-separated list of header names to remove from requests
+    set_response_header.<n> "Name: value" header to set in responses
+    remove_response_headers whitespace-separated list of header names to remove from responses
+
+  For example:
+
+    [rule.10-block-tracker]
+    hosts = ^tracker\.example\.com$
+    action = block
+    status = 404
+
+    [rule.20-no-frames]
+    hosts = (^|\.)example\.com$
+    set_response_header.1 = X-Frame-Options: DENY
+    remove_request_headers = Referer Cookie
+ */
+type RuleHandler struct {
+  Rules []*Rule
+}
+
+/*
+  Creates a new RuleHandler instance for the given rules.
+ */
+func NewRuleHandler(rules []*Rule) *RuleHandler {
+  return &RuleHandler{Rules:rules}
+}
+
+
+/*
+  Loads all rules from the application configuration and the rules file, if set. Invalid rules are logged and skipped.
+ */
+func LoadRules() []*Rule {
+  rv:=ParseRules(utils.GetConfigValuesByPrefix("rule."))
+  filename:=utils.GetConfigValue("rules.file")
+  if filename!="" {
+    if !filepath.IsAbs(filename) {
+      filename=utils.GetResourcePath(filename)
+    }
+    config:=utils.ParseINIFile(filename)
+    if config!=nil {
+      rv=append(rv,ParseRules(*config)...)
+    }
+  }
+  sort.SliceStable(rv,func(a int, b int) bool {
+    return rv[a].Name<rv[b].Name
+  })
+  return rv
+}
+
+/*
+  Parses rules from configuration values in the form of <name>.<setting>, sorted by name. Invalid rules are logged and skipped.
+ */
+func ParseRules(config map[string]string) []*Rule {
+  settings:=make(map[string]map[string]string)
+  for key,value:=range config {
+    dot_pos:=strings.Index(key,".")
+    if dot_pos<1 {
+      log.Error("invalid rule setting \"%s\", expected <name>.<setting>",key)
+      continue
+    }
+    name:=key[0:dot_pos]
+    if settings[name]==nil {
+      settings[name]=make(map[string]string)
+    }
+    settings[name][key[dot_pos+1:]]=value
+  }
+
+  var rv []*Rule
+  for name,values:=range settings {
+    rule,err:=parseRule(name,values)
+    if err!=nil {
+      log.Error("skipping rule \"%s\": %s",name,err)
+      continue
+    }
+    rv=append(rv,rule)
+  }
+  sort.Slice(rv,func(a int, b int) bool {
+    return rv[a].Name<rv[b].Name
+  })
+  return rv
+}
+
+func parseRule(name string, values map[string]string) (*Rule,error) {
+  rv:=&Rule{Name:name,Action:"forward"}
+
+  hosts:=strings.Fields(values["hosts"])
+  if len(hosts)==0 {
+    return nil,errors.New("missing hosts")
+  }
+  for _,host:=range hosts {
+    if _,err:=regexp.Compile(host);err!=nil {
+      return nil,fmt.Errorf("invalid host regex: %s",err)
+    }
+  }
+  rv.Hosts=utils.NewMultiRegexMatcher(hosts)
+
+  var err error
+  if values["path"]!="" {
+    rv.Path,err=regexp.Compile(values["path"])
+    if err!=nil {
+      return nil,fmt.Errorf("invalid path regex: %s",err)
+    }
+  }
+
+  if values["action"]!="" {
+    rv.Action=strings.ToLower(values["action"])
+  }
+  switch rv.Action {
+    case "forward":
+    case "block":
+      rv.Status,err=parseRuleStatus(values["status"],403)
+      rv.Body=values["body"]
+    case "redirect":
+      rv.Status,err=parseRuleStatus(values["status"],302)
+      rv.Location=values["location"]
+      if rv.Location=="" {
+        err=errors.New("missing location")
+      }
+    case "file":
+      rv.File=values["file"]
+      rv.ContentType=values["content_type"]
+      if rv.File=="" {
+        err=errors.New("missing file")
+      } else if !filepath.IsAbs(rv.File) {
+        rv.File=utils.GetResourcePath(rv.File)
+      }
+    default:
+      err=errors.New("unknown action \""+rv.Action+"\"")
+  }
+  if err!=nil {
+    return nil,err
+  }
+
+  rv.RemoveRequestHeaders=strings.Fields(values["remove_request_headers"])
+  rv.RemoveResponseHeaders=strings.Fields(values["remove_response_headers"])
+  rv.SetRequestHeaders,err=parseRuleHeaders(values,"set_request_header.")
+  if err==nil {
+    rv.SetResponseHeaders,err=parseRuleHeaders(values,"set_response_header.")
+  }
+  return rv,err
+}
+
+func parseRuleStatus(value string, fallback uint16) (uint16,error) {
+  if value=="" {
+    return fallback,nil
+  }
+  status,err:=strconv.Atoi(value)
+  if err!=nil || status<100 || status>599 {
+    return 0,errors.New("invalid status \""+value+"\"")
+  }
+  return uint16(status),nil
+}
+
+func parseRuleHeaders(values map[string]string, prefix string) ([][]string,error) {
+  var keys []string
+  for key:=range values {
+    if strings.HasPrefix(key,prefix) {
+      keys=append(keys,key)
+    }
+  }
+  sort.Strings(keys)
+
+  var rv [][]string
+  for _,key:=range keys {
+    colon:=strings.Index(values[key],":")
+    if colon<1 {
+      return nil,fmt.Errorf("invalid header \"%s\", expected \"Name: value\"",values[key])
+    }
+    rv=append(rv,[]string{strings.TrimSpace(values[key][0:colon]),strings.TrimSpace(values[key][colon+1:])})
+  }
+  return rv,nil
+}
+
+
+/*
+  required by http.SiteHandler interface
+ */
+func (this *RuleHandler) HandlesHost(host string) bool {
+  for _,rule:=range this.Rules {
+    if rule.Hosts.MatchesAnyRegex(host) {
+      return true
+    }
+  }
+  return false
+}
+
+/*
+  required by http.SiteHandler interface
+ */
+func (this *RuleHandler) HandleRequest(server *http.Server, browserio *bufio.ReadWriter, request *http.Request) {
+  rule:=this.findRule(request)
+  if rule==nil {
+    server.ServeForwarded(this,browserio,request)
+    return
+  }
+  request.Logger().Debug("applying rule \"%s\" to %s",rule.Name,request.Url)
+
+  client:=http.NewServerClient(server)
+  final:=client.RoundTrip
+  switch rule.Action {
+    case "block":
+      final=rule.block
+    case "redirect":
+      final=rule.redirect
+    case "file":
+      final=rule.serveFile
+  }
+  server.ServeRoundTrip(this,browserio,request,http.ChainMiddlewares(final,rule.getMiddlewares()))
+}
+
+/*
+  optional http.HostPatternSiteHandler interface: all rules' host regexes
+ */
+func (this *RuleHandler) GetHostPatterns() []string {
+  var rv []string
+  for _,rule:=range this.Rules {
+    rv=append(rv,rule.Hosts.GetRegexes()...)
+  }
+  return rv
+}
+
+/*
+  required by http.SiteHandler interface
+ */
+func (this *RuleHandler) GetCertificateMap() map[string]*tls.Certificate {
+  return map[string]*tls.Certificate{}
+}
+
+func (this *RuleHandler) findRule(request *http.Request) *Rule {
+  host:=request.GetTargetHost()
+  path:=getRequestPath(request.Url)
+  for _,rule:=range this.Rules {
+    if rule.Hosts.MatchesAnyRegex(host) && (rule.Path==nil || rule.Path.MatchString(path)) {
+      return rule
+    }
+  }
+  return nil
+}
+
+/*
+  Removes scheme and host from absolute URLs.
+ */
+func getRequestPath(url string) string {
+  scheme_end:=strings.Index(url,"://")
+  if scheme_end<0 {
+    return url
+  }
+  path_start:=strings.Index(url[scheme_end+3:],"/")
+  if path_start<0 {
+    return "/"
+  }
+  return url[scheme_end+3+path_start:]
+}
+
+
+func (this *Rule) getMiddlewares() []http.Middleware {
+  rv:=[]http.Middleware {
+    StripRequestHeaders(this.RemoveRequestHeaders...),
+    StripResponseHeaders(this.RemoveResponseHeaders...),
+  }
+  if len(this.SetRequestHeaders)>0 || len(this.SetResponseHeaders)>0 {
+    rv=append(rv,this.setHeaders)
+  }
+  return rv
+}
+
+func (this *Rule) setHeaders(next http.RoundTripFunc) http.RoundTripFunc {
+  return func(request *http.Request) (*http.Response,error) {
+    for _,header:=range this.SetRequestHeaders {
+      request.Headers.Set(header[0],header[1])
+    }
+    response,err:=next(request)
+    if response!=nil {
+      for _,header:=range this.SetResponseHeaders {
+        response.Headers.Set(header[0],header[1])
+      }
+    }
+    return response,err
+  }
+}
+
+func (this *Rule) block(request *http.Request) (*http.Response,error) {
+  response:=http.NewResponse()
+  response.Status=this.Status
+  response.Headers.Set("Content-Type","text/plain")
+  response.Body=[]byte(this.Body)
+  return response,nil
+}
+
+func (this *Rule) redirect(request *http.Request) (*http.Response,error) {
+  response:=http.NewResponse()
+  response.Status=this.Status
+  response.Headers.Set("Location",this.Location)
+  return response,nil
+}
+
+func (this *Rule) serveFile(request *http.Request) (*http.Response,error) {
+  file,err:=os.Open(this.File)
+  if err!=nil {
+    request.Logger().Warn("rule \"%s\" can't open file: %s",this.Name,err)
+    return http.CreateSimpleResponse(404),nil
+  }
+  info,err:=file.Stat()
+  if err!=nil || info.IsDir() {
+    file.Close()
+    return http.CreateSimpleResponse(404),nil
+  }
+
+  content_type:=this.ContentType
+  if content_type=="" {
+    content_type=mime.TypeByExtension(filepath.Ext(this.File))
+  }
+  if content_type=="" {
+    content_type="application/octet-stream"
+  }
+  response:=http.NewResponse()
+  response.Headers.Set("Content-Type",content_type)
+  response.Headers.Set("Content-Length",strconv.FormatInt(info.Size(),10))
+  response.BodyStream=file
+  return response,nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package sitehandlers
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "bufio"
+  "bytes"
+  "io/ioutil"
+  "os"
+  "github.com/rinusser/hopgoblin/http"
+)
+
+
+/*
+  Makes sure rules are parsed from configuration values, sorted by name, and invalid rules are skipped.
+ */
+func TestParseRules(t *testing.T) {
+  rules:=ParseRules(map[string]string {
+    "b.hosts":"^b\\.local$ ^c\\.local$",
+    "b.action":"Redirect",
+    "b.location":"http://example.com/",
+    "a.hosts":"^a\\.local$",
+    "a.path":"^/ads/",
+    "a.action":"block",
+    "a.set_response_header.2":"X-Two: 2",
+    "a.set_response_header.1":"X-One: 1",
+    "a.remove_request_headers":"Cookie Referer",
+    "no_hosts.action":"block",
+    "bad_action.hosts":".",
+    "bad_action.action":"explode",
+    "bad_status.hosts":".",
+    "bad_status.action":"block",
+    "bad_status.status":"42",
+    "no_location.hosts":".",
+    "no_location.action":"redirect",
+    "bad_header.hosts":".",
+    "bad_header.set_request_header.1":"no colon",
+    "bad_regex.hosts":"(",
+  })
+  assert.Equal(t,2,len(rules))
+  assert.Equal(t,"a",rules[0].Name)
+  assert.Equal(t,uint16(403),rules[0].Status,"block should have defaulted to 403")
+  assert.Equal(t,[][]string{{"X-One","1"},{"X-Two","2"}},rules[0].SetResponseHeaders)
+  assert.Equal(t,[]string{"Cookie","Referer"},rules[0].RemoveRequestHeaders)
+  assert.Equal(t,"redirect",rules[1].Action)
+  assert.Equal(t,uint16(302),rules[1].Status,"redirect should have defaulted to 302")
+  assert.True(t,rules[1].Hosts.MatchesAnyRegex("c.local"))
+}
+
+func runRuleHandler(t *testing.T, handler *RuleHandler, raw string) http.Response {
+  var output bytes.Buffer
+  buf:=bufio.NewReadWriter(bufio.NewReader(&output),bufio.NewWriter(&output))
+  handler.HandleRequest(http.NewServer(),buf,http.ParseRequest(raw))
+  return http.ParseResponseBytes(output.Bytes())
+}
+
+/*
+  Makes sure the first rule matching host and path is applied.
+ */
+func TestRuleHandlerActions(t *testing.T) {
+  file,err:=ioutil.TempFile("","hopgoblin-rule*.json")
+  assert.Nil(t,err)
+  defer os.Remove(file.Name())
+  file.WriteString(`{"local":true}`)
+  file.Close()
+
+  handler:=NewRuleHandler(ParseRules(map[string]string {
+    "1.hosts":"^example\\.com$",
+    "1.path":"^/blocked",
+    "1.action":"block",
+    "1.status":"410",
+    "1.body":"gone",
+    "1.set_response_header.1":"X-Rule: 1",
+    "2.hosts":"^example\\.com$",
+    "2.path":"^/old\\?",
+    "2.action":"redirect",
+    "2.location":"http://example.com/new",
+    "3.hosts":"^example\\.com$ ^example\\.org$",
+    "3.action":"file",
+    "3.file":file.Name(),
+  }))
+  assert.True(t,handler.HandlesHost("example.org"))
+  assert.False(t,handler.HandlesHost("example.net"))
+
+  response:=runRuleHandler(t,handler,"GET http://example.com/blocked/1 HTTP/1.1\r\n\r\n")
+  assert.Equal(t,uint16(410),response.Status)
+  assert.Equal(t,"gone",string(response.Body))
+  value,_:=response.Headers.Get("X-Rule")
+  assert.Equal(t,"1",value,"response header should have been set")
+
+  response=runRuleHandler(t,handler,"GET /old?x=1 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+  assert.Equal(t,uint16(302),response.Status)
+  value,_=response.Headers.Get("Location")
+  assert.Equal(t,"http://example.com/new",value)
+
+  response=runRuleHandler(t,handler,"GET http://example.org/anything HTTP/1.1\r\n\r\n")
+  assert.Equal(t,uint16(200),response.Status)
+  assert.Equal(t,`{"local":true}`,string(response.Body))
+  value,_=response.Headers.Get("Content-Type")
+  assert.Equal(t,"application/json",value,"content type should have been determined by extension")
+}
+
+/*
+  Makes sure request paths are extracted from absolute and relative URLs.
+ */
+func TestGetRequestPath(t *testing.T) {
+  assert.Equal(t,"/a/b?c",getRequestPath("http://example.com:8080/a/b?c"))
+  assert.Equal(t,"/",getRequestPath("https://example.com"))
+  assert.Equal(t,"/relative",getRequestPath("/relative"))
+}
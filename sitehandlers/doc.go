@@ -10,6 +10,9 @@
   Handlers' HandleRequest() methods can answer requests themselves, forward requests to another server/proxy, analyze or modify
   requests and responses, ... - anything goes!
 
+  Common cases like blocking, redirecting, serving local files or changing headers don't require writing a site handler: the
+  RuleHandler applies rules from the application configuration instead. The ReplayHandler answers requests from recorded traffic.
+
   Note that intercepting HTTPS connections will trigger certificate warnings/errors in the connecting client (e.g. the browser).
   It's recommended that you create a self-signed certificate chain, load custom certificates (with appropriate hostnames entered)
   in the site handler and add your CA file to the browser (ideally in a separate profile just for this purpose, so you don't run a
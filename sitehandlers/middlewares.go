@@ -0,0 +1,87 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package sitehandlers
+
+import (
+  "fmt"
+  "time"
+  "github.com/rinusser/hopgoblin/http"
+)
+
+
+func init() {
+  http.RegisterMiddleware("log",LogRequests)
+  http.RegisterMiddleware("timing",ServerTiming)
+  http.RegisterMiddleware("strip_proxy_headers",StripRequestHeaders("Proxy-Authorization","Proxy-Connection"))
+}
+
+
+/*
+  Creates middleware removing the given headers from requests before they're passed on.
+ */
+func StripRequestHeaders(names ...string) http.Middleware {
+  return func(next http.RoundTripFunc) http.RoundTripFunc {
+    return func(request *http.Request) (*http.Response,error) {
+      for _,name:=range names {
+        request.Headers.Del(name)
+      }
+      return next(request)
+    }
+  }
+}
+
+/*
+  Creates middleware removing the given headers from responses before they're passed on.
+ */
+func StripResponseHeaders(names ...string) http.Middleware {
+  return func(next http.RoundTripFunc) http.RoundTripFunc {
+    return func(request *http.Request) (*http.Response,error) {
+      response,err:=next(request)
+      if response!=nil {
+        for _,name:=range names {
+          response.Headers.Del(name)
+        }
+      }
+      return response,err
+    }
+  }
+}
+
+/*
+  Middleware logging each request along with its proxy user, response status and the time it took to get the response header.
+ */
+func LogRequests(next http.RoundTripFunc) http.RoundTripFunc {
+  return func(request *http.Request) (*http.Response,error) {
+    method,url:=request.Method,request.Url
+    user:=""
+    if request.User!="" {
+      user=" by "+request.User
+    }
+    start:=time.Now()
+    response,err:=next(request)
+    duration:=time.Since(start)
+    if err!=nil {
+      request.Logger().Info("%s %s%s failed after %s: %s",method,url,user,duration,err)
+    } else if response!=nil {
+      request.Logger().Info("%s %s%s: %d after %s",method,url,user,response.Status,duration)
+    }
+    return response,err
+  }
+}
+
+/*
+  Middleware adding the time it took to get the response header as Server-Timing header, so it shows up in browsers' developer
+  tools.
+ */
+func ServerTiming(next http.RoundTripFunc) http.RoundTripFunc {
+  return func(request *http.Request) (*http.Response,error) {
+    start:=time.Now()
+    response,err:=next(request)
+    if response!=nil {
+      milliseconds:=float64(time.Since(start))/float64(time.Millisecond)
+      response.Headers.Set("Server-Timing",fmt.Sprintf("hopgoblin;desc=\"upstream\";dur=%.1f",milliseconds))
+    }
+    return response,err
+  }
+}
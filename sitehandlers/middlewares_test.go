@@ -0,0 +1,50 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package sitehandlers
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "strings"
+  "github.com/rinusser/hopgoblin/http"
+)
+
+
+func createResponder(received **http.Request) http.RoundTripFunc {
+  return func(request *http.Request) (*http.Response,error) {
+    *received=request
+    response:=http.CreateSimpleResponse(200)
+    response.Headers.Set("Set-Cookie","tracking=1")
+    response.Headers.Set("Content-Type","text/plain")
+    return response,nil
+  }
+}
+
+/*
+  Makes sure the header stripping middleware removes only the given headers.
+ */
+func TestStripHeaders(t *testing.T) {
+  var received *http.Request
+  request:=http.ParseRequest("GET http://example.com/ HTTP/1.1\r\nReferer: http://example.org/\r\nProxy-Connection: keep-alive\r\nAccept: */*\r\n\r\n")
+  roundtrip:=http.ChainMiddlewares(createResponder(&received),[]http.Middleware {
+    StripRequestHeaders("referer","Proxy-Connection"),
+    StripResponseHeaders("Set-Cookie"),
+  })
+  response,err:=roundtrip(request)
+  assert.Nil(t,err)
+  assert.Equal(t,[]string{"Accept"},received.Headers.Keys())
+  assert.Equal(t,[]string{"Content-Type"},response.Headers.Keys())
+}
+
+/*
+  Makes sure the timing middleware adds a Server-Timing header.
+ */
+func TestServerTiming(t *testing.T) {
+  var received *http.Request
+  request:=http.ParseRequest("GET http://example.com/ HTTP/1.1\r\n\r\n")
+  response,_:=ServerTiming(createResponder(&received))(request)
+  timing,found:=response.Headers.Get("Server-Timing")
+  assert.True(t,found)
+  assert.True(t,strings.HasPrefix(timing,"hopgoblin;"),timing)
+}
@@ -0,0 +1,415 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package utils
+
+import (
+  "container/list"
+  "crypto"
+  "crypto/ecdsa"
+  "crypto/elliptic"
+  "crypto/rand"
+  "crypto/tls"
+  "crypto/x509"
+  "crypto/x509/pkix"
+  "encoding/pem"
+  "errors"
+  "io/ioutil"
+  "math/big"
+  "net"
+  "os"
+  "regexp"
+  "strings"
+  "sync"
+  "time"
+  "github.com/rinusser/hopgoblin/log"
+)
+
+
+/*
+  The validity period of certificates issued by CertificateAuthority.
+ */
+var IssuedCertificateValidity=365*24*time.Hour
+
+/*
+  The default number of issued certificates a CertificateAuthority keeps in memory.
+ */
+var DefaultMaxCachedCertificates=1000
+
+
+/*
+  Local certificate authority, issues certificates for intercepted hosts on demand.
+
+  Issued certificates are cached in memory, and in CacheDirectory if that's set. Certificates are issued for any hostname
+  requested, so keep the CA's private key safe. Since hostnames come from clients the memory cache is limited to
+  MaxCachedCertificates, the least recently used certificates are dropped first.
+ */
+type CertificateAuthority struct {
+  Certificate *x509.Certificate //the CA certificate
+  CacheDirectory string         //directory to cache issued certificates in, empty to cache in memory only
+  MaxCachedCertificates int     //maximum number of certificates cached in memory, 0 or less for no limit
+
+  signer crypto.Signer
+  cache map[string]*list.Element          //cached certificates by hostname, the elements' values are *cachedCertificate
+  cacheOrder *list.List                   //cached certificates, most recently used first
+  pending map[string]*pendingCertificate  //certificates currently being loaded or issued, by hostname
+  mutex sync.Mutex                        //guards the cache and pending certificates
+}
+
+type cachedCertificate struct {
+  hostname string
+  certificate *tls.Certificate
+}
+
+/*
+  A certificate being loaded or issued: other requests for the same hostname wait for it instead of issuing their own.
+ */
+type pendingCertificate struct {
+  done chan struct{} //closed once certificate and err are set
+  certificate *tls.Certificate
+  err error
+}
+
+/*
+  Loads a named CA keypair from the given certificate directory, the same way LoadCertificate() does.
+  Returns nil on error.
+ */
+func LoadCertificateAuthority(directory string, name string) *CertificateAuthority {
+  keypair:=LoadCertificate(directory,name)
+  if keypair==nil {
+    return nil
+  }
+  rv,err:=newCertificateAuthority(keypair)
+  if err!=nil {
+    log.Error("can't use %s as certificate authority: %s",name,err)
+    return nil
+  }
+  return rv
+}
+
+/*
+  Generates a new CA keypair, valid for the given duration.
+ */
+func GenerateCertificateAuthority(name string, validity time.Duration) (*CertificateAuthority,error) {
+  key,err:=ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+  if err!=nil {
+    return nil,err
+  }
+  serial,err:=generateSerialNumber()
+  if err!=nil {
+    return nil,err
+  }
+  now:=time.Now()
+  template:=&x509.Certificate {
+    SerialNumber: serial,
+    Subject: pkix.Name{CommonName:name,Organization:[]string{"hopgoblin"}},
+    NotBefore: now.Add(-time.Hour),
+    NotAfter: now.Add(validity),
+    KeyUsage: x509.KeyUsageCertSign|x509.KeyUsageCRLSign|x509.KeyUsageDigitalSignature,
+    BasicConstraintsValid: true,
+    IsCA: true,
+    MaxPathLenZero: true,
+  }
+  der,err:=x509.CreateCertificate(rand.Reader,template,template,key.Public(),key)
+  if err!=nil {
+    return nil,err
+  }
+  return newCertificateAuthority(&tls.Certificate{Certificate:[][]byte{der},PrivateKey:key})
+}
+
+func newCertificateAuthority(keypair *tls.Certificate) (*CertificateAuthority,error) {
+  certificate,err:=x509.ParseCertificate(keypair.Certificate[0])
+  if err!=nil {
+    return nil,err
+  }
+  if !certificate.IsCA {
+    return nil,errors.New("certificate isn't a CA certificate")
+  }
+  signer,ok:=keypair.PrivateKey.(crypto.Signer)
+  if !ok {
+    return nil,errors.New("unsupported private key type")
+  }
+  rv:=&CertificateAuthority {
+    Certificate: certificate,
+    MaxCachedCertificates: DefaultMaxCachedCertificates,
+    signer: signer,
+  }
+  rv.clearCache()
+  return rv,nil
+}
+
+/*
+  Drops all certificates from the memory cache.
+ */
+func (this *CertificateAuthority) clearCache() {
+  this.mutex.Lock()
+  defer this.mutex.Unlock()
+  this.cache=make(map[string]*list.Element)
+  this.cacheOrder=list.New()
+  if this.pending==nil {
+    this.pending=make(map[string]*pendingCertificate)
+  }
+}
+
+
+/*
+  Returns a certificate for the given hostname or IP address, issuing a new one if there's no valid one in the cache yet.
+
+  Certificates are loaded and issued without blocking requests for other hostnames. Concurrent requests for the same hostname
+  share a single new certificate.
+ */
+func (this *CertificateAuthority) GetCertificate(hostname string) (*tls.Certificate,error) {
+  return this.GetCertificateLogged(hostname,log.CorrelatedLogger{})
+}
+
+/*
+  Returns a certificate for the given hostname or IP address like GetCertificate(), logging messages through the given logger,
+  e.g. with the correlation ID of the request the certificate is needed for.
+ */
+func (this *CertificateAuthority) GetCertificateLogged(hostname string, logger log.CorrelatedLogger) (*tls.Certificate,error) {
+  hostname=strings.ToLower(hostname)
+  this.mutex.Lock()
+  if cached:=this.getCachedCertificate(hostname);cached!=nil {
+    this.mutex.Unlock()
+    return cached,nil
+  }
+  pending,found:=this.pending[hostname]
+  if !found {
+    pending=&pendingCertificate{done:make(chan struct{})}
+    this.pending[hostname]=pending
+  }
+  this.mutex.Unlock()
+
+  if found {
+    <-pending.done
+    return pending.certificate,pending.err
+  }
+  pending.certificate,pending.err=this.obtainCertificate(hostname,logger)
+  this.mutex.Lock()
+  delete(this.pending,hostname)
+  if pending.err==nil {
+    this.addCachedCertificate(hostname,pending.certificate)
+  }
+  this.mutex.Unlock()
+  close(pending.done)
+  return pending.certificate,pending.err
+}
+
+/*
+  Loads a certificate for the hostname from the cache directory, or issues a new one.
+ */
+func (this *CertificateAuthority) obtainCertificate(hostname string, logger log.CorrelatedLogger) (*tls.Certificate,error) {
+  if cached:=this.loadCachedCertificate(hostname,logger);cached!=nil {
+    return cached,nil
+  }
+  logger.Debug("issuing certificate for %s",hostname)
+  rv,err:=this.IssueCertificate([]string{hostname})
+  if err!=nil {
+    return nil,err
+  }
+  this.storeCachedCertificate(hostname,rv,logger)
+  return rv,nil
+}
+
+/*
+  Fetches a certificate from the memory cache, returns nil if there's no usable one. Requires the mutex to be locked.
+ */
+func (this *CertificateAuthority) getCachedCertificate(hostname string) *tls.Certificate {
+  element,found:=this.cache[hostname]
+  if !found {
+    return nil
+  }
+  certificate:=element.Value.(*cachedCertificate).certificate
+  if !isUnexpired(certificate.Leaf) {
+    this.cacheOrder.Remove(element)
+    delete(this.cache,hostname)
+    return nil
+  }
+  this.cacheOrder.MoveToFront(element)
+  return certificate
+}
+
+/*
+  Adds a certificate to the memory cache, dropping the least recently used ones if the cache is full. Requires the mutex to be
+  locked.
+ */
+func (this *CertificateAuthority) addCachedCertificate(hostname string, certificate *tls.Certificate) {
+  if element,found:=this.cache[hostname];found {
+    this.cacheOrder.Remove(element)
+  }
+  this.cache[hostname]=this.cacheOrder.PushFront(&cachedCertificate{hostname:hostname,certificate:certificate})
+  for this.MaxCachedCertificates>0 && this.cacheOrder.Len()>this.MaxCachedCertificates {
+    oldest:=this.cacheOrder.Back()
+    this.cacheOrder.Remove(oldest)
+    delete(this.cache,oldest.Value.(*cachedCertificate).hostname)
+  }
+}
+
+/*
+  Issues a new certificate valid for all given hostnames and IP addresses. The first name will be used as common name.
+  The issued certificate isn't cached.
+ */
+func (this *CertificateAuthority) IssueCertificate(names []string) (*tls.Certificate,error) {
+  if len(names)<1 {
+    return nil,errors.New("missing certificate name")
+  }
+  key,err:=ecdsa.GenerateKey(elliptic.P256(),rand.Reader)
+  if err!=nil {
+    return nil,err
+  }
+  serial,err:=generateSerialNumber()
+  if err!=nil {
+    return nil,err
+  }
+  now:=time.Now()
+  template:=&x509.Certificate {
+    SerialNumber: serial,
+    Subject: pkix.Name{CommonName:names[0]},
+    NotBefore: now.Add(-time.Hour),
+    NotAfter: now.Add(IssuedCertificateValidity),
+    KeyUsage: x509.KeyUsageDigitalSignature, //ECDSA keys can't encipher keys
+    ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    BasicConstraintsValid: true,
+  }
+  for _,name:=range names {
+    if ip:=net.ParseIP(name);ip!=nil {
+      template.IPAddresses=append(template.IPAddresses,ip)
+    } else {
+      template.DNSNames=append(template.DNSNames,name)
+    }
+  }
+  if template.NotAfter.After(this.Certificate.NotAfter) {
+    template.NotAfter=this.Certificate.NotAfter
+  }
+
+  der,err:=x509.CreateCertificate(rand.Reader,template,this.Certificate,key.Public(),this.signer)
+  if err!=nil {
+    return nil,err
+  }
+  leaf,err:=x509.ParseCertificate(der)
+  if err!=nil {
+    return nil,err
+  }
+  return &tls.Certificate {
+    Certificate: [][]byte{der,this.Certificate.Raw},
+    PrivateKey: key,
+    Leaf: leaf,
+  },nil
+}
+
+
+/*
+  Returns the CA certificate in PEM format.
+ */
+func (this *CertificateAuthority) CertificatePEM() []byte {
+  return pem.EncodeToMemory(&pem.Block{Type:"CERTIFICATE",Bytes:this.Certificate.Raw})
+}
+
+/*
+  Returns the CA keypair, e.g. for SaveCertificate().
+ */
+func (this *CertificateAuthority) Keypair() *tls.Certificate {
+  return &tls.Certificate {
+    Certificate: [][]byte{this.Certificate.Raw},
+    PrivateKey: this.signer,
+    Leaf: this.Certificate,
+  }
+}
+
+
+/*
+  Checks whether a certificate was issued by this CA and will remain valid for at least another hour.
+ */
+func (this *CertificateAuthority) isUsable(leaf *x509.Certificate) bool {
+  return isUnexpired(leaf) && leaf.CheckSignatureFrom(this.Certificate)==nil
+}
+
+/*
+  Checks whether a certificate will remain valid for at least another hour.
+ */
+func isUnexpired(leaf *x509.Certificate) bool {
+  return leaf!=nil && time.Now().Add(time.Hour).Before(leaf.NotAfter)
+}
+
+var cacheableHostnameMatcher=regexp.MustCompile(`^[a-z0-9.:-]+$`)
+
+func (this *CertificateAuthority) getCacheFilename(hostname string) string {
+  if this.CacheDirectory=="" || !cacheableHostnameMatcher.MatchString(hostname) {
+    return ""
+  }
+  return this.CacheDirectory+string(os.PathSeparator)+strings.Replace(hostname,":","_",-1)
+}
+
+func (this *CertificateAuthority) loadCachedCertificate(hostname string, logger log.CorrelatedLogger) *tls.Certificate {
+  filename:=this.getCacheFilename(hostname)
+  if filename=="" {
+    return nil
+  }
+  if _,err:=os.Stat(filename+".pem");err!=nil {
+    return nil
+  }
+  keypair,err:=tls.LoadX509KeyPair(filename+".pem",filename+".key")
+  if err!=nil {
+    logger.Warn("can't load cached certificate for %s: %s",hostname,err)
+    return nil
+  }
+  keypair.Leaf,err=x509.ParseCertificate(keypair.Certificate[0])
+  if err!=nil || !this.isUsable(keypair.Leaf) {
+    logger.Debug("discarding cached certificate for %s",hostname)
+    return nil
+  }
+  logger.Trace("loaded cached certificate for %s",hostname)
+  return &keypair
+}
+
+func (this *CertificateAuthority) storeCachedCertificate(hostname string, keypair *tls.Certificate, logger log.CorrelatedLogger) {
+  filename:=this.getCacheFilename(hostname)
+  if filename=="" {
+    return
+  }
+  err:=os.MkdirAll(this.CacheDirectory,0700)
+  if err==nil {
+    err=writeCertificateFiles(filename,keypair)
+  }
+  if err!=nil {
+    logger.Warn("can't cache certificate for %s: %s",hostname,err)
+  }
+}
+
+
+/*
+  Writes a keypair to the given certificate directory, in a way LoadCertificate() can read it: the certificate chain as <name>.pem,
+  the private key as <name>.key. Existing files will be overwritten.
+ */
+func SaveCertificate(directory string, name string, keypair *tls.Certificate) error {
+  return writeCertificateFiles(directory+string(os.PathSeparator)+name,keypair)
+}
+
+func writeCertificateFiles(filename string, keypair *tls.Certificate) error {
+  var certificates []byte
+  for _,der:=range keypair.Certificate {
+    certificates=append(certificates,pem.EncodeToMemory(&pem.Block{Type:"CERTIFICATE",Bytes:der})...)
+  }
+  key,err:=encodePrivateKeyPEM(keypair.PrivateKey)
+  if err!=nil {
+    return err
+  }
+  err=ioutil.WriteFile(filename+".key",key,0600)
+  if err!=nil {
+    return err
+  }
+  return ioutil.WriteFile(filename+".pem",certificates,0644)
+}
+
+
+func generateSerialNumber() (*big.Int,error) {
+  return rand.Int(rand.Reader,new(big.Int).Lsh(big.NewInt(1),128))
+}
+
+func encodePrivateKeyPEM(key crypto.PrivateKey) ([]byte,error) {
+  der,err:=x509.MarshalPKCS8PrivateKey(key)
+  if err!=nil {
+    return nil,err
+  }
+  return pem.EncodeToMemory(&pem.Block{Type:"PRIVATE KEY",Bytes:der}),nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 Richard Nusser
+// Licensed under GPLv3 (see http://www.gnu.org/licenses/)
+
+package utils
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+  "crypto/x509"
+  "io/ioutil"
+  "os"
+  "sync"
+  "time"
+)
+
+
+func verifyIssuedCertificate(t *testing.T, ca *CertificateAuthority, hostname string, certificate *x509.Certificate) {
+  pool:=x509.NewCertPool()
+  pool.AddCert(ca.Certificate)
+  _,err:=certificate.Verify(x509.VerifyOptions{DNSName:hostname,Roots:pool})
+  assert.Nil(t,err,"certificate for %s should have been valid",hostname)
+}
+
+/*
+  Makes sure issued certificates are valid for the requested names and are cached in memory.
+ */
+func TestCertificateAuthorityIssuesCertificates(t *testing.T) {
+  ca,err:=GenerateCertificateAuthority("test CA",time.Hour*24)
+  assert.Nil(t,err)
+  assert.True(t,ca.Certificate.IsCA)
+
+  for _,hostname:=range []string{"example.com","127.0.0.1"} {
+    certificate,err:=ca.GetCertificate(hostname)
+    assert.Nil(t,err)
+    verifyIssuedCertificate(t,ca,hostname,certificate.Leaf)
+    assert.Equal(t,x509.KeyUsageDigitalSignature,certificate.Leaf.KeyUsage,"ECDSA certificate shouldn't allow key encipherment")
+    assert.True(t,certificate.Leaf.NotAfter.Before(ca.Certificate.NotAfter.Add(time.Second)),"certificate shouldn't outlive CA")
+  }
+
+  first,_:=ca.GetCertificate("Example.com")
+  second,_:=ca.GetCertificate("example.com")
+  assert.True(t,first==second,"certificate should have been cached")
+
+  multi,err:=ca.IssueCertificate([]string{"a.local","b.local"})
+  assert.Nil(t,err)
+  verifyIssuedCertificate(t,ca,"b.local",multi.Leaf)
+}
+
+/*
+  Makes sure concurrent requests for the same hostname share a single certificate.
+ */
+func TestCertificateAuthorityConcurrentRequests(t *testing.T) {
+  ca,_:=GenerateCertificateAuthority("test CA",time.Hour*24)
+  var wait sync.WaitGroup
+  serials:=make([]string,10)
+  for index:=range serials {
+    wait.Add(1)
+    go func(index int) {
+      defer wait.Done()
+      certificate,err:=ca.GetCertificate("concurrent.local")
+      if assert.Nil(t,err) {
+        serials[index]=certificate.Leaf.SerialNumber.String()
+      }
+    }(index)
+  }
+  wait.Wait()
+  for _,serial:=range serials {
+    assert.Equal(t,serials[0],serial,"all requests should have gotten the same certificate")
+  }
+}
+
+/*
+  Makes sure the memory cache keeps at most MaxCachedCertificates certificates, dropping the least recently used first.
+ */
+func TestCertificateAuthorityCacheLimit(t *testing.T) {
+  ca,_:=GenerateCertificateAuthority("test CA",time.Hour*24)
+  ca.MaxCachedCertificates=2
+
+  first,_:=ca.GetCertificate("first.local")
+  second,_:=ca.GetCertificate("second.local")
+  again,_:=ca.GetCertificate("first.local")
+  assert.True(t,first==again,"certificate should have been cached")
+  ca.GetCertificate("third.local")
+  assert.Equal(t,2,len(ca.cache))
+  assert.Equal(t,2,ca.cacheOrder.Len())
+
+  again,_=ca.GetCertificate("first.local")
+  assert.True(t,first==again,"recently used certificate should have been kept")
+  again,_=ca.GetCertificate("second.local")
+  assert.False(t,second==again,"least recently used certificate should have been dropped")
+}
+
+/*
+  Makes sure issued certificates are cached on disk if a cache directory is set, and certificates issued by other CAs are ignored.
+ */
+func TestCertificateAuthorityDiskCache(t *testing.T) {
+  directory,err:=ioutil.TempDir("","hopgoblin-certs")
+  assert.Nil(t,err)
+  defer os.RemoveAll(directory)
+
+  ca,_:=GenerateCertificateAuthority("test CA",time.Hour*24)
+  ca.CacheDirectory=directory
+  first,err:=ca.GetCertificate("cached.local")
+  assert.Nil(t,err)
+  _,err=os.Stat(directory+string(os.PathSeparator)+"cached.local.pem")
+  assert.Nil(t,err,"certificate should have been written to disk")
+
+  ca.clearCache()
+  second,err:=ca.GetCertificate("cached.local")
+  assert.Nil(t,err)
+  assert.Equal(t,first.Certificate[0],second.Certificate[0],"certificate should have been loaded from disk")
+
+  other,_:=GenerateCertificateAuthority("other CA",time.Hour*24)
+  other.CacheDirectory=directory
+  third,err:=other.GetCertificate("cached.local")
+  assert.Nil(t,err)
+  assert.NotEqual(t,first.Certificate[0],third.Certificate[0],"other CA's certificate shouldn't have been used")
+  verifyIssuedCertificate(t,other,"cached.local",third.Leaf)
+}
+
+/*
+  Makes sure saved keypairs can be loaded again, as CA and as regular certificate.
+ */
+func TestSaveCertificate(t *testing.T) {
+  directory,err:=ioutil.TempDir("","hopgoblin-certs")
+  assert.Nil(t,err)
+  defer os.RemoveAll(directory)
+
+  ca,_:=GenerateCertificateAuthority("test CA",time.Hour*24)
+  assert.Nil(t,SaveCertificate(directory,"CA-test",ca.Keypair()))
+  loaded:=LoadCertificateAuthority(directory,"CA-test")
+  assert.NotNil(t,loaded)
+  assert.Equal(t,ca.Certificate.Raw,loaded.Certificate.Raw)
+
+  keypair,_:=loaded.IssueCertificate([]string{"saved.local"})
+  assert.Nil(t,SaveCertificate(directory,"test",keypair))
+  assert.NotNil(t,LoadCertificate(directory,"test"))
+  assert.Nil(t,LoadCertificateAuthority(directory,"test"),"regular certificate shouldn't have been accepted as CA")
+}
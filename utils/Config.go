@@ -4,19 +4,92 @@
 package utils
 
 import (
+  "fmt"
   "strings"
+  "sync"
   "github.com/rinusser/hopgoblin/bootstrap"
+  "github.com/rinusser/hopgoblin/log"
 )
 
 
 var appConfiguration *map[string]string=nil
+var appConfigurationMutex sync.RWMutex
+
+/*
+  Checks configuration values before they're used, see AddConfigValidator().
+ */
+type ConfigValidator func(values map[string]string) error
+
+type configValidatorEntry struct {
+  prefix string
+  validator ConfigValidator
+}
+
+var configValidators []configValidatorEntry
+var configValidatorsMutex sync.Mutex
 
 func init() {
   bootstrap.AfterFlagParse(initHook)
+  bootstrap.OnReload(reloadHook)
 }
 
 func initHook() {
-  appConfiguration=ParseINIFile(GetResourcePath("application.ini"))
+  setAppConfiguration(ParseINIFile(GetResourcePath("application.ini")))
+}
+
+/*
+  Re-reads the application configuration. Keeps the previous configuration if the file can't be read or is invalid.
+ */
+func reloadHook() {
+  configuration:=ParseINIFile(GetResourcePath("application.ini"))
+  if configuration==nil {
+    return
+  }
+  if err:=ReplaceAppConfiguration(configuration);err!=nil {
+    log.Error("keeping previous configuration: %s",err)
+  }
+}
+
+/*
+  Registers a validator for the configuration values starting with the prefix. The validator receives the values with the prefix
+  removed, like GetConfigValuesByPrefix() returns them.
+
+  Reloaded configurations are only used if all validators accept them, so packages parsing values at runtime can rely on them
+  being as valid as they were at startup.
+ */
+func AddConfigValidator(prefix string, validator ConfigValidator) {
+  configValidatorsMutex.Lock()
+  defer configValidatorsMutex.Unlock()
+  configValidators=append(configValidators,configValidatorEntry{prefix:prefix,validator:validator})
+}
+
+/*
+  Replaces the application configuration if all validators registered with AddConfigValidator() accept it. Returns the first
+  validation error otherwise, the current configuration is kept in that case.
+ */
+func ReplaceAppConfiguration(configuration *map[string]string) error {
+  configValidatorsMutex.Lock()
+  validators:=append([]configValidatorEntry(nil),configValidators...)
+  configValidatorsMutex.Unlock()
+  for _,entry:=range validators {
+    if err:=entry.validator(filterConfigValuesByPrefix(configuration,entry.prefix));err!=nil {
+      return fmt.Errorf("invalid %s settings: %s",strings.TrimSuffix(entry.prefix,"."),err)
+    }
+  }
+  setAppConfiguration(configuration)
+  return nil
+}
+
+func setAppConfiguration(configuration *map[string]string) {
+  appConfigurationMutex.Lock()
+  defer appConfigurationMutex.Unlock()
+  appConfiguration=configuration
+}
+
+func getAppConfiguration() *map[string]string {
+  appConfigurationMutex.RLock()
+  defer appConfigurationMutex.RUnlock()
+  return appConfiguration
 }
 
 
@@ -25,10 +98,11 @@ func initHook() {
   By default the configuration is read from resources/application.ini (relative to application root).
  */
 func GetConfigValue(key string) string {
-  if appConfiguration==nil {
+  configuration:=getAppConfiguration()
+  if configuration==nil {
     return ""
   }
-  value,_:=(*appConfiguration)[strings.ToLower(key)]
+  value,_:=(*configuration)[strings.ToLower(key)]
   return value
 }
 
@@ -50,14 +124,18 @@ func GetConfigValue(key string) string {
     }
    */
 func GetConfigValuesByPrefix(prefix string) map[string]string {
+  return filterConfigValuesByPrefix(getAppConfiguration(),prefix)
+}
+
+func filterConfigValuesByPrefix(configuration *map[string]string, prefix string) map[string]string {
   rv:=make(map[string]string)
-  if appConfiguration==nil {
+  if configuration==nil {
     return rv
   }
 
   prefix_length:=len(prefix)
   prefix=strings.ToLower(prefix)
-  for key,value:=range *appConfiguration {
+  for key,value:=range *configuration {
     if strings.HasPrefix(key,prefix) {
       rv[key[prefix_length:]]=value
     }
@@ -6,6 +6,7 @@ package utils
 import (
   "testing"
   "github.com/stretchr/testify/assert"
+  "errors"
 )
 
 
@@ -57,3 +58,23 @@ func TestGetConfigValuesByPrefix(t *testing.T) {
   appConfiguration=nil
   assert.Equal(t,0,len(GetConfigValuesByPrefix("pkg2.")),"nil application config should return empty values gracefully")
 }
+
+func TestReplaceAppConfiguration(t *testing.T) {
+  previous:=configValidators
+  defer func() {
+    configValidators=previous
+  }()
+  AddConfigValidator("pkg.",func(values map[string]string) error {
+    if values["value"]!="valid" {
+      return errors.New("not valid")
+    }
+    return nil
+  })
+
+  assert.Nil(t,ReplaceAppConfiguration(&map[string]string{"pkg.value":"valid","other":"1"}))
+  assert.Equal(t,"1",GetConfigValue("other"))
+  assert.NotNil(t,ReplaceAppConfiguration(&map[string]string{"pkg.value":"invalid","other":"2"}))
+  assert.Equal(t,"1",GetConfigValue("other"),"invalid configuration shouldn't have replaced the previous one")
+
+  appConfiguration=nil
+}
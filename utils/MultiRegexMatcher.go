@@ -48,3 +48,10 @@ func (this *MultiRegexMatcher) MatchesAnyRegex(needle string) bool {
   }
   return false
 }
+
+/*
+  Returns the regular expressions matched against.
+ */
+func (this *MultiRegexMatcher) GetRegexes() []string {
+  return append([]string(nil),this.regexes...)
+}
@@ -22,7 +22,7 @@ func LoadCertificate(directory string, name string) *tls.Certificate {
   }
   cert,err:=tls.LoadX509KeyPair(directory+name+".pem",directory+name+".key")
   if err!=nil {
-    log.Error("can't load cert/key files: ",err)
+    log.Error("can't load cert/key files: %s",err)
     return nil
   }
   return &cert